@@ -2,6 +2,7 @@ package storage
 
 import (
 	"archive/tar"
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -134,6 +135,10 @@ func RepairEverything() *RepairOptions {
 // Check returns a list of problems with what's in the store, as a whole.  It can be very expensive
 // to call.
 func (s *store) Check(options *CheckOptions) (CheckReport, error) {
+	return s.CheckWithContext(context.Background(), options)
+}
+
+func (s *store) CheckWithContext(ctx context.Context, options *CheckOptions) (CheckReport, error) {
 	var ignore checkIgnore
 	for _, o := range s.graphOptions {
 		if strings.Contains(o, "ignore_chown_errors=true") {
@@ -193,6 +198,9 @@ func (s *store) Check(options *CheckOptions) (CheckReport, error) {
 		}
 		// Examine each layer in turn.
 		for i := range layers {
+			if err := ctx.Err(); err != nil {
+				return struct{}{}, true, err
+			}
 			layer := layers[i]
 			id := layer.ID
 			// If we've already seen a layer with this ID, no need to process it again.
@@ -289,7 +297,7 @@ func (s *store) Check(options *CheckOptions) (CheckReport, error) {
 					// Digest and count the length of the diff.
 					digester := expectedDigest.Algorithm().Digester()
 					counter := ioutils.NewWriteCounter(digester.Hash())
-					reader := io.TeeReader(diff, counter)
+					reader := io.TeeReader(ioutils.NewContextReader(ctx, diff), counter)
 					var wg sync.WaitGroup
 					var archiveErr error
 					wg.Add(1)
@@ -495,6 +503,9 @@ func (s *store) Check(options *CheckOptions) (CheckReport, error) {
 		}
 		// Examine each image in turn.
 		for i := range images {
+			if err := ctx.Err(); err != nil {
+				return struct{}{}, true, err
+			}
 			image := images[i]
 			id := image.ID
 			// If we've already seen an image with this ID, skip it.
@@ -607,6 +618,9 @@ func (s *store) Check(options *CheckOptions) (CheckReport, error) {
 			return struct{}{}, true, err
 		}
 		for i := range containers {
+			if err := ctx.Err(); err != nil {
+				return struct{}{}, true, err
+			}
 			container := containers[i]
 			id := container.ID
 			logrus.Debugf("checking container %s", id)
@@ -658,6 +672,19 @@ func (s *store) Check(options *CheckOptions) (CheckReport, error) {
 		return CheckReport{}, err
 	}
 
+	// Layers which have leases, and the layers they're based on, are in use, too.
+	leased, err := s.leases.leased()
+	if err != nil {
+		return CheckReport{}, err
+	}
+	for topLayer := range leased.layers {
+		for layer := topLayer; layer != ""; layer = report.layerParentsByLayerID[layer] {
+			if _, ok := referencedLayers[layer]; ok {
+				referencedLayers[layer] = true
+			}
+		}
+	}
+
 	// Now go back through all of the layer stores, and flag any layers which don't belong
 	// to an image or a container, and has been around longer than we can reasonably expect
 	// such a layer to be present before a corresponding image record is added.
@@ -0,0 +1,190 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/containers/storage/drivers/copy"
+	"github.com/containers/storage/pkg/archive"
+	"github.com/containers/storage/pkg/system"
+	"github.com/containers/storage/types"
+	"github.com/sirupsen/logrus"
+)
+
+// CloneOptions controls how CloneContainer creates a copy of a container.
+type CloneOptions struct {
+	// Metadata is caller-specified metadata to store with the new
+	// container.  If it is not set, the source container's metadata is
+	// copied.
+	Metadata string
+	// Labels is a set of key/value pairs to store with the new container.
+	// If it is nil, the source container's labels are copied.
+	Labels map[string]string
+}
+
+// CloneContainer creates a container which uses the same image, ID mappings
+// and flags as an existing container, and whose read-write layer starts out
+// with the same contents as the existing container's layer.  The layer is
+// created using the driver's CreateFromTemplate, which can use snapshots or
+// reflinks, and if that fails, the existing layer's contents are copied into
+// a new layer instead.  The existing container's big data items and the files
+// in its ContainerDirectory are copied, too.
+func (s *store) CloneContainer(srcID, newID string, names []string, options *CloneOptions) (*Container, error) {
+	if options == nil {
+		options = &CloneOptions{}
+	}
+	rlstore, lstores, err := s.bothLayerStoreKinds()
+	if err != nil {
+		return nil, err
+	}
+	if err := rlstore.startWriting(); err != nil {
+		return nil, err
+	}
+	defer rlstore.stopWriting()
+	for _, s := range lstores {
+		store := s
+		if err := store.startReading(); err != nil {
+			return nil, err
+		}
+		defer store.stopReading()
+	}
+	if err := s.containerStore.startWriting(); err != nil {
+		return nil, err
+	}
+	defer s.containerStore.stopWriting()
+
+	src, err := s.containerStore.Get(srcID)
+	if err != nil {
+		return nil, err
+	}
+	srcLayer, err := rlstore.Get(src.LayerID)
+	if err != nil {
+		return nil, fmt.Errorf("locating layer %q of container %q: %w", src.LayerID, src.ID, err)
+	}
+	var parentLayer *Layer
+	if srcLayer.Parent != "" {
+		for _, lstore := range append([]roLayerStore{rlstore}, lstores...) {
+			if l, err := lstore.Get(srcLayer.Parent); err == nil && l != nil {
+				parentLayer = l
+				break
+			}
+		}
+		if parentLayer == nil {
+			return nil, fmt.Errorf("locating parent %q of layer %q: %w", srcLayer.Parent, srcLayer.ID, ErrLayerUnknown)
+		}
+	}
+
+	cOptions := &ContainerOptions{
+		IDMappingOptions: types.IDMappingOptions{
+			HostUIDMapping: len(src.UIDMap) == 0,
+			HostGIDMapping: len(src.GIDMap) == 0,
+			UIDMap:         copySlicePreferringNil(src.UIDMap),
+			GIDMap:         copySlicePreferringNil(src.GIDMap),
+		},
+		Flags:    src.Flags,
+		Volatile: src.volatileStore,
+		Metadata: src.Metadata,
+		Labels:   src.Labels,
+	}
+	if options.Metadata != "" {
+		cOptions.Metadata = options.Metadata
+	}
+	if options.Labels != nil {
+		cOptions.Labels = options.Labels
+	}
+	for _, key := range src.BigDataNames {
+		data, err := s.containerStore.BigData(src.ID, key)
+		if err != nil {
+			return nil, fmt.Errorf("reading data item %q of container %q: %w", key, src.ID, err)
+		}
+		cOptions.BigData = append(cOptions.BigData, ContainerBigDataOption{Key: key, Data: data})
+	}
+
+	layerOptions := &LayerOptions{
+		IDMappingOptions: types.IDMappingOptions{
+			HostUIDMapping: len(srcLayer.UIDMap) == 0,
+			HostGIDMapping: len(srcLayer.GIDMap) == 0,
+			UIDMap:         copySlicePreferringNil(srcLayer.UIDMap),
+			GIDMap:         copySlicePreferringNil(srcLayer.GIDMap),
+		},
+		TemplateLayer: srcLayer.ID,
+		Volatile:      src.volatileStore || s.transientStore,
+	}
+	layer, _, err := rlstore.create(context.Background(), "", parentLayer, nil, srcLayer.MountLabel, nil, layerOptions, true, nil, nil)
+	if err != nil {
+		logrus.Debugf("Creating a copy of layer %q from a template failed, copying its contents instead: %v", srcLayer.ID, err)
+		layerOptions.TemplateLayer = ""
+		if layer, err = s.copyContainerLayer(rlstore, srcLayer, parentLayer, layerOptions); err != nil {
+			return nil, fmt.Errorf("copying layer %q of container %q: %w", srcLayer.ID, src.ID, err)
+		}
+	}
+
+	container, err := s.containerStore.create(newID, names, src.ImageID, layer.ID, cOptions)
+	if err != nil {
+		if err2 := rlstore.deleteWhileHoldingLock(layer.ID); err2 != nil {
+			logrus.Errorf("While recovering from a failure to clone container %q, error deleting layer %q: %v", src.ID, layer.ID, err2)
+		}
+		return nil, err
+	}
+
+	middleDir := s.graphDriverName + "-containers"
+	srcDir := filepath.Join(s.GraphRoot(), middleDir, src.ID, "userdata")
+	if _, err := os.Stat(srcDir); err == nil {
+		dir := filepath.Join(s.GraphRoot(), middleDir, container.ID, "userdata")
+		if err = os.MkdirAll(dir, 0o700); err == nil {
+			err = copy.DirCopy(srcDir, dir, copy.Content, true)
+		}
+		if err != nil {
+			if err2 := system.EnsureRemoveAll(filepath.Dir(dir)); err2 != nil {
+				logrus.Errorf("While recovering from a failure to clone container %q, error removing %q: %v", src.ID, filepath.Dir(dir), err2)
+			}
+			if err2 := s.containerStore.Delete(container.ID); err2 != nil {
+				logrus.Errorf("While recovering from a failure to clone container %q, error deleting container %q: %v", src.ID, container.ID, err2)
+			}
+			if err2 := rlstore.deleteWhileHoldingLock(layer.ID); err2 != nil {
+				logrus.Errorf("While recovering from a failure to clone container %q, error deleting layer %q: %v", src.ID, layer.ID, err2)
+			}
+			return nil, fmt.Errorf("copying directory of container %q: %w", src.ID, err)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	return container, nil
+}
+
+// copyContainerLayer creates a read-write layer on top of parentLayer and
+// populates it with the diff between srcLayer and its parent.
+// On entry:
+// - rlstore must be locked for writing
+// - the stores which contain parentLayer must be locked for reading
+func (s *store) copyContainerLayer(rlstore rwLayerStore, srcLayer, parentLayer *Layer, layerOptions *LayerOptions) (*Layer, error) {
+	diff, err := os.CreateTemp(s.GraphRoot(), ".clone-")
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		diff.Close()
+		os.Remove(diff.Name())
+	}()
+	uncompressed := archive.Uncompressed
+	rc, err := rlstore.Diff("", srcLayer.ID, &DiffOptions{Compression: &uncompressed})
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.Copy(diff, rc)
+	if err2 := rc.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, err := diff.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	layer, _, err := rlstore.create(context.Background(), "", parentLayer, nil, srcLayer.MountLabel, nil, layerOptions, true, diff, nil)
+	return layer, err
+}
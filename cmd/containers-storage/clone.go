@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/containers/storage"
+	"github.com/containers/storage/internal/opts"
+	"github.com/containers/storage/pkg/mflag"
+)
+
+func cloneContainer(flags *mflag.FlagSet, action string, m storage.Store, args []string) (int, error) {
+	if paramMetadataFile != "" {
+		b, err := os.ReadFile(paramMetadataFile)
+		if err != nil {
+			return 1, err
+		}
+		paramMetadata = string(b)
+	}
+	container, err := m.CloneContainer(args[0], paramID, paramNames, &storage.CloneOptions{Metadata: paramMetadata})
+	if err != nil {
+		return 1, err
+	}
+	if jsonOutput {
+		return outputJSON(container)
+	}
+	fmt.Printf("%s\n", container.ID)
+	for _, name := range container.Names {
+		fmt.Printf("\t%s\n", name)
+	}
+	return 0, nil
+}
+
+func init() {
+	commands = append(commands, command{
+		names:       []string{"clone-container", "clonecontainer"},
+		optionsHelp: "[options [...]] containerNameOrID",
+		usage:       "Create a copy of a container",
+		minArgs:     1,
+		maxArgs:     1,
+		action:      cloneContainer,
+		addFlags: func(flags *mflag.FlagSet, cmd *command) {
+			flags.Var(opts.NewListOptsRef(&paramNames, nil), []string{"-name", "n"}, "Container name")
+			flags.StringVar(&paramID, []string{"-id", "i"}, "", "Container ID")
+			flags.StringVar(&paramMetadata, []string{"-metadata", "m"}, "", "Metadata")
+			flags.StringVar(&paramMetadataFile, []string{"-metadata-file", "f"}, "", "Metadata File")
+			flags.BoolVar(&jsonOutput, []string{"-json", "j"}, jsonOutput, "Prefer JSON output")
+		},
+	})
+}
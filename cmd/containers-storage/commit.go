@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/containers/storage"
+	"github.com/containers/storage/internal/opts"
+	"github.com/containers/storage/pkg/mflag"
+)
+
+var (
+	commitCopyData = false
+	commitData     = []string{}
+	commitPause    = false
+)
+
+func commitContainer(flags *mflag.FlagSet, action string, m storage.Store, args []string) (int, error) {
+	if paramMetadataFile != "" {
+		b, err := os.ReadFile(paramMetadataFile)
+		if err != nil {
+			return 1, err
+		}
+		paramMetadata = string(b)
+	}
+	options := &storage.CommitOptions{
+		ID:          paramID,
+		Names:       paramNames,
+		Metadata:    paramMetadata,
+		CopyBigData: commitCopyData,
+		Pause:       commitPause,
+	}
+	for _, item := range commitData {
+		key, file, ok := strings.Cut(item, "=")
+		if !ok || key == "" {
+			return 1, fmt.Errorf("invalid data item %q, expected KEY=FILE", item)
+		}
+		var data []byte
+		var err error
+		if file == "-" {
+			data, err = io.ReadAll(os.Stdin)
+		} else {
+			data, err = os.ReadFile(file)
+		}
+		if err != nil {
+			return 1, err
+		}
+		options.BigData = append(options.BigData, storage.ImageBigDataOption{Key: key, Data: data})
+	}
+	image, err := m.CommitContainer(args[0], options)
+	if err != nil {
+		return 1, err
+	}
+	if jsonOutput {
+		return outputJSON(image)
+	}
+	fmt.Printf("%s\n", image.ID)
+	for _, name := range image.Names {
+		fmt.Printf("\t%s\n", name)
+	}
+	return 0, nil
+}
+
+func init() {
+	commands = append(commands, command{
+		names:       []string{"commit"},
+		optionsHelp: "[options [...]] containerNameOrID",
+		usage:       "Create an image from a container",
+		minArgs:     1,
+		maxArgs:     1,
+		action:      commitContainer,
+		addFlags: func(flags *mflag.FlagSet, cmd *command) {
+			flags.Var(opts.NewListOptsRef(&paramNames, nil), []string{"-name", "n"}, "Image name")
+			flags.StringVar(&paramID, []string{"-id", "i"}, "", "Image ID")
+			flags.StringVar(&paramMetadata, []string{"-metadata", "m"}, "", "Metadata")
+			flags.StringVar(&paramMetadataFile, []string{"-metadata-file", "f"}, "", "Metadata File")
+			flags.BoolVar(&commitCopyData, []string{"-copy-data"}, commitCopyData, "Copy data items from the container's image")
+			flags.Var(opts.NewListOptsRef(&commitData, nil), []string{"-data"}, "Data item to set, as KEY=FILE")
+			flags.BoolVar(&commitPause, []string{"-pause"}, commitPause, "Unmount the container while its contents are read")
+			flags.BoolVar(&jsonOutput, []string{"-json", "j"}, jsonOutput, "Prefer JSON output")
+		},
+	})
+}
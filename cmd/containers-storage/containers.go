@@ -4,11 +4,16 @@ import (
 	"fmt"
 
 	"github.com/containers/storage"
+	"github.com/containers/storage/internal/opts"
 	"github.com/containers/storage/pkg/mflag"
 )
 
 func containers(flags *mflag.FlagSet, action string, m storage.Store, args []string) (int, error) {
-	containers, err := m.Containers()
+	selector, err := labelSelector()
+	if err != nil {
+		return 1, err
+	}
+	containers, err := m.ContainersByLabel(selector)
 	if err != nil {
 		return 1, err
 	}
@@ -23,6 +28,7 @@ func containers(flags *mflag.FlagSet, action string, m storage.Store, args []str
 		for _, name := range container.BigDataNames {
 			fmt.Printf("\tdata: %s\n", name)
 		}
+		printLabels(container.Labels)
 	}
 	return 0, nil
 }
@@ -37,6 +43,7 @@ func init() {
 		maxArgs:     0,
 		addFlags: func(flags *mflag.FlagSet, cmd *command) {
 			flags.BoolVar(&jsonOutput, []string{"-json", "j"}, jsonOutput, "Prefer JSON output")
+			flags.Var(opts.NewListOptsRef(&listFilters, nil), []string{"-filter", "f"}, "Only list containers which match a filter (label=SELECTOR)")
 		},
 	})
 }
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/containers/storage"
+	"github.com/containers/storage/internal/opts"
+	"github.com/containers/storage/pkg/mflag"
+	"github.com/containers/storage/types"
+)
+
+var (
+	copyImageDestRunRoot    = ""
+	copyImageDestGraphRoot  = ""
+	copyImageDestDriver     = ""
+	copyImageDestDriverOpts = []string{}
+	copyImageNames          = []string{}
+)
+
+func copyImage(flags *mflag.FlagSet, action string, m storage.Store, args []string) (int, error) {
+	if copyImageDestGraphRoot == "" || copyImageDestRunRoot == "" {
+		return 1, fmt.Errorf("both --dest-graph and --dest-run must be specified")
+	}
+	options := types.StoreOptions{
+		RunRoot:            copyImageDestRunRoot,
+		GraphRoot:          copyImageDestGraphRoot,
+		GraphDriverName:    copyImageDestDriver,
+		GraphDriverOptions: copyImageDestDriverOpts,
+	}
+	if options.GraphDriverName == "" {
+		options.GraphDriverName = m.GraphDriverName()
+	}
+	dest, err := storage.GetStore(options)
+	if err != nil {
+		return 1, err
+	}
+	defer func() {
+		if _, err := dest.Shutdown(false); err != nil {
+			fmt.Fprintf(os.Stderr, "shutdown: %v\n", err)
+		}
+	}()
+	copyOptions := storage.CopyImageOptions{}
+	if len(copyImageNames) > 0 {
+		copyOptions.Names = copyImageNames
+	}
+	image, err := storage.CopyImage(m, dest, args[0], &copyOptions)
+	if err != nil {
+		return 1, err
+	}
+	if jsonOutput {
+		return outputJSON(image)
+	}
+	fmt.Printf("%s\n", image.ID)
+	for _, name := range image.Names {
+		fmt.Printf("\t%s\n", name)
+	}
+	return 0, nil
+}
+
+func init() {
+	commands = append(commands, command{
+		names:       []string{"copy-image"},
+		optionsHelp: "[options [...]] imageNameOrID",
+		usage:       "Copy an image and its layers to another store",
+		minArgs:     1,
+		maxArgs:     1,
+		action:      copyImage,
+		addFlags: func(flags *mflag.FlagSet, cmd *command) {
+			flags.StringVar(&copyImageDestRunRoot, []string{"-dest-run"}, copyImageDestRunRoot, "Root of the destination's runtime state tree")
+			flags.StringVar(&copyImageDestGraphRoot, []string{"-dest-graph"}, copyImageDestGraphRoot, "Root of the destination's storage tree")
+			flags.StringVar(&copyImageDestDriver, []string{"-dest-storage-driver"}, copyImageDestDriver, "Storage driver to use for the destination")
+			flags.Var(opts.NewListOptsRef(&copyImageDestDriverOpts, nil), []string{"-dest-storage-opt"}, "Set storage driver options for the destination")
+			flags.Var(opts.NewListOptsRef(&copyImageNames, nil), []string{"-name", "n"}, "Image name to use instead of the original's names")
+			flags.BoolVar(&jsonOutput, []string{"-json", "j"}, jsonOutput, "Prefer JSON output")
+		},
+	})
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/containers/storage"
+	"github.com/containers/storage/pkg/mflag"
+)
+
+func df(flags *mflag.FlagSet, action string, m storage.Store, args []string) (int, error) {
+	report, err := m.DiskUsage()
+	if err != nil {
+		return 1, err
+	}
+	if jsonOutput {
+		return outputJSON(report)
+	}
+	for _, image := range report.Images {
+		fmt.Printf("image %s\n", image.ID)
+		for _, name := range image.Names {
+			fmt.Printf("\tname: %s\n", name)
+		}
+		fmt.Printf("\tsize: %d\n", image.Size)
+		fmt.Printf("\tshared: %d\n", image.Shared)
+		fmt.Printf("\treclaimable: %d\n", image.Reclaimable)
+		fmt.Printf("\tcontainers: %d\n", image.Containers)
+	}
+	for _, container := range report.Containers {
+		fmt.Printf("container %s\n", container.ID)
+		for _, name := range container.Names {
+			fmt.Printf("\tname: %s\n", name)
+		}
+		if container.Image != "" {
+			fmt.Printf("\timage: %s\n", container.Image)
+		}
+		if container.Error != "" {
+			fmt.Printf("\terror: %s\n", container.Error)
+			continue
+		}
+		fmt.Printf("\tsize: %d\n", container.Size)
+		fmt.Printf("\tshared: %d\n", container.Shared)
+		fmt.Printf("\treclaimable: %d\n", container.Reclaimable)
+	}
+	return 0, nil
+}
+
+func init() {
+	commands = append(commands, command{
+		names:   []string{"df"},
+		usage:   "Show disk space used by images and containers",
+		minArgs: 0,
+		maxArgs: 0,
+		action:  df,
+		addFlags: func(flags *mflag.FlagSet, cmd *command) {
+			flags.BoolVar(&jsonOutput, []string{"-json", "j"}, jsonOutput, "Prefer JSON output")
+		},
+	})
+}
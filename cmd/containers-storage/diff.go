@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"sync"
+	"time"
 
 	"github.com/containers/storage"
 	graphdriver "github.com/containers/storage/drivers"
@@ -18,14 +20,42 @@ import (
 )
 
 var (
-	applyDiffFile    = ""
-	diffFile         = ""
-	diffUncompressed = false
-	diffGzip         = false
-	diffBzip2        = false
-	diffXz           = false
+	applyDiffFile     = ""
+	diffFile          = ""
+	diffUncompressed  = false
+	diffGzip          = false
+	diffBzip2         = false
+	diffXz            = false
+	diffProgress      = false
+	applyDiffProgress = false
 )
 
+// progressPrinter returns a callback which writes progress reports to stderr,
+// at most a few times per second, and a function which writes the final one.
+func progressPrinter() (archive.ProgressFunc, func()) {
+	var mu sync.Mutex
+	var last time.Time
+	var current archive.Progress
+	report := func() {
+		fmt.Fprintf(os.Stderr, "%d entries, %d bytes read, %d bytes written\n", current.Entries, current.BytesRead, current.BytesWritten)
+		last = time.Now()
+	}
+	update := func(p archive.Progress) {
+		mu.Lock()
+		defer mu.Unlock()
+		current = p
+		if time.Since(last) >= 250*time.Millisecond {
+			report()
+		}
+	}
+	finish := func() {
+		mu.Lock()
+		defer mu.Unlock()
+		report()
+	}
+	return update, finish
+}
+
 func changes(flags *mflag.FlagSet, action string, m storage.Store, args []string) (int, error) {
 	if len(args) < 1 {
 		return 1, nil
@@ -90,6 +120,10 @@ func diff(flags *mflag.FlagSet, action string, m storage.Store, args []string) (
 		}
 		options.Compression = &c
 	}
+	var finishProgress func()
+	if diffProgress {
+		options.Progress, finishProgress = progressPrinter()
+	}
 
 	reader, err := m.Diff(from, to, &options)
 	if err != nil {
@@ -100,6 +134,9 @@ func diff(flags *mflag.FlagSet, action string, m storage.Store, args []string) (
 	if err != nil {
 		return 1, err
 	}
+	if finishProgress != nil {
+		finishProgress()
+	}
 	return 0, nil
 }
 
@@ -214,10 +251,18 @@ func applyDiff(flags *mflag.FlagSet, action string, m storage.Store, args []stri
 		diffStream = f
 		defer f.Close()
 	}
-	_, err := m.ApplyDiff(args[0], diffStream)
+	options := storage.ApplyDiffOptions{}
+	var finishProgress func()
+	if applyDiffProgress {
+		options.Progress, finishProgress = progressPrinter()
+	}
+	_, err := m.ApplyDiffWithContext(context.Background(), args[0], &options, diffStream)
 	if err != nil {
 		return 1, err
 	}
+	if finishProgress != nil {
+		finishProgress()
+	}
 	return 0, nil
 }
 
@@ -271,6 +316,7 @@ func init() {
 			flags.BoolVar(&diffGzip, []string{"-gzip", "c"}, diffGzip, "Compress using gzip")
 			flags.BoolVar(&diffBzip2, []string{"-bzip2", "-bz2", "b"}, diffBzip2, "Compress using bzip2 (not currently supported)")
 			flags.BoolVar(&diffXz, []string{"-xz", "x"}, diffXz, "Compress using xz (not currently supported)")
+			flags.BoolVar(&diffProgress, []string{"-progress"}, diffProgress, "Report progress on stderr")
 		},
 	})
 	commands = append(commands, command{
@@ -282,6 +328,7 @@ func init() {
 		action:      applyDiff,
 		addFlags: func(flags *mflag.FlagSet, cmd *command) {
 			flags.StringVar(&applyDiffFile, []string{"-file", "f"}, "", "Read from file instead of stdin")
+			flags.BoolVar(&applyDiffProgress, []string{"-progress"}, applyDiffProgress, "Report progress on stderr")
 		},
 	})
 	commands = append(commands, command{
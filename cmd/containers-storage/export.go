@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/containers/storage"
+	"github.com/containers/storage/pkg/mflag"
+)
+
+func exportImage(flags *mflag.FlagSet, action string, m storage.Store, args []string) (int, error) {
+	image, err := m.Image(args[0])
+	if err != nil {
+		return 1, err
+	}
+	if err := m.ExportImage(image.ID, args[1]); err != nil {
+		return 1, err
+	}
+	if jsonOutput {
+		return outputJSON(image.ID)
+	}
+	return 0, nil
+}
+
+func importImage(flags *mflag.FlagSet, action string, m storage.Store, args []string) (int, error) {
+	image, err := m.ImportImage(args[0])
+	if err != nil {
+		return 1, err
+	}
+	if jsonOutput {
+		return outputJSON(image)
+	}
+	fmt.Printf("%s\n", image.ID)
+	for _, name := range image.Names {
+		fmt.Printf("\t%s\n", name)
+	}
+	return 0, nil
+}
+
+func init() {
+	commands = append(commands, command{
+		names:       []string{"export-image"},
+		optionsHelp: "[options [...]] imageNameOrID destination",
+		usage:       "Write an image to an OCI layout directory or archive",
+		minArgs:     2,
+		maxArgs:     2,
+		action:      exportImage,
+		addFlags: func(flags *mflag.FlagSet, cmd *command) {
+			flags.BoolVar(&jsonOutput, []string{"-json", "j"}, jsonOutput, "Prefer JSON output")
+		},
+	})
+	commands = append(commands, command{
+		names:       []string{"import-image"},
+		optionsHelp: "[options [...]] source",
+		usage:       "Read an image from an OCI layout directory or archive",
+		minArgs:     1,
+		maxArgs:     1,
+		action:      importImage,
+		addFlags: func(flags *mflag.FlagSet, cmd *command) {
+			flags.BoolVar(&jsonOutput, []string{"-json", "j"}, jsonOutput, "Prefer JSON output")
+		},
+	})
+}
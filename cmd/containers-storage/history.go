@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/containers/storage"
+	"github.com/containers/storage/pkg/mflag"
+)
+
+var imageHistoryRollback = 0
+
+func imageHistory(flags *mflag.FlagSet, action string, m storage.Store, args []string) (int, error) {
+	name := args[0]
+	if imageHistoryRollback != 0 {
+		if err := m.RollbackName(name, imageHistoryRollback); err != nil {
+			return 1, err
+		}
+	}
+	history, err := m.NameHistory(name)
+	if err != nil {
+		return 1, err
+	}
+	if jsonOutput {
+		return outputJSON(history)
+	}
+	for _, entry := range history {
+		image := entry.ImageID
+		if image == "" {
+			image = "(none)"
+		}
+		fmt.Printf("%s\t%s\t%s\n", entry.Timestamp.Format(time.RFC3339), entry.Operation, image)
+	}
+	return 0, nil
+}
+
+func init() {
+	commands = append(commands, command{
+		names:       []string{"image-history", "imagehistory"},
+		optionsHelp: "[options [...]] imageName",
+		usage:       "Show or roll back the images which a name has referred to",
+		minArgs:     1,
+		maxArgs:     1,
+		action:      imageHistory,
+		addFlags: func(flags *mflag.FlagSet, cmd *command) {
+			flags.IntVar(&imageHistoryRollback, []string{"-rollback"}, imageHistoryRollback, "Undo this many changes to the name first")
+			flags.BoolVar(&jsonOutput, []string{"-json", "j"}, jsonOutput, "Prefer JSON output")
+		},
+	})
+}
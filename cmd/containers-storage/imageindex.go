@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/containers/storage"
+	"github.com/containers/storage/internal/opts"
+	"github.com/containers/storage/pkg/mflag"
+)
+
+var imageIndexPlatform = ""
+
+// parsePlatform parses a platform in the "os/architecture[/variant]" form.
+func parsePlatform(s string) (storage.ImagePlatform, error) {
+	parts := strings.Split(s, "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return storage.ImagePlatform{}, fmt.Errorf("invalid platform %q, expected OS/ARCH[/VARIANT]", s)
+	}
+	platform := storage.ImagePlatform{OS: parts[0], Architecture: parts[1]}
+	if len(parts) == 3 {
+		platform.Variant = parts[2]
+	}
+	return platform, nil
+}
+
+func printImageIndex(index *storage.ImageIndex) {
+	fmt.Printf("ID: %s\n", index.ID)
+	for _, name := range index.Names {
+		fmt.Printf("Name: %s\n", name)
+	}
+	for _, member := range index.Members {
+		fmt.Printf("Image: %s %s\n", member.ImageID, member.Platform)
+	}
+}
+
+func createImageIndex(flags *mflag.FlagSet, action string, m storage.Store, args []string) (int, error) {
+	members := make([]storage.ImageIndexMember, 0, len(args))
+	for _, arg := range args {
+		image, platformSpec, ok := strings.Cut(arg, "=")
+		if !ok || image == "" {
+			return 1, fmt.Errorf("invalid member %q, expected IMAGE=OS/ARCH[/VARIANT]", arg)
+		}
+		platform, err := parsePlatform(platformSpec)
+		if err != nil {
+			return 1, err
+		}
+		members = append(members, storage.ImageIndexMember{ImageID: image, Platform: platform})
+	}
+	index, err := m.CreateImageIndex(paramID, paramNames, members)
+	if err != nil {
+		return 1, err
+	}
+	if jsonOutput {
+		return outputJSON(index)
+	}
+	fmt.Printf("%s\n", index.ID)
+	for _, name := range index.Names {
+		fmt.Printf("\t%s\n", name)
+	}
+	return 0, nil
+}
+
+func imageIndex(flags *mflag.FlagSet, action string, m storage.Store, args []string) (int, error) {
+	if imageIndexPlatform != "" {
+		platform, err := parsePlatform(imageIndexPlatform)
+		if err != nil {
+			return 1, err
+		}
+		image, err := m.ImageForPlatform(args[0], platform)
+		if err != nil {
+			return 1, err
+		}
+		if jsonOutput {
+			return outputJSON(image)
+		}
+		fmt.Printf("%s\n", image.ID)
+		return 0, nil
+	}
+	index, err := m.ImageIndex(args[0])
+	if err != nil {
+		return 1, err
+	}
+	if jsonOutput {
+		return outputJSON(index)
+	}
+	printImageIndex(index)
+	return 0, nil
+}
+
+func imageIndexes(flags *mflag.FlagSet, action string, m storage.Store, args []string) (int, error) {
+	indexes, err := m.ImageIndexes()
+	if err != nil {
+		return 1, err
+	}
+	if jsonOutput {
+		return outputJSON(indexes)
+	}
+	for _, index := range indexes {
+		fmt.Printf("%s\n", index.ID)
+		for _, name := range index.Names {
+			fmt.Printf("\tname: %s\n", name)
+		}
+		for _, member := range index.Members {
+			fmt.Printf("\timage: %s %s\n", member.ImageID, member.Platform)
+		}
+	}
+	return 0, nil
+}
+
+func deleteImageIndex(flags *mflag.FlagSet, action string, m storage.Store, args []string) (int, error) {
+	for _, arg := range args {
+		if err := m.DeleteImageIndex(arg); err != nil {
+			return 1, err
+		}
+	}
+	return 0, nil
+}
+
+func init() {
+	commands = append(commands,
+		command{
+			names:       []string{"create-image-index", "createimageindex"},
+			optionsHelp: "[options [...]] imageNameOrID=os/arch[/variant] [...]",
+			usage:       "Create an image index from images for different platforms",
+			minArgs:     1,
+			maxArgs:     -1,
+			action:      createImageIndex,
+			addFlags: func(flags *mflag.FlagSet, cmd *command) {
+				flags.Var(opts.NewListOptsRef(&paramNames, nil), []string{"-name", "n"}, "Image index name")
+				flags.StringVar(&paramID, []string{"-id", "i"}, "", "Image index ID")
+				flags.BoolVar(&jsonOutput, []string{"-json", "j"}, jsonOutput, "Prefer JSON output")
+			},
+		},
+		command{
+			names:       []string{"image-index", "imageindex"},
+			optionsHelp: "[options [...]] indexNameOrID",
+			usage:       "Examine an image index",
+			minArgs:     1,
+			maxArgs:     1,
+			action:      imageIndex,
+			addFlags: func(flags *mflag.FlagSet, cmd *command) {
+				flags.StringVar(&imageIndexPlatform, []string{"-platform"}, imageIndexPlatform, "Show the image for this platform, as OS/ARCH[/VARIANT]")
+				flags.BoolVar(&jsonOutput, []string{"-json", "j"}, jsonOutput, "Prefer JSON output")
+			},
+		},
+		command{
+			names:       []string{"image-indexes", "imageindexes"},
+			optionsHelp: "[options [...]]",
+			usage:       "List image indexes",
+			minArgs:     0,
+			maxArgs:     0,
+			action:      imageIndexes,
+			addFlags: func(flags *mflag.FlagSet, cmd *command) {
+				flags.BoolVar(&jsonOutput, []string{"-json", "j"}, jsonOutput, "Prefer JSON output")
+			},
+		},
+		command{
+			names:       []string{"delete-image-index", "deleteimageindex"},
+			optionsHelp: "[options [...]] indexNameOrID [...]",
+			usage:       "Delete an image index, but not its images",
+			minArgs:     1,
+			maxArgs:     -1,
+			action:      deleteImageIndex,
+		})
+}
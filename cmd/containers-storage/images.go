@@ -4,6 +4,7 @@ import (
 	"fmt"
 
 	"github.com/containers/storage"
+	"github.com/containers/storage/internal/opts"
 	"github.com/containers/storage/pkg/mflag"
 	digest "github.com/opencontainers/go-digest"
 )
@@ -11,7 +12,11 @@ import (
 var imagesQuiet = false
 
 func images(flags *mflag.FlagSet, action string, m storage.Store, args []string) (int, error) {
-	images, err := m.Images()
+	selector, err := labelSelector()
+	if err != nil {
+		return 1, err
+	}
+	images, err := m.ImagesByLabel(selector)
 	if err != nil {
 		return 1, err
 	}
@@ -32,6 +37,7 @@ func images(flags *mflag.FlagSet, action string, m storage.Store, args []string)
 		for _, name := range image.BigDataNames {
 			fmt.Printf("\tdata: %s\n", name)
 		}
+		printLabels(image.Labels)
 	}
 	return 0, nil
 }
@@ -81,6 +87,7 @@ func init() {
 		addFlags: func(flags *mflag.FlagSet, cmd *command) {
 			flags.BoolVar(&jsonOutput, []string{"-json", "j"}, jsonOutput, "Prefer JSON output")
 			flags.BoolVar(&imagesQuiet, []string{"-quiet", "q"}, imagesQuiet, "Only print IDs")
+			flags.Var(opts.NewListOptsRef(&listFilters, nil), []string{"-filter", "f"}, "Only list images which match a filter (label=SELECTOR)")
 		},
 	})
 	commands = append(commands, command{
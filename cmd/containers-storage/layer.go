@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"time"
 
 	"github.com/containers/storage"
 	"github.com/containers/storage/pkg/mflag"
@@ -102,6 +103,20 @@ func layer(flags *mflag.FlagSet, action string, m storage.Store, args []string)
 			if layer.ReadOnly {
 				fmt.Printf("Read Only: true\n")
 			}
+			for _, p := range layer.Provenance {
+				if p.SourceReference != "" {
+					fmt.Printf("Source: %s\n", p.SourceReference)
+				}
+				if p.PulledAt != nil {
+					fmt.Printf("Pulled At: %s\n", p.PulledAt.Format(time.RFC3339))
+				}
+				if p.MediaType != "" {
+					fmt.Printf("Media Type: %s\n", p.MediaType)
+				}
+				if p.SignatureDigest != "" {
+					fmt.Printf("Signature Digest: %s\n", p.SignatureDigest)
+				}
+			}
 		}
 	}
 	if len(matched) != len(args) {
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+
+	"github.com/containers/storage"
+	"github.com/containers/storage/pkg/mflag"
+)
+
+var layerFilesLong = false
+
+func layerFiles(flags *mflag.FlagSet, action string, m storage.Store, args []string) (int, error) {
+	files, err := m.LayerFiles(args[0])
+	if err != nil {
+		return 1, err
+	}
+	var headers []*tar.Header
+	for hdr, err := range files {
+		if err != nil {
+			return 1, err
+		}
+		if jsonOutput {
+			headers = append(headers, hdr)
+			continue
+		}
+		if layerFilesLong {
+			fmt.Printf("%s %d/%d %10d %s %s\n", hdr.FileInfo().Mode(), hdr.Uid, hdr.Gid, hdr.Size, hdr.ModTime.UTC().Format("2006-01-02 15:04"), hdr.Name)
+		} else {
+			fmt.Printf("%s\n", hdr.Name)
+		}
+	}
+	if jsonOutput {
+		return outputJSON(headers)
+	}
+	return 0, nil
+}
+
+func init() {
+	commands = append(commands, command{
+		names:       []string{"layer-files", "layerfiles"},
+		optionsHelp: "[options [...]] layerNameOrID",
+		usage:       "List the contents of a layer without mounting it",
+		minArgs:     1,
+		maxArgs:     1,
+		action:      layerFiles,
+		addFlags: func(flags *mflag.FlagSet, cmd *command) {
+			flags.BoolVar(&layerFilesLong, []string{"-long", "l"}, layerFilesLong, "List file modes, owners, sizes, and modification times")
+			flags.BoolVar(&jsonOutput, []string{"-json", "j"}, jsonOutput, "Prefer JSON output")
+		},
+	})
+}
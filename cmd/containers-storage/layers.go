@@ -2,16 +2,20 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
+	"slices"
 
 	"github.com/containers/storage"
+	"github.com/containers/storage/internal/opts"
 	"github.com/containers/storage/pkg/mflag"
 )
 
 var (
-	listLayersTree  = false
-	listLayersQuick = false
+	listLayersTree   = false
+	listLayersQuick  = false
+	listLayersSource = ""
 )
 
 func storageLayers(flags *mflag.FlagSet, action string, m storage.Store, args []string) (int, error) {
@@ -36,10 +40,29 @@ func storageLayers(flags *mflag.FlagSet, action string, m storage.Store, args []
 }
 
 func layers(flags *mflag.FlagSet, action string, m storage.Store, args []string) (int, error) {
-	layers, err := m.Layers()
+	selector, err := labelSelector()
 	if err != nil {
 		return 1, err
 	}
+	listed, err := m.MultiList(storage.MultiListOptions{Layers: true, LabelSelector: selector})
+	if err != nil {
+		return 1, err
+	}
+	layers := listed.Layers
+	if listLayersSource != "" {
+		pulled, err := m.LayersBySource(listLayersSource)
+		if err != nil && !errors.Is(err, storage.ErrLayerUnknown) {
+			return 1, err
+		}
+		fromSource := make(map[string]struct{}, len(pulled))
+		for _, layer := range pulled {
+			fromSource[layer.ID] = struct{}{}
+		}
+		layers = slices.DeleteFunc(layers, func(layer storage.Layer) bool {
+			_, ok := fromSource[layer.ID]
+			return !ok
+		})
+	}
 	if jsonOutput {
 		return outputJSON(layers)
 	}
@@ -103,6 +126,7 @@ func layers(flags *mflag.FlagSet, action string, m storage.Store, args []string)
 			for _, name := range layer.Names {
 				fmt.Printf("\tname: %s\n", name)
 			}
+			printLabels(layer.Labels)
 			if imageList, ok := imageMap[layer.ID]; ok && imageList != nil {
 				for _, image := range *imageList {
 					fmt.Printf("\timage: %s\n", image.ID)
@@ -137,6 +161,8 @@ func init() {
 			flags.BoolVar(&listLayersTree, []string{"-tree", "t"}, listLayersTree, "Use a tree")
 			flags.BoolVar(&listLayersQuick, []string{"-quick", "q"}, listLayersTree, "Just the IDs")
 			flags.BoolVar(&jsonOutput, []string{"-json", "j"}, jsonOutput, "Prefer JSON output")
+			flags.Var(opts.NewListOptsRef(&listFilters, nil), []string{"-filter", "f"}, "Only list layers which match a filter (label=SELECTOR)")
+			flags.StringVar(&listLayersSource, []string{"-source"}, listLayersSource, "Only list layers which were pulled from a reference or repository")
 		},
 	})
 	commands = append(commands, command{
@@ -3,8 +3,10 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"maps"
 	"os"
 	"slices"
+	"strings"
 
 	"github.com/containers/storage"
 	"github.com/containers/storage/internal/opts"
@@ -26,9 +28,10 @@ type command struct {
 }
 
 var (
-	commands   = []command{}
-	jsonOutput = false
-	force      = false
+	commands    = []command{}
+	jsonOutput  = false
+	force       = false
+	listFilters = []string{}
 )
 
 func main() {
@@ -156,3 +159,25 @@ func outputJSON(data any) (int, error) {
 	}
 	return 0, nil
 }
+
+// labelSelector combines the label filters in listFilters into a selector
+// suitable for use with storage.MultiListOptions.LabelSelector.
+func labelSelector() (string, error) {
+	var terms []string
+	for _, filter := range listFilters {
+		kind, term, ok := strings.Cut(filter, "=")
+		if !ok || kind != "label" || term == "" {
+			return "", fmt.Errorf("unsupported filter %q, expected label=SELECTOR", filter)
+		}
+		terms = append(terms, term)
+	}
+	return strings.Join(terms, ","), nil
+}
+
+// printLabels prints labels in sorted order, using the indentation that the
+// listing commands use for properties.
+func printLabels(labels map[string]string) {
+	for _, key := range slices.Sorted(maps.Keys(labels)) {
+		fmt.Printf("\tlabel: %s=%s\n", key, labels[key])
+	}
+}
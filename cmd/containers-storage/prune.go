@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/containers/storage"
+	"github.com/containers/storage/pkg/mflag"
+)
+
+var (
+	pruneDryRun        = false
+	prunePolicy        = string(storage.PruneLeastRecentlyUsed)
+	pruneHighWatermark = 0.0
+	pruneLowWatermark  = 0.0
+	pruneMaxSize       = int64(0)
+	pruneMaxAge        = time.Duration(0)
+	pruneLayers        = false
+	pruneLayersMinAge  = 24 * time.Hour
+)
+
+func prune(flags *mflag.FlagSet, action string, m storage.Store, args []string) (int, error) {
+	options := storage.PruneOptions{
+		Policy:                   storage.PrunePolicy(prunePolicy),
+		HighWatermark:            pruneHighWatermark,
+		LowWatermark:             pruneLowWatermark,
+		MaxSize:                  pruneMaxSize,
+		MaxAge:                   pruneMaxAge,
+		DanglingLayers:           pruneLayers,
+		DanglingLayersMinimumAge: &pruneLayersMinAge,
+		DryRun:                   pruneDryRun,
+	}
+	report, err := m.Prune(options)
+	if err != nil {
+		return 1, err
+	}
+	if jsonOutput {
+		return outputJSON(report)
+	}
+	for _, image := range report.Images {
+		fmt.Printf("image %s\n", image)
+	}
+	for _, layer := range report.Layers {
+		fmt.Printf("layer %s\n", layer)
+	}
+	fmt.Printf("reclaimed: %d\n", report.Reclaimed)
+	return 0, nil
+}
+
+func init() {
+	commands = append(commands, command{
+		names:   []string{"prune"},
+		usage:   "Remove unused images, and optionally dangling layers",
+		minArgs: 0,
+		maxArgs: 0,
+		action:  prune,
+		addFlags: func(flags *mflag.FlagSet, cmd *command) {
+			flags.BoolVar(&pruneDryRun, []string{"-dry-run", "n"}, pruneDryRun, "Only report what would be removed")
+			flags.StringVar(&prunePolicy, []string{"-policy", "p"}, prunePolicy, "Order in which to remove images (lru, age, or size)")
+			flags.Float64Var(&pruneHighWatermark, []string{"-high-watermark"}, pruneHighWatermark, "Remove images if more than this percentage of the filesystem is used")
+			flags.Float64Var(&pruneLowWatermark, []string{"-low-watermark"}, pruneLowWatermark, "Remove images until no more than this percentage of the filesystem is used")
+			flags.Int64Var(&pruneMaxSize, []string{"-max-size"}, pruneMaxSize, "Remove images until they use no more than this many bytes")
+			flags.DurationVar(&pruneMaxAge, []string{"-max-age"}, pruneMaxAge, "Remove images which have not been used for this long")
+			flags.BoolVar(&pruneLayers, []string{"-layers", "l"}, pruneLayers, "Remove dangling layers")
+			flags.DurationVar(&pruneLayersMinAge, []string{"-layers-min-age"}, pruneLayersMinAge, "Only remove dangling layers which are at least this old")
+			flags.BoolVar(&jsonOutput, []string{"-json", "j"}, jsonOutput, "Prefer JSON output")
+		},
+	})
+}
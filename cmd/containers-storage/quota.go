@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/containers/storage"
+	"github.com/containers/storage/pkg/mflag"
+	"github.com/docker/go-units"
+)
+
+var (
+	quotaSize   = ""
+	quotaInodes = uint64(0)
+)
+
+func getContainerQuota(flags *mflag.FlagSet, action string, m storage.Store, args []string) (int, error) {
+	quota, err := m.GetContainerQuota(args[0])
+	if err != nil {
+		return 1, err
+	}
+	if jsonOutput {
+		return outputJSON(quota)
+	}
+	if quota.Size != 0 {
+		fmt.Printf("size: %d\n", quota.Size)
+	} else {
+		fmt.Printf("size: unlimited\n")
+	}
+	if quota.Inodes != 0 {
+		fmt.Printf("inodes: %d\n", quota.Inodes)
+	} else {
+		fmt.Printf("inodes: unlimited\n")
+	}
+	fmt.Printf("used size: %d\n", quota.UsedSize)
+	if quota.UsedInodes != -1 {
+		fmt.Printf("used inodes: %d\n", quota.UsedInodes)
+	}
+	return 0, nil
+}
+
+func setContainerQuota(flags *mflag.FlagSet, action string, m storage.Store, args []string) (int, error) {
+	var size int64
+	if quotaSize != "" {
+		var err error
+		if size, err = units.RAMInBytes(quotaSize); err != nil {
+			return 1, fmt.Errorf("parsing size %q: %w", quotaSize, err)
+		}
+		if size < 0 {
+			return 1, fmt.Errorf("invalid size %q", quotaSize)
+		}
+	}
+	if err := m.SetContainerQuota(args[0], uint64(size), quotaInodes); err != nil {
+		return 1, err
+	}
+	return 0, nil
+}
+
+func init() {
+	commands = append(commands, command{
+		names:       []string{"get-container-quota", "getcontainerquota"},
+		optionsHelp: "[options [...]] containerNameOrID",
+		usage:       "Show the disk quota of a container and its usage",
+		minArgs:     1,
+		maxArgs:     1,
+		action:      getContainerQuota,
+		addFlags: func(flags *mflag.FlagSet, cmd *command) {
+			flags.BoolVar(&jsonOutput, []string{"-json", "j"}, jsonOutput, "Prefer JSON output")
+		},
+	})
+	commands = append(commands, command{
+		names:       []string{"set-container-quota", "setcontainerquota"},
+		optionsHelp: "[options [...]] containerNameOrID",
+		usage:       "Set the disk quota of a container",
+		minArgs:     1,
+		maxArgs:     1,
+		action:      setContainerQuota,
+		addFlags: func(flags *mflag.FlagSet, cmd *command) {
+			flags.StringVar(&quotaSize, []string{"-size"}, quotaSize, "Maximum size of the container's layer, or 0 for no limit")
+			flags.Uint64Var(&quotaInodes, []string{"-inodes"}, quotaInodes, "Maximum number of inodes in the container's layer, or 0 for no limit")
+		},
+	})
+}
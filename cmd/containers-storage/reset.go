@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/containers/storage"
+	"github.com/containers/storage/pkg/mflag"
+)
+
+func resetContainer(flags *mflag.FlagSet, action string, m storage.Store, args []string) (int, error) {
+	reset := make(map[string]string)
+	for _, what := range args {
+		if err := m.ResetContainerLayer(what); err != nil {
+			reset[what] = err.Error()
+		} else {
+			reset[what] = ""
+		}
+	}
+	if jsonOutput {
+		if _, err := outputJSON(reset); err != nil {
+			return 1, err
+		}
+	} else {
+		for what, err := range reset {
+			if err != "" {
+				fmt.Fprintf(os.Stderr, "%s: %s\n", what, err)
+			}
+		}
+	}
+	for _, err := range reset {
+		if err != "" {
+			return 1, nil
+		}
+	}
+	return 0, nil
+}
+
+func init() {
+	commands = append(commands, command{
+		names:       []string{"reset-container", "resetcontainer"},
+		optionsHelp: "[ContainerNameOrID [...]]",
+		usage:       "Discard changes made to containers' file systems",
+		minArgs:     1,
+		maxArgs:     -1,
+		action:      resetContainer,
+		addFlags: func(flags *mflag.FlagSet, cmd *command) {
+			flags.BoolVar(&jsonOutput, []string{"-json", "j"}, jsonOutput, "Prefer JSON output")
+		},
+	})
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/containers/storage"
+	"github.com/containers/storage/internal/opts"
+	"github.com/containers/storage/pkg/mflag"
+)
+
+var (
+	squashBase   = ""
+	squashImage  = ""
+	squashRemove = false
+)
+
+func squashLayer(flags *mflag.FlagSet, action string, m storage.Store, args []string) (int, error) {
+	options := &storage.SquashOptions{
+		ID:             paramID,
+		Names:          paramNames,
+		Image:          squashImage,
+		RemoveSquashed: squashRemove,
+	}
+	layer, err := m.SquashLayers(args[0], squashBase, options)
+	if err != nil {
+		return 1, err
+	}
+	if jsonOutput {
+		return outputJSON(layer)
+	}
+	fmt.Printf("%s\n", layer.ID)
+	for _, name := range layer.Names {
+		fmt.Printf("\tname: %s\n", name)
+	}
+	return 0, nil
+}
+
+func init() {
+	commands = append(commands, command{
+		names:       []string{"squash-layer", "squashlayer"},
+		optionsHelp: "[options [...]] topLayerNameOrID",
+		usage:       "Combine a layer and its parents into a new layer",
+		minArgs:     1,
+		maxArgs:     1,
+		action:      squashLayer,
+		addFlags: func(flags *mflag.FlagSet, cmd *command) {
+			flags.StringVar(&squashBase, []string{"-base", "b"}, "", "Parent of the new layer, whose contents are not included")
+			flags.StringVar(&squashImage, []string{"-image"}, "", "Image whose top layer is replaced with the new layer")
+			flags.BoolVar(&squashRemove, []string{"-remove"}, squashRemove, "Remove the squashed layers which are no longer used")
+			flags.Var(opts.NewListOptsRef(&paramNames, nil), []string{"-name", "n"}, "Layer name")
+			flags.StringVar(&paramID, []string{"-id", "i"}, "", "Layer ID")
+			flags.BoolVar(&jsonOutput, []string{"-json", "j"}, jsonOutput, "Prefer JSON output")
+		},
+	})
+}
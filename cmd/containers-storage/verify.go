@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/containers/storage"
+	"github.com/containers/storage/pkg/mflag"
+)
+
+var (
+	verifyParents     = false
+	verifyParallelism = 1
+)
+
+type verifyResult struct {
+	Layer string `json:"layer"`
+	Path  string `json:"path,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+func outputVerification(results []storage.LayerVerification) (int, error) {
+	failed := 0
+	var jsonResults []verifyResult
+	for _, result := range results {
+		if result.Err != nil {
+			failed++
+		}
+		if jsonOutput {
+			r := verifyResult{Layer: result.Layer, Path: result.Path}
+			if result.Err != nil {
+				r.Error = result.Err.Error()
+			}
+			jsonResults = append(jsonResults, r)
+			continue
+		}
+		if result.Err != nil {
+			fmt.Printf("%v\n", result.Err)
+		} else {
+			fmt.Printf("layer %s: ok\n", result.Layer)
+		}
+	}
+	if jsonOutput {
+		if _, err := outputJSON(jsonResults); err != nil {
+			return 1, err
+		}
+	}
+	if failed > 0 {
+		return 1, fmt.Errorf("%d of %d layers failed verification", failed, len(results))
+	}
+	return 0, nil
+}
+
+func verifyLayer(flags *mflag.FlagSet, action string, m storage.Store, args []string) (int, error) {
+	results, err := m.VerifyLayer(args[0], &storage.VerifyLayerOptions{
+		Parents:     verifyParents,
+		Parallelism: verifyParallelism,
+	})
+	if err != nil {
+		return 1, err
+	}
+	return outputVerification(results)
+}
+
+func verifyImage(flags *mflag.FlagSet, action string, m storage.Store, args []string) (int, error) {
+	image, err := m.Image(args[0])
+	if err != nil {
+		return 1, err
+	}
+	if image.TopLayer == "" {
+		return outputVerification(nil)
+	}
+	results, err := m.VerifyLayer(image.TopLayer, &storage.VerifyLayerOptions{
+		Parents:     true,
+		Parallelism: verifyParallelism,
+	})
+	if err != nil {
+		return 1, err
+	}
+	return outputVerification(results)
+}
+
+func init() {
+	commands = append(commands, command{
+		names:       []string{"verify-layer"},
+		optionsHelp: "[options [...]] layerNameOrID",
+		usage:       "Check that a layer's contents match its recorded digests",
+		minArgs:     1,
+		maxArgs:     1,
+		action:      verifyLayer,
+		addFlags: func(flags *mflag.FlagSet, cmd *command) {
+			flags.BoolVar(&verifyParents, []string{"-parents", "p"}, verifyParents, "Also verify the layer's parents")
+			flags.IntVar(&verifyParallelism, []string{"-parallel", "P"}, verifyParallelism, "Maximum number of layers to verify at once")
+			flags.BoolVar(&jsonOutput, []string{"-json", "j"}, jsonOutput, "Prefer JSON output")
+		},
+	})
+	commands = append(commands, command{
+		names:       []string{"verify-image"},
+		optionsHelp: "[options [...]] imageNameOrID",
+		usage:       "Check that an image's layers' contents match their recorded digests",
+		minArgs:     1,
+		maxArgs:     1,
+		action:      verifyImage,
+		addFlags: func(flags *mflag.FlagSet, cmd *command) {
+			flags.IntVar(&verifyParallelism, []string{"-parallel", "P"}, verifyParallelism, "Maximum number of layers to verify at once")
+			flags.BoolVar(&jsonOutput, []string{"-json", "j"}, jsonOutput, "Prefer JSON output")
+		},
+	})
+}
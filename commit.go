@@ -0,0 +1,150 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"slices"
+
+	drivers "github.com/containers/storage/drivers"
+	"github.com/containers/storage/pkg/archive"
+	"github.com/sirupsen/logrus"
+)
+
+// CommitOptions controls how CommitContainer creates an image from a
+// container.
+type CommitOptions struct {
+	// ID is the ID to give the new image.  If it is not set, a random ID
+	// is generated.
+	ID string
+	// Names are names to give the new image.
+	Names []string
+	// Metadata is caller-specified metadata to store with the new image.
+	Metadata string
+	// CopyBigData causes the big data items of the container's image to
+	// be copied to the new image, except for those which are replaced by
+	// items in BigData.
+	CopyBigData bool
+	// BigData is a set of items which should be stored with the new
+	// image.
+	BigData []ImageBigDataOption
+	// Pause causes the container's layer to be unmounted while its
+	// contents are read.  It is mounted again afterwards, as many times as
+	// it was mounted before and with the options which it was mounted
+	// with.  Unmounting a layer doesn't stop processes which are already
+	// using it from writing to it, so callers which need the contents to
+	// be consistent should stop the container first.  Otherwise, changes
+	// which are made while the layer is being read may or may not be
+	// included.
+	Pause bool
+}
+
+// CommitContainer creates an image from a container.  The contents of the
+// container's layer are copied into a new read-only layer on top of the
+// container's image's top layer, and a new image is created using it as its
+// top layer.  The container is not modified.
+func (s *store) CommitContainer(id string, options *CommitOptions) (*Image, error) {
+	if options == nil {
+		options = &CommitOptions{}
+	}
+	container, err := s.Container(id)
+	if err != nil {
+		return nil, err
+	}
+	rwLayer, err := s.Layer(container.LayerID)
+	if err != nil {
+		return nil, err
+	}
+
+	// The container's layer's parent might be a copy of the image's top
+	// layer with the container's ID mappings, but the new layer is placed
+	// on top of the original.
+	parent := ""
+	imageOptions := &ImageOptions{}
+	if container.ImageID != "" {
+		image, err := s.Image(container.ImageID)
+		if err != nil {
+			return nil, err
+		}
+		parent = image.TopLayer
+		if options.CopyBigData {
+			for _, key := range image.BigDataNames {
+				if slices.ContainsFunc(options.BigData, func(item ImageBigDataOption) bool { return item.Key == key }) {
+					continue
+				}
+				data, err := s.ImageBigData(image.ID, key)
+				if err != nil {
+					return nil, fmt.Errorf("reading data item %q of image %q: %w", key, image.ID, err)
+				}
+				imageOptions.BigData = append(imageOptions.BigData, ImageBigDataOption{Key: key, Data: data})
+			}
+		}
+	}
+	imageOptions.BigData = append(imageOptions.BigData, options.BigData...)
+
+	diff, err := os.CreateTemp(s.GraphRoot(), ".commit-")
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		diff.Close()
+		os.Remove(diff.Name())
+	}()
+	if err := s.writeContainerDiff(container, rwLayer, options.Pause, diff); err != nil {
+		return nil, err
+	}
+	if _, err := diff.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	layer, _, err := s.PutLayer("", parent, nil, "", false, nil, diff)
+	if err != nil {
+		return nil, fmt.Errorf("creating layer for container %q: %w", container.ID, err)
+	}
+	image, err := s.CreateImage(options.ID, options.Names, layer.ID, options.Metadata, imageOptions)
+	if err != nil {
+		if err2 := s.DeleteLayer(layer.ID); err2 != nil {
+			logrus.Errorf("While recovering from a failure to create an image for container %q, error deleting layer %q: %v", container.ID, layer.ID, err2)
+		}
+		return nil, err
+	}
+	return image, nil
+}
+
+// writeContainerDiff writes the uncompressed diff of a container's layer to
+// w, optionally unmounting the layer while doing so.
+func (s *store) writeContainerDiff(container *Container, rwLayer *Layer, pause bool, w io.Writer) error {
+	mounts := 0
+	var mountOptions *drivers.MountOpts
+	if pause {
+		_, err := writeToLayerStore(s, func(rlstore rwLayerStore) (struct{}, error) {
+			var err error
+			mounts, mountOptions, err = rlstore.unmountAll(rwLayer.ID)
+			return struct{}{}, err
+		})
+		if err != nil {
+			return fmt.Errorf("pausing container %q: %w", container.ID, err)
+		}
+	}
+
+	uncompressed := archive.Uncompressed
+	rc, err := s.Diff(rwLayer.Parent, rwLayer.ID, &DiffOptions{Compression: &uncompressed})
+	if err == nil {
+		_, err = io.Copy(w, rc)
+		if err2 := rc.Close(); err == nil {
+			err = err2
+		}
+	}
+
+	for range mounts {
+		if _, err2 := s.mountLayer(rwLayer.ID, *mountOptions); err2 != nil {
+			err2 = fmt.Errorf("remounting container %q: %w", container.ID, err2)
+			if err == nil {
+				return err2
+			}
+			logrus.Error(err2)
+			break
+		}
+	}
+	return err
+}
@@ -84,6 +84,10 @@ type Container struct {
 
 	Flags map[string]any `json:"flags,omitempty"`
 
+	// Labels are caller-specified key/value pairs which can be used to
+	// select containers.
+	Labels map[string]string `json:"labels,omitempty"`
+
 	// volatileStore is true if the container is from the volatile json file
 	volatileStore bool `json:"-"`
 }
@@ -108,6 +112,12 @@ type rwContainerStore interface {
 	// stopReading releases locks obtained by startReading.
 	stopReading()
 
+	// changedSince checks if the on-disk state of the store was modified
+	// since the point described by previous, and returns a value which
+	// describes the current state, for use in later calls.  If previous
+	// is nil, the state is always treated as modified.
+	changedSince(previous *storeWriteMarker) (storeWriteMarker, bool, error)
+
 	// create creates a container that has a specified ID (or generates a
 	// random one if an empty value is supplied) and optional names,
 	// based on the specified image, using the specified layer as its
@@ -116,6 +126,10 @@ type rwContainerStore interface {
 	// convenience of the caller, nothing more.
 	create(id string, names []string, image, layer string, options *ContainerOptions) (*Container, error)
 
+	// setLayer changes which layer a container uses as its read-write
+	// layer.
+	setLayer(id, layer string) error
+
 	// updateNames modifies names associated with a  container based on (op, names).
 	updateNames(id string, names []string, op updateNameOperation) error
 
@@ -138,6 +152,10 @@ type rwContainerStore interface {
 	// Containers returns a slice enumerating the known containers.
 	Containers() ([]Container, error)
 
+	// containersMatching returns the known containers whose labels match
+	// selector.
+	containersMatching(selector labelSelector) []Container
+
 	// Clean up unreferenced datadirs
 	GarbageCollect() error
 }
@@ -158,6 +176,7 @@ type containerStore struct {
 	byid       map[string]*Container
 	bylayer    map[string]*Container
 	byname     map[string]*Container
+	bylabel    labelIndex[Container]
 }
 
 func copyContainer(c *Container) *Container {
@@ -174,6 +193,7 @@ func copyContainer(c *Container) *Container {
 		UIDMap:         copySlicePreferringNil(c.UIDMap),
 		GIDMap:         copySlicePreferringNil(c.GIDMap),
 		Flags:          copyMapPreferringNil(c.Flags),
+		Labels:         copyMapPreferringNil(c.Labels),
 		volatileStore:  c.volatileStore,
 	}
 }
@@ -361,6 +381,25 @@ func (r *containerStore) modified() (lockfile.LastWrite, bool, error) {
 	return r.lockfile.ModifiedSince(r.lastWrite)
 }
 
+// changedSince checks if the on-disk state of the store was modified since the
+// point described by previous.
+//
+// Requires startReading or startWriting.
+func (r *containerStore) changedSince(previous *storeWriteMarker) (storeWriteMarker, bool, error) {
+	if previous == nil {
+		lastWrite, err := r.lockfile.GetLastWrite()
+		if err != nil {
+			return storeWriteMarker{}, false, err
+		}
+		return storeWriteMarker{data: lastWrite}, true, nil
+	}
+	lastWrite, modified, err := r.lockfile.ModifiedSince(previous.data)
+	if err != nil {
+		return storeWriteMarker{}, false, err
+	}
+	return storeWriteMarker{data: lastWrite}, modified, nil
+}
+
 // reloadIfChanged reloads the contents of the store from disk if it is changed.
 //
 // The caller must hold r.lockfile for reading _or_ writing; lockedForWriting is true
@@ -389,6 +428,20 @@ func (r *containerStore) reloadIfChanged(lockedForWriting bool) (bool, error) {
 	return false, nil
 }
 
+func containerLabels(container *Container) map[string]string {
+	return container.Labels
+}
+
+// Requires startReading or startWriting.
+func (r *containerStore) containersMatching(selector labelSelector) []Container {
+	matched := r.bylabel.matching(selector, r.containers, containerLabels)
+	containers := make([]Container, len(matched))
+	for i := range matched {
+		containers[i] = *copyContainer(matched[i])
+	}
+	return containers
+}
+
 // Requires startReading or startWriting.
 func (r *containerStore) Containers() ([]Container, error) {
 	containers := make([]Container, len(r.containers))
@@ -510,6 +563,7 @@ func (r *containerStore) load(lockedForWriting bool) (bool, error) {
 	r.byid = ids
 	r.bylayer = layers
 	r.byname = names
+	r.bylabel = newLabelIndex(containers, containerLabels)
 	if errorToResolveBySaving != nil {
 		if !lockedForWriting {
 			return true, errorToResolveBySaving
@@ -598,6 +652,7 @@ func newContainerStore(dir string, runDir string, transient bool) (rwContainerSt
 		byid:       make(map[string]*Container),
 		bylayer:    make(map[string]*Container),
 		byname:     make(map[string]*Container),
+		bylabel:    make(labelIndex[Container]),
 	}
 
 	if err := cstore.startWritingWithReload(false); err != nil {
@@ -692,6 +747,7 @@ func (r *containerStore) create(id string, names []string, image, layer string,
 		BigDataDigests: make(map[string]digest.Digest),
 		Created:        time.Now().UTC(),
 		Flags:          newMapFrom(options.Flags),
+		Labels:         copyMapPreferringNil(options.Labels),
 		UIDMap:         copySlicePreferringNil(options.UIDMap),
 		GIDMap:         copySlicePreferringNil(options.GIDMap),
 		volatileStore:  options.Volatile,
@@ -710,6 +766,7 @@ func (r *containerStore) create(id string, names []string, image, layer string,
 	_ = r.idindex.Add(id)
 	r.byid[id] = container
 	r.bylayer[layer] = container
+	r.bylabel.add(container, container.Labels)
 	for _, name := range names {
 		r.byname[name] = container
 	}
@@ -753,6 +810,29 @@ func (r *containerStore) SetMetadata(id, metadata string) error {
 	return ErrContainerUnknown
 }
 
+// Requires startWriting.
+func (r *containerStore) SetLabels(id string, labels map[string]string) error {
+	if container, ok := r.lookup(id); ok {
+		r.bylabel.remove(container, container.Labels)
+		container.Labels = copyMapPreferringNil(labels)
+		r.bylabel.add(container, container.Labels)
+		return r.saveFor(container)
+	}
+	return ErrContainerUnknown
+}
+
+// Requires startWriting.
+func (r *containerStore) setLayer(id, layer string) error {
+	container, ok := r.lookup(id)
+	if !ok {
+		return ErrContainerUnknown
+	}
+	delete(r.bylayer, container.LayerID)
+	container.LayerID = layer
+	r.bylayer[layer] = container
+	return r.saveFor(container)
+}
+
 // The caller must hold r.inProcessLock for writing.
 func (r *containerStore) removeName(container *Container, name string) {
 	container.Names = stringSliceWithoutValue(container.Names, name)
@@ -790,6 +870,7 @@ func (r *containerStore) Delete(id string) error {
 	}
 	id = container.ID
 	delete(r.byid, id)
+	r.bylabel.remove(container, container.Labels)
 	// This can only fail if the ID is already missing, which shouldn’t happen — and in that case the index is already in the desired state anyway.
 	// The store’s Delete method is used on various paths to recover from failures, so this should be robust against partially missing data.
 	_ = r.idindex.Delete(id)
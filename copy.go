@@ -0,0 +1,207 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/containers/storage/pkg/archive"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/sirupsen/logrus"
+)
+
+// CopyImageOptions controls how CopyImage copies an image.
+type CopyImageOptions struct {
+	// Names, if not nil, is used as the list of names for the copy of the
+	// image instead of the names of the original.
+	Names []string
+}
+
+// CopyImage copies an image, its layers, its big data items, and its names
+// from one store to another, and returns the copy.
+//
+// Layers which are already present in dst, with the same parent, the same
+// uncompressed digest or TOC digest, are reused rather than copied.  The
+// contents of the other layers are read from src using Diff and written to
+// dst using PutLayer, in a single transaction, so that if copying fails, no
+// partial copy is left behind.
+//
+// If dst already has an image with the same ID, it is given any names and big
+// data items which it is missing, and returned.
+//
+// src and dst must not use the same graph root.
+func CopyImage(src, dst Store, id string, options *CopyImageOptions) (*Image, error) {
+	if src.GraphRoot() == dst.GraphRoot() {
+		return nil, fmt.Errorf("copying image %q: source and destination are the same store", id)
+	}
+	image, err := src.Image(id)
+	if err != nil {
+		return nil, err
+	}
+	names := image.Names
+	if options != nil && options.Names != nil {
+		names = options.Names
+	}
+
+	if existing, err := dst.Image(image.ID); err == nil {
+		return updateCopiedImage(src, dst, image, existing, names)
+	} else if !errors.Is(err, ErrImageUnknown) {
+		return nil, err
+	}
+
+	// Walk the layer chain from the top layer down, and then copy the
+	// layers base layer first.
+	var chain []*Layer
+	for layerID := image.TopLayer; layerID != ""; {
+		layer, err := src.Layer(layerID)
+		if err != nil {
+			return nil, fmt.Errorf("locating layer %q of image %q: %w", layerID, image.ID, err)
+		}
+		chain = append(chain, layer)
+		layerID = layer.Parent
+	}
+	slices.Reverse(chain)
+
+	// Find out how much of the chain dst already has.
+	parent := ""
+	reused := 0
+	for _, layer := range chain {
+		match, err := findCopiedLayer(dst, parent, layer)
+		if err != nil {
+			return nil, err
+		}
+		if match == "" {
+			break
+		}
+		parent = match
+		reused++
+	}
+
+	// Read the big data items before locking dst.
+	imageOptions := ImageOptions{
+		CreationDate: image.Created,
+		Digest:       image.Digest,
+		NamesHistory: image.NamesHistory,
+		Flags:        image.Flags,
+	}
+	for _, key := range image.BigDataNames {
+		data, err := src.ImageBigData(image.ID, key)
+		if err != nil {
+			return nil, fmt.Errorf("reading data item %q of image %q: %w", key, image.ID, err)
+		}
+		imageOptions.BigData = append(imageOptions.BigData, ImageBigDataOption{Key: key, Data: data, Digest: image.BigDataDigests[key]})
+	}
+
+	tx, err := dst.Begin()
+	if err != nil {
+		return nil, err
+	}
+	succeeded := false
+	defer func() {
+		if !succeeded {
+			if err := tx.Rollback(); err != nil {
+				logrus.Errorf("Rolling back copy of image %q: %v", image.ID, err)
+			}
+		}
+	}()
+	for _, layer := range chain[reused:] {
+		copied, err := copyLayerContents(src, tx, parent, layer)
+		if err != nil {
+			return nil, fmt.Errorf("copying layer %q of image %q: %w", layer.ID, image.ID, err)
+		}
+		parent = copied.ID
+	}
+	if _, err := tx.CreateImage(image.ID, names, parent, image.Metadata, &imageOptions); err != nil {
+		return nil, err
+	}
+	// Commit cleans up after itself if it fails.
+	succeeded = true
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return dst.Image(image.ID)
+}
+
+// findCopiedLayer returns the ID of a layer in dst with the specified parent
+// and the same contents as layer, or "".
+func findCopiedLayer(dst Store, parent string, layer *Layer) (string, error) {
+	var candidates []Layer
+	if layer.UncompressedDigest != "" {
+		layers, err := dst.LayersByUncompressedDigest(layer.UncompressedDigest)
+		if err != nil && !errors.Is(err, ErrLayerUnknown) {
+			return "", err
+		}
+		candidates = append(candidates, layers...)
+	}
+	if layer.TOCDigest != "" {
+		layers, err := dst.LayersByTOCDigest(layer.TOCDigest)
+		if err != nil && !errors.Is(err, ErrLayerUnknown) {
+			return "", err
+		}
+		candidates = append(candidates, layers...)
+	}
+	for _, candidate := range candidates {
+		if candidate.Parent == parent && !layerHasIncompleteFlag(&candidate) {
+			return candidate.ID, nil
+		}
+	}
+	return "", nil
+}
+
+// copyLayerContents copies the contents and big data items of layer from src to a new
+// layer with the specified parent, created using tx.
+func copyLayerContents(src Store, tx Transaction, parent string, layer *Layer) (*Layer, error) {
+	layerOptions := LayerOptions{
+		UncompressedDigest: layer.UncompressedDigest,
+		Flags:              layer.Flags,
+		Provenance:         layer.Provenance,
+	}
+	// The copied contents are not compressed, so the digest of the
+	// original, compressed, blob can only be recorded if the uncompressed
+	// digest is also known.  Otherwise it would be mistaken for one.
+	if layer.UncompressedDigest != "" && layer.CompressedDigest != "" {
+		layerOptions.OriginalDigest = layer.CompressedDigest
+		layerOptions.OriginalSize = &layer.CompressedSize
+	}
+	for _, key := range layer.BigDataNames {
+		rc, err := src.LayerBigData(layer.ID, key)
+		if err != nil {
+			return nil, fmt.Errorf("reading data item %q: %w", key, err)
+		}
+		defer rc.Close()
+		layerOptions.BigData = append(layerOptions.BigData, LayerBigDataOption{Key: key, Data: rc})
+	}
+	uncompressed := archive.Uncompressed
+	diff, err := src.Diff("", layer.ID, &DiffOptions{Compression: &uncompressed})
+	if err != nil {
+		return nil, err
+	}
+	defer diff.Close()
+	copied, _, err := tx.PutLayer("", parent, nil, layer.MountLabel, false, &layerOptions, diff)
+	if err != nil {
+		return nil, err
+	}
+	return copied, nil
+}
+
+// updateCopiedImage adds names and big data items of image which are missing
+// from existing, which is the image with the same ID in dst.
+func updateCopiedImage(src, dst Store, image, existing *Image, names []string) (*Image, error) {
+	if err := dst.AddNames(existing.ID, names); err != nil {
+		return nil, err
+	}
+	for _, key := range image.BigDataNames {
+		if slices.Contains(existing.BigDataNames, key) {
+			continue
+		}
+		data, err := src.ImageBigData(image.ID, key)
+		if err != nil {
+			return nil, fmt.Errorf("reading data item %q of image %q: %w", key, image.ID, err)
+		}
+		recorded := image.BigDataDigests[key]
+		if err := dst.SetImageBigData(existing.ID, key, data, func([]byte) (digest.Digest, error) { return recorded, nil }); err != nil {
+			return nil, err
+		}
+	}
+	return dst.Image(existing.ID)
+}
@@ -0,0 +1,282 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/containers/storage/pkg/archive"
+	"github.com/containers/storage/pkg/chunked/toc"
+	"github.com/containers/storage/pkg/ioutils"
+	digest "github.com/opencontainers/go-digest"
+)
+
+// DeferredFilesBigDataKey is the key of the big data item in which the
+// zstd:chunked differ records, as a JSON list of absolute paths, the regular
+// files in a layer pulled with the defer_file_contents pull option whose
+// contents have not been retrieved yet.  The files are present in the layer, but empty.  Once all of them have
+// been retrieved, the list is empty.
+const DeferredFilesBigDataKey = "deferred-files"
+
+// LayerFetcher retrieves parts of the zstd:chunked blobs from which layers
+// with deferred file contents were created.
+type LayerFetcher interface {
+	// GetBlobAt returns a reader for length bytes of the blob from which
+	// the layer was created, starting at offset.
+	GetBlobAt(layer *Layer, offset, length int64) (io.ReadCloser, error)
+}
+
+// directoryLayerFetcher is a LayerFetcher which reads blobs from files in a
+// directory.
+type directoryLayerFetcher struct {
+	dir string
+}
+
+// NewDirectoryLayerFetcher returns a LayerFetcher which reads a layer's blob
+// from a file in dir which is named after the encoded part of the layer's
+// TOCDigest.
+func NewDirectoryLayerFetcher(dir string) LayerFetcher {
+	return &directoryLayerFetcher{dir: dir}
+}
+
+func (f *directoryLayerFetcher) GetBlobAt(layer *Layer, offset, length int64) (io.ReadCloser, error) {
+	if layer.TOCDigest == "" {
+		return nil, fmt.Errorf("layer %q was not created from a zstd:chunked blob: %w", layer.ID, ErrNotSupported)
+	}
+	if err := layer.TOCDigest.Validate(); err != nil {
+		return nil, fmt.Errorf("TOC digest of layer %q: %w", layer.ID, err)
+	}
+	file, err := os.Open(filepath.Join(f.dir, layer.TOCDigest.Encoded()))
+	if err != nil {
+		return nil, err
+	}
+	return ioutils.NewReadCloserWrapper(io.NewSectionReader(file, offset, length), file.Close), nil
+}
+
+func (s *store) SetLayerFetcher(fetcher LayerFetcher) {
+	s.layerFetcherLock.Lock()
+	defer s.layerFetcherLock.Unlock()
+	s.layerFetcher = fetcher
+}
+
+func (s *store) getLayerFetcher() LayerFetcher {
+	s.layerFetcherLock.Lock()
+	defer s.layerFetcherLock.Unlock()
+	return s.layerFetcher
+}
+
+// Requires startReading or startWriting.
+func deferredFiles(store roLayerStore, id string) ([]string, error) {
+	rc, err := store.BigData(id, DeferredFilesBigDataKey)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer rc.Close()
+	var missing []string
+	if err := json.NewDecoder(rc).Decode(&missing); err != nil {
+		return nil, fmt.Errorf("reading list of files missing from layer %q: %w", id, err)
+	}
+	return missing, nil
+}
+
+// fetchDeferredLayers retrieves the missing contents of the specified layer
+// and its parents, if any of them have deferred file contents.  Files are not
+// fetched as they are accessed through a mounted layer, so this is used to
+// fetch everything before a layer is mounted or its diff is read.
+func (s *store) fetchDeferredLayers(id string) error {
+	for id != "" {
+		layer, err := s.Layer(id)
+		if err != nil {
+			return err
+		}
+		if slices.Contains(layer.BigDataNames, DeferredFilesBigDataKey) {
+			if err := s.fetchDeferredFiles(layer.ID, nil); err != nil {
+				return err
+			}
+		}
+		id = layer.Parent
+	}
+	return nil
+}
+
+// fetchDeferredFiles retrieves the contents of the named files, or all of
+// them if names is nil, if they are missing from a layer with deferred file
+// contents.
+// Names must be cleaned absolute paths.  The files are fetched without
+// holding any locks, and are then written to the layer.
+func (s *store) fetchDeferredFiles(id string, names []string) error {
+	type deferredLayer struct {
+		layer   *Layer
+		missing []string
+		files   map[string]*toc.RegularFile
+	}
+	deferred, err := writeToLayerStore(s, func(rlstore rwLayerStore) (*deferredLayer, error) {
+		if !rlstore.Exists(id) {
+			// Only layers which we pulled can be missing anything.
+			return nil, nil
+		}
+		layer, err := rlstore.Get(id)
+		if err != nil {
+			return nil, err
+		}
+		missing, err := deferredFiles(rlstore, layer.ID)
+		if err != nil || len(missing) == 0 {
+			return nil, err
+		}
+		rc, err := rlstore.BigData(layer.ID, toc.BigDataKey)
+		if err != nil {
+			return nil, fmt.Errorf("reading TOC of layer %q: %w", layer.ID, err)
+		}
+		defer rc.Close()
+		manifest, err := io.ReadAll(rc)
+		if err != nil {
+			return nil, fmt.Errorf("reading TOC of layer %q: %w", layer.ID, err)
+		}
+		files, err := toc.RegularFiles(manifest)
+		if err != nil {
+			return nil, fmt.Errorf("reading TOC of layer %q: %w", layer.ID, err)
+		}
+		return &deferredLayer{layer: layer, missing: missing, files: files}, nil
+	})
+	if err != nil || deferred == nil {
+		return err
+	}
+
+	wanted := deferred.missing
+	if names != nil {
+		wanted = slices.DeleteFunc(slices.Clone(wanted), func(name string) bool {
+			return !slices.Contains(names, name)
+		})
+	}
+	if len(wanted) == 0 {
+		return nil
+	}
+	fetcher := s.getLayerFetcher()
+	if fetcher == nil {
+		return fmt.Errorf("layer %q is missing the contents of %d files: %w", deferred.layer.ID, len(deferred.missing), ErrLayerContentsDeferred)
+	}
+
+	fetched := make(map[string]*os.File, len(wanted))
+	defer func() {
+		for _, f := range fetched {
+			removeSpooledDiff(f)
+		}
+	}()
+	for _, name := range wanted {
+		file, ok := deferred.files[name]
+		if !ok {
+			return fmt.Errorf("%q, which is missing from layer %q, is not a regular file in its TOC", name, deferred.layer.ID)
+		}
+		f, err := s.fetchDeferredFile(fetcher, deferred.layer, file)
+		if err != nil {
+			return fmt.Errorf("fetching %q in layer %q: %w", name, deferred.layer.ID, err)
+		}
+		fetched[name] = f
+	}
+
+	_, err = writeToLayerStore(s, func(rlstore rwLayerStore) (struct{}, error) {
+		if !rlstore.Exists(id) {
+			return struct{}{}, ErrLayerUnknown
+		}
+		// Another caller may have retrieved some of the files while we
+		// weren't holding the lock.
+		missing, err := deferredFiles(rlstore, id)
+		if err != nil {
+			return struct{}{}, err
+		}
+		root, err := rlstore.DifferTarget(id)
+		if err != nil {
+			return struct{}{}, err
+		}
+		remaining := []string{}
+		for _, name := range missing {
+			f, ok := fetched[name]
+			if !ok {
+				remaining = append(remaining, name)
+				continue
+			}
+			if err := writeDeferredFile(root, name, f); err != nil {
+				return struct{}{}, fmt.Errorf("writing %q in layer %q: %w", name, id, err)
+			}
+		}
+		data, err := json.Marshal(remaining)
+		if err != nil {
+			return struct{}{}, err
+		}
+		if err := rlstore.SetBigData(id, DeferredFilesBigDataKey, bytes.NewReader(data)); err != nil {
+			return struct{}{}, err
+		}
+		if len(remaining) > 0 {
+			return struct{}{}, nil
+		}
+		// The differ couldn't compute the digest of the layer's diff
+		// while its contents were incomplete, so do that now.
+		return struct{}{}, rlstore.recordUncompressedDigest(id)
+	})
+	return err
+}
+
+// fetchDeferredFile retrieves and decompresses the contents of a file in a layer
+// into a temporary file, checking them against the layer's TOC.
+func (s *store) fetchDeferredFile(fetcher LayerFetcher, layer *Layer, file *toc.RegularFile) (_ *os.File, retErr error) {
+	f, err := os.CreateTemp(s.GraphRoot(), ".deferred-")
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if retErr != nil {
+			removeSpooledDiff(f)
+		}
+	}()
+	fileDigester := digest.Canonical.Digester()
+	written := int64(0)
+	for _, chunk := range file.Chunks {
+		if chunk.FileOffset != written {
+			return nil, fmt.Errorf("chunk at offset %d does not follow the previous one, which ended at %d", chunk.FileOffset, written)
+		}
+		if err := fetchDeferredChunk(fetcher, layer, chunk, io.MultiWriter(f, fileDigester.Hash())); err != nil {
+			return nil, err
+		}
+		written += chunk.Size
+	}
+	if written != file.Size {
+		return nil, fmt.Errorf("retrieved %d bytes, expected %d", written, file.Size)
+	}
+	if file.Digest != "" && fileDigester.Digest() != file.Digest {
+		return nil, fmt.Errorf("retrieved contents have digest %s, expected %s", fileDigester.Digest(), file.Digest)
+	}
+	return f, nil
+}
+
+// fetchDeferredChunk retrieves and decompresses one chunk of a file's contents.
+func fetchDeferredChunk(fetcher LayerFetcher, layer *Layer, chunk toc.FileChunk, dest io.Writer) error {
+	rc, err := fetcher.GetBlobAt(layer, chunk.Offset, chunk.Length)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	decompressed, err := archive.DecompressStream(rc)
+	if err != nil {
+		return err
+	}
+	defer decompressed.Close()
+	chunkDigester := digest.Canonical.Digester()
+	n, err := io.Copy(io.MultiWriter(dest, chunkDigester.Hash()), decompressed)
+	if err != nil {
+		return err
+	}
+	if n != chunk.Size {
+		return fmt.Errorf("chunk at offset %d has %d bytes, expected %d", chunk.FileOffset, n, chunk.Size)
+	}
+	if chunk.Digest != "" && chunkDigester.Digest() != chunk.Digest {
+		return fmt.Errorf("chunk at offset %d has digest %s, expected %s", chunk.FileOffset, chunkDigester.Digest(), chunk.Digest)
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	securejoin "github.com/cyphar/filepath-securejoin"
+	"golang.org/x/sys/unix"
+)
+
+// writeDeferredFile replaces the contents of the empty placeholder for a file
+// whose contents were deferred with the contents of src, preserving the
+// placeholder's other attributes.
+func writeDeferredFile(root, name string, src *os.File) error {
+	handle, err := securejoin.OpenInRoot(root, name)
+	if err != nil {
+		return err
+	}
+	defer handle.Close()
+	file, err := securejoin.Reopen(handle, unix.O_WRONLY|unix.O_TRUNC|unix.O_CLOEXEC)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	var st unix.Stat_t
+	if err := unix.Fstat(int(file.Fd()), &st); err != nil {
+		return err
+	}
+	if st.Mode&unix.S_IFMT != unix.S_IFREG {
+		return fmt.Errorf("%q is not a regular file", name)
+	}
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := io.Copy(file, src); err != nil {
+		return err
+	}
+	// Writing updated the modification time, which the placeholder had
+	// already been given.
+	times := []unix.Timespec{st.Atim, st.Mtim}
+	if err := unix.UtimesNanoAt(unix.AT_FDCWD, fmt.Sprintf("/proc/self/fd/%d", file.Fd()), times, 0); err != nil {
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package storage
+
+import (
+	"os"
+)
+
+// writeDeferredFile replaces the contents of the empty placeholder for a file
+// whose contents were deferred with the contents of src.
+func writeDeferredFile(root, name string, src *os.File) error {
+	return ErrNotSupported
+}
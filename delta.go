@@ -0,0 +1,417 @@
+package storage
+
+import (
+	"archive/tar"
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/containers/storage/pkg/archive"
+	"github.com/containers/storage/pkg/chunked/compressor"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/sirupsen/logrus"
+)
+
+// layerDeltaMagic starts every layer delta.  The rest of the delta is
+// zstd-compressed, and consists of a length-prefixed JSON layerDeltaHeader
+// followed by a series of operations, each of which is a one-byte opcode
+// followed by varint-encoded arguments.
+const layerDeltaMagic = "containers-storage layer delta v1\n"
+
+const (
+	// deltaOpCopy is followed by an offset and a length, and copies that
+	// many bytes from the base layer's uncompressed diff.
+	deltaOpCopy = 'c'
+	// deltaOpLiteral is followed by a length and then that many bytes,
+	// which are copied from the delta itself.
+	deltaOpLiteral = 'l'
+	// deltaOpEnd ends the delta.
+	deltaOpEnd = 'e'
+
+	// deltaMaxChunkSize limits the size of the chunks which are compared
+	// when the rolling checksum doesn't find a split point.
+	deltaMaxChunkSize = 1 << 20
+)
+
+// layerDeltaHeader describes the base layer which a delta applies to, and the
+// layer which applying it produces.
+type layerDeltaHeader struct {
+	// Base is the digest of the base layer's uncompressed diff.
+	Base digest.Digest `json:"base"`
+	// Parent is the ID of the parent of the layer which the delta was
+	// created from, and of the layer which applying it creates.
+	Parent             string        `json:"parent,omitempty"`
+	UncompressedDigest digest.Digest `json:"uncompressed-digest"`
+	UncompressedSize   int64         `json:"uncompressed-size"`
+}
+
+// spoolLayerDiff writes the uncompressed diff of a layer to a temporary file,
+// so that its contents can be read while the store is modified, and returns
+// the file, positioned at its start, and the digest of its contents.
+func (s *store) spoolLayerDiff(id string) (_ *os.File, _ digest.Digest, retErr error) {
+	f, err := os.CreateTemp(s.GraphRoot(), ".delta-")
+	if err != nil {
+		return nil, "", err
+	}
+	defer func() {
+		if retErr != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+	uncompressed := archive.Uncompressed
+	rc, err := s.Diff("", id, &DiffOptions{Compression: &uncompressed})
+	if err != nil {
+		return nil, "", err
+	}
+	digester := digest.Canonical.Digester()
+	_, err = io.Copy(io.MultiWriter(f, digester.Hash()), rc)
+	if err2 := rc.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("reading diff of layer %q: %w", id, err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, "", err
+	}
+	return f, digester.Digest(), nil
+}
+
+// removeSpooledDiff closes and removes a file created by spoolLayerDiff.
+func removeSpooledDiff(f *os.File) {
+	f.Close()
+	os.Remove(f.Name())
+}
+
+// forEachFileData calls fn with the offset and length of the contents of each
+// regular file in the uncompressed diff in f.
+func forEachFileData(f *os.File, fn func(offset, length int64) error) error {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg || hdr.Size == 0 {
+			continue
+		}
+		// The tar reader doesn't read ahead, so the file is positioned
+		// at the start of the entry's contents.
+		offset, err := f.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return err
+		}
+		if err := fn(offset, hdr.Size); err != nil {
+			return err
+		}
+	}
+}
+
+// forEachChunk splits the contents of a file into chunks at the points chosen
+// by the rolling checksum which zstd:chunked uses, so that identical runs of
+// data in different versions of a file tend to produce identical chunks, and
+// calls fn with the offset and length of each one and its digest.
+func forEachChunk(r io.Reader, fn func(offset, length int64, d digest.Digest) error) error {
+	br := bufio.NewReader(r)
+	var chunk []byte
+	offset := int64(0)
+	flush := func() error {
+		if len(chunk) == 0 {
+			return nil
+		}
+		if err := fn(offset, int64(len(chunk)), digest.FromBytes(chunk)); err != nil {
+			return err
+		}
+		offset += int64(len(chunk))
+		chunk = chunk[:0]
+		return nil
+	}
+	rollsum := compressor.NewRollSum()
+	for {
+		b, err := br.ReadByte()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return flush()
+			}
+			return err
+		}
+		chunk = append(chunk, b)
+		rollsum.Roll(b)
+		if rollsum.OnSplitWithBits(compressor.RollsumBits) || len(chunk) >= deltaMaxChunkSize {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// deltaRange is a range of bytes in a base or new layer's uncompressed diff.
+type deltaRange struct {
+	offset, length int64
+}
+
+// deltaWriter encodes operations, merging adjacent ones where possible.
+type deltaWriter struct {
+	w       io.Writer
+	target  *os.File // The new layer's uncompressed diff, which literals are read from.
+	pending deltaRange
+	op      byte
+}
+
+func (d *deltaWriter) add(op byte, r deltaRange) error {
+	if r.length == 0 {
+		return nil
+	}
+	if op == d.op && d.pending.offset+d.pending.length == r.offset {
+		d.pending.length += r.length
+		return nil
+	}
+	if err := d.flush(); err != nil {
+		return err
+	}
+	d.op, d.pending = op, r
+	return nil
+}
+
+func (d *deltaWriter) flush() error {
+	if d.op == 0 {
+		return nil
+	}
+	buf := []byte{d.op}
+	if d.op == deltaOpCopy {
+		buf = binary.AppendUvarint(buf, uint64(d.pending.offset))
+	}
+	buf = binary.AppendUvarint(buf, uint64(d.pending.length))
+	if _, err := d.w.Write(buf); err != nil {
+		return err
+	}
+	if d.op == deltaOpLiteral {
+		if _, err := io.Copy(d.w, io.NewSectionReader(d.target, d.pending.offset, d.pending.length)); err != nil {
+			return err
+		}
+	}
+	d.op = 0
+	return nil
+}
+
+// CreateLayerDelta writes a delta which can be applied to a copy of the old
+// layer, using ApplyLayerDelta, to recreate the new layer.  The contents of
+// each file in the new layer are split into chunks, and chunks which are also
+// present in any file in the old layer are recorded as copies from the old
+// layer instead of being included in the delta.
+func (s *store) CreateLayerDelta(oldID, newID string, delta io.Writer) error {
+	newLayer, err := s.Layer(newID)
+	if err != nil {
+		return err
+	}
+	base, baseDigest, err := s.spoolLayerDiff(oldID)
+	if err != nil {
+		return err
+	}
+	defer removeSpooledDiff(base)
+	target, targetDigest, err := s.spoolLayerDiff(newLayer.ID)
+	if err != nil {
+		return err
+	}
+	defer removeSpooledDiff(target)
+	if newLayer.UncompressedDigest != "" && newLayer.UncompressedDigest != targetDigest {
+		return fmt.Errorf("the diff for layer %q can not be reproduced exactly, so a delta which recreates it can't be created", newLayer.ID)
+	}
+	targetSize, err := target.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+
+	baseChunks := make(map[digest.Digest]deltaRange)
+	if err := forEachFileData(base, func(offset, length int64) error {
+		return forEachChunk(io.NewSectionReader(base, offset, length), func(chunkOffset, chunkLength int64, d digest.Digest) error {
+			if _, ok := baseChunks[d]; !ok {
+				baseChunks[d] = deltaRange{offset: offset + chunkOffset, length: chunkLength}
+			}
+			return nil
+		})
+	}); err != nil {
+		return fmt.Errorf("reading diff of layer %q: %w", oldID, err)
+	}
+
+	if _, err := io.WriteString(delta, layerDeltaMagic); err != nil {
+		return err
+	}
+	compressed, err := archive.CompressStream(delta, archive.Zstd)
+	if err != nil {
+		return err
+	}
+	header, err := json.Marshal(layerDeltaHeader{
+		Base:               baseDigest,
+		Parent:             newLayer.Parent,
+		UncompressedDigest: targetDigest,
+		UncompressedSize:   targetSize,
+	})
+	if err != nil {
+		compressed.Close()
+		return err
+	}
+	if _, err := compressed.Write(append(binary.AppendUvarint(nil, uint64(len(header))), header...)); err != nil {
+		compressed.Close()
+		return err
+	}
+
+	// Every byte of the new layer's diff is either copied from the old
+	// layer's diff or included as a literal, so only the contents of files
+	// need to be examined.  Everything else is included as-is.
+	w := &deltaWriter{w: compressed, target: target}
+	written := int64(0)
+	if err := forEachFileData(target, func(offset, length int64) error {
+		if err := w.add(deltaOpLiteral, deltaRange{offset: written, length: offset - written}); err != nil {
+			return err
+		}
+		written = offset + length
+		return forEachChunk(io.NewSectionReader(target, offset, length), func(chunkOffset, chunkLength int64, d digest.Digest) error {
+			if r, ok := baseChunks[d]; ok && r.length == chunkLength {
+				return w.add(deltaOpCopy, r)
+			}
+			return w.add(deltaOpLiteral, deltaRange{offset: offset + chunkOffset, length: chunkLength})
+		})
+	}); err != nil {
+		compressed.Close()
+		return fmt.Errorf("reading diff of layer %q: %w", newLayer.ID, err)
+	}
+	if err := w.add(deltaOpLiteral, deltaRange{offset: written, length: targetSize - written}); err != nil {
+		compressed.Close()
+		return err
+	}
+	if err := w.flush(); err != nil {
+		compressed.Close()
+		return err
+	}
+	if _, err := compressed.Write([]byte{deltaOpEnd}); err != nil {
+		compressed.Close()
+		return err
+	}
+	return compressed.Close()
+}
+
+// ApplyLayerDelta creates a new layer using a delta created by
+// CreateLayerDelta and a copy of the layer which was the delta's old layer.
+// The new layer's parent is the parent of the layer which the delta was
+// created from, which must also be present.  The reconstructed diff is
+// verified against the original layer's uncompressed digest before the layer
+// is created.
+func (s *store) ApplyLayerDelta(baseID string, delta io.Reader) (*Layer, error) {
+	br := bufio.NewReader(delta)
+	magic := make([]byte, len(layerDeltaMagic))
+	if _, err := io.ReadFull(br, magic); err != nil || string(magic) != layerDeltaMagic {
+		return nil, errors.New("reading layer delta: not a layer delta")
+	}
+	decompressed, err := archive.DecompressStream(br)
+	if err != nil {
+		return nil, fmt.Errorf("reading layer delta: %w", err)
+	}
+	defer decompressed.Close()
+	dr := bufio.NewReader(decompressed)
+	headerLength, err := binary.ReadUvarint(dr)
+	if err != nil {
+		return nil, fmt.Errorf("reading layer delta header: %w", err)
+	}
+	headerBytes := make([]byte, headerLength)
+	if _, err := io.ReadFull(dr, headerBytes); err != nil {
+		return nil, fmt.Errorf("reading layer delta header: %w", err)
+	}
+	var header layerDeltaHeader
+	if err := json.Unmarshal(headerBytes, &header); err != nil {
+		return nil, fmt.Errorf("decoding layer delta header: %w", err)
+	}
+
+	base, baseDigest, err := s.spoolLayerDiff(baseID)
+	if err != nil {
+		return nil, err
+	}
+	defer removeSpooledDiff(base)
+	if baseDigest != header.Base {
+		return nil, fmt.Errorf("layer delta was created from a layer with diff digest %s, but layer %q has diff digest %s", header.Base, baseID, baseDigest)
+	}
+	baseSize, err := base.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+
+	target, err := os.CreateTemp(s.GraphRoot(), ".delta-")
+	if err != nil {
+		return nil, err
+	}
+	defer removeSpooledDiff(target)
+	digester := digest.Canonical.Digester()
+	out := io.MultiWriter(target, digester.Hash())
+	written := int64(0)
+	for done := false; !done; {
+		op, err := dr.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("reading layer delta: %w", err)
+		}
+		switch op {
+		case deltaOpCopy:
+			offset, err := binary.ReadUvarint(dr)
+			if err != nil {
+				return nil, fmt.Errorf("reading layer delta: %w", err)
+			}
+			length, err := binary.ReadUvarint(dr)
+			if err != nil {
+				return nil, fmt.Errorf("reading layer delta: %w", err)
+			}
+			if offset > uint64(baseSize) || length > uint64(baseSize)-offset {
+				return nil, fmt.Errorf("layer delta refers to bytes %d-%d of a %d-byte base diff", offset, offset+length, baseSize)
+			}
+			if length > uint64(header.UncompressedSize-written) {
+				return nil, fmt.Errorf("layer delta produces more than the expected %d bytes", header.UncompressedSize)
+			}
+			if _, err := io.Copy(out, io.NewSectionReader(base, int64(offset), int64(length))); err != nil {
+				return nil, err
+			}
+			written += int64(length)
+		case deltaOpLiteral:
+			length, err := binary.ReadUvarint(dr)
+			if err != nil {
+				return nil, fmt.Errorf("reading layer delta: %w", err)
+			}
+			if length > uint64(header.UncompressedSize-written) {
+				return nil, fmt.Errorf("layer delta produces more than the expected %d bytes", header.UncompressedSize)
+			}
+			if _, err := io.CopyN(out, dr, int64(length)); err != nil {
+				return nil, fmt.Errorf("reading layer delta: %w", err)
+			}
+			written += int64(length)
+		case deltaOpEnd:
+			done = true
+		default:
+			return nil, fmt.Errorf("reading layer delta: unrecognized operation %q", op)
+		}
+	}
+	if written != header.UncompressedSize || digester.Digest() != header.UncompressedDigest {
+		return nil, fmt.Errorf("layer delta produced %d bytes with digest %s, expected %d bytes with digest %s", written, digester.Digest(), header.UncompressedSize, header.UncompressedDigest)
+	}
+	if _, err := target.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	layer, _, err := s.PutLayer("", header.Parent, nil, "", false, nil, target)
+	if err != nil {
+		return nil, fmt.Errorf("creating layer from delta: %w", err)
+	}
+	if layer.UncompressedDigest != header.UncompressedDigest {
+		if err2 := s.DeleteLayer(layer.ID); err2 != nil {
+			logrus.Errorf("While recovering from a layer digest mismatch, error deleting layer %q: %v", layer.ID, err2)
+		}
+		return nil, fmt.Errorf("layer created from delta has digest %s, expected %s", layer.UncompressedDigest, header.UncompressedDigest)
+	}
+	return layer, nil
+}
@@ -0,0 +1,285 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/containers/storage/pkg/directory"
+)
+
+// ImageDiskUsage describes how much disk space is used by an image.
+type ImageDiskUsage struct {
+	ID    string   `json:"id"`
+	Names []string `json:"names,omitempty"`
+	// Size is the size of all of the image's layers and big data items,
+	// which is the value that ImageSize returns.
+	Size int64 `json:"size"`
+	// Shared is the part of Size which is used by layers that are also
+	// used by other images.
+	Shared int64 `json:"shared"`
+	// Reclaimable is the part of Size which would be freed if the image
+	// was deleted.  It is zero if the image is used by containers, since
+	// it can't be deleted while they exist.
+	Reclaimable int64 `json:"reclaimable"`
+	// Containers is the number of containers which are based on the image.
+	Containers int `json:"containers"`
+}
+
+// ContainerDiskUsage describes how much disk space is used by a container.
+type ContainerDiskUsage struct {
+	ID    string   `json:"id"`
+	Names []string `json:"names,omitempty"`
+	Image string   `json:"image,omitempty"`
+	// Size is the size of the container's writable layer, its big data
+	// items and its directories, along with the layers which it is based
+	// on.
+	Size int64 `json:"size"`
+	// Shared is the part of Size which is used by the layers which the
+	// container is based on, which are shared with its image.
+	Shared int64 `json:"shared"`
+	// Reclaimable is the part of Size which would be freed if the
+	// container was deleted.
+	Reclaimable int64 `json:"reclaimable"`
+	// Error, if set, describes why the sizes of the container's layers
+	// could not be determined, usually because one of them is missing.
+	// Size, Shared, and Reclaimable are then -1.
+	Error string `json:"error,omitempty"`
+}
+
+// DiskUsageReport is the result of a call to Store.DiskUsage().
+type DiskUsageReport struct {
+	Images     []ImageDiskUsage     `json:"images,omitempty"`
+	Containers []ContainerDiskUsage `json:"containers,omitempty"`
+}
+
+// layerContentsSize returns the size of a layer's contents, computing it if
+// the layer's record doesn't include it.
+// Requires startReading or startWriting on store.
+func layerContentsSize(store roLayerStore, layer *Layer) (int64, error) {
+	n, err := store.Size(layer.ID)
+	if err != nil {
+		return -1, err
+	}
+	if n == -1 {
+		if n, err = store.DiffSize("", layer.ID); err != nil {
+			return -1, fmt.Errorf("size/digest of layer with ID %q could not be calculated: %w", layer.ID, err)
+		}
+	}
+	return n, nil
+}
+
+// diskUsageLayers looks up layers, and their sizes, for DiskUsage.
+type diskUsageLayers struct {
+	stores []roLayerStore
+	sizes  map[string]int64
+}
+
+// chain returns the IDs of the layers which make up the specified top layers
+// and all of their parents.
+func (d *diskUsageLayers) chain(topLayers ...string) (map[string]struct{}, error) {
+	chain := make(map[string]struct{})
+	for _, layerID := range topLayers {
+		for layerID != "" {
+			if _, ok := chain[layerID]; ok {
+				break
+			}
+			var layer *Layer
+			for _, store := range d.stores {
+				if l, err := store.Get(layerID); err == nil {
+					layer = l
+					if _, ok := d.sizes[layer.ID]; !ok {
+						n, err := layerContentsSize(store, layer)
+						if err != nil {
+							return nil, err
+						}
+						d.sizes[layer.ID] = n
+					}
+					break
+				}
+			}
+			if layer == nil {
+				return nil, fmt.Errorf("locating layer with ID %q: %w", layerID, ErrLayerUnknown)
+			}
+			chain[layer.ID] = struct{}{}
+			layerID = layer.Parent
+		}
+	}
+	return chain, nil
+}
+
+// size returns the sum of the sizes of the layers in a chain.
+func (d *diskUsageLayers) size(chain map[string]struct{}) int64 {
+	var size int64
+	for layerID := range chain {
+		size += d.sizes[layerID]
+	}
+	return size
+}
+
+// optionalDirectorySize returns the size of a directory, or 0 if it doesn't
+// exist.
+func optionalDirectorySize(dir string) (int64, error) {
+	n, err := directory.Size(dir)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return 0, nil
+		}
+		return -1, err
+	}
+	return n, nil
+}
+
+// DiskUsage reports how much disk space is used by each image and container,
+// without counting layers which are shared by several of them more than once.
+func (s *store) DiskUsage() (*DiskUsageReport, error) {
+	rlstore, lstores, err := s.bothLayerStoreKinds()
+	if err != nil {
+		return nil, err
+	}
+	layers := diskUsageLayers{
+		stores: append([]roLayerStore{rlstore}, lstores...),
+		sizes:  make(map[string]int64),
+	}
+	for _, store := range layers.stores {
+		if err := store.startReading(); err != nil {
+			return nil, err
+		}
+		defer store.stopReading()
+	}
+	imageStores := s.allImageStores()
+	for _, store := range imageStores {
+		if err := store.startReading(); err != nil {
+			return nil, err
+		}
+		defer store.stopReading()
+	}
+	if err := s.containerStore.startReading(); err != nil {
+		return nil, err
+	}
+	defer s.containerStore.stopReading()
+
+	// Find the layers which each image and container use, and count how
+	// many of them use each layer.
+	type imageInfo struct {
+		image   Image
+		chain   map[string]struct{}
+		bigData int64
+	}
+	var images []imageInfo
+	seen := make(map[string]struct{})
+	imageUsers := make(map[string]int)
+	for _, store := range imageStores {
+		storeImages, err := store.Images()
+		if err != nil {
+			return nil, err
+		}
+		for _, image := range storeImages {
+			if _, ok := seen[image.ID]; ok {
+				continue
+			}
+			seen[image.ID] = struct{}{}
+			chain, err := layers.chain(append([]string{image.TopLayer}, image.MappedTopLayers...)...)
+			if err != nil {
+				return nil, fmt.Errorf("reading layers of image %q: %w", image.ID, err)
+			}
+			for layerID := range chain {
+				imageUsers[layerID]++
+			}
+			info := imageInfo{image: image, chain: chain}
+			for _, name := range image.BigDataNames {
+				n, err := store.BigDataSize(image.ID, name)
+				if err != nil {
+					return nil, fmt.Errorf("reading size of big data item %q for image %q: %w", name, image.ID, err)
+				}
+				info.bigData += n
+			}
+			images = append(images, info)
+		}
+	}
+
+	containers, err := s.containerStore.Containers()
+	if err != nil {
+		return nil, err
+	}
+	containerUsers := make(map[string]int)
+	imageContainers := make(map[string]int)
+	report := DiskUsageReport{}
+	for _, container := range containers {
+		usage := ContainerDiskUsage{
+			ID:    container.ID,
+			Names: container.Names,
+			Image: container.ImageID,
+		}
+		if container.ImageID != "" {
+			imageContainers[container.ImageID]++
+		}
+		// A container whose layers are damaged shouldn't keep the rest
+		// of the report from being produced.
+		chain, n, err := func() (map[string]struct{}, int64, error) {
+			layer, err := rlstore.Get(container.LayerID)
+			if err != nil {
+				return nil, -1, fmt.Errorf("locating layer with ID %q: %w", container.LayerID, err)
+			}
+			chain, err := layers.chain(layer.Parent)
+			if err != nil {
+				return nil, -1, fmt.Errorf("reading layers of container %q: %w", container.ID, err)
+			}
+			n, err := rlstore.ReadWriteDiskUsage(layer.ID)
+			if err != nil {
+				return nil, -1, fmt.Errorf("determining size of layer with ID %q: %w", layer.ID, err)
+			}
+			return chain, n, nil
+		}()
+		if err != nil {
+			usage.Size, usage.Shared, usage.Reclaimable = -1, -1, -1
+			usage.Error = err.Error()
+			report.Containers = append(report.Containers, usage)
+			continue
+		}
+		for layerID := range chain {
+			containerUsers[layerID]++
+		}
+		usage.Shared = layers.size(chain)
+		usage.Reclaimable += n
+		// The container's data directory holds its big data items as
+		// well as the directory returned by ContainerDirectory().
+		middleDir := s.graphDriverName + "-containers"
+		for _, dir := range []string{
+			filepath.Join(s.GraphRoot(), middleDir, container.ID),
+			filepath.Join(s.RunRoot(), middleDir, container.ID, "userdata"),
+		} {
+			n, err := optionalDirectorySize(dir)
+			if err != nil {
+				return nil, err
+			}
+			usage.Reclaimable += n
+		}
+		usage.Size = usage.Shared + usage.Reclaimable
+		report.Containers = append(report.Containers, usage)
+	}
+
+	for _, info := range images {
+		usage := ImageDiskUsage{
+			ID:         info.image.ID,
+			Names:      info.image.Names,
+			Size:       layers.size(info.chain) + info.bigData,
+			Containers: imageContainers[info.image.ID],
+		}
+		exclusive := info.bigData
+		for layerID := range info.chain {
+			if imageUsers[layerID] > 1 {
+				usage.Shared += layers.sizes[layerID]
+			} else if containerUsers[layerID] == 0 {
+				exclusive += layers.sizes[layerID]
+			}
+		}
+		if usage.Containers == 0 {
+			usage.Reclaimable = exclusive
+		}
+		report.Images = append(report.Images, usage)
+	}
+
+	return &report, nil
+}
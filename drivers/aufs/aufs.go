@@ -42,6 +42,7 @@ import (
 	"github.com/containers/storage/pkg/directory"
 	"github.com/containers/storage/pkg/fileutils"
 	"github.com/containers/storage/pkg/idtools"
+	"github.com/containers/storage/pkg/ioutils"
 	"github.com/containers/storage/pkg/locker"
 	mountpk "github.com/containers/storage/pkg/mount"
 	"github.com/containers/storage/pkg/parsers"
@@ -556,13 +557,14 @@ func (a *Driver) DiffGetter(id string) (graphdriver.FileGetCloser, error) {
 	return fileGetNilCloser{storage.NewPathFileGetter(p)}, nil
 }
 
-func (a *Driver) applyDiff(id string, idMappings *idtools.IDMappings, diff io.Reader) error {
+func (a *Driver) applyDiff(id string, idMappings *idtools.IDMappings, diff io.Reader, progress archive.ProgressFunc) error {
 	if idMappings == nil {
 		idMappings = &idtools.IDMappings{}
 	}
 	return chrootarchive.UntarUncompressed(diff, path.Join(a.rootPath(), "diff", id), &archive.TarOptions{
-		UIDMaps: idMappings.UIDs(),
-		GIDMaps: idMappings.GIDs(),
+		UIDMaps:  idMappings.UIDs(),
+		GIDMaps:  idMappings.GIDs(),
+		Progress: progress,
 	})
 }
 
@@ -585,8 +587,13 @@ func (a *Driver) ApplyDiff(id, parent string, options graphdriver.ApplyDiffOpts)
 		return a.naiveDiff.ApplyDiff(id, parent, options)
 	}
 
+	diff := options.Diff
+	if options.Context != nil {
+		diff = ioutils.NewContextReader(options.Context, diff)
+	}
+
 	// AUFS doesn't need the parent id to apply the diff if it is the direct parent.
-	if err = a.applyDiff(id, options.Mappings, options.Diff); err != nil {
+	if err = a.applyDiff(id, options.Mappings, diff, options.Progress); err != nil {
 		return
 	}
 
@@ -643,7 +643,7 @@ func TestApplyDiff(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	if err := d.applyDiff("3", nil, diff); err != nil {
+	if err := d.applyDiff("3", nil, diff, nil); err != nil {
 		t.Fatal(err)
 	}
 
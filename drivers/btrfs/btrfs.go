@@ -508,7 +508,7 @@ func (d *Driver) Create(id, parent string, opts *graphdriver.CreateOpts) error {
 			return err
 		}
 
-		if err := d.setStorageSize(path.Join(subvolumes, id), driver); err != nil {
+		if err := d.setStorageSize(path.Join(subvolumes, id), driver.options.size); err != nil {
 			return err
 		}
 		if err := os.MkdirAll(quotas, 0o700); err != nil {
@@ -548,11 +548,11 @@ func (d *Driver) parseStorageOpt(storageOpt map[string]string, driver *Driver) e
 }
 
 // Set btrfs storage size
-func (d *Driver) setStorageSize(dir string, driver *Driver) error {
-	if driver.options.size <= 0 {
-		return fmt.Errorf("btrfs: invalid storage size: %s", units.HumanSize(float64(driver.options.size)))
+func (d *Driver) setStorageSize(dir string, size uint64) error {
+	if size <= 0 {
+		return fmt.Errorf("btrfs: invalid storage size: %s", units.HumanSize(float64(size)))
 	}
-	if d.options.minSpace > 0 && driver.options.size < d.options.minSpace {
+	if d.options.minSpace > 0 && size < d.options.minSpace {
 		return fmt.Errorf("btrfs: storage size cannot be less than %s", units.HumanSize(float64(d.options.minSpace)))
 	}
 
@@ -560,7 +560,7 @@ func (d *Driver) setStorageSize(dir string, driver *Driver) error {
 		return err
 	}
 
-	if err := subvolLimitQgroup(dir, driver.options.size); err != nil {
+	if err := subvolLimitQgroup(dir, size); err != nil {
 		return err
 	}
 
@@ -647,6 +647,54 @@ func (d *Driver) ReadWriteDiskUsage(id string) (*directory.DiskUsage, error) {
 	return directory.Usage(d.subvolumesDirID(id))
 }
 
+// SetQuota sets the qgroup limit for the subvolume for the ID, and records it
+// so that it is reapplied when the subvolume is mounted.  Btrfs qgroups can't
+// limit the number of inodes.
+func (d *Driver) SetQuota(id string, size, inodes uint64) error {
+	if inodes > 0 {
+		return fmt.Errorf("btrfs: inode limits: %w", graphdriver.ErrQuotaNotSupported)
+	}
+	dir := d.subvolumesDirID(id)
+	if err := fileutils.Exists(dir); err != nil {
+		return err
+	}
+	if size == 0 {
+		if err := os.Remove(d.quotasDirID(id)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		d.updateQuotaStatus()
+		if !d.quotaEnabled {
+			return nil
+		}
+		return subvolLimitQgroup(dir, math.MaxUint64)
+	}
+	if err := d.setStorageSize(dir, size); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(d.quotasDir(), 0o700); err != nil {
+		return err
+	}
+	return os.WriteFile(d.quotasDirID(id), []byte(fmt.Sprint(size)), 0o644)
+}
+
+// GetQuota returns the qgroup limit which was set for the subvolume for the
+// ID, and its current usage.
+func (d *Driver) GetQuota(id string) (*graphdriver.LayerQuota, error) {
+	usage, err := directory.Usage(d.subvolumesDirID(id))
+	if err != nil {
+		return nil, err
+	}
+	quota := &graphdriver.LayerQuota{UsedSize: usage.Size, UsedInodes: usage.InodeCount}
+	if limit, err := os.ReadFile(d.quotasDirID(id)); err == nil {
+		if quota.Size, err = strconv.ParseUint(string(limit), 10, 64); err != nil {
+			return nil, fmt.Errorf("btrfs: parsing quota for %s: %w", id, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	return quota, nil
+}
+
 // Exists checks if the id exists in the filesystem.
 func (d *Driver) Exists(id string) bool {
 	dir := d.subvolumesDirID(id)
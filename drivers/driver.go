@@ -1,6 +1,7 @@
 package graphdriver
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -39,6 +40,8 @@ var (
 	ErrIncompatibleFS = errors.New("backing file system is unsupported for this graph driver")
 	// ErrLayerUnknown returned when the specified layer is unknown by the driver.
 	ErrLayerUnknown = errors.New("unknown layer")
+	// ErrQuotaNotSupported returned when a driver can't enforce the requested quota.
+	ErrQuotaNotSupported = errors.New("quota not supported")
 )
 
 // CreateOpts contains optional arguments for Create() and CreateReadWrite()
@@ -74,6 +77,11 @@ type ApplyDiffOpts struct {
 	MountLabel        string
 	IgnoreChownErrors bool
 	ForceMask         *os.FileMode
+	// Context, if set, stops the diff from being applied, with an error,
+	// when it is cancelled.
+	Context context.Context
+	// Progress, if set, is called as entries in the diff are applied.
+	Progress archive.ProgressFunc
 }
 
 // ApplyDiffWithDifferOpts contains optional arguments for ApplyDiffWithDiffer methods.
@@ -275,6 +283,9 @@ type DifferOptions struct {
 
 	// UseFsVerity defines whether fs-verity is used
 	UseFsVerity DifferFsVerity
+
+	// Context, if set, stops the differ, with an error, when it is cancelled
+	Context context.Context
 }
 
 // Differ defines the interface for using a custom differ.
@@ -356,6 +367,36 @@ type DiffGetterDriver interface {
 	DiffGetter(id string) (FileGetCloser, error)
 }
 
+// LayerQuota describes the limits on the disk space and inodes which a layer
+// can use, and how much of each it is using.
+type LayerQuota struct {
+	// Size is the maximum number of bytes the layer can use, or 0 if it
+	// is not limited.
+	Size uint64 `json:"size,omitempty"`
+	// Inodes is the maximum number of inodes the layer can use, or 0 if
+	// it is not limited.
+	Inodes uint64 `json:"inodes,omitempty"`
+	// UsedSize is the number of bytes the layer is using.
+	UsedSize int64 `json:"used-size"`
+	// UsedInodes is the number of inodes the layer is using, or -1 if
+	// that isn't known.
+	UsedInodes int64 `json:"used-inodes"`
+}
+
+// QuotaDriver is the interface for layered file system drivers that can
+// limit the disk space and inodes which an existing layer can use.
+type QuotaDriver interface {
+	Driver
+	// SetQuota sets the limits on the disk space and inodes which a
+	// layer can use.  A limit of 0 removes any limit that was set before.
+	// Drivers return an error wrapping ErrQuotaNotSupported for limits
+	// which they can't enforce.
+	SetQuota(id string, size, inodes uint64) error
+	// GetQuota returns the limits which are set for a layer, and its
+	// current usage.
+	GetQuota(id string) (*LayerQuota, error)
+}
+
 // FileGetCloser extends the storage.FileGetter interface with a Close method
 // for cleaning up.
 type FileGetCloser interface {
@@ -179,6 +179,7 @@ func (gdw *NaiveDiffDriver) ApplyDiff(id, parent string, options ApplyDiffOpts)
 		InUserNS:          unshare.IsRootless(),
 		IgnoreChownErrors: options.IgnoreChownErrors,
 		ForceMask:         forceMask,
+		Progress:          options.Progress,
 	}
 	if options.Mappings != nil {
 		tarOptions.UIDMaps = options.Mappings.UIDs()
@@ -186,7 +187,11 @@ func (gdw *NaiveDiffDriver) ApplyDiff(id, parent string, options ApplyDiffOpts)
 	}
 	start := time.Now().UTC()
 	logrus.Debug("Start untar layer")
-	if size, err = ApplyUncompressedLayer(layerFs, options.Diff, tarOptions); err != nil {
+	diff := options.Diff
+	if options.Context != nil {
+		diff = ioutils.NewContextReader(options.Context, diff)
+	}
+	if size, err = ApplyUncompressedLayer(layerFs, diff, tarOptions); err != nil {
 		logrus.Errorf("While applying layer: %s", err)
 		return
 	}
@@ -4,6 +4,7 @@ package overlay
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
 	"errors"
 	"fmt"
@@ -20,6 +21,7 @@ import (
 	"syscall"
 
 	graphdriver "github.com/containers/storage/drivers"
+	"github.com/containers/storage/drivers/copy"
 	"github.com/containers/storage/drivers/overlayutils"
 	"github.com/containers/storage/drivers/quota"
 	"github.com/containers/storage/internal/dedup"
@@ -32,6 +34,7 @@ import (
 	"github.com/containers/storage/pkg/fsutils"
 	"github.com/containers/storage/pkg/idmap"
 	"github.com/containers/storage/pkg/idtools"
+	"github.com/containers/storage/pkg/ioutils"
 	"github.com/containers/storage/pkg/mount"
 	"github.com/containers/storage/pkg/parsers"
 	"github.com/containers/storage/pkg/system"
@@ -938,11 +941,35 @@ func (d *Driver) LookupAdditionalLayerByID(id string) (graphdriver.AdditionalLay
 }
 
 // CreateFromTemplate creates a layer with the same contents and parent as another layer.
-func (d *Driver) CreateFromTemplate(id, template string, templateIDMappings *idtools.IDMappings, parent string, parentIDMappings *idtools.IDMappings, opts *graphdriver.CreateOpts, readWrite bool) error {
-	if readWrite {
-		return d.CreateReadWrite(id, template, opts)
+// Read-write templates can go on being modified, so instead of stacking the new
+// layer on top of the template, the template's upper directory is copied, using
+// reflinks where the underlying file system supports them.
+func (d *Driver) CreateFromTemplate(id, template string, templateIDMappings *idtools.IDMappings, parent string, parentIDMappings *idtools.IDMappings, opts *graphdriver.CreateOpts, readWrite bool) (retErr error) {
+	if !readWrite {
+		return d.Create(id, template, opts)
+	}
+	templateDiff, err := d.getDiffPath(template)
+	if err != nil {
+		return err
+	}
+	if err := d.CreateReadWrite(id, parent, opts); err != nil {
+		return err
 	}
-	return d.Create(id, template, opts)
+	defer func() {
+		if retErr != nil {
+			if err := d.Remove(id); err != nil {
+				logrus.Errorf("Removing layer %q: %v", id, err)
+			}
+		}
+	}()
+	diff, err := d.getDiffPath(id)
+	if err != nil {
+		return err
+	}
+	if err := copy.DirCopy(templateDiff, diff, copy.Content, true); err != nil {
+		return fmt.Errorf("copying contents of layer %q: %w", template, err)
+	}
+	return nil
 }
 
 // CreateReadWrite creates a layer that is writable for use as a container
@@ -2247,10 +2274,14 @@ func supportsDataOnlyLayersCached(home, runhome string) (bool, error) {
 func (d *Driver) ApplyDiffWithDiffer(options *graphdriver.ApplyDiffWithDifferOpts, differ graphdriver.Differ) (output graphdriver.DriverWithDifferOutput, errRet error) {
 	var idMappings *idtools.IDMappings
 	var forceMask *os.FileMode
+	var ctx context.Context
+	var progress archive.ProgressFunc
 
 	if options != nil {
 		idMappings = options.Mappings
 		forceMask = options.ForceMask
+		ctx = options.Context
+		progress = options.Progress
 	}
 	if d.options.forceMask != nil {
 		forceMask = d.options.forceMask
@@ -2294,7 +2325,8 @@ func (d *Driver) ApplyDiffWithDiffer(options *graphdriver.ApplyDiffWithDifferOpt
 	logrus.Debugf("Applying differ in %s", applyDir)
 
 	differOptions := graphdriver.DifferOptions{
-		Format: graphdriver.DifferOutputFormatDir,
+		Format:  graphdriver.DifferOutputFormatDir,
+		Context: ctx,
 	}
 	if d.usingComposefs {
 		differOptions.Format = graphdriver.DifferOutputFormatFlat
@@ -2307,6 +2339,7 @@ func (d *Driver) ApplyDiffWithDiffer(options *graphdriver.ApplyDiffWithDifferOpt
 		WhiteoutFormat:    d.getWhiteoutFormat(),
 		InUserNS:          unshare.IsRootless(),
 		ForceMask:         forceMask,
+		Progress:          progress,
 	}, &differOptions)
 
 	out.Target = applyDir
@@ -2391,15 +2424,21 @@ func (d *Driver) ApplyDiff(id, parent string, options graphdriver.ApplyDiffOpts)
 		return 0, err
 	}
 
+	diff := options.Diff
+	if options.Context != nil {
+		diff = ioutils.NewContextReader(options.Context, diff)
+	}
+
 	logrus.Debugf("Applying tar in %s", applyDir)
 	// Overlay doesn't need the parent id to apply the diff
-	if err := untar(options.Diff, applyDir, &archive.TarOptions{
+	if err := untar(diff, applyDir, &archive.TarOptions{
 		UIDMaps:           idMappings.UIDs(),
 		GIDMaps:           idMappings.GIDs(),
 		IgnoreChownErrors: d.options.ignoreChownErrors,
 		ForceMask:         d.options.forceMask,
 		WhiteoutFormat:    d.getWhiteoutFormat(),
 		InUserNS:          unshare.IsRootless(),
+		Progress:          options.Progress,
 	}); err != nil {
 		return 0, err
 	}
@@ -3,8 +3,11 @@
 package overlay
 
 import (
+	"fmt"
 	"path"
 
+	graphdriver "github.com/containers/storage/drivers"
+	"github.com/containers/storage/drivers/quota"
 	"github.com/containers/storage/pkg/directory"
 )
 
@@ -19,3 +22,39 @@ func (d *Driver) ReadWriteDiskUsage(id string) (*directory.DiskUsage, error) {
 	}
 	return directory.Usage(path.Join(d.dir(id), "diff"))
 }
+
+// SetQuota sets the project quota limits for a layer.  It requires that the
+// layer was created while project quotas were enabled, so that its directory
+// already has a project ID.
+func (d *Driver) SetQuota(id string, size, inodes uint64) error {
+	if d.quotaCtl == nil {
+		return fmt.Errorf("overlay: project quotas are not enabled for %s: %w", d.home, graphdriver.ErrQuotaNotSupported)
+	}
+	return d.quotaCtl.ReplaceQuota(d.dir(id), quota.Quota{Size: size, Inodes: inodes})
+}
+
+// GetQuota returns a layer's project quota limits and its usage.
+func (d *Driver) GetQuota(id string) (*graphdriver.LayerQuota, error) {
+	if d.quotaCtl == nil {
+		usage, err := directory.Usage(path.Join(d.dir(id), "diff"))
+		if err != nil {
+			return nil, err
+		}
+		return &graphdriver.LayerQuota{UsedSize: usage.Size, UsedInodes: usage.InodeCount}, nil
+	}
+	dir := d.dir(id)
+	var limits quota.Quota
+	if err := d.quotaCtl.GetQuota(dir, &limits); err != nil {
+		return nil, err
+	}
+	var usage directory.DiskUsage
+	if err := d.quotaCtl.GetDiskUsage(dir, &usage); err != nil {
+		return nil, err
+	}
+	return &graphdriver.LayerQuota{
+		Size:       limits.Size,
+		Inodes:     limits.Inodes,
+		UsedSize:   usage.Size,
+		UsedInodes: usage.InodeCount,
+	}, nil
+}
@@ -3,8 +3,10 @@
 package overlay
 
 import (
+	"fmt"
 	"path"
 
+	graphdriver "github.com/containers/storage/drivers"
 	"github.com/containers/storage/pkg/directory"
 )
 
@@ -14,3 +16,18 @@ import (
 func (d *Driver) ReadWriteDiskUsage(id string) (*directory.DiskUsage, error) {
 	return directory.Usage(path.Join(d.dir(id), "diff"))
 }
+
+// SetQuota is not supported without project quota support.
+func (d *Driver) SetQuota(id string, size, inodes uint64) error {
+	return fmt.Errorf("overlay: project quotas are not supported: %w", graphdriver.ErrQuotaNotSupported)
+}
+
+// GetQuota returns the usage of the layer's "diff" directory.  No limits are
+// set without project quota support.
+func (d *Driver) GetQuota(id string) (*graphdriver.LayerQuota, error) {
+	usage, err := directory.Usage(path.Join(d.dir(id), "diff"))
+	if err != nil {
+		return nil, err
+	}
+	return &graphdriver.LayerQuota{UsedSize: usage.Size, UsedInodes: usage.InodeCount}, nil
+}
@@ -1,7 +1,7 @@
 //go:build linux && !exclude_disk_quota && cgo
 
 //
-// projectquota.go - implements XFS project quota controls
+// projectquota.go - implements XFS and ext4 project quota controls
 // for setting quota limits on a newly created directory.
 // It currently supports the legacy XFS specific ioctls.
 //
@@ -168,7 +168,7 @@ func NewControl(basePath string) (*Control, error) {
 		basePath:          basePath,
 	}
 
-	if err := q.setProjectQuota(minProjectID, quota); err != nil {
+	if err := q.setProjectQuota(minProjectID, quota, false); err != nil {
 		return nil, err
 	}
 
@@ -193,6 +193,16 @@ func NewControl(basePath string) (*Control, error) {
 // for that project id.
 // targetPath must exist, must be a directory, and must be empty.
 func (q *Control) SetQuota(targetPath string, quota Quota) error {
+	return q.setQuota(targetPath, quota, false)
+}
+
+// ReplaceQuota - like SetQuota, but limits which are 0 are also written,
+// clearing any limits which were set before.
+func (q *Control) ReplaceQuota(targetPath string, quota Quota) error {
+	return q.setQuota(targetPath, quota, true)
+}
+
+func (q *Control) setQuota(targetPath string, quota Quota, replace bool) error {
 	var projectID uint32
 	value, ok := q.quotas.Load(targetPath)
 	if ok {
@@ -227,7 +237,7 @@ func (q *Control) SetQuota(targetPath string, quota Quota) error {
 	// set the quota limit for the container's project id
 	//
 	logrus.Debugf("SetQuota path=%s, size=%d, inodes=%d, projectID=%d", targetPath, quota.Size, quota.Inodes, projectID)
-	return q.setProjectQuota(projectID, quota)
+	return q.setProjectQuota(projectID, quota, replace)
 }
 
 // ClearQuota removes the map entry in the quotas map for targetPath.
@@ -236,19 +246,21 @@ func (q *Control) ClearQuota(targetPath string) {
 	q.quotas.Delete(targetPath)
 }
 
-// setProjectQuota - set the quota for project id on xfs block device
-func (q *Control) setProjectQuota(projectID uint32, quota Quota) error {
+// setProjectQuota - set the quota for project id on xfs block device.
+// If replace is set, limits which are 0 clear the corresponding limits
+// instead of leaving them unchanged.
+func (q *Control) setProjectQuota(projectID uint32, quota Quota, replace bool) error {
 	var d C.fs_disk_quota_t
 	d.d_version = C.FS_DQUOT_VERSION
 	d.d_id = C.__u32(projectID)
 	d.d_flags = C.FS_PROJ_QUOTA
 
-	if quota.Size > 0 {
+	if quota.Size > 0 || replace {
 		d.d_fieldmask = d.d_fieldmask | C.FS_DQ_BHARD | C.FS_DQ_BSOFT
 		d.d_blk_hardlimit = C.__u64(quota.Size / 512)
 		d.d_blk_softlimit = d.d_blk_hardlimit
 	}
-	if quota.Inodes > 0 {
+	if quota.Inodes > 0 || replace {
 		d.d_fieldmask = d.d_fieldmask | C.FS_DQ_IHARD | C.FS_DQ_ISOFT
 		d.d_ino_hardlimit = C.__u64(quota.Inodes)
 		d.d_ino_softlimit = d.d_ino_hardlimit
@@ -26,6 +26,12 @@ func (q *Control) SetQuota(targetPath string, quota Quota) error {
 	return errors.New("filesystem does not support, or has not enabled quotas")
 }
 
+// ReplaceQuota - like SetQuota, but limits which are 0 are also written,
+// clearing any limits which were set before.
+func (q *Control) ReplaceQuota(targetPath string, quota Quota) error {
+	return errors.New("filesystem does not support, or has not enabled quotas")
+}
+
 // GetQuota - get the quota limits of a directory that was configured with SetQuota
 func (q *Control) GetQuota(targetPath string, quota *Quota) error {
 	return errors.New("filesystem does not support, or has not enabled quotas")
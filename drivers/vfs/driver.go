@@ -8,6 +8,7 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
+	"sync"
 
 	graphdriver "github.com/containers/storage/drivers"
 	"github.com/containers/storage/internal/dedup"
@@ -86,6 +87,7 @@ type Driver struct {
 	naiveDiff         graphdriver.DiffDriver
 	updater           graphdriver.LayerIDMapUpdater
 	imageStore        string
+	quotaLock         sync.Mutex
 }
 
 func (d *Driver) String() string {
@@ -102,9 +104,10 @@ func (d *Driver) Metadata(id string) (map[string]string, error) {
 	return nil, nil //nolint: nilnil
 }
 
-// Cleanup is used to implement graphdriver.ProtoDriver. There is no cleanup required for this driver.
+// Cleanup is used to implement graphdriver.ProtoDriver. It unmounts the file
+// system images of layers which have quotas.
 func (d *Driver) Cleanup() error {
-	return nil
+	return d.unmountQuotas()
 }
 
 type fileGetNilCloser struct {
@@ -117,7 +120,11 @@ func (f fileGetNilCloser) Close() error {
 
 // DiffGetter returns a FileGetCloser that can read files from the directory that
 // contains files for the layer differences. Used for direct access for tar-split.
+// If the layer has a quota, its file system image is mounted first.
 func (d *Driver) DiffGetter(id string) (graphdriver.FileGetCloser, error) {
+	if err := d.mountQuota(id); err != nil {
+		return nil, err
+	}
 	p := d.dir(id)
 	return fileGetNilCloser{storage.NewPathFileGetter(p)}, nil
 }
@@ -245,6 +252,9 @@ func (d *Driver) dir(id string) string {
 
 // Remove deletes the content from the directory for a given id.
 func (d *Driver) Remove(id string) error {
+	if err := d.removeQuota(id); err != nil {
+		return err
+	}
 	return system.EnsureRemoveAll(d.dir(id))
 }
 
@@ -277,6 +287,9 @@ func (d *Driver) DeferredRemove(id string) (tempdir.CleanupTempDirFunc, error) {
 		return nil, err
 	}
 
+	if err := d.removeQuota(id); err != nil {
+		return t.Cleanup, err
+	}
 	layerDir := d.dir(id)
 	if err := t.StageDeletion(layerDir); err != nil {
 		return t.Cleanup, err
@@ -300,6 +313,9 @@ func (d *Driver) Get(id string, options graphdriver.MountOpts) (_ string, retErr
 	} else if !st.IsDir() {
 		return "", fmt.Errorf("%s: not a directory", dir)
 	}
+	if err := d.mountQuota(id); err != nil {
+		return "", err
+	}
 	return dir, nil
 }
 
@@ -311,8 +327,12 @@ func (d *Driver) Put(id string) error {
 }
 
 // ReadWriteDiskUsage returns the disk usage of the writable directory for the ID.
-// For VFS, it queries the directory for this ID.
+// For VFS, it queries the directory for this ID, after mounting the layer's
+// file system image if it has a quota.
 func (d *Driver) ReadWriteDiskUsage(id string) (*directory.DiskUsage, error) {
+	if err := d.mountQuota(id); err != nil {
+		return nil, err
+	}
 	return directory.Usage(d.dir(id))
 }
 
@@ -0,0 +1,395 @@
+package vfs
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	graphdriver "github.com/containers/storage/drivers"
+	"github.com/containers/storage/pkg/directory"
+	"github.com/containers/storage/pkg/loopback"
+	"github.com/containers/storage/pkg/mount"
+	"github.com/containers/storage/pkg/system"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// The vfs driver enforces quotas by moving a layer's contents into an ext4
+// file system image of the requested size, which is mounted over the layer's
+// directory through a loop device whenever the layer is used.
+
+func (d *Driver) quotasDir() string {
+	return filepath.Join(d.home, "quotas")
+}
+
+func (d *Driver) quotaImage(id string) string {
+	return filepath.Join(d.quotasDir(), filepath.Base(id)+".img")
+}
+
+// SetQuota moves the layer's contents into a file system image which is
+// limited to the specified size and number of inodes, or grows the image if
+// the layer already has one.  Images can't be shrunk or removed, and their
+// number of inodes can only change as a side effect of growing them.
+func (d *Driver) SetQuota(id string, size, inodes uint64) error {
+	d.quotaLock.Lock()
+	defer d.quotaLock.Unlock()
+
+	dir := d.dir(id)
+	if dir != filepath.Join(d.home, "dir", filepath.Base(id)) {
+		return fmt.Errorf("vfs: layer %s is not in %s: %w", id, d.home, graphdriver.ErrQuotaNotSupported)
+	}
+	image := d.quotaImage(id)
+	st, err := os.Stat(image)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return err
+		}
+		if size == 0 && inodes == 0 {
+			return nil
+		}
+		if size == 0 {
+			return fmt.Errorf("vfs: inode limits require a size limit: %w", graphdriver.ErrQuotaNotSupported)
+		}
+		return d.createQuotaImage(dir, image, size, inodes)
+	}
+
+	if size == 0 {
+		return fmt.Errorf("vfs: removing the quota for layer %s: %w", id, graphdriver.ErrQuotaNotSupported)
+	}
+	if inodes != 0 {
+		sb, err := readQuotaImageSuperblock(image)
+		if err != nil {
+			return err
+		}
+		if inodes != sb.inodes {
+			return fmt.Errorf("vfs: changing the inode limit for layer %s: %w", id, graphdriver.ErrQuotaNotSupported)
+		}
+	}
+	switch current := uint64(st.Size()); {
+	case size == current:
+		return nil
+	case size < current:
+		return fmt.Errorf("vfs: shrinking the quota for layer %s: %w", id, graphdriver.ErrQuotaNotSupported)
+	}
+	return d.growQuotaImage(dir, image, size)
+}
+
+// createQuotaImage creates a file system image containing the contents of
+// dir, and mounts it over dir.
+func (d *Driver) createQuotaImage(dir, image string, size, inodes uint64) (retErr error) {
+	mkfs, err := exec.LookPath("mkfs.ext4")
+	if err != nil {
+		return fmt.Errorf("vfs: %v: %w", err, graphdriver.ErrQuotaNotSupported)
+	}
+	st, err := system.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(d.quotasDir(), 0o700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(image, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if retErr != nil {
+			if err := os.Remove(image); err != nil {
+				logrus.Errorf("While recovering from a failure setting a quota, error deleting %q: %v", image, err)
+			}
+		}
+	}()
+	err = f.Truncate(int64(size))
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		return err
+	}
+
+	args := []string{"-q", "-F", "-m", "0"}
+	if inodes != 0 {
+		args = append(args, "-N", strconv.FormatUint(inodes, 10))
+	}
+	args = append(args, "-d", dir, image)
+	if out, err := exec.Command(mkfs, args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("vfs: creating quota image for %q: %s: %w", dir, strings.TrimSpace(string(out)), err)
+	}
+
+	// The image has a copy of everything, so the originals can go.
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := system.EnsureRemoveAll(filepath.Join(dir, entry.Name())); err != nil {
+			return err
+		}
+	}
+	if err := d.mountQuotaImage(dir, image); err != nil {
+		return err
+	}
+	if err := os.Chown(dir, int(st.UID()), int(st.GID())); err != nil {
+		return err
+	}
+	return os.Chmod(dir, os.FileMode(st.Mode())&os.ModePerm)
+}
+
+// mountQuotaImage mounts a layer's file system image over its directory, if
+// it isn't already mounted there.  mkfs.ext4 creates lost+found, and e2fsck
+// recreates it if it is missing, so it is removed after mounting.
+func (d *Driver) mountQuotaImage(dir, image string) error {
+	if mounted, err := mount.Mounted(dir); err != nil || mounted {
+		return err
+	}
+	loop, err := loopback.AttachLoopDevice(image)
+	if err != nil {
+		return fmt.Errorf("vfs: attaching %q: %w", image, err)
+	}
+	// The loop device is detached automatically when it is unmounted.
+	defer loop.Close()
+	if err := unix.Mount(loop.Name(), dir, "ext4", 0, ""); err != nil {
+		return fmt.Errorf("vfs: mounting %q on %q: %w", image, dir, err)
+	}
+	if err := os.Remove(filepath.Join(dir, "lost+found")); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// growQuotaImage extends a layer's file system image to the specified size.
+// If the image is mounted on dir, it is resized online.  That requires
+// CAP_SYS_RESOURCE, so if it fails, and the image isn't in use, it is
+// unmounted and resized offline instead.
+func (d *Driver) growQuotaImage(dir, image string, size uint64) error {
+	resize, err := exec.LookPath("resize2fs")
+	if err != nil {
+		return fmt.Errorf("vfs: %v: %w", err, graphdriver.ErrQuotaNotSupported)
+	}
+	mounted, err := mount.Mounted(dir)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(image, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := f.Truncate(int64(size)); err != nil {
+		return err
+	}
+	if !mounted {
+		return resizeQuotaImage(resize, image)
+	}
+	loop := loopback.FindLoopDeviceFor(f)
+	if loop == nil {
+		return fmt.Errorf("vfs: no loop device found for %q", image)
+	}
+	defer loop.Close()
+	if err := loopback.SetCapacity(loop); err != nil {
+		return err
+	}
+	out, err := exec.Command(resize, loop.Name()).CombinedOutput()
+	if err == nil {
+		return nil
+	}
+	onlineErr := fmt.Errorf("vfs: resizing %q: %s: %w", image, strings.TrimSpace(string(out)), err)
+
+	// The loop device is only detached once the file system isn't
+	// mounted anywhere, including in other mount namespaces.
+	if err := unix.Unmount(dir, 0); err != nil {
+		return onlineErr
+	}
+	backingFile := filepath.Join("/sys/block", filepath.Base(loop.Name()), "loop", "backing_file")
+	loop.Close()
+	detached := false
+	for range 50 {
+		if name, err := os.ReadFile(backingFile); err != nil || strings.TrimSpace(string(name)) != image {
+			detached = true
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !detached {
+		if err := d.mountQuotaImage(dir, image); err != nil {
+			logrus.Errorf("Remounting %q on %q: %v", image, dir, err)
+		}
+		return onlineErr
+	}
+	if err := resizeQuotaImage(resize, image); err != nil {
+		if err2 := d.mountQuotaImage(dir, image); err2 != nil {
+			logrus.Errorf("Remounting %q on %q: %v", image, dir, err2)
+		}
+		return err
+	}
+	return d.mountQuotaImage(dir, image)
+}
+
+// resizeQuotaImage grows the file system in an image which isn't mounted to
+// fill the image.
+func resizeQuotaImage(resize, image string) error {
+	// resize2fs insists on a freshly checked file system.
+	if fsck, err := exec.LookPath("e2fsck"); err == nil {
+		if out, err := exec.Command(fsck, "-f", "-p", image).CombinedOutput(); err != nil {
+			logrus.Debugf("Checking %q: %s: %v", image, strings.TrimSpace(string(out)), err)
+		}
+	}
+	if out, err := exec.Command(resize, image).CombinedOutput(); err != nil {
+		return fmt.Errorf("vfs: resizing %q: %s: %w", image, strings.TrimSpace(string(out)), err)
+	}
+	return nil
+}
+
+// quotaImageSuperblock holds the parts of the superblock of a layer's file
+// system image which describe its capacity and usage.  The counts of free
+// blocks and inodes are only kept up to date on disk while the image isn't
+// mounted.
+type quotaImageSuperblock struct {
+	inodes, freeInodes, reservedInodes uint64
+	blocks, freeBlocks, blockSize      uint64
+}
+
+// readQuotaImageSuperblock reads the ext4 superblock of a layer's file system
+// image, so that it can be examined without mounting the image.
+func readQuotaImageSuperblock(image string) (*quotaImageSuperblock, error) {
+	f, err := os.Open(image)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	buf := make([]byte, 1024)
+	if _, err := f.ReadAt(buf, 1024); err != nil {
+		return nil, fmt.Errorf("vfs: reading superblock of %q: %w", image, err)
+	}
+	le := binary.LittleEndian
+	if magic := le.Uint16(buf[0x38:]); magic != 0xef53 {
+		return nil, fmt.Errorf("vfs: %q does not contain an ext4 file system", image)
+	}
+	sb := &quotaImageSuperblock{
+		inodes:         uint64(le.Uint32(buf[0x00:])),
+		blocks:         uint64(le.Uint32(buf[0x04:])),
+		freeBlocks:     uint64(le.Uint32(buf[0x0c:])),
+		freeInodes:     uint64(le.Uint32(buf[0x10:])),
+		blockSize:      1024 << le.Uint32(buf[0x18:]),
+		reservedInodes: 10,
+	}
+	if le.Uint32(buf[0x4c:]) > 0 { // s_rev_level
+		sb.reservedInodes = uint64(le.Uint32(buf[0x54:])) - 1 // s_first_ino
+	}
+	if le.Uint32(buf[0x60:])&0x80 != 0 { // INCOMPAT_64BIT
+		sb.blocks |= uint64(le.Uint32(buf[0x150:])) << 32
+		sb.freeBlocks |= uint64(le.Uint32(buf[0x158:])) << 32
+	}
+	return sb, nil
+}
+
+// GetQuota returns the size and number of inodes of the layer's file system
+// image, if it has one, and the space and inodes which the layer is using.
+// The image is not mounted if it isn't already, and the usage of an image
+// which isn't mounted is read from its superblock, so it includes the file
+// system's own metadata.
+func (d *Driver) GetQuota(id string) (*graphdriver.LayerQuota, error) {
+	d.quotaLock.Lock()
+	defer d.quotaLock.Unlock()
+
+	dir := d.dir(id)
+	image := d.quotaImage(id)
+	st, err := os.Stat(image)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+		usage, err := directory.Usage(dir)
+		if err != nil {
+			return nil, err
+		}
+		return &graphdriver.LayerQuota{UsedSize: usage.Size, UsedInodes: usage.InodeCount}, nil
+	}
+	sb, err := readQuotaImageSuperblock(image)
+	if err != nil {
+		return nil, err
+	}
+	quota := &graphdriver.LayerQuota{
+		Size:   uint64(st.Size()),
+		Inodes: sb.inodes,
+	}
+	mounted, err := mount.Mounted(dir)
+	if err != nil {
+		return nil, err
+	}
+	if mounted {
+		usage, err := directory.Usage(dir)
+		if err != nil {
+			return nil, err
+		}
+		quota.UsedSize, quota.UsedInodes = usage.Size, usage.InodeCount
+	} else {
+		quota.UsedSize = int64((sb.blocks - sb.freeBlocks) * sb.blockSize)
+		quota.UsedInodes = int64(sb.inodes - sb.freeInodes - sb.reservedInodes)
+	}
+	return quota, nil
+}
+
+// mountQuota mounts the layer's file system image, if it has one.
+func (d *Driver) mountQuota(id string) error {
+	d.quotaLock.Lock()
+	defer d.quotaLock.Unlock()
+
+	image := d.quotaImage(id)
+	if err := unix.Access(image, unix.F_OK); err != nil {
+		if errors.Is(err, unix.ENOENT) {
+			return nil
+		}
+		return &os.PathError{Op: "access", Path: image, Err: err}
+	}
+	return d.mountQuotaImage(d.dir(id), image)
+}
+
+// removeQuota unmounts and deletes the layer's file system image, if it has
+// one.
+func (d *Driver) removeQuota(id string) error {
+	d.quotaLock.Lock()
+	defer d.quotaLock.Unlock()
+
+	image := d.quotaImage(id)
+	if err := unix.Access(image, unix.F_OK); err != nil {
+		if errors.Is(err, unix.ENOENT) {
+			return nil
+		}
+		return &os.PathError{Op: "access", Path: image, Err: err}
+	}
+	if err := mount.Unmount(d.dir(id)); err != nil {
+		return err
+	}
+	return os.Remove(image)
+}
+
+// unmountQuotas unmounts all of the file system images which are mounted.
+func (d *Driver) unmountQuotas() error {
+	d.quotaLock.Lock()
+	defer d.quotaLock.Unlock()
+
+	entries, err := os.ReadDir(d.quotasDir())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(entry.Name(), ".img")
+		if !ok {
+			continue
+		}
+		if err := mount.Unmount(d.dir(id)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
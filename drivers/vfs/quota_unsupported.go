@@ -0,0 +1,36 @@
+//go:build !linux
+
+package vfs
+
+import (
+	"fmt"
+
+	graphdriver "github.com/containers/storage/drivers"
+)
+
+// SetQuota is only supported on Linux.
+func (d *Driver) SetQuota(id string, size, inodes uint64) error {
+	return fmt.Errorf("vfs: quotas: %w", graphdriver.ErrQuotaNotSupported)
+}
+
+// GetQuota returns the space and inodes which the layer is using.  No limits
+// are set on platforms other than Linux.
+func (d *Driver) GetQuota(id string) (*graphdriver.LayerQuota, error) {
+	usage, err := d.ReadWriteDiskUsage(id)
+	if err != nil {
+		return nil, err
+	}
+	return &graphdriver.LayerQuota{UsedSize: usage.Size, UsedInodes: usage.InodeCount}, nil
+}
+
+func (d *Driver) mountQuota(id string) error {
+	return nil
+}
+
+func (d *Driver) removeQuota(id string) error {
+	return nil
+}
+
+func (d *Driver) unmountQuotas() error {
+	return nil
+}
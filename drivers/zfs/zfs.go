@@ -500,6 +500,32 @@ func (d *Driver) ReadWriteDiskUsage(id string) (*directory.DiskUsage, error) {
 	return directory.Usage(d.mountPath(id))
 }
 
+// SetQuota sets the "quota" property of the dataset for the ID.  ZFS datasets
+// can't limit the number of inodes.
+func (d *Driver) SetQuota(id string, size, inodes uint64) error {
+	if inodes > 0 {
+		return fmt.Errorf("zfs: inode limits: %w", graphdriver.ErrQuotaNotSupported)
+	}
+	fs, err := zfs.GetDataset(d.zfsPath(id))
+	if err != nil {
+		return err
+	}
+	quota := "none"
+	if size > 0 {
+		quota = strconv.FormatUint(size, 10)
+	}
+	return fs.SetProperty("quota", quota)
+}
+
+// GetQuota returns the "quota" and "used" properties of the dataset for the ID.
+func (d *Driver) GetQuota(id string) (*graphdriver.LayerQuota, error) {
+	fs, err := zfs.GetDataset(d.zfsPath(id))
+	if err != nil {
+		return nil, err
+	}
+	return &graphdriver.LayerQuota{Size: fs.Quota, UsedSize: int64(fs.Used), UsedInodes: -1}, nil
+}
+
 // Exists checks to see if the cache entry exists for the given id.
 func (d *Driver) Exists(id string) bool {
 	d.Lock()
@@ -3,6 +3,7 @@ package storage
 import (
 	"errors"
 
+	drivers "github.com/containers/storage/drivers"
 	"github.com/containers/storage/types"
 )
 
@@ -23,6 +24,10 @@ var (
 	ErrImageUnknown = types.ErrImageUnknown
 	// ErrImageUsedByContainer is returned when the caller attempts to delete an image that is a container's image.
 	ErrImageUsedByContainer = types.ErrImageUsedByContainer
+	// ErrImageUsedByIndex is returned when the caller attempts to delete an image that is a member of an image index.
+	ErrImageUsedByIndex = types.ErrImageUsedByIndex
+	// ErrImageIndexUnknown indicates that there was no image index with the specified name or ID.
+	ErrImageIndexUnknown = types.ErrImageIndexUnknown
 	// ErrIncompleteOptions is returned when the caller attempts to initialize a Store without providing required information.
 	ErrIncompleteOptions = types.ErrIncompleteOptions
 	// ErrInvalidBigDataName indicates that the name for a big data item is not acceptable; it may be empty.
@@ -59,6 +64,20 @@ var (
 	ErrNotSupported = types.ErrNotSupported
 	// ErrInvalidMappings is returned when the specified mappings are invalid.
 	ErrInvalidMappings = types.ErrInvalidMappings
+	// ErrTransactionDone is returned when the caller attempts to use a transaction which has already been committed or rolled back.
+	ErrTransactionDone = types.ErrTransactionDone
+	// ErrLayerLeased is returned when the caller attempts to delete a layer that has a lease.
+	ErrLayerLeased = types.ErrLayerLeased
+	// ErrImageLeased is returned when the caller attempts to delete an image that has a lease.
+	ErrImageLeased = types.ErrImageLeased
+	// ErrLeaseUnknown is returned when the caller attempts to release a lease that doesn't exist, possibly because it has expired.
+	ErrLeaseUnknown = types.ErrLeaseUnknown
+	// ErrLayerContentsDeferred is returned when the deferred contents of a layer's files are needed, but no LayerFetcher has been set to retrieve them.
+	ErrLayerContentsDeferred = types.ErrLayerContentsDeferred
+	// ErrLayerMounted is returned when an operation requires that a layer not be mounted, and it is mounted.
+	ErrLayerMounted = types.ErrLayerMounted
+	// ErrQuotaNotSupported is returned when the storage driver can't enforce the requested quota.
+	ErrQuotaNotSupported = drivers.ErrQuotaNotSupported
 	// ErrInvalidNameOperation is returned when updateName is called with invalid operation.
 	// Internal error
 	errInvalidUpdateNameOperation = errors.New("invalid update name operation")
@@ -0,0 +1,380 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"os"
+	"reflect"
+	"slices"
+	"time"
+
+	"github.com/containers/storage/pkg/lockfile"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/sirupsen/logrus"
+)
+
+// EventType describes what happened to the object an Event refers to.
+type EventType string
+
+const (
+	// EventCreated is reported when a layer, image, or container first appears.
+	EventCreated EventType = "created"
+	// EventDeleted is reported when a layer, image, or container goes away.
+	EventDeleted EventType = "deleted"
+	// EventRenamed is reported when the list of names of an object changes.
+	EventRenamed EventType = "renamed"
+	// EventMounted is reported when a layer's mount count goes up.
+	EventMounted EventType = "mounted"
+	// EventUnmounted is reported when a layer's mount count goes down.
+	EventUnmounted EventType = "unmounted"
+	// EventBigDataSet is reported when a big data item is added or changed.
+	EventBigDataSet EventType = "big-data-set"
+	// EventFlagsChanged is reported when the flags of an object change.
+	EventFlagsChanged EventType = "flags-changed"
+)
+
+// EventObject describes the kind of object an Event refers to.
+type EventObject string
+
+const (
+	EventLayer     EventObject = "layer"
+	EventImage     EventObject = "image"
+	EventContainer EventObject = "container"
+)
+
+// defaultWatchInterval is how often a watcher checks the stores for changes
+// if WatchFilter.Interval is not set.
+const defaultWatchInterval = time.Second
+
+// maxWatchFailures is the number of consecutive failed checks for changes
+// after which a watcher gives up and closes its channel.
+const maxWatchFailures = 10
+
+// An Event describes a single change to a layer, image, or container that was
+// noticed by Store.Watch.
+type Event struct {
+	// Type is what happened.
+	Type EventType `json:"type"`
+	// Object is the kind of object the event refers to.
+	Object EventObject `json:"object"`
+	// ID is the ID of the object.
+	ID string `json:"id"`
+	// Names is the list of names the object had when the change was
+	// noticed, or, for EventDeleted, the names it had before it went away.
+	Names []string `json:"names,omitempty"`
+	// Key is the name of the big data item for EventBigDataSet events.
+	Key string `json:"key,omitempty"`
+	// Time is when the change was noticed, which can be later than when it
+	// was made.
+	Time time.Time `json:"time"`
+}
+
+// WatchFilter selects which events are delivered by Store.Watch.  An empty
+// list in any of the fields matches everything.
+type WatchFilter struct {
+	// Objects limits events to layers, images, and/or containers.
+	Objects []EventObject
+	// Types limits events to the listed types.
+	Types []EventType
+	// IDs limits events to objects with the listed IDs.
+	IDs []string
+	// Interval is how often the stores are checked for changes.  If not
+	// set, a default of one second is used.
+	Interval time.Duration
+}
+
+func (f *WatchFilter) matches(e *Event) bool {
+	if f == nil {
+		return true
+	}
+	if len(f.Objects) > 0 && !slices.Contains(f.Objects, e.Object) {
+		return false
+	}
+	if len(f.Types) > 0 && !slices.Contains(f.Types, e.Type) {
+		return false
+	}
+	if len(f.IDs) > 0 && !slices.Contains(f.IDs, e.ID) {
+		return false
+	}
+	return true
+}
+
+// storeWriteMarker records the lockfile.LastWrite values of a store at some
+// point in time, so that a watcher can cheaply tell whether anything could
+// have changed since then.
+type storeWriteMarker struct {
+	data   lockfile.LastWrite
+	mounts lockfile.LastWrite // Only used by read-write layer stores
+}
+
+// watchedObject is the subset of a layer, image, or container record which a
+// watcher compares between polls.
+type watchedObject struct {
+	names      []string
+	bigData    map[string]string // Digests for images and containers, size and modification time markers for layers
+	flags      map[string]any
+	mountCount int
+}
+
+// watchedStore is what a watcher remembers about one store between polls.
+type watchedStore struct {
+	marker  *storeWriteMarker // nil until the store is first read
+	objects map[string]watchedObject
+}
+
+// diff compares the recorded state with objects, and returns the events which
+// describe the difference, in a stable order.
+func (w *watchedStore) diff(object EventObject, objects map[string]watchedObject, now time.Time) []Event {
+	var events []Event
+	newEvent := func(t EventType, id string, names []string) Event {
+		return Event{Type: t, Object: object, ID: id, Names: copySlicePreferringNil(names), Time: now}
+	}
+	for _, id := range slices.Sorted(maps.Keys(objects)) {
+		current := objects[id]
+		previous, existed := w.objects[id]
+		if !existed {
+			events = append(events, newEvent(EventCreated, id, current.names))
+			previous = watchedObject{}
+		} else if !slices.Equal(previous.names, current.names) {
+			events = append(events, newEvent(EventRenamed, id, current.names))
+		}
+		for _, key := range slices.Sorted(maps.Keys(current.bigData)) {
+			if oldDigest, ok := previous.bigData[key]; !ok || oldDigest != current.bigData[key] {
+				e := newEvent(EventBigDataSet, id, current.names)
+				e.Key = key
+				events = append(events, e)
+			}
+		}
+		if existed && !reflect.DeepEqual(previous.flags, current.flags) {
+			events = append(events, newEvent(EventFlagsChanged, id, current.names))
+		}
+		switch {
+		case current.mountCount > previous.mountCount:
+			events = append(events, newEvent(EventMounted, id, current.names))
+		case current.mountCount < previous.mountCount:
+			events = append(events, newEvent(EventUnmounted, id, current.names))
+		}
+	}
+	for _, id := range slices.Sorted(maps.Keys(w.objects)) {
+		if _, ok := objects[id]; !ok {
+			events = append(events, newEvent(EventDeleted, id, w.objects[id].names))
+		}
+	}
+	w.objects = objects
+	return events
+}
+
+// storeWatcher tracks the state of all of the stores of a store object for
+// a single caller of Store.Watch.
+type storeWatcher struct {
+	s          *store
+	layers     []watchedStore
+	images     []watchedStore
+	containers watchedStore
+}
+
+// poll checks every store for changes, and returns events describing them.
+// Stores whose lock files record no writes since the previous poll are not
+// read at all.
+func (w *storeWatcher) poll() ([]Event, error) {
+	var events []Event
+	now := time.Now().UTC()
+
+	layerStores, err := w.s.allLayerStores()
+	if err != nil {
+		return nil, err
+	}
+	if len(w.layers) != len(layerStores) {
+		w.layers = slices.Grow(w.layers[:0], len(layerStores))[:len(layerStores)]
+	}
+	for i, store := range layerStores {
+		objects, err := pollWatchedStore(&w.layers[i], store, func() (map[string]watchedObject, error) {
+			layers, err := store.Layers()
+			if err != nil {
+				return nil, err
+			}
+			objects := make(map[string]watchedObject, len(layers))
+			for _, layer := range layers {
+				bigData := make(map[string]string, len(layer.BigDataNames))
+				for _, name := range layer.BigDataNames {
+					marker, err := store.bigDataMarker(layer.ID, name)
+					if err != nil {
+						if errors.Is(err, os.ErrNotExist) {
+							// The item is being replaced or removed, or
+							// was never written completely; the next poll
+							// will notice whatever happens to it.
+							continue
+						}
+						return nil, err
+					}
+					bigData[name] = marker
+				}
+				objects[layer.ID] = watchedObject{
+					names:      layer.Names,
+					bigData:    bigData,
+					flags:      layer.Flags,
+					mountCount: layer.MountCount,
+				}
+			}
+			return objects, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		if objects != nil {
+			events = append(events, w.layers[i].diff(EventLayer, objects, now)...)
+		}
+	}
+
+	imageStores := w.s.allImageStores()
+	if len(w.images) != len(imageStores) {
+		w.images = slices.Grow(w.images[:0], len(imageStores))[:len(imageStores)]
+	}
+	for i, store := range imageStores {
+		objects, err := pollWatchedStore(&w.images[i], store, func() (map[string]watchedObject, error) {
+			images, err := store.Images()
+			if err != nil {
+				return nil, err
+			}
+			objects := make(map[string]watchedObject, len(images))
+			for _, image := range images {
+				objects[image.ID] = watchedObject{
+					names:   image.Names,
+					bigData: digestMarkers(image.BigDataDigests),
+					flags:   image.Flags,
+				}
+			}
+			return objects, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		if objects != nil {
+			events = append(events, w.images[i].diff(EventImage, objects, now)...)
+		}
+	}
+
+	objects, err := pollWatchedStore(&w.containers, w.s.containerStore, func() (map[string]watchedObject, error) {
+		containers, err := w.s.containerStore.Containers()
+		if err != nil {
+			return nil, err
+		}
+		objects := make(map[string]watchedObject, len(containers))
+		for _, container := range containers {
+			objects[container.ID] = watchedObject{
+				names:   container.Names,
+				bigData: digestMarkers(container.BigDataDigests),
+				flags:   container.Flags,
+			}
+		}
+		return objects, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if objects != nil {
+		events = append(events, w.containers.diff(EventContainer, objects, now)...)
+	}
+	return events, nil
+}
+
+// digestMarkers converts a map of big data digests to the form which a
+// watchedObject records.
+func digestMarkers(digests map[string]digest.Digest) map[string]string {
+	markers := make(map[string]string, len(digests))
+	for key, d := range digests {
+		markers[key] = d.String()
+	}
+	return markers
+}
+
+// changeTrackingStore is implemented by all of the layer, image, and
+// container stores.
+type changeTrackingStore interface {
+	startReading() error
+	stopReading()
+	changedSince(previous *storeWriteMarker) (storeWriteMarker, bool, error)
+}
+
+// pollWatchedStore locks store for reading and, if it was modified since
+// state was last updated, returns the objects it now contains, as read by
+// list.  It returns nil objects if nothing changed.
+func pollWatchedStore(state *watchedStore, store changeTrackingStore, list func() (map[string]watchedObject, error)) (map[string]watchedObject, error) {
+	if err := store.startReading(); err != nil {
+		return nil, err
+	}
+	defer store.stopReading()
+	marker, modified, err := store.changedSince(state.marker)
+	if err != nil {
+		return nil, err
+	}
+	if !modified {
+		return nil, nil
+	}
+	objects, err := list()
+	if err != nil {
+		return nil, err
+	}
+	if state.marker == nil {
+		// The first poll only records the initial state.
+		state.marker = &marker
+		state.objects = objects
+		return nil, nil
+	}
+	state.marker = &marker
+	return objects, nil
+}
+
+// Watch returns a channel which receives events describing changes to layers,
+// images, and containers, whether they were made by this process or another
+// one, until ctx is cancelled.  The channel is also closed if checking for
+// changes fails repeatedly.
+func (s *store) Watch(ctx context.Context, filter *WatchFilter) (<-chan Event, error) {
+	interval := defaultWatchInterval
+	if filter != nil && filter.Interval > 0 {
+		interval = filter.Interval
+	}
+	w := &storeWatcher{s: s}
+	// Record the starting point, so that only changes made after this call
+	// are reported.
+	if _, err := w.poll(); err != nil {
+		return nil, err
+	}
+	events := make(chan Event)
+	go func() {
+		defer close(events)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		failures := 0
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			changes, err := w.poll()
+			if err != nil {
+				failures++
+				if failures >= maxWatchFailures {
+					logrus.Errorf("Checking storage for changes failed %d times in a row, no longer watching: %v", failures, err)
+					return
+				}
+				logrus.Warnf("Checking storage for changes: %v", err)
+				continue
+			}
+			failures = 0
+			for _, e := range changes {
+				if !filter.matches(&e) {
+					continue
+				}
+				select {
+				case events <- e:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return events, nil
+}
@@ -0,0 +1,592 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/containers/storage/pkg/archive"
+	"github.com/containers/storage/pkg/ioutils"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	ociLayoutFile        = "oci-layout"
+	ociLayoutVersion     = "1.0.0"
+	ociIndexFile         = "index.json"
+	ociBlobsDir          = "blobs"
+	ociRefNameAnnotation = "org.opencontainers.image.ref.name"
+
+	ociMediaTypeIndex        = "application/vnd.oci.image.index.v1+json"
+	ociMediaTypeManifest     = "application/vnd.oci.image.manifest.v1+json"
+	ociMediaTypeConfig       = "application/vnd.oci.image.config.v1+json"
+	ociMediaTypeLayer        = "application/vnd.oci.image.layer.v1.tar"
+	ociMediaTypeLayerGzip    = "application/vnd.oci.image.layer.v1.tar+gzip"
+	ociMediaTypeLayerZstd    = "application/vnd.oci.image.layer.v1.tar+zstd"
+	dockerMediaTypeManifest  = "application/vnd.docker.distribution.manifest.v2+json"
+	dockerMediaTypeLayerGzip = "application/vnd.docker.image.rootfs.diff.tar.gzip"
+	exportedImageMediaType   = "application/vnd.containers.storage.image.v1+json"
+	exportedImageAnnotation  = "io.containers.storage.image"
+)
+
+// ociDescriptor, ociLayout, ociIndex, ociManifest, and ociConfig describe the
+// subset of the OCI image layout and image formats which ExportImage writes
+// and ImportImage reads.
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      digest.Digest     `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+type ociLayout struct {
+	Version string `json:"imageLayoutVersion"`
+}
+
+type ociIndex struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	MediaType     string          `json:"mediaType,omitempty"`
+	Manifests     []ociDescriptor `json:"manifests"`
+}
+
+type ociManifest struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	MediaType     string            `json:"mediaType,omitempty"`
+	Config        ociDescriptor     `json:"config"`
+	Layers        []ociDescriptor   `json:"layers"`
+	Annotations   map[string]string `json:"annotations,omitempty"`
+}
+
+type ociConfig struct {
+	Created      *time.Time `json:"created,omitempty"`
+	Architecture string     `json:"architecture"`
+	OS           string     `json:"os"`
+	RootFS       struct {
+		Type    string          `json:"type"`
+		DiffIDs []digest.Digest `json:"diff_ids"`
+	} `json:"rootfs"`
+}
+
+// exportedImage is written as a blob alongside the OCI manifest, and records
+// the parts of an Image which the OCI formats have no place for, so that
+// ImportImage can recreate the image exactly.
+type exportedImage struct {
+	ID       string              `json:"id"`
+	Digest   digest.Digest       `json:"digest,omitempty"`
+	Names    []string            `json:"names,omitempty"`
+	Metadata string              `json:"metadata,omitempty"`
+	Created  time.Time           `json:"created"`
+	Flags    map[string]any      `json:"flags,omitempty"`
+	BigData  []exportedImageData `json:"big-data,omitempty"`
+}
+
+// exportedImageData describes one of an image's big data items.  Digest is
+// the digest which the image recorded for the item, which is not necessarily
+// the digest of the blob, which is Blob.
+type exportedImageData struct {
+	Key    string        `json:"key"`
+	Digest digest.Digest `json:"digest"`
+	Blob   digest.Digest `json:"blob"`
+}
+
+// ociLayoutWriter writes blobs into an OCI image layout directory.
+type ociLayoutWriter struct {
+	dir string
+}
+
+func (w *ociLayoutWriter) blobPath(d digest.Digest) string {
+	return filepath.Join(w.dir, ociBlobsDir, d.Algorithm().String(), d.Encoded())
+}
+
+// putBlob copies r into the layout, and returns its digest and size.
+func (w *ociLayoutWriter) putBlob(r io.Reader) (digest.Digest, int64, error) {
+	blobDir := filepath.Join(w.dir, ociBlobsDir, digest.Canonical.String())
+	if err := os.MkdirAll(blobDir, 0o755); err != nil {
+		return "", -1, err
+	}
+	f, err := os.CreateTemp(blobDir, ".tmp-")
+	if err != nil {
+		return "", -1, err
+	}
+	succeeded := false
+	defer func() {
+		if !succeeded {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+	digester := digest.Canonical.Digester()
+	size, err := io.Copy(f, io.TeeReader(r, digester.Hash()))
+	if err != nil {
+		return "", -1, err
+	}
+	if err := f.Close(); err != nil {
+		return "", -1, err
+	}
+	d := digester.Digest()
+	if err := os.Rename(f.Name(), w.blobPath(d)); err != nil {
+		return "", -1, err
+	}
+	succeeded = true
+	return d, size, nil
+}
+
+// putJSON marshals v and writes it into the layout as a blob.
+func (w *ociLayoutWriter) putJSON(mediaType string, v any) (ociDescriptor, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return ociDescriptor{}, err
+	}
+	d, size, err := w.putBlob(strings.NewReader(string(data)))
+	if err != nil {
+		return ociDescriptor{}, err
+	}
+	return ociDescriptor{MediaType: mediaType, Digest: d, Size: size}, nil
+}
+
+// ExportImage writes an image, its layers, big data items, and names to dest as
+// an OCI image layout.
+func (s *store) ExportImage(id, dest string) error {
+	image, err := s.Image(id)
+	if err != nil {
+		return err
+	}
+
+	dir := dest
+	asTar := strings.HasSuffix(dest, ".tar")
+	if asTar {
+		if dir, err = os.MkdirTemp(filepath.Dir(dest), ".export-image-"); err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+	} else {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return err
+		}
+		if _, err := os.Stat(filepath.Join(dir, ociIndexFile)); err == nil {
+			return fmt.Errorf("%q already contains an image layout: %w", dir, os.ErrExist)
+		}
+	}
+	w := &ociLayoutWriter{dir: dir}
+
+	// Walk the layer chain from the top layer down, and then write the
+	// layers out base layer first.
+	var chain []*Layer
+	for layerID := image.TopLayer; layerID != ""; {
+		layer, err := s.Layer(layerID)
+		if err != nil {
+			return fmt.Errorf("locating layer %q of image %q: %w", layerID, image.ID, err)
+		}
+		chain = append(chain, layer)
+		layerID = layer.Parent
+	}
+	slices.Reverse(chain)
+
+	compression := archive.Gzip
+	layers := make([]ociDescriptor, 0, len(chain))
+	diffIDs := make([]digest.Digest, 0, len(chain))
+	for _, layer := range chain {
+		rc, err := s.Diff("", layer.ID, &DiffOptions{Compression: &compression})
+		if err != nil {
+			return fmt.Errorf("reading layer %q: %w", layer.ID, err)
+		}
+		blobDigest, size, err := w.putBlob(rc)
+		rc.Close()
+		if err != nil {
+			return fmt.Errorf("writing layer %q: %w", layer.ID, err)
+		}
+		diffID := layer.UncompressedDigest
+		if diffID == "" {
+			if diffID, err = uncompressedBlobDigest(w.blobPath(blobDigest)); err != nil {
+				return fmt.Errorf("digesting layer %q: %w", layer.ID, err)
+			}
+		}
+		layers = append(layers, ociDescriptor{MediaType: ociMediaTypeLayerGzip, Digest: blobDigest, Size: size})
+		diffIDs = append(diffIDs, diffID)
+	}
+
+	record := exportedImage{
+		ID:       image.ID,
+		Digest:   image.Digest,
+		Names:    image.Names,
+		Metadata: image.Metadata,
+		Created:  image.Created,
+		Flags:    image.Flags,
+	}
+	var config []byte
+	for _, key := range image.BigDataNames {
+		data, err := s.ImageBigData(image.ID, key)
+		if err != nil {
+			return err
+		}
+		blobDigest, _, err := w.putBlob(strings.NewReader(string(data)))
+		if err != nil {
+			return err
+		}
+		record.BigData = append(record.BigData, exportedImageData{Key: key, Digest: image.BigDataDigests[key], Blob: blobDigest})
+		if key == ImageDigestBigDataKey {
+			config = imageConfigFromManifest(s, image.ID, data)
+		}
+	}
+	recordDescriptor, err := w.putJSON(exportedImageMediaType, &record)
+	if err != nil {
+		return err
+	}
+
+	var configDescriptor ociDescriptor
+	if config != nil {
+		d, size, err := w.putBlob(strings.NewReader(string(config)))
+		if err != nil {
+			return err
+		}
+		configDescriptor = ociDescriptor{MediaType: ociMediaTypeConfig, Digest: d, Size: size}
+	} else {
+		// We don't have the original configuration, so write the minimum
+		// needed for the layout to be usable by other tools.
+		generated := ociConfig{Architecture: runtime.GOARCH, OS: runtime.GOOS}
+		generated.Created = &image.Created
+		generated.RootFS.Type = "layers"
+		generated.RootFS.DiffIDs = diffIDs
+		if configDescriptor, err = w.putJSON(ociMediaTypeConfig, &generated); err != nil {
+			return err
+		}
+	}
+
+	manifestDescriptor, err := w.putJSON(ociMediaTypeManifest, &ociManifest{
+		SchemaVersion: 2,
+		MediaType:     ociMediaTypeManifest,
+		Config:        configDescriptor,
+		Layers:        layers,
+		Annotations:   map[string]string{exportedImageAnnotation: recordDescriptor.Digest.String()},
+	})
+	if err != nil {
+		return err
+	}
+	index := ociIndex{SchemaVersion: 2, MediaType: ociMediaTypeIndex}
+	if len(image.Names) == 0 {
+		index.Manifests = append(index.Manifests, manifestDescriptor)
+	}
+	for _, name := range image.Names {
+		descriptor := manifestDescriptor
+		descriptor.Annotations = map[string]string{ociRefNameAnnotation: name}
+		index.Manifests = append(index.Manifests, descriptor)
+	}
+	indexData, err := json.Marshal(&index)
+	if err != nil {
+		return err
+	}
+	if err := ioutils.AtomicWriteFile(filepath.Join(dir, ociIndexFile), indexData, 0o644); err != nil {
+		return err
+	}
+	layoutData, err := json.Marshal(&ociLayout{Version: ociLayoutVersion})
+	if err != nil {
+		return err
+	}
+	if err := ioutils.AtomicWriteFile(filepath.Join(dir, ociLayoutFile), layoutData, 0o644); err != nil {
+		return err
+	}
+
+	if !asTar {
+		return nil
+	}
+	rc, err := archive.Tar(dir, archive.Uncompressed)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	f, err := ioutils.NewAtomicFileWriterWithOpts(dest, 0o644, &ioutils.AtomicFileWriterOptions{ExplicitCommit: true})
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := io.Copy(f, rc); err != nil {
+		return fmt.Errorf("writing %q: %w", dest, err)
+	}
+	return f.Commit()
+}
+
+// imageConfigFromManifest returns the configuration blob referred to by the
+// manifest, if the image has it as a big data item, or nil.
+func imageConfigFromManifest(s *store, imageID string, manifest []byte) []byte {
+	var m ociManifest
+	if err := json.Unmarshal(manifest, &m); err != nil || m.Config.Digest == "" {
+		return nil
+	}
+	config, err := s.ImageBigData(imageID, m.Config.Digest.String())
+	if err != nil {
+		return nil
+	}
+	return config
+}
+
+// uncompressedBlobDigest returns the digest of the decompressed contents of
+// the file at path.
+func uncompressedBlobDigest(path string) (digest.Digest, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	rc, err := archive.DecompressStream(f)
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+	return digest.Canonical.FromReader(rc)
+}
+
+// ociLayoutReader reads blobs from an OCI image layout directory, verifying
+// their digests.
+type ociLayoutReader struct {
+	dir string
+}
+
+func (r *ociLayoutReader) openBlob(d digest.Digest) (io.ReadCloser, error) {
+	if err := d.Validate(); err != nil {
+		return nil, err
+	}
+	f, err := os.Open(filepath.Join(r.dir, ociBlobsDir, d.Algorithm().String(), d.Encoded()))
+	if err != nil {
+		return nil, err
+	}
+	return &verifyingReadCloser{file: f, verifier: d.Verifier(), digest: d}, nil
+}
+
+func (r *ociLayoutReader) readBlob(d digest.Digest) ([]byte, error) {
+	rc, err := r.openBlob(d)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(rc)
+}
+
+// verifyingReadCloser returns an error instead of io.EOF at the end of a blob
+// whose contents don't match its digest.
+type verifyingReadCloser struct {
+	file     *os.File
+	verifier digest.Verifier
+	digest   digest.Digest
+}
+
+func (v *verifyingReadCloser) Read(p []byte) (int, error) {
+	n, err := v.file.Read(p)
+	v.verifier.Write(p[:n]) //nolint:errcheck // Writing to a hash never fails.
+	if errors.Is(err, io.EOF) && !v.verifier.Verified() {
+		return n, fmt.Errorf("contents of blob %s do not match its digest", v.digest)
+	}
+	return n, err
+}
+
+func (v *verifyingReadCloser) Close() error {
+	return v.file.Close()
+}
+
+// ImportImage reads an image from the OCI image layout at src.
+func (s *store) ImportImage(src string) (*Image, error) {
+	info, err := os.Stat(src)
+	if err != nil {
+		return nil, err
+	}
+	dir := src
+	if !info.IsDir() {
+		// Extract it next to the store's own data, which is more likely
+		// to have room for it than the default temporary directory is.
+		if dir, err = os.MkdirTemp(s.graphRoot, ".import-image-"); err != nil {
+			return nil, err
+		}
+		defer os.RemoveAll(dir)
+		f, err := os.Open(src)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		if err := archive.Untar(f, dir, &archive.TarOptions{NoLchown: true}); err != nil {
+			return nil, fmt.Errorf("extracting %q: %w", src, err)
+		}
+	}
+	r := &ociLayoutReader{dir: dir}
+
+	layoutData, err := os.ReadFile(filepath.Join(dir, ociLayoutFile))
+	if err != nil {
+		return nil, fmt.Errorf("%q is not an OCI image layout: %w", src, err)
+	}
+	var layout ociLayout
+	if err := json.Unmarshal(layoutData, &layout); err != nil {
+		return nil, fmt.Errorf("parsing %q: %w", ociLayoutFile, err)
+	}
+	if layout.Version != ociLayoutVersion {
+		return nil, fmt.Errorf("OCI image layout version %q: %w", layout.Version, ErrNotSupported)
+	}
+	indexData, err := os.ReadFile(filepath.Join(dir, ociIndexFile))
+	if err != nil {
+		return nil, err
+	}
+	var index ociIndex
+	if err := json.Unmarshal(indexData, &index); err != nil {
+		return nil, fmt.Errorf("parsing %q: %w", ociIndexFile, err)
+	}
+
+	// There should be exactly one manifest, possibly listed more than
+	// once, under different names.
+	var manifestDigest digest.Digest
+	var names []string
+	for _, descriptor := range index.Manifests {
+		if descriptor.MediaType != ociMediaTypeManifest && descriptor.MediaType != dockerMediaTypeManifest {
+			continue
+		}
+		if manifestDigest != "" && descriptor.Digest != manifestDigest {
+			return nil, fmt.Errorf("%q contains more than one image: %w", src, ErrNotSupported)
+		}
+		manifestDigest = descriptor.Digest
+		if name := descriptor.Annotations[ociRefNameAnnotation]; name != "" {
+			names = append(names, name)
+		}
+	}
+	if manifestDigest == "" {
+		return nil, fmt.Errorf("%q does not contain an image: %w", src, ErrImageUnknown)
+	}
+	manifestData, err := r.readBlob(manifestDigest)
+	if err != nil {
+		return nil, fmt.Errorf("reading manifest: %w", err)
+	}
+	var manifest ociManifest
+	if err := json.Unmarshal(manifestData, &manifest); err != nil {
+		return nil, fmt.Errorf("parsing manifest: %w", err)
+	}
+	configData, err := r.readBlob(manifest.Config.Digest)
+	if err != nil {
+		return nil, fmt.Errorf("reading configuration: %w", err)
+	}
+	var config ociConfig
+	if err := json.Unmarshal(configData, &config); err != nil {
+		return nil, fmt.Errorf("parsing configuration: %w", err)
+	}
+
+	// Work out what the image should look like.
+	id := manifest.Config.Digest.Encoded()
+	var options ImageOptions
+	if recordDigest, ok := manifest.Annotations[exportedImageAnnotation]; ok {
+		recordData, err := r.readBlob(digest.Digest(recordDigest))
+		if err != nil {
+			return nil, fmt.Errorf("reading image record: %w", err)
+		}
+		var record exportedImage
+		if err := json.Unmarshal(recordData, &record); err != nil {
+			return nil, fmt.Errorf("parsing image record: %w", err)
+		}
+		id = record.ID
+		names = record.Names
+		options.Digest = record.Digest
+		options.Metadata = record.Metadata
+		options.CreationDate = record.Created
+		options.Flags = record.Flags
+		for _, item := range record.BigData {
+			data, err := r.readBlob(item.Blob)
+			if err != nil {
+				return nil, fmt.Errorf("reading data item %q: %w", item.Key, err)
+			}
+			options.BigData = append(options.BigData, ImageBigDataOption{Key: item.Key, Data: data, Digest: item.Digest})
+		}
+	} else {
+		// An image from somewhere else: keep its manifest and configuration
+		// where other consumers of the store expect to find them.
+		options.Digest = manifestDigest
+		options.BigData = []ImageBigDataOption{
+			{Key: manifest.Config.Digest.String(), Data: configData, Digest: manifest.Config.Digest},
+			{Key: ImageDigestBigDataKey, Data: manifestData, Digest: manifestDigest},
+		}
+		if config.Created != nil {
+			options.CreationDate = *config.Created
+		}
+	}
+	if len(config.RootFS.DiffIDs) != 0 && len(config.RootFS.DiffIDs) != len(manifest.Layers) {
+		return nil, fmt.Errorf("configuration lists %d layers, manifest lists %d", len(config.RootFS.DiffIDs), len(manifest.Layers))
+	}
+
+	// Reuse as much of the layer chain as is already present.
+	parent := ""
+	reused := 0
+	for i, descriptor := range manifest.Layers {
+		var diffID digest.Digest
+		if len(config.RootFS.DiffIDs) > 0 {
+			diffID = config.RootFS.DiffIDs[i]
+		}
+		layer := s.findImportedLayer(parent, descriptor.Digest, diffID)
+		if layer == "" {
+			break
+		}
+		parent = layer
+		reused++
+	}
+
+	tx, err := s.Begin()
+	if err != nil {
+		return nil, err
+	}
+	succeeded := false
+	defer func() {
+		if !succeeded {
+			if err := tx.Rollback(); err != nil {
+				logrus.Errorf("Rolling back import of %q: %v", src, err)
+			}
+		}
+	}()
+	for i, descriptor := range manifest.Layers[reused:] {
+		switch descriptor.MediaType {
+		case ociMediaTypeLayer, ociMediaTypeLayerGzip, ociMediaTypeLayerZstd, dockerMediaTypeLayerGzip:
+		default:
+			return nil, fmt.Errorf("layer media type %q: %w", descriptor.MediaType, ErrNotSupported)
+		}
+		layerOptions := LayerOptions{OriginalDigest: descriptor.Digest, OriginalSize: &descriptor.Size}
+		if len(config.RootFS.DiffIDs) > 0 {
+			layerOptions.UncompressedDigest = config.RootFS.DiffIDs[reused+i]
+		}
+		rc, err := r.openBlob(descriptor.Digest)
+		if err != nil {
+			return nil, fmt.Errorf("reading layer %s: %w", descriptor.Digest, err)
+		}
+		layer, _, err := tx.PutLayer("", parent, nil, "", false, &layerOptions, rc)
+		rc.Close()
+		if err != nil {
+			return nil, fmt.Errorf("creating layer for %s: %w", descriptor.Digest, err)
+		}
+		parent = layer.ID
+	}
+	if _, err := tx.CreateImage(id, names, parent, "", &options); err != nil {
+		return nil, err
+	}
+	// Commit cleans up after itself if it fails.
+	succeeded = true
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return s.Image(id)
+}
+
+// findImportedLayer returns the ID of a layer with the specified parent which
+// has the specified compressed or uncompressed digest, or "".
+func (s *store) findImportedLayer(parent string, compressedDigest, uncompressedDigest digest.Digest) string {
+	var candidates []Layer
+	if layers, err := s.LayersByCompressedDigest(compressedDigest); err == nil {
+		candidates = append(candidates, layers...)
+	}
+	if uncompressedDigest != "" {
+		if layers, err := s.LayersByUncompressedDigest(uncompressedDigest); err == nil {
+			candidates = append(candidates, layers...)
+		}
+	}
+	for _, layer := range candidates {
+		if layer.Parent == parent && !layerHasIncompleteFlag(&layer) {
+			return layer.ID
+		}
+	}
+	return ""
+}
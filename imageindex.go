@@ -0,0 +1,319 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/containers/storage/pkg/ioutils"
+	"github.com/containers/storage/pkg/stringid"
+)
+
+// ImagePlatform describes the platform which an image in an image index is
+// for, using the same fields as the platform in an OCI image index.
+type ImagePlatform struct {
+	Architecture string   `json:"architecture"`
+	OS           string   `json:"os"`
+	OSVersion    string   `json:"os.version,omitempty"`
+	OSFeatures   []string `json:"os.features,omitempty"`
+	Variant      string   `json:"variant,omitempty"`
+}
+
+// String returns the platform in the "os/architecture[/variant]" form.
+func (p ImagePlatform) String() string {
+	s := p.OS + "/" + p.Architecture
+	if p.Variant != "" {
+		s += "/" + p.Variant
+	}
+	return s
+}
+
+// matches checks if an image for p can be used when one for wanted is
+// requested.  Fields which are not set in wanted match any value.
+func (p ImagePlatform) matches(wanted ImagePlatform) bool {
+	return p.OS == wanted.OS && p.Architecture == wanted.Architecture &&
+		(wanted.Variant == "" || p.Variant == wanted.Variant) &&
+		(wanted.OSVersion == "" || p.OSVersion == wanted.OSVersion)
+}
+
+// ImageIndexMember is an image in an image index, along with the platform
+// which it is for.
+type ImageIndexMember struct {
+	// ImageID is the ID of the image.
+	ImageID string `json:"image"`
+	// Platform is the platform which the image is for.
+	Platform ImagePlatform `json:"platform"`
+}
+
+// ImageIndex is a record of a set of images which are builds of the same
+// image for different platforms.  Images which are members of an index can't
+// be deleted until the index is.
+type ImageIndex struct {
+	// ID is either one which was specified at create-time, or a random
+	// value which was generated by the library.
+	ID string `json:"id"`
+
+	// Names is an optional set of user-defined convenience values.  Image
+	// indexes have their own namespace, so an index and an image can have
+	// the same name.
+	Names []string `json:"names,omitempty"`
+
+	// Members are the images in the index, and the platforms they're for.
+	Members []ImageIndexMember `json:"members"`
+
+	// Created is the datestamp for when this index was created.
+	Created time.Time `json:"created"`
+}
+
+func copyImageIndex(i *ImageIndex) *ImageIndex {
+	members := slices.Clone(i.Members)
+	for n := range members {
+		members[n].Platform.OSFeatures = slices.Clone(members[n].Platform.OSFeatures)
+	}
+	return &ImageIndex{
+		ID:      i.ID,
+		Names:   slices.Clone(i.Names),
+		Members: members,
+		Created: i.Created,
+	}
+}
+
+func (r *imageStore) indexespath() string {
+	return filepath.Join(r.dir, "image-indexes.json")
+}
+
+// loadIndexes reads the list of image indexes.
+// The caller must hold r.lockfile for reading or writing.
+func (r *imageStore) loadIndexes() ([]*ImageIndex, error) {
+	indexes := []*ImageIndex{}
+	ipath := r.indexespath()
+	data, err := os.ReadFile(ipath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return indexes, nil
+		}
+		return nil, err
+	}
+	if len(data) != 0 {
+		if err := json.Unmarshal(data, &indexes); err != nil {
+			return nil, fmt.Errorf("loading %q: %w", ipath, err)
+		}
+	}
+	return indexes, nil
+}
+
+// saveIndexes writes the list of image indexes, or removes the file if there
+// aren't any, if the list changed since it was last read or written.
+// The caller must hold r.lockfile locked for writing, and must have already
+// recorded the write.
+// The caller must hold r.inProcessLock for reading, or for writing if the
+// list changed.
+func (r *imageStore) saveIndexes() error {
+	if !r.indexesChanged {
+		return nil
+	}
+	if len(r.indexes) == 0 {
+		if err := os.Remove(r.indexespath()); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	} else {
+		jdata, err := json.Marshal(&r.indexes)
+		if err != nil {
+			return err
+		}
+		if err := ioutils.AtomicWriteFile(r.indexespath(), jdata, 0o600); err != nil {
+			return err
+		}
+	}
+	r.indexesChanged = false
+	return nil
+}
+
+// Requires startReading or startWriting.
+func (r *imageStore) lookupIndex(id string) (*ImageIndex, bool) {
+	for _, index := range r.indexes {
+		if index.ID == id {
+			return index, true
+		}
+	}
+	for _, index := range r.indexes {
+		if slices.Contains(index.Names, id) {
+			return index, true
+		}
+	}
+	return nil, false
+}
+
+// Requires startWriting.
+func (r *imageStore) createIndex(id string, names []string, members []ImageIndexMember) (*ImageIndex, error) {
+	if !r.lockfile.IsReadWrite() {
+		return nil, fmt.Errorf("not allowed to create new image indexes at %q: %w", r.imagespath(), ErrStoreIsReadOnly)
+	}
+	if id == "" {
+		id = stringid.GenerateRandomID()
+		for r.indexIDInUse(id) {
+			id = stringid.GenerateRandomID()
+		}
+	}
+	if r.indexIDInUse(id) {
+		return nil, fmt.Errorf("an image index with ID %q already exists: %w", id, ErrDuplicateID)
+	}
+	names = dedupeStrings(names)
+	for _, name := range names {
+		if index, nameInUse := r.lookupIndex(name); nameInUse {
+			return nil, fmt.Errorf("image index name %q is already associated with image index %q: %w", name, index.ID, ErrDuplicateName)
+		}
+	}
+	index := &ImageIndex{
+		ID:      id,
+		Names:   names,
+		Members: members,
+		Created: time.Now().UTC(),
+	}
+	r.indexes = append(r.indexes, index)
+	r.indexesChanged = true
+	if err := r.Save(); err != nil {
+		r.indexes = slices.DeleteFunc(r.indexes, func(candidate *ImageIndex) bool {
+			return candidate == index
+		})
+		return nil, err
+	}
+	return copyImageIndex(index), nil
+}
+
+// Requires startReading or startWriting.
+func (r *imageStore) indexIDInUse(id string) bool {
+	return slices.ContainsFunc(r.indexes, func(index *ImageIndex) bool {
+		return index.ID == id
+	})
+}
+
+// Requires startWriting.
+func (r *imageStore) deleteIndex(id string) error {
+	if !r.lockfile.IsReadWrite() {
+		return fmt.Errorf("not allowed to delete image indexes at %q: %w", r.imagespath(), ErrStoreIsReadOnly)
+	}
+	index, ok := r.lookupIndex(id)
+	if !ok {
+		return fmt.Errorf("locating image index with ID %q: %w", id, ErrImageIndexUnknown)
+	}
+	r.indexes = slices.DeleteFunc(r.indexes, func(candidate *ImageIndex) bool {
+		return candidate == index
+	})
+	r.indexesChanged = true
+	return r.Save()
+}
+
+// Requires startReading or startWriting.
+func (r *imageStore) Index(id string) (*ImageIndex, error) {
+	if index, ok := r.lookupIndex(id); ok {
+		return copyImageIndex(index), nil
+	}
+	return nil, fmt.Errorf("locating image index with ID %q: %w", id, ErrImageIndexUnknown)
+}
+
+// Requires startReading or startWriting.
+func (r *imageStore) Indexes() []ImageIndex {
+	indexes := make([]ImageIndex, len(r.indexes))
+	for i := range r.indexes {
+		indexes[i] = *copyImageIndex(r.indexes[i])
+	}
+	return indexes
+}
+
+// Requires startReading or startWriting.
+func (r *imageStore) indexesUsing(imageID string) []string {
+	var ids []string
+	for _, index := range r.indexes {
+		if slices.ContainsFunc(index.Members, func(member ImageIndexMember) bool { return member.ImageID == imageID }) {
+			ids = append(ids, index.ID)
+		}
+	}
+	return ids
+}
+
+// CreateImageIndex creates an image index which refers to images which were
+// built for different platforms.
+func (s *store) CreateImageIndex(id string, names []string, members []ImageIndexMember) (*ImageIndex, error) {
+	if len(members) == 0 {
+		return nil, fmt.Errorf("creating image index %q: no member images specified", id)
+	}
+	return writeToImageStore(s, func() (*ImageIndex, error) {
+		for _, is := range s.roImageStores {
+			store := is
+			if err := store.startReading(); err != nil {
+				return nil, err
+			}
+			defer store.stopReading()
+		}
+		resolved := make([]ImageIndexMember, 0, len(members))
+		for _, member := range members {
+			if member.Platform.OS == "" || member.Platform.Architecture == "" {
+				return nil, fmt.Errorf("image %q in image index: platform OS and architecture must be set", member.ImageID)
+			}
+			var image *Image
+			for _, store := range s.allImageStores() {
+				if i, err := store.Get(member.ImageID); err == nil {
+					image = i
+					break
+				}
+			}
+			if image == nil {
+				return nil, fmt.Errorf("locating image %q for image index: %w", member.ImageID, ErrImageUnknown)
+			}
+			for _, other := range resolved {
+				if other.Platform.String() == member.Platform.String() && other.Platform.OSVersion == member.Platform.OSVersion {
+					return nil, fmt.Errorf("images %q and %q in image index are both for platform %s", other.ImageID, image.ID, member.Platform)
+				}
+			}
+			member.ImageID = image.ID
+			member.Platform.OSFeatures = slices.Clone(member.Platform.OSFeatures)
+			resolved = append(resolved, member)
+		}
+		return s.imageStore.createIndex(id, names, resolved)
+	})
+}
+
+// ImageIndex returns the image index with the specified ID or name.
+func (s *store) ImageIndex(id string) (*ImageIndex, error) {
+	if err := s.imageStore.startReading(); err != nil {
+		return nil, err
+	}
+	defer s.imageStore.stopReading()
+	return s.imageStore.Index(id)
+}
+
+// ImageIndexes returns all of the image indexes.
+func (s *store) ImageIndexes() ([]ImageIndex, error) {
+	if err := s.imageStore.startReading(); err != nil {
+		return nil, err
+	}
+	defer s.imageStore.stopReading()
+	return s.imageStore.Indexes(), nil
+}
+
+// ImageForPlatform returns the first image in an image index which is for a
+// platform which matches the specified one.  If platform.Variant or
+// platform.OSVersion are not set, images for any variant or OS version match.
+func (s *store) ImageForPlatform(index string, platform ImagePlatform) (*Image, error) {
+	i, err := s.ImageIndex(index)
+	if err != nil {
+		return nil, err
+	}
+	for _, member := range i.Members {
+		if member.Platform.matches(platform) {
+			return s.Image(member.ImageID)
+		}
+	}
+	return nil, fmt.Errorf("locating image for platform %s in image index %q: %w", platform, i.ID, ErrImageUnknown)
+}
+
+// DeleteImageIndex removes an image index, but not the images in it.
+func (s *store) DeleteImageIndex(id string) error {
+	_, err := writeToImageStore(s, func() (struct{}, error) {
+		return struct{}{}, s.imageStore.deleteIndex(id)
+	})
+	return err
+}
@@ -90,10 +90,23 @@ type Image struct {
 	// is set before using it.
 	Created time.Time `json:"created,omitempty"`
 
+	// LastUsed is the datestamp for when a container was last created
+	// from this image, or the image was last mounted.  It is not tracked
+	// for images in read-only stores, or for images which have never been
+	// used.  It is recorded separately from the rest of the image's
+	// information, so that using an image doesn't force other processes to
+	// reload the store, and they might not see a new value until they do
+	// so for some other reason.
+	LastUsed time.Time `json:"-"`
+
 	// ReadOnly is true if this image resides in a read-only layer store.
 	ReadOnly bool `json:"-"`
 
 	Flags map[string]any `json:"flags,omitempty"`
+
+	// Labels are caller-specified key/value pairs which can be used to
+	// select images.
+	Labels map[string]string `json:"labels,omitempty"`
 }
 
 // roImageStore provides bookkeeping for information about Images.
@@ -108,6 +121,12 @@ type roImageStore interface {
 	// stopReading releases locks obtained by startReading.
 	stopReading()
 
+	// changedSince checks if the on-disk state of the store was modified
+	// since the point described by previous, and returns a value which
+	// describes the current state, for use in later calls.  If previous
+	// is nil, the state is always treated as modified.
+	changedSince(previous *storeWriteMarker) (storeWriteMarker, bool, error)
+
 	// Exists checks if there is an image with the given ID or name.
 	Exists(id string) bool
 
@@ -117,6 +136,10 @@ type roImageStore interface {
 	// Images returns a slice enumerating the known images.
 	Images() ([]Image, error)
 
+	// imagesMatching returns the known images whose labels match
+	// selector.
+	imagesMatching(selector labelSelector) []Image
+
 	// ByDigest returns a slice enumerating the images which have either an
 	// explicitly-set digest, or a big data item with a name that starts
 	// with ImageDigestManifestBigDataNamePrefix, which matches the
@@ -151,9 +174,56 @@ type rwImageStore interface {
 	// Delete removes the record of the image.
 	Delete(id string) error
 
+	// deleteRolledBack is like Delete, for an image which was created by
+	// a transaction which is being rolled back.  The name history entries
+	// which were recorded when it was created are forgotten, instead of
+	// recording that its names were deleted.
+	deleteRolledBack(id string) error
+
 	addMappedTopLayer(id, layer string) error
 	removeMappedTopLayer(id, layer string) error
 
+	// setTopLayer replaces the image's top layer with one which has the
+	// same contents.  ID-mapped versions of the old top layer are kept, so
+	// that they are still used, and are removed along with the image.
+	setTopLayer(id, layer string) error
+
+	// recordUse notes that the image was just used to create a container,
+	// or was mounted.
+	recordUse(id string) error
+
+	// loadLastUsed reads the most recently recorded times at which images
+	// were used, which can be newer than the values of their LastUsed
+	// fields if other processes used them.
+	loadLastUsed() (map[string]time.Time, error)
+
+	// NameHistory returns the recorded changes to which image a name
+	// refers to, oldest first.
+	NameHistory(name string) []NameHistoryEntry
+
+	// rollbackName undoes the most recent steps recorded changes to which
+	// image a name refers to.
+	rollbackName(name string, steps int) error
+
+	// createIndex creates an image index with the specified ID (or a
+	// random one) and optional names, which refers to the specified
+	// images, whose IDs must already have been resolved.
+	createIndex(id string, names []string, members []ImageIndexMember) (*ImageIndex, error)
+
+	// deleteIndex removes the record of an image index.
+	deleteIndex(id string) error
+
+	// Index retrieves information about an image index given an ID or
+	// name.
+	Index(id string) (*ImageIndex, error)
+
+	// Indexes returns a slice enumerating the known image indexes.
+	Indexes() []ImageIndex
+
+	// indexesUsing returns the IDs of the image indexes which the image
+	// with the specified ID is a member of.
+	indexesUsing(imageID string) []string
+
 	// Clean up unreferenced per-image data.
 	GarbageCollect() error
 
@@ -176,6 +246,18 @@ type imageStore struct {
 	byid      map[string]*Image
 	byname    map[string]*Image
 	bydigest  map[digest.Digest][]*Image
+	bylabel   labelIndex[Image]
+	// nameHistory records changes to which images names refer to, oldest
+	// first, for each name.
+	nameHistory map[string][]NameHistoryEntry
+	// nameHistoryChanged is set when nameHistory has changes which haven't
+	// been written to disk.
+	nameHistoryChanged bool
+	// indexes are the image indexes which refer to images in the store.
+	indexes []*ImageIndex
+	// indexesChanged is set when indexes has changes which haven't been
+	// written to disk.
+	indexesChanged bool
 }
 
 func copyImage(i *Image) *Image {
@@ -192,8 +274,10 @@ func copyImage(i *Image) *Image {
 		BigDataSizes:    copyMapPreferringNil(i.BigDataSizes),
 		BigDataDigests:  copyMapPreferringNil(i.BigDataDigests),
 		Created:         i.Created,
+		LastUsed:        i.LastUsed,
 		ReadOnly:        i.ReadOnly,
 		Flags:           copyMapPreferringNil(i.Flags),
+		Labels:          copyMapPreferringNil(i.Labels),
 	}
 }
 
@@ -364,6 +448,25 @@ func (r *imageStore) modified() (lockfile.LastWrite, bool, error) {
 	return r.lockfile.ModifiedSince(r.lastWrite)
 }
 
+// changedSince checks if the on-disk state of the store was modified since the
+// point described by previous.
+//
+// Requires startReading or startWriting.
+func (r *imageStore) changedSince(previous *storeWriteMarker) (storeWriteMarker, bool, error) {
+	if previous == nil {
+		lastWrite, err := r.lockfile.GetLastWrite()
+		if err != nil {
+			return storeWriteMarker{}, false, err
+		}
+		return storeWriteMarker{data: lastWrite}, true, nil
+	}
+	lastWrite, modified, err := r.lockfile.ModifiedSince(previous.data)
+	if err != nil {
+		return storeWriteMarker{}, false, err
+	}
+	return storeWriteMarker{data: lastWrite}, modified, nil
+}
+
 // reloadIfChanged reloads the contents of the store from disk if it is changed.
 //
 // The caller must hold r.lockfile for reading _or_ writing; lockedForWriting is true
@@ -392,6 +495,20 @@ func (r *imageStore) reloadIfChanged(lockedForWriting bool) (bool, error) {
 	return false, nil
 }
 
+func imageLabels(image *Image) map[string]string {
+	return image.Labels
+}
+
+// Requires startReading or startWriting.
+func (r *imageStore) imagesMatching(selector labelSelector) []Image {
+	matched := r.bylabel.matching(selector, r.images, imageLabels)
+	images := make([]Image, len(matched))
+	for i := range matched {
+		images[i] = *copyImage(matched[i])
+	}
+	return images
+}
+
 // Requires startReading or startWriting.
 func (r *imageStore) Images() ([]Image, error) {
 	images := make([]Image, len(r.images))
@@ -513,6 +630,18 @@ func (r *imageStore) load(lockedForWriting bool) (bool, error) {
 			return false, fmt.Errorf("loading %q: %w", rpath, err)
 		}
 	}
+	nameHistory, err := r.loadNameHistory()
+	if err != nil {
+		return false, err
+	}
+	lastUsed, err := r.loadLastUsed()
+	if err != nil {
+		return false, err
+	}
+	indexes, err := r.loadIndexes()
+	if err != nil {
+		return false, err
+	}
 	idlist := make([]string, 0, len(images))
 	ids := make(map[string]*Image)
 	names := make(map[string]*Image)
@@ -539,6 +668,7 @@ func (r *imageStore) load(lockedForWriting bool) (bool, error) {
 			digests[digest] = append(list, image)
 		}
 		image.ReadOnly = !r.lockfile.IsReadWrite()
+		image.LastUsed = lastUsed[image.ID]
 	}
 
 	if errorToResolveBySaving != nil {
@@ -554,6 +684,11 @@ func (r *imageStore) load(lockedForWriting bool) (bool, error) {
 	r.byid = ids
 	r.byname = names
 	r.bydigest = digests
+	r.bylabel = newLabelIndex(images, imageLabels)
+	r.nameHistory = nameHistory
+	r.nameHistoryChanged = false
+	r.indexes = indexes
+	r.indexesChanged = false
 	if errorToResolveBySaving != nil {
 		return false, r.Save()
 	}
@@ -586,7 +721,10 @@ func (r *imageStore) Save() error {
 	if err := ioutils.AtomicWriteFile(rpath, jdata, 0o600); err != nil {
 		return err
 	}
-	return nil
+	if err := r.saveNameHistory(); err != nil {
+		return err
+	}
+	return r.saveIndexes()
 }
 
 func newImageStore(dir string) (rwImageStore, error) {
@@ -604,7 +742,11 @@ func newImageStore(dir string) (rwImageStore, error) {
 		images:   []*Image{},
 		byid:     make(map[string]*Image),
 		byname:   make(map[string]*Image),
+		bylabel:  make(labelIndex[Image]),
 		bydigest: make(map[digest.Digest][]*Image),
+
+		nameHistory: make(map[string][]NameHistoryEntry),
+		indexes:     []*ImageIndex{},
 	}
 	if err := istore.startWritingWithReload(false); err != nil {
 		return nil, err
@@ -632,7 +774,11 @@ func newROImageStore(dir string) (roImageStore, error) {
 		images:   []*Image{},
 		byid:     make(map[string]*Image),
 		byname:   make(map[string]*Image),
+		bylabel:  make(labelIndex[Image]),
 		bydigest: make(map[digest.Digest][]*Image),
+
+		nameHistory: make(map[string][]NameHistoryEntry),
+		indexes:     []*ImageIndex{},
 	}
 	if err := istore.startReadingWithReload(false); err != nil {
 		return nil, err
@@ -674,6 +820,62 @@ func (r *imageStore) ClearFlag(id string, flag string) error {
 	return r.Save()
 }
 
+// Requires startWriting.
+func (r *imageStore) recordUse(id string) error {
+	if !r.lockfile.IsReadWrite() {
+		return fmt.Errorf("not allowed to record use of images at %q: %w", r.imagespath(), ErrStoreIsReadOnly)
+	}
+	image, ok := r.lookup(id)
+	if !ok {
+		return fmt.Errorf("locating image with ID %q: %w", id, ErrImageUnknown)
+	}
+	lastUsed, err := r.loadLastUsed()
+	if err != nil {
+		return err
+	}
+	// Drop records for images which have since been deleted, and catch up
+	// with images which other processes have used.
+	for imageID, when := range lastUsed {
+		if other, ok := r.byid[imageID]; ok {
+			other.LastUsed = when
+		} else {
+			delete(lastUsed, imageID)
+		}
+	}
+	image.LastUsed = time.Now().UTC()
+	lastUsed[image.ID] = image.LastUsed
+	jdata, err := json.Marshal(lastUsed)
+	if err != nil {
+		return err
+	}
+	// This deliberately doesn't record a write to r.lockfile, so that other
+	// processes aren't made to reload everything else.
+	return ioutils.AtomicWriteFile(r.lastusedpath(), jdata, 0o600)
+}
+
+func (r *imageStore) lastusedpath() string {
+	return filepath.Join(r.dir, "images-last-used.json")
+}
+
+// Requires startReading or startWriting.
+func (r *imageStore) loadLastUsed() (map[string]time.Time, error) {
+	lastUsed := make(map[string]time.Time)
+	lpath := r.lastusedpath()
+	data, err := os.ReadFile(lpath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return lastUsed, nil
+		}
+		return nil, err
+	}
+	if len(data) != 0 {
+		if err := json.Unmarshal(data, &lastUsed); err != nil {
+			return nil, fmt.Errorf("loading %q: %w", lpath, err)
+		}
+	}
+	return lastUsed, nil
+}
+
 // Requires startWriting.
 func (r *imageStore) SetFlag(id string, flag string, value any) error {
 	if !r.lockfile.IsReadWrite() {
@@ -725,6 +927,7 @@ func (r *imageStore) create(id string, names []string, layer string, options Ima
 		BigDataDigests: make(map[string]digest.Digest),
 		Created:        options.CreationDate,
 		Flags:          newMapFrom(options.Flags),
+		Labels:         copyMapPreferringNil(options.Labels),
 	}
 	if image.Created.IsZero() {
 		image.Created = time.Now().UTC()
@@ -740,8 +943,10 @@ func (r *imageStore) create(id string, names []string, layer string, options Ima
 	// would be too risky.
 	_ = r.idindex.Add(id)
 	r.byid[id] = image
+	r.bylabel.add(image, image.Labels)
 	for _, name := range names {
 		r.byname[name] = image
+		r.recordName(name, "", id, NameCreated)
 	}
 	for _, digest := range image.Digests {
 		list := r.bydigest[digest]
@@ -782,6 +987,18 @@ func (r *imageStore) addMappedTopLayer(id, layer string) error {
 	return fmt.Errorf("locating image with ID %q: %w", id, ErrImageUnknown)
 }
 
+// Requires startWriting.
+func (r *imageStore) setTopLayer(id, layer string) error {
+	if !r.lockfile.IsReadWrite() {
+		return fmt.Errorf("not allowed to modify image top layers at %q: %w", r.imagespath(), ErrStoreIsReadOnly)
+	}
+	if image, ok := r.lookup(id); ok {
+		image.TopLayer = layer
+		return r.Save()
+	}
+	return fmt.Errorf("locating image with ID %q: %w", id, ErrImageUnknown)
+}
+
 // Requires startWriting.
 func (r *imageStore) removeMappedTopLayer(id, layer string) error {
 	if image, ok := r.lookup(id); ok {
@@ -816,6 +1033,20 @@ func (r *imageStore) SetMetadata(id, metadata string) error {
 	return fmt.Errorf("locating image with ID %q: %w", id, ErrImageUnknown)
 }
 
+// Requires startWriting.
+func (r *imageStore) SetLabels(id string, labels map[string]string) error {
+	if !r.lockfile.IsReadWrite() {
+		return fmt.Errorf("not allowed to modify image labels at %q: %w", r.imagespath(), ErrStoreIsReadOnly)
+	}
+	if image, ok := r.lookup(id); ok {
+		r.bylabel.remove(image, image.Labels)
+		image.Labels = copyMapPreferringNil(labels)
+		r.bylabel.add(image, image.Labels)
+		return r.Save()
+	}
+	return fmt.Errorf("locating image with ID %q: %w", id, ErrImageUnknown)
+}
+
 // The caller must hold r.inProcessLock for writing.
 func (r *imageStore) removeName(image *Image, name string) {
 	image.Names = stringSliceWithoutValue(image.Names, name)
@@ -840,6 +1071,18 @@ func (r *imageStore) updateNames(id string, names []string, op updateNameOperati
 	if err != nil {
 		return err
 	}
+	for _, name := range oldNames {
+		if !slices.Contains(names, name) {
+			r.recordName(name, image.ID, "", op.historyOperation())
+		}
+	}
+	for _, name := range names {
+		previousID := ""
+		if previous, ok := r.byname[name]; ok {
+			previousID = previous.ID
+		}
+		r.recordName(name, previousID, image.ID, op.historyOperation())
+	}
 	for _, name := range oldNames {
 		delete(r.byname, name)
 	}
@@ -856,6 +1099,16 @@ func (r *imageStore) updateNames(id string, names []string, op updateNameOperati
 
 // Requires startWriting.
 func (r *imageStore) Delete(id string) error {
+	return r.delete(id, false)
+}
+
+// Requires startWriting.
+func (r *imageStore) deleteRolledBack(id string) error {
+	return r.delete(id, true)
+}
+
+// Requires startWriting.
+func (r *imageStore) delete(id string, rolledBack bool) error {
 	if !r.lockfile.IsReadWrite() {
 		return fmt.Errorf("not allowed to delete images at %q: %w", r.imagespath(), ErrStoreIsReadOnly)
 	}
@@ -865,11 +1118,17 @@ func (r *imageStore) Delete(id string) error {
 	}
 	id = image.ID
 	delete(r.byid, id)
+	r.bylabel.remove(image, image.Labels)
 	// This can only fail if the ID is already missing, which shouldn’t happen — and in that case the index is already in the desired state anyway.
 	// The store’s Delete method is used on various paths to recover from failures, so this should be robust against partially missing data.
 	_ = r.idindex.Delete(id)
 	for _, name := range image.Names {
 		delete(r.byname, name)
+		if rolledBack {
+			r.forgetCreatedName(name, id)
+		} else {
+			r.recordName(name, id, "", NameDeleted)
+		}
 	}
 	for _, digest := range image.Digests {
 		prunedList := slices.DeleteFunc(r.bydigest[digest], func(i *Image) bool {
@@ -1058,6 +1317,10 @@ func (r *imageStore) Wipe() error {
 	if !r.lockfile.IsReadWrite() {
 		return fmt.Errorf("not allowed to delete images at %q: %w", r.imagespath(), ErrStoreIsReadOnly)
 	}
+	if len(r.indexes) > 0 {
+		r.indexes = []*ImageIndex{}
+		r.indexesChanged = true
+	}
 	ids := make([]string, 0, len(r.byid))
 	for id := range r.byid {
 		ids = append(ids, id)
@@ -107,3 +107,57 @@ func TestHistoryNames(t *testing.T) {
 	require.Nil(t, err)
 	require.Equal(t, firstImage.NamesHistory, []string{"4", "3", "2", "1", "5"})
 }
+
+func TestNameHistoryAndRollback(t *testing.T) {
+	dir := t.TempDir()
+	store, err := newImageStore(dir)
+	require.NoError(t, err)
+
+	addTestImage(t, store, "first", []string{"app:latest"})
+	addTestImage(t, store, "second", nil)
+
+	require.NoError(t, store.startWriting())
+	require.NoError(t, store.updateNames("second", []string{"app:latest"}, addNames))
+	require.NoError(t, store.updateNames("second", []string{"app:latest"}, removeNames))
+	history := store.NameHistory("app:latest")
+	require.Len(t, history, 3)
+	require.Equal(t, NameHistoryEntry{Name: "app:latest", ImageID: "first", Operation: NameSet, Timestamp: history[0].Timestamp}, history[0])
+	require.Equal(t, NameHistoryEntry{Name: "app:latest", ImageID: "second", PreviousImageID: "first", Operation: NameAdded, Timestamp: history[1].Timestamp}, history[1])
+	require.Equal(t, NameHistoryEntry{Name: "app:latest", PreviousImageID: "second", Operation: NameRemoved, Timestamp: history[2].Timestamp}, history[2])
+
+	// Rolling back two changes points the name at the first image again.
+	require.NoError(t, store.rollbackName("app:latest", 2))
+	image, err := store.Get("app:latest")
+	require.NoError(t, err)
+	require.Equal(t, "first", image.ID)
+	history = store.NameHistory("app:latest")
+	require.Len(t, history, 4)
+	require.Equal(t, NameRolledBack, history[3].Operation)
+	require.Equal(t, "first", history[3].ImageID)
+
+	// Rolling back all of the changes removes the name.
+	require.NoError(t, store.rollbackName("app:latest", 4))
+	require.False(t, store.Exists("app:latest"))
+	require.Error(t, store.rollbackName("app:latest", 6))
+	require.Error(t, store.rollbackName("app:latest", 0))
+	require.Empty(t, store.NameHistory("no-such-name"))
+
+	// Deleting an image is recorded, and the history is still there after
+	// reloading the store.
+	require.NoError(t, store.updateNames("second", []string{"app:latest"}, setNames))
+	require.NoError(t, store.Delete("second"))
+	store.stopWriting()
+	store, err = newImageStore(dir)
+	require.NoError(t, err)
+	require.NoError(t, store.startReading())
+	history = store.NameHistory("app:latest")
+	store.stopReading()
+	require.Len(t, history, 7)
+	require.Equal(t, NameDeleted, history[6].Operation)
+	require.Equal(t, "second", history[6].PreviousImageID)
+
+	// A name can't be rolled back to an image which was deleted.
+	require.NoError(t, store.startWriting())
+	defer store.stopWriting()
+	require.ErrorIs(t, store.rollbackName("app:latest", 1), ErrImageUnknown)
+}
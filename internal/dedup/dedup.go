@@ -1,6 +1,7 @@
 package dedup
 
 import (
+	"context"
 	"crypto/sha256"
 	"encoding/binary"
 	"errors"
@@ -27,6 +28,9 @@ type DedupHashMethod int
 type DedupOptions struct {
 	// HashMethod is the hash function to use to find identical files
 	HashMethod DedupHashMethod
+
+	// Context, if set, stops deduplication, with an error, when it is cancelled
+	Context context.Context
 }
 
 type DedupResult struct {
@@ -80,12 +84,20 @@ func DedupDirs(dirs []string, options DedupOptions) (DedupResult, error) {
 		return res, err
 	}
 
+	ctx := options.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
 	for _, dir := range dirs {
 		logrus.Debugf("Deduping directory %s", dir)
 		if err := pwalkdir.Walk(dir, func(path string, d fs.DirEntry, err error) error {
 			if err != nil {
 				return err
 			}
+			if err := ctx.Err(); err != nil {
+				return err
+			}
 			if !d.Type().IsRegular() {
 				return nil
 			}
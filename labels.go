@@ -0,0 +1,208 @@
+package storage
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+)
+
+// labelRequirement is one of the comma-separated terms in a label selector.
+type labelRequirement struct {
+	key     string
+	value   string
+	exists  bool // The key must (or, if false, must not) be present.
+	equal   bool // The key's value must be value.
+	inequal bool // The key's value must not be value.
+}
+
+// labelSelector is a parsed label selector.  The empty selector matches
+// everything.
+type labelSelector []labelRequirement
+
+// parseLabelSelector parses a selector, which is a comma-separated list of
+// terms which must all match.  Each term is one of "key", which requires that
+// the label be set, "!key", which requires that it not be set, "key=value",
+// which requires that it be set to value, and "key!=value", which requires
+// that it not be set to value.  A backslash makes the character after it,
+// such as a ",", "=", "!", or another backslash, part of a key or value.
+func parseLabelSelector(selector string) (labelSelector, error) {
+	var parsed labelSelector
+	if strings.TrimSpace(selector) == "" {
+		return parsed, nil
+	}
+	rest := selector
+	for {
+		term := rest
+		comma := unescapedIndex(rest, ',')
+		if comma >= 0 {
+			term, rest = rest[:comma], rest[comma+1:]
+		}
+		term = strings.TrimSpace(term)
+		var req labelRequirement
+		rawKey, rawValue := term, ""
+		if eq := unescapedIndex(term, '='); eq >= 0 {
+			rawKey, rawValue = term[:eq], term[eq+1:]
+			if bang := unescapedIndex(rawKey, '!'); bang >= 0 && bang == len(rawKey)-1 {
+				rawKey = rawKey[:bang]
+				req.inequal = true
+			} else {
+				rawValue = strings.TrimPrefix(rawValue, "=")
+				req.exists = true
+				req.equal = true
+			}
+		} else if strings.HasPrefix(term, "!") {
+			rawKey = term[1:]
+		} else {
+			req.exists = true
+		}
+		rawKey = strings.TrimSpace(rawKey)
+		if rawKey == "" || unescapedIndex(rawKey, '!') >= 0 {
+			return nil, fmt.Errorf("invalid term %q in label selector %q", term, selector)
+		}
+		req.key = unescapeLabel(rawKey)
+		req.value = unescapeLabel(strings.TrimSpace(rawValue))
+		parsed = append(parsed, req)
+		if comma < 0 {
+			break
+		}
+	}
+	return parsed, nil
+}
+
+// unescapedIndex returns the index of the first instance of c in s which
+// isn't escaped with a backslash, or -1 if there isn't one.
+func unescapedIndex(s string, c byte) int {
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case c:
+			return i
+		}
+	}
+	return -1
+}
+
+// unescapeLabel removes the backslashes which escape characters in a key or
+// value in a label selector.
+func unescapeLabel(s string) string {
+	if !strings.Contains(s, "\\") {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			i++
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// matches returns true if labels satisfy every term in the selector.
+func (s labelSelector) matches(labels map[string]string) bool {
+	for _, req := range s {
+		value, ok := labels[req.key]
+		switch {
+		case req.equal:
+			if !ok || value != req.value {
+				return false
+			}
+		case req.inequal:
+			if ok && value == req.value {
+				return false
+			}
+		case ok != req.exists:
+			return false
+		}
+	}
+	return true
+}
+
+// labelIndex records which objects have which labels, by key and then by
+// value, so that selectors which require labels to be set don't have to be
+// checked against every object in a store.
+type labelIndex[T any] map[string]map[string][]*T
+
+// newLabelIndex builds an index of the labels of objects.
+func newLabelIndex[T any](objects []*T, labels func(*T) map[string]string) labelIndex[T] {
+	index := make(labelIndex[T])
+	for _, object := range objects {
+		index.add(object, labels(object))
+	}
+	return index
+}
+
+// add records that object has labels.
+func (x labelIndex[T]) add(object *T, labels map[string]string) {
+	for key, value := range labels {
+		values, ok := x[key]
+		if !ok {
+			values = make(map[string][]*T)
+			x[key] = values
+		}
+		values[value] = append(values[value], object)
+	}
+}
+
+// remove forgets that object has labels.
+func (x labelIndex[T]) remove(object *T, labels map[string]string) {
+	for key, value := range labels {
+		values := x[key]
+		objects := slices.DeleteFunc(values[value], func(candidate *T) bool {
+			return candidate == object
+		})
+		if len(objects) > 0 {
+			values[value] = objects
+			continue
+		}
+		delete(values, value)
+		if len(values) == 0 {
+			delete(x, key)
+		}
+	}
+}
+
+// candidates returns the objects which have the label which one of the terms
+// in selector requires, picking the term which narrows things down the most.
+// The objects still need to be checked against the whole selector.  It
+// returns false if none of the terms require a label to be set.
+func (x labelIndex[T]) candidates(selector labelSelector) ([]*T, bool) {
+	var best []*T
+	found := false
+	for _, req := range selector {
+		if !req.exists {
+			continue
+		}
+		var objects []*T
+		if req.equal {
+			objects = x[req.key][req.value]
+		} else {
+			values := x[req.key]
+			for _, value := range slices.Sorted(maps.Keys(values)) {
+				objects = append(objects, values[value]...)
+			}
+		}
+		if !found || len(objects) < len(best) {
+			best, found = objects, true
+		}
+	}
+	return best, found
+}
+
+// matching returns the objects in a store, whose full list is all, which match
+// selector, using the index to avoid checking all of them if it can.
+func (x labelIndex[T]) matching(selector labelSelector, all []*T, labels func(*T) map[string]string) []*T {
+	candidates, ok := x.candidates(selector)
+	if !ok {
+		candidates = all
+	}
+	var matched []*T
+	for _, object := range candidates {
+		if selector.matches(labels(object)) {
+			matched = append(matched, object)
+		}
+	}
+	return matched
+}
@@ -0,0 +1,96 @@
+package storage
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLabelSelector(t *testing.T) {
+	labels := map[string]string{"pipeline": "nightly", "arch": "amd64", "note": "a,b", "odd=key!": `back\slash`}
+	for _, c := range []struct {
+		selector string
+		matches  bool
+	}{
+		{"", true},
+		{"pipeline", true},
+		{"owner", false},
+		{"!owner", true},
+		{"!pipeline", false},
+		{"pipeline=nightly", true},
+		{"pipeline==nightly", true},
+		{"pipeline=weekly", false},
+		{"pipeline!=weekly", true},
+		{"pipeline!=nightly", false},
+		{"owner!=someone", true},
+		{"pipeline=nightly, arch=amd64", true},
+		{"pipeline=nightly,arch=arm64", false},
+		{`note=a\,b`, true},
+		{`note=a\,b,arch=amd64`, true},
+		{`note!=a\,b`, false},
+		{"note=a,b", false},
+		{`odd\=key\!`, true},
+		{`odd\=key\!=back\\slash`, true},
+		{`odd\=key\!!=back\\slash`, false},
+	} {
+		selector, err := parseLabelSelector(c.selector)
+		require.NoError(t, err, c.selector)
+		assert.Equal(t, c.matches, selector.matches(labels), c.selector)
+	}
+	for _, bad := range []string{"=value", "!", "a,,b", "!=value", "a!b"} {
+		_, err := parseLabelSelector(bad)
+		assert.Error(t, err, bad)
+	}
+}
+
+func TestLabelIndex(t *testing.T) {
+	type object struct {
+		name   string
+		labels map[string]string
+	}
+	labels := func(o *object) map[string]string { return o.labels }
+	first := &object{"first", map[string]string{"arch": "amd64", "pipeline": "nightly"}}
+	second := &object{"second", map[string]string{"arch": "arm64", "pipeline": "nightly"}}
+	third := &object{"third", nil}
+	all := []*object{first, second, third}
+	index := newLabelIndex(all, labels)
+
+	names := func(objects []*object) []string {
+		var names []string
+		for _, o := range objects {
+			names = append(names, o.name)
+		}
+		return names
+	}
+	for _, c := range []struct {
+		selector   string
+		candidates []string
+		indexed    bool
+		matching   []string
+	}{
+		{"", nil, false, []string{"first", "second", "third"}},
+		{"!arch", nil, false, []string{"third"}},
+		{"arch=amd64", []string{"first"}, true, []string{"first"}},
+		{"pipeline,arch=arm64", []string{"second"}, true, []string{"second"}},
+		{"pipeline,arch!=arm64", []string{"first", "second"}, true, []string{"first"}},
+		{"arch=s390x", nil, true, nil},
+	} {
+		selector, err := parseLabelSelector(c.selector)
+		require.NoError(t, err, c.selector)
+		candidates, indexed := index.candidates(selector)
+		assert.Equal(t, c.indexed, indexed, c.selector)
+		assert.Equal(t, c.candidates, names(candidates), c.selector)
+		assert.Equal(t, c.matching, names(index.matching(selector, all, labels)), c.selector)
+	}
+
+	index.remove(first, first.labels)
+	index.remove(second, second.labels)
+	second.labels = map[string]string{"arch": "amd64"}
+	index.add(second, second.labels)
+	selector, err := parseLabelSelector("arch=amd64")
+	require.NoError(t, err)
+	candidates, _ := index.candidates(selector)
+	assert.Equal(t, []string{"second"}, names(candidates))
+	assert.NotContains(t, index, "pipeline")
+}
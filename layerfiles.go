@@ -0,0 +1,406 @@
+package storage
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"iter"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"syscall"
+
+	"github.com/containers/storage/pkg/archive"
+	"github.com/containers/storage/pkg/chunked/toc"
+	"github.com/klauspost/pgzip"
+	"github.com/vbatts/tar-split/tar/storage"
+)
+
+// LayerPath describes the layer which determines whether or not a path is
+// present in an image, as returned by FindPath.
+type LayerPath struct {
+	// Layer is the ID of the topmost layer in the image which adds,
+	// modifies, or removes the path.
+	Layer string `json:"layer"`
+	// Whiteout is true if the layer removes the path, or hides the
+	// contents of a directory which contains it, rather than providing it.
+	Whiteout bool `json:"whiteout,omitempty"`
+	// Header describes the layer's entry for the path, if it provides it.
+	Header *tar.Header `json:"header,omitempty"`
+}
+
+// LayerFiles returns an iterator over the headers of the entries in a layer's
+// diff, read from the tar-split metadata which was recorded when the diff was
+// applied or, if there isn't any, from its zstd:chunked TOC.  The layer is not
+// mounted.
+func (s *store) LayerFiles(id string) (iter.Seq2[*tar.Header, error], error) {
+	type layerFileData struct {
+		tarSplit []byte
+		manifest []byte
+	}
+	data, done, err := readAllLayerStores(s, func(store roLayerStore) (layerFileData, bool, error) {
+		layer, err := store.Get(id)
+		if err != nil {
+			return layerFileData{}, false, nil
+		}
+		tarSplit, err := store.tarSplitData(layer.ID)
+		if err == nil {
+			return layerFileData{tarSplit: tarSplit}, true, nil
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return layerFileData{}, true, err
+		}
+		rc, err := store.BigData(layer.ID, toc.BigDataKey)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return layerFileData{}, true, fmt.Errorf("no file metadata was recorded for layer %q: %w", layer.ID, ErrNotSupported)
+			}
+			return layerFileData{}, true, err
+		}
+		defer rc.Close()
+		manifest, err := io.ReadAll(rc)
+		if err != nil {
+			return layerFileData{}, true, err
+		}
+		return layerFileData{manifest: manifest}, true, nil
+	})
+	if !done {
+		return nil, ErrLayerUnknown
+	}
+	if err != nil {
+		return nil, err
+	}
+	if data.tarSplit != nil {
+		return tarSplitHeaders(data.tarSplit), nil
+	}
+	headers, err := toc.Headers(data.manifest)
+	if err != nil {
+		return nil, err
+	}
+	return func(yield func(*tar.Header, error) bool) {
+		for _, hdr := range headers {
+			if !yield(hdr, nil) {
+				return
+			}
+		}
+	}, nil
+}
+
+// tarSplitReader reconstructs a layer diff from its tar-split metadata,
+// substituting zeros for the contents of files, which are not needed for
+// reading the headers.
+type tarSplitReader struct {
+	unpacker storage.Unpacker
+	pending  []byte
+	zeros    int64
+}
+
+func (t *tarSplitReader) Read(b []byte) (int, error) {
+	for len(t.pending) == 0 && t.zeros == 0 {
+		entry, err := t.unpacker.Next()
+		if err != nil {
+			return 0, err
+		}
+		switch entry.Type {
+		case storage.SegmentType:
+			t.pending = entry.Payload
+		case storage.FileType:
+			t.zeros = entry.Size
+		}
+	}
+	if len(t.pending) > 0 {
+		n := copy(b, t.pending)
+		t.pending = t.pending[n:]
+		return n, nil
+	}
+	n := min(int64(len(b)), t.zeros)
+	clear(b[:n])
+	t.zeros -= n
+	return int(n), nil
+}
+
+// tarSplitHeaders returns an iterator over the headers described by
+// compressed tar-split metadata.
+func tarSplitHeaders(data []byte) iter.Seq2[*tar.Header, error] {
+	return func(yield func(*tar.Header, error) bool) {
+		decompressor, err := pgzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			yield(nil, err)
+			return
+		}
+		defer decompressor.Close()
+		tr := tar.NewReader(&tarSplitReader{unpacker: storage.NewJSONUnpacker(decompressor)})
+		for {
+			hdr, err := tr.Next()
+			if err != nil {
+				if !errors.Is(err, io.EOF) {
+					yield(nil, err)
+				}
+				return
+			}
+			if !yield(hdr, nil) {
+				return
+			}
+		}
+	}
+}
+
+// layerIndex records the entries in one layer's diff, and the paths in its
+// parents which it hides.
+type layerIndex struct {
+	id        string
+	entries   map[string]*tar.Header
+	whiteouts map[string]struct{} // Paths removed from the parents.
+	opaque    map[string]struct{} // Directories whose contents in the parents are hidden.
+}
+
+// hides returns true if the layer hides p in its parents, either by removing
+// it or one of the directories which contain it, or by replacing a directory
+// which contains it with something else.
+func (l *layerIndex) hides(p string) bool {
+	if _, ok := l.whiteouts[p]; ok {
+		return true
+	}
+	for dir := p; dir != "/"; {
+		dir = path.Dir(dir)
+		if _, ok := l.opaque[dir]; ok {
+			return true
+		}
+		if dir == "/" {
+			break
+		}
+		if _, ok := l.whiteouts[dir]; ok {
+			return true
+		}
+		if hdr, ok := l.entries[dir]; ok && hdr.Typeflag != tar.TypeDir {
+			return true
+		}
+	}
+	return false
+}
+
+// layerChain is a layer and its parents, whose file lists are read as they
+// are needed.
+type layerChain struct {
+	s      *store
+	layers []*layerIndex
+	next   string // ID of the next layer to read, or "" after the bottom one.
+}
+
+// layerChainFrom returns a layerChain which starts with the specified layer.
+func (s *store) layerChainFrom(id string) (*layerChain, error) {
+	layer, err := s.Layer(id)
+	if err != nil {
+		return nil, err
+	}
+	return &layerChain{s: s, next: layer.ID}, nil
+}
+
+// at returns the i'th layer in the chain, counting down from the top, or nil
+// if the chain has fewer layers than that.
+func (c *layerChain) at(i int) (*layerIndex, error) {
+	for len(c.layers) <= i && c.next != "" {
+		layer, err := c.s.Layer(c.next)
+		if err != nil {
+			return nil, err
+		}
+		files, err := c.s.LayerFiles(layer.ID)
+		if err != nil {
+			return nil, err
+		}
+		index := &layerIndex{
+			id:        layer.ID,
+			entries:   make(map[string]*tar.Header),
+			whiteouts: make(map[string]struct{}),
+			opaque:    make(map[string]struct{}),
+		}
+		for hdr, err := range files {
+			if err != nil {
+				return nil, fmt.Errorf("reading file list of layer %q: %w", layer.ID, err)
+			}
+			name := path.Clean("/" + hdr.Name)
+			dir, base := path.Split(name)
+			dir = path.Clean(dir)
+			switch {
+			case base == archive.WhiteoutOpaqueDir:
+				index.opaque[dir] = struct{}{}
+			case strings.HasPrefix(base, archive.WhiteoutMetaPrefix):
+				// Other metadata entries don't hide anything.
+			case strings.HasPrefix(base, archive.WhiteoutPrefix):
+				index.whiteouts[path.Join(dir, strings.TrimPrefix(base, archive.WhiteoutPrefix))] = struct{}{}
+			default:
+				index.entries[name] = hdr
+			}
+		}
+		c.layers = append(c.layers, index)
+		c.next = layer.Parent
+	}
+	if i < len(c.layers) {
+		return c.layers[i], nil
+	}
+	return nil, nil
+}
+
+// find returns the topmost layer in the chain which provides or hides p, which
+// must be a cleaned absolute path, or nil if none of them do.  Symbolic links
+// are not followed.
+func (c *layerChain) find(p string) (*LayerPath, error) {
+	for i := 0; ; i++ {
+		layer, err := c.at(i)
+		if err != nil || layer == nil {
+			return nil, err
+		}
+		if hdr, ok := layer.entries[p]; ok {
+			return &LayerPath{Layer: layer.id, Header: hdr}, nil
+		}
+		if layer.hides(p) {
+			return &LayerPath{Layer: layer.id, Whiteout: true}, nil
+		}
+	}
+}
+
+// maxSymlinks is the number of symbolic links which resolve will follow before
+// giving up, matching the kernel's limit.
+const maxSymlinks = 40
+
+// resolve returns the layer which provides the file at filePath, following
+// symbolic links, both in the path's directories and at its end, as the
+// kernel would if the chain were mounted.
+func (c *layerChain) resolve(filePath string) (*LayerPath, error) {
+	components := strings.Split(path.Clean("/"+filePath), "/")
+	resolved := "/"
+	var found *LayerPath
+	links := 0
+	for len(components) > 0 {
+		component := components[0]
+		components = components[1:]
+		switch component {
+		case "", ".":
+			continue
+		case "..":
+			resolved = path.Dir(resolved)
+			found = nil
+			continue
+		}
+		candidate := path.Join(resolved, component)
+		var err error
+		if found, err = c.find(candidate); err != nil {
+			return nil, err
+		}
+		if found == nil || found.Whiteout {
+			return nil, fmt.Errorf("%q: %w", filePath, os.ErrNotExist)
+		}
+		switch found.Header.Typeflag {
+		case tar.TypeSymlink:
+			if links++; links > maxSymlinks {
+				return nil, fmt.Errorf("%q: %w", filePath, syscall.ELOOP)
+			}
+			target := found.Header.Linkname
+			if path.IsAbs(target) {
+				resolved = "/"
+			}
+			components = append(strings.Split(target, "/"), components...)
+			found = nil
+			continue
+		case tar.TypeDir:
+		default:
+			if len(components) > 0 {
+				return nil, fmt.Errorf("%q: %w", filePath, syscall.ENOTDIR)
+			}
+		}
+		resolved = candidate
+	}
+	if found == nil {
+		return nil, fmt.Errorf("%q: %w", filePath, syscall.EISDIR)
+	}
+	return found, nil
+}
+
+// FindPath reports which layer in an image's chain of layers provides a path,
+// or removes it.  If no layer mentions the path, the error wraps
+// os.ErrNotExist.
+func (s *store) FindPath(imageID, filePath string) (*LayerPath, error) {
+	image, err := s.Image(imageID)
+	if err != nil {
+		return nil, err
+	}
+	if image.TopLayer == "" {
+		return nil, fmt.Errorf("%q is not present in image %q, which has no layers: %w", filePath, image.ID, os.ErrNotExist)
+	}
+	chain, err := s.layerChainFrom(image.TopLayer)
+	if err != nil {
+		return nil, err
+	}
+	found, err := chain.find(path.Clean("/" + filePath))
+	if err != nil {
+		return nil, err
+	}
+	if found == nil {
+		return nil, fmt.Errorf("%q is not present in any layer of image %q: %w", filePath, image.ID, os.ErrNotExist)
+	}
+	return found, nil
+}
+
+// OpenLayerFile opens a regular file in the filesystem formed by a layer and
+// its parents, without mounting them.  Symbolic links are followed, but may not
+// point outside of the layer's filesystem.  The file's contents are read
+// directly from the driver's storage for the layer which provides it, so the
+// driver must implement drivers.DiffGetterDriver.  If the contents of the file
+// were deferred when its layer was pulled, they are retrieved first.
+func (s *store) OpenLayerFile(layerID, filePath string) (io.ReadCloser, error) {
+	chain, err := s.layerChainFrom(layerID)
+	if err != nil {
+		return nil, err
+	}
+	found, err := chain.resolve(filePath)
+	if err != nil {
+		return nil, err
+	}
+	// A hard link's target is always in the same layer, so the link can be
+	// read from that layer's storage using its own name.
+	if found.Header.Typeflag != tar.TypeReg && found.Header.Typeflag != tar.TypeLink {
+		return nil, fmt.Errorf("%q in layer %q is not a regular file", filePath, found.Layer)
+	}
+	layer, err := s.Layer(found.Layer)
+	if err != nil {
+		return nil, err
+	}
+	if slices.Contains(layer.BigDataNames, DeferredFilesBigDataKey) {
+		// The layer's copy of the file, which a hard link shares, may
+		// not have been retrieved yet.
+		name := found.Header.Name
+		if found.Header.Typeflag == tar.TypeLink {
+			name = found.Header.Linkname
+		}
+		if err := s.fetchDeferredFiles(layer.ID, []string{path.Clean("/" + name)}); err != nil {
+			return nil, err
+		}
+	}
+	rc, done, err := readAllLayerStores(s, func(store roLayerStore) (io.ReadCloser, bool, error) {
+		if !store.Exists(found.Layer) {
+			return nil, false, nil
+		}
+		rc, err := store.openFile(found.Layer, found.Header.Name)
+		return rc, true, err
+	})
+	if !done {
+		return nil, ErrLayerUnknown
+	}
+	return rc, err
+}
+
+// OpenImageFile opens a regular file in an image's filesystem without mounting
+// it.  It is otherwise like OpenLayerFile.
+func (s *store) OpenImageFile(imageID, filePath string) (io.ReadCloser, error) {
+	image, err := s.Image(imageID)
+	if err != nil {
+		return nil, err
+	}
+	if image.TopLayer == "" {
+		return nil, fmt.Errorf("%q is not present in image %q, which has no layers: %w", filePath, image.ID, os.ErrNotExist)
+	}
+	return s.OpenLayerFile(image.TopLayer, filePath)
+}
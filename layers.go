@@ -2,6 +2,7 @@ package storage
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -116,6 +117,11 @@ type Layer struct {
 	// should not be used for any decisions, maybe apart from heuristic user warnings.
 	MountCount int `json:"-"`
 
+	// mountOptions are the options which the layer was mounted with when
+	// it was first mounted at MountPoint, so that it can be mounted the
+	// same way again after being unmounted temporarily.
+	mountOptions *drivers.MountOpts
+
 	// Created is the datestamp for when this layer was created.  Older
 	// versions of the library did not track this information, so callers
 	// will likely want to use the IsZero() method to verify that a value
@@ -166,6 +172,15 @@ type Layer struct {
 	// Flags is arbitrary data about the layer.
 	Flags map[string]any `json:"flags,omitempty"`
 
+	// Labels are caller-specified key/value pairs which can be used to
+	// select layers.
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// Provenance records where the layer's contents were retrieved from,
+	// with one entry for each source reference, if the callers which
+	// created or reused the layer provided that information.
+	Provenance []LayerProvenance `json:"provenance,omitempty"`
+
 	// UIDMap and GIDMap are used for setting up a layer's contents
 	// for use inside of a user namespace where UID mapping is being used.
 	UIDMap []idtools.IDMap `json:"uidmap,omitempty"`
@@ -183,16 +198,56 @@ type Layer struct {
 	BigDataNames []string `json:"big-data-names,omitempty"`
 }
 
+// LayerProvenance describes where a layer's contents were retrieved from.
+type LayerProvenance struct {
+	// SourceReference is the reference, for example
+	// "registry.example.com/repo:tag", of the image which the layer was
+	// pulled as a part of.
+	SourceReference string `json:"source-reference,omitempty"`
+
+	// PulledAt is the time when the layer was pulled.
+	PulledAt *time.Time `json:"pulled-at,omitempty"`
+
+	// MediaType is the media type of the blob which the layer was
+	// created from, as it was recorded in the image's manifest.
+	MediaType string `json:"media-type,omitempty"`
+
+	// SignatureDigest is the digest of the signature which was verified
+	// for the image when the layer was pulled.
+	SignatureDigest digest.Digest `json:"signature-digest,omitempty"`
+}
+
+// copyLayerProvenance returns a deep copy of p.
+func copyLayerProvenance(p []LayerProvenance) []LayerProvenance {
+	if p == nil {
+		return nil
+	}
+	c := make([]LayerProvenance, len(p))
+	for i := range p {
+		c[i] = p[i]
+		if p[i].PulledAt != nil {
+			pulledAt := *p[i].PulledAt
+			c[i].PulledAt = &pulledAt
+		}
+	}
+	return c
+}
+
 type layerMountPoint struct {
-	ID         string `json:"id"`
-	MountPoint string `json:"path"`
-	MountCount int    `json:"count"`
+	ID         string             `json:"id"`
+	MountPoint string             `json:"path"`
+	MountCount int                `json:"count"`
+	Options    *drivers.MountOpts `json:"options,omitempty"`
 }
 
 // DiffOptions override the default behavior of Diff() methods.
 type DiffOptions struct {
 	// Compression, if set overrides the default compressor when generating a diff.
 	Compression *archive.Compression
+	// Progress, if set, is called from another goroutine as entries in the
+	// diff are read, with totals for the uncompressed diff.  It is not
+	// called if the diff is read directly from an additional layer store.
+	Progress archive.ProgressFunc
 }
 
 // stagedLayerOptions are the options passed to .create to populate a staged
@@ -216,6 +271,16 @@ type roLayerStore interface {
 	// stopReading releases locks obtained by startReading.
 	stopReading()
 
+	// changedSince checks if the on-disk state of the store was modified
+	// since the point described by previous, and returns a value which
+	// describes the current state, for use in later calls.  If previous
+	// is nil, the state is always treated as modified.
+	changedSince(previous *storeWriteMarker) (storeWriteMarker, bool, error)
+
+	// bigDataMarker returns a value which changes whenever the big data
+	// item with the specified key is rewritten.
+	bigDataMarker(id, key string) (string, error)
+
 	// Exists checks if a layer with the specified name or ID is known.
 	Exists(id string) bool
 
@@ -230,12 +295,14 @@ type roLayerStore interface {
 	// (Path) and a description of what sort of change (Kind) was made by the
 	// layer (either ChangeModify, ChangeAdd, or ChangeDelete), relative to a
 	// specified layer.  By default, the layer's parent is used as a reference.
+	// Any other layer in the store can be used instead.
 	Changes(from, to string) ([]archive.Change, error)
 
 	// Diff produces a tarstream which can be applied to a layer with the contents
 	// of the first layer to produce a layer with the contents of the second layer.
 	// By default, the parent of the second layer is used as the first
-	// layer, so it need not be specified.  Options can be used to override
+	// layer, so it need not be specified, but any other layer in the store
+	// can be used instead.  Options can be used to override
 	// default behavior, but are also not required.
 	Diff(from, to string, options *DiffOptions) (io.ReadCloser, error)
 
@@ -243,6 +310,26 @@ type roLayerStore interface {
 	// produced by Diff.
 	DiffSize(from, to string) (int64, error)
 
+	// flattenedDiff produces an uncompressed tarstream which can be applied
+	// on top of the from layer, which must be an ancestor of the to layer,
+	// to produce a layer with the contents of the to layer.  If from is "",
+	// the tarstream contains all of the to layer's contents.
+	flattenedDiff(from, to string) (io.ReadCloser, error)
+
+	// tarSplitData returns the compressed tar-split metadata which was
+	// recorded when the layer's diff was applied.  The error wraps
+	// os.ErrNotExist if none was recorded.
+	tarSplitData(id string) ([]byte, error)
+
+	// openFile opens a file in the layer's diff, without mounting it, using
+	// the name recorded for it in the diff.  The driver must implement
+	// drivers.DiffGetterDriver.
+	openFile(id, name string) (io.ReadCloser, error)
+
+	// ReadWriteDiskUsage returns the disk space used by the layer's own
+	// contents, not counting those of its parents.
+	ReadWriteDiskUsage(id string) (int64, error)
+
 	// Size produces a cached value for the uncompressed size of the layer,
 	// if one is known, or -1 if it is not known.  If the layer can not be
 	// found, it returns an error.
@@ -262,6 +349,9 @@ type roLayerStore interface {
 
 	// Layers returns a slice of the known layers.
 	Layers() ([]Layer, error)
+
+	// layersMatching returns the known layers whose labels match selector.
+	layersMatching(selector labelSelector) []Layer
 }
 
 // rwLayerStore wraps a graph driver, adding the ability to refer to layers by
@@ -288,7 +378,7 @@ type rwLayerStore interface {
 	// underlying drivers do not themselves distinguish between writeable
 	// and read-only layers.  Returns the new layer structure and the size of the
 	// diff which was applied to its parent to initialize its contents.
-	create(id string, parent *Layer, names []string, mountLabel string, options map[string]string, moreOptions *LayerOptions, writeable bool, diff io.Reader, slo *stagedLayerOptions) (*Layer, int64, error)
+	create(ctx context.Context, id string, parent *Layer, names []string, mountLabel string, options map[string]string, moreOptions *LayerOptions, writeable bool, diff io.Reader, slo *stagedLayerOptions) (*Layer, int64, error)
 
 	// updateNames modifies names associated with a layer based on (op, names).
 	updateNames(id string, names []string, op updateNameOperation) error
@@ -311,6 +401,11 @@ type rwLayerStore interface {
 	// The mappings used by the container can be specified.
 	Mount(id string, options drivers.MountOpts) (string, error)
 
+	// unmountAll unmounts a layer, however many times it is mounted, and
+	// returns how many times that was and the options it was first mounted
+	// with, so that it can be mounted again the same way.
+	unmountAll(id string) (int, *drivers.MountOpts, error)
+
 	// unmount unmounts a layer when it is no longer in use.
 	// If conditional is set, it will fail with ErrLayerNotMounted if the layer is not mounted (without conditional, the caller is
 	// making a promise that the layer is actually mounted).
@@ -330,7 +425,12 @@ type rwLayerStore interface {
 
 	// ApplyDiff reads a tarstream which was created by a previous call to Diff and
 	// applies its changes to a specified layer.
-	ApplyDiff(to string, diff io.Reader) (int64, error)
+	ApplyDiff(ctx context.Context, to string, options *LayerOptions, diff io.Reader) (int64, error)
+
+	// resetContents discards the contents of a layer which has never had a
+	// diff applied to it, leaving it as it was when it was created.
+	// Caller MUST call all returned cleanup functions outside of the locks.
+	resetContents(id string, writeable bool) ([]tempdir.CleanupTempDirFunc, error)
 
 	// applyDiffWithDifferNoLock applies the changes through the differ callback function.
 	applyDiffWithDifferNoLock(options *drivers.ApplyDiffWithDifferOpts, differ drivers.Differ) (*drivers.DriverWithDifferOutput, error)
@@ -344,6 +444,15 @@ type rwLayerStore interface {
 	// DifferTarget gets the location where files are stored for the layer.
 	DifferTarget(id string) (string, error)
 
+	// addProvenance records where the layer's contents were retrieved
+	// from, replacing any entry for the same source reference.
+	addProvenance(id string, provenance LayerProvenance) error
+
+	// recordUncompressedDigest computes and records the digest of the
+	// layer's diff, if it has a tar-split and its UncompressedDigest is
+	// not already known.
+	recordUncompressedDigest(id string) error
+
 	// PutAdditionalLayer creates a layer using the diff contained in the additional layer
 	// store.
 	// This API is experimental and can be changed without bumping the major version number.
@@ -354,6 +463,15 @@ type rwLayerStore interface {
 
 	// Dedup deduplicates layers in the store.
 	dedup(drivers.DedupArgs) (drivers.DedupResult, error)
+
+	// setQuota limits the disk space and inodes which a layer can use.
+	// The driver must implement drivers.QuotaDriver.
+	setQuota(id string, size, inodes uint64) error
+
+	// getQuota returns the limits on the disk space and inodes which a
+	// layer can use, and its current usage.  The driver must implement
+	// drivers.QuotaDriver.
+	getQuota(id string) (*drivers.LayerQuota, error)
 }
 
 type multipleLockFile struct {
@@ -439,6 +557,7 @@ type layerStore struct {
 	bycompressedsum     map[digest.Digest][]string
 	byuncompressedsum   map[digest.Digest][]string
 	bytocsum            map[digest.Digest][]string
+	bylabel             labelIndex[Layer]
 	layerspathsModified [numLayerLocationIndex]time.Time
 
 	// FIXME: This field is only set when constructing layerStore, but locking rules of the driver
@@ -466,6 +585,8 @@ func copyLayer(l *Layer) *Layer {
 		location:           l.location,
 		BigDataNames:       copySlicePreferringNil(l.BigDataNames),
 		Flags:              copyMapPreferringNil(l.Flags),
+		Labels:             copyMapPreferringNil(l.Labels),
+		Provenance:         copyLayerProvenance(l.Provenance),
 		UIDMap:             copySlicePreferringNil(l.UIDMap),
 		GIDMap:             copySlicePreferringNil(l.GIDMap),
 		UIDs:               copySlicePreferringNil(l.UIDs),
@@ -741,6 +862,54 @@ func (r *layerStore) reloadMountsIfChanged() error {
 	return nil
 }
 
+// changedSince checks if the on-disk state of the store (layers or mounts) was
+// modified since the point described by previous.
+//
+// Requires startReading or startWriting.
+func (r *layerStore) changedSince(previous *storeWriteMarker) (storeWriteMarker, bool, error) {
+	var current storeWriteMarker
+	var modified bool
+	var err error
+	if previous == nil {
+		current.data, err = r.lockfile.GetLastWrite()
+		modified = true
+	} else {
+		current.data, modified, err = r.lockfile.ModifiedSince(previous.data)
+	}
+	if err != nil {
+		return storeWriteMarker{}, false, err
+	}
+	if r.lockfile.IsReadWrite() {
+		r.mountsLockfile.RLock()
+		defer r.mountsLockfile.Unlock()
+		mountsModified := true
+		if previous == nil {
+			current.mounts, err = r.mountsLockfile.GetLastWrite()
+		} else {
+			current.mounts, mountsModified, err = r.mountsLockfile.ModifiedSince(previous.mounts)
+		}
+		if err != nil {
+			return storeWriteMarker{}, false, err
+		}
+		modified = modified || mountsModified
+	}
+	return current, modified, nil
+}
+
+func layerLabels(layer *Layer) map[string]string {
+	return layer.Labels
+}
+
+// Requires startReading or startWriting.
+func (r *layerStore) layersMatching(selector labelSelector) []Layer {
+	matched := r.bylabel.matching(selector, r.layers, layerLabels)
+	layers := make([]Layer, len(matched))
+	for i := range matched {
+		layers[i] = *copyLayer(matched[i])
+	}
+	return layers
+}
+
 // Requires startReading or startWriting.
 func (r *layerStore) Layers() ([]Layer, error) {
 	layers := make([]Layer, len(r.layers))
@@ -908,6 +1077,7 @@ func (r *layerStore) load(lockedForWriting bool) (bool, error) {
 	r.bycompressedsum = compressedsums
 	r.byuncompressedsum = uncompressedsums
 	r.bytocsum = tocsums
+	r.bylabel = newLabelIndex(layers, layerLabels)
 
 	// Load and merge information about which layers are mounted, and where.
 	if r.lockfile.IsReadWrite() {
@@ -1005,6 +1175,7 @@ func (r *layerStore) loadMounts() error {
 	for _, layer := range r.layers {
 		layer.MountPoint = ""
 		layer.MountCount = 0
+		layer.mountOptions = nil
 	}
 	// All of the non-zero count values will have been encoded, so
 	// we reset the still-mounted ones based on the contents.
@@ -1014,6 +1185,7 @@ func (r *layerStore) loadMounts() error {
 				mounts[mount.MountPoint] = layer
 				layer.MountPoint = mount.MountPoint
 				layer.MountCount = mount.MountCount
+				layer.mountOptions = mount.Options
 			}
 		}
 	}
@@ -1109,6 +1281,7 @@ func (r *layerStore) saveMounts() error {
 				ID:         layer.ID,
 				MountPoint: layer.MountPoint,
 				MountCount: layer.MountCount,
+				Options:    layer.mountOptions,
 			})
 		}
 	}
@@ -1188,6 +1361,7 @@ func (s *store) newLayerStore(rundir, layerdir, imagedir string, driver drivers.
 		byid:    make(map[string]*Layer),
 		byname:  make(map[string]*Layer),
 		bymount: make(map[string]*Layer),
+		bylabel: make(labelIndex[Layer]),
 
 		driver: driver,
 	}
@@ -1226,6 +1400,7 @@ func newROLayerStore(rundir string, layerdir string, driver drivers.Driver) (roL
 		byid:    make(map[string]*Layer),
 		byname:  make(map[string]*Layer),
 		bymount: make(map[string]*Layer),
+		bylabel: make(labelIndex[Layer]),
 
 		driver: driver,
 	}
@@ -1349,6 +1524,7 @@ func (r *layerStore) PutAdditionalLayer(id string, parentLayer *Layer, names []s
 	for _, name := range names { // names got from the additional layer store won't be used
 		r.byname[name] = layer
 	}
+	r.bylabel.add(layer, layer.Labels)
 	if layer.CompressedDigest != "" {
 		r.bycompressedsum[layer.CompressedDigest] = append(r.bycompressedsum[layer.CompressedDigest], layer.ID)
 	}
@@ -1379,7 +1555,7 @@ func (r *layerStore) pickStoreLocation(volatile, writeable bool) layerLocations
 }
 
 // Requires startWriting.
-func (r *layerStore) create(id string, parentLayer *Layer, names []string, mountLabel string, options map[string]string, moreOptions *LayerOptions, writeable bool, diff io.Reader, slo *stagedLayerOptions) (layer *Layer, size int64, err error) {
+func (r *layerStore) create(ctx context.Context, id string, parentLayer *Layer, names []string, mountLabel string, options map[string]string, moreOptions *LayerOptions, writeable bool, diff io.Reader, slo *stagedLayerOptions) (layer *Layer, size int64, err error) {
 	if moreOptions == nil {
 		moreOptions = &LayerOptions{}
 	}
@@ -1467,6 +1643,8 @@ func (r *layerStore) create(id string, parentLayer *Layer, names []string, mount
 		UIDs:               templateUIDs,
 		GIDs:               templateGIDs,
 		Flags:              newMapFrom(moreOptions.Flags),
+		Labels:             copyMapPreferringNil(moreOptions.Labels),
+		Provenance:         copyLayerProvenance(moreOptions.Provenance),
 		UIDMap:             copySlicePreferringNil(moreOptions.UIDMap),
 		GIDMap:             copySlicePreferringNil(moreOptions.GIDMap),
 		BigDataNames:       []string{},
@@ -1484,6 +1662,7 @@ func (r *layerStore) create(id string, parentLayer *Layer, names []string, mount
 	for _, name := range names {
 		r.byname[name] = layer
 	}
+	r.bylabel.add(layer, layer.Labels)
 
 	cleanupFailureContext := ""
 	defer func() {
@@ -1569,7 +1748,7 @@ func (r *layerStore) create(id string, parentLayer *Layer, names []string, mount
 
 	size = -1
 	if diff != nil {
-		if size, err = r.applyDiffWithOptions(layer.ID, moreOptions, diff); err != nil {
+		if size, err = r.applyDiffWithOptions(ctx, layer.ID, moreOptions, diff); err != nil {
 			cleanupFailureContext = "applying layer diff"
 			return nil, -1, err
 		}
@@ -1670,6 +1849,10 @@ func (r *layerStore) Mount(id string, options drivers.MountOpts) (string, error)
 			delete(r.bymount, layer.MountPoint)
 		}
 		layer.MountPoint = filepath.Clean(mountpoint)
+		if layer.MountCount == 0 || layer.mountOptions == nil {
+			options.Options = slices.Clone(options.Options)
+			layer.mountOptions = &options
+		}
 		layer.MountCount++
 		r.bymount[layer.MountPoint] = layer
 		err = r.saveMounts()
@@ -1718,11 +1901,40 @@ func (r *layerStore) unmount(id string, force bool, conditional bool) (bool, err
 		}
 		layer.MountCount--
 		layer.MountPoint = ""
+		layer.mountOptions = nil
 		return false, r.saveMounts()
 	}
 	return true, err
 }
 
+// Requires startWriting.
+func (r *layerStore) unmountAll(id string) (int, *drivers.MountOpts, error) {
+	r.mountsLockfile.Lock()
+	if err := r.reloadMountsIfChanged(); err != nil {
+		r.mountsLockfile.Unlock()
+		return 0, nil, err
+	}
+	layer, ok := r.lookup(id)
+	if !ok {
+		r.mountsLockfile.Unlock()
+		return 0, nil, ErrLayerUnknown
+	}
+	mounts, options := layer.MountCount, layer.mountOptions
+	r.mountsLockfile.Unlock()
+	if mounts == 0 {
+		return 0, nil, nil
+	}
+	if options == nil {
+		// The layer was mounted by a version of this library which
+		// didn't record how.
+		options = &drivers.MountOpts{MountLabel: layer.MountLabel}
+	}
+	if _, err := r.unmount(id, true, false); err != nil {
+		return 0, nil, err
+	}
+	return mounts, options, nil
+}
+
 // Requires startReading or startWriting.
 func (r *layerStore) ParentOwners(id string) (uids, gids []int, err error) {
 	if !r.lockfile.IsReadWrite() {
@@ -1894,9 +2106,29 @@ func (r *layerStore) setBigData(layer *Layer, key string, data io.Reader) error
 		layer.BigDataNames = append(layer.BigDataNames, key)
 		return r.saveFor(layer)
 	}
+	// The list of items didn't change, but record the write anyway, so that
+	// watchers notice that the item did.
+	lw, err := r.lockfile.RecordWrite()
+	if err != nil {
+		return err
+	}
+	r.lastWrite = lw
 	return nil
 }
 
+// Requires startReading or startWriting.
+func (r *layerStore) bigDataMarker(id, key string) (string, error) {
+	layer, ok := r.lookup(id)
+	if !ok {
+		return "", fmt.Errorf("locating layer with ID %q: %w", id, ErrLayerUnknown)
+	}
+	st, err := os.Stat(r.datapath(layer.ID, key))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d:%d", st.Size(), st.ModTime().UnixNano()), nil
+}
+
 // Requires startReading or startWriting.
 func (r *layerStore) BigDataNames(id string) ([]string, error) {
 	layer, ok := r.lookup(id)
@@ -1926,6 +2158,75 @@ func (r *layerStore) SetMetadata(id, metadata string) error {
 	return ErrLayerUnknown
 }
 
+// Requires startWriting.
+func (r *layerStore) SetLabels(id string, labels map[string]string) error {
+	if !r.lockfile.IsReadWrite() {
+		return fmt.Errorf("not allowed to modify layer labels at %q: %w", r.layerdir, ErrStoreIsReadOnly)
+	}
+	if layer, ok := r.lookup(id); ok {
+		r.bylabel.remove(layer, layer.Labels)
+		layer.Labels = copyMapPreferringNil(labels)
+		r.bylabel.add(layer, layer.Labels)
+		return r.saveFor(layer)
+	}
+	return ErrLayerUnknown
+}
+
+// Requires startWriting.
+func (r *layerStore) addProvenance(id string, provenance LayerProvenance) error {
+	if !r.lockfile.IsReadWrite() {
+		return fmt.Errorf("not allowed to modify layer provenance at %q: %w", r.layerdir, ErrStoreIsReadOnly)
+	}
+	layer, ok := r.lookup(id)
+	if !ok {
+		return ErrLayerUnknown
+	}
+	entry := copyLayerProvenance([]LayerProvenance{provenance})[0]
+	if i := slices.IndexFunc(layer.Provenance, func(p LayerProvenance) bool {
+		return p.SourceReference == provenance.SourceReference
+	}); i != -1 {
+		layer.Provenance[i] = entry
+	} else {
+		layer.Provenance = append(layer.Provenance, entry)
+	}
+	return r.saveFor(layer)
+}
+
+// Requires startReading or startWriting.
+func (r *layerStore) tarSplitData(id string) ([]byte, error) {
+	layer, ok := r.lookup(id)
+	if !ok {
+		return nil, ErrLayerUnknown
+	}
+	return os.ReadFile(r.tspath(layer.ID))
+}
+
+// Requires startReading or startWriting.
+func (r *layerStore) openFile(id, name string) (io.ReadCloser, error) {
+	layer, ok := r.lookup(id)
+	if !ok {
+		return nil, ErrLayerUnknown
+	}
+	getter, ok := r.driver.(drivers.DiffGetterDriver)
+	if !ok {
+		return nil, fmt.Errorf("reading files from layers without mounting them with the %q driver: %w", r.driver.String(), ErrNotSupported)
+	}
+	fgc, err := getter.DiffGetter(layer.ID)
+	if err != nil {
+		return nil, err
+	}
+	if fgc == nil {
+		return nil, fmt.Errorf("reading files from layer %q without mounting it: %w", layer.ID, ErrNotSupported)
+	}
+	rc, err := fgc.Get(name)
+	if err != nil {
+		return nil, errors.Join(err, fgc.Close())
+	}
+	return ioutils.NewReadCloserWrapper(rc, func() error {
+		return errors.Join(rc.Close(), fgc.Close())
+	}), nil
+}
+
 func (r *layerStore) tspath(id string) string {
 	return filepath.Join(r.layerdir, id+tarSplitSuffix)
 }
@@ -1990,6 +2291,7 @@ func (r *layerStore) internalDelete(id string) ([]tempdir.CleanupTempDirFunc, er
 	for _, name := range layer.Names {
 		delete(r.byname, name)
 	}
+	r.bylabel.remove(layer, layer.Labels)
 	// This can only fail if the ID is already missing, which shouldn’t
 	// happen — and in that case the index is already in the desired state
 	// anyway.  The store’s Delete method is used on various paths to
@@ -2126,6 +2428,11 @@ func (r *layerStore) findParentAndLayer(from, to string) (fromID string, toID st
 		if ok {
 			from = fromLayer.ID
 		} else {
+			if from != toLayer.Parent {
+				// The layer's parent can be in another store, but
+				// other layers must be in this one.
+				return "", "", nil, nil, fmt.Errorf("locating layer %q to compare with %q: %w", from, to, ErrLayerUnknown)
+			}
 			fromLayer, ok = r.lookup(toLayer.Parent)
 			if ok {
 				from = fromLayer.ID
@@ -2135,6 +2442,17 @@ func (r *layerStore) findParentAndLayer(from, to string) (fromID string, toID st
 	return from, to, fromLayer, toLayer, nil
 }
 
+// fullDiffDriver returns a driver which compares the complete contents of two
+// layers, for use when one isn't the other's parent.  The driver's own Diff,
+// DiffSize, and Changes methods may only be able to compare a layer with its
+// parent.
+func (r *layerStore) fullDiffDriver(from string, toLayer *Layer) drivers.DiffDriver {
+	if from == toLayer.Parent {
+		return r.driver
+	}
+	return drivers.NewNaiveDiffDriver(r.driver, drivers.NewNaiveLayerIDMapUpdater(r.driver))
+}
+
 // The caller must hold r.inProcessLock for reading.
 func (r *layerStore) layerMappings(layer *Layer) *idtools.IDMappings {
 	if layer == nil {
@@ -2152,7 +2470,7 @@ func (r *layerStore) Changes(from, to string) ([]archive.Change, error) {
 	if err != nil {
 		return nil, ErrLayerUnknown
 	}
-	return r.driver.Changes(to, r.layerMappings(toLayer), from, r.layerMappings(fromLayer), toLayer.MountLabel)
+	return r.fullDiffDriver(from, toLayer).Changes(to, r.layerMappings(toLayer), from, r.layerMappings(fromLayer), toLayer.MountLabel)
 }
 
 type simpleGetCloser struct {
@@ -2232,6 +2550,19 @@ func (r *layerStore) Diff(from, to string, options *DiffOptions) (io.ReadCloser,
 		compression = *options.Compression
 	}
 	maybeCompressReadCloser := func(rc io.ReadCloser) (io.ReadCloser, error) {
+		// If progress reports were requested, watch the uncompressed
+		// data go by.
+		if options != nil && options.Progress != nil {
+			progress, err := archive.NewProgressReader(rc, options.Progress)
+			if err != nil {
+				rc.Close()
+				return nil, err
+			}
+			uncompressed := rc
+			rc = ioutils.NewReadCloserWrapper(progress, func() error {
+				return closeAll(progress.Close, uncompressed.Close)
+			})
+		}
 		// Depending on whether or not compression is desired, return either the
 		// passed-in ReadCloser, or a new one that provides its readers with a
 		// compressed version of the data that the original would have provided
@@ -2252,7 +2583,7 @@ func (r *layerStore) Diff(from, to string, options *DiffOptions) (io.ReadCloser,
 	}
 
 	if from != toLayer.Parent {
-		diff, err := r.driver.Diff(to, r.layerMappings(toLayer), from, r.layerMappings(fromLayer), toLayer.MountLabel)
+		diff, err := r.fullDiffDriver(from, toLayer).Diff(to, r.layerMappings(toLayer), from, r.layerMappings(fromLayer), toLayer.MountLabel)
 		if err != nil {
 			return nil, err
 		}
@@ -2364,6 +2695,71 @@ func (r *layerStore) Diff(from, to string, options *DiffOptions) (io.ReadCloser,
 	return maybeCompressReadCloser(rc)
 }
 
+// Requires startReading or startWriting.
+func (r *layerStore) flattenedDiff(from, to string) (io.ReadCloser, error) {
+	toLayer, ok := r.lookup(to)
+	if !ok {
+		return nil, ErrLayerUnknown
+	}
+	if from == "" {
+		return r.driver.Diff(toLayer.ID, r.layerMappings(toLayer), "", nil, toLayer.MountLabel)
+	}
+	fromLayer, ok := r.lookup(from)
+	if !ok {
+		return nil, ErrLayerUnknown
+	}
+	for ancestor := toLayer.Parent; ancestor != fromLayer.ID; {
+		layer, ok := r.lookup(ancestor)
+		if !ok {
+			return nil, fmt.Errorf("layer %q is not an ancestor of layer %q: %w", fromLayer.ID, toLayer.ID, ErrLayerUnknown)
+		}
+		ancestor = layer.Parent
+	}
+	// Diff would otherwise compress the result the same way that the to
+	// layer's diff was compressed when it was applied.
+	compression := archive.Uncompressed
+	return r.Diff(fromLayer.ID, toLayer.ID, &DiffOptions{Compression: &compression})
+}
+
+// Requires startReading or startWriting.
+func (r *layerStore) ReadWriteDiskUsage(id string) (int64, error) {
+	layer, ok := r.lookup(id)
+	if !ok {
+		return -1, ErrLayerUnknown
+	}
+	usage, err := r.driver.ReadWriteDiskUsage(layer.ID)
+	if err != nil {
+		return -1, err
+	}
+	return usage.Size, nil
+}
+
+// Requires startWriting.
+func (r *layerStore) setQuota(id string, size, inodes uint64) error {
+	qdriver, ok := r.driver.(drivers.QuotaDriver)
+	if !ok {
+		return fmt.Errorf("%s driver: %w", r.driver.String(), ErrQuotaNotSupported)
+	}
+	layer, ok := r.lookup(id)
+	if !ok {
+		return ErrLayerUnknown
+	}
+	return qdriver.SetQuota(layer.ID, size, inodes)
+}
+
+// Requires startReading or startWriting.
+func (r *layerStore) getQuota(id string) (*drivers.LayerQuota, error) {
+	qdriver, ok := r.driver.(drivers.QuotaDriver)
+	if !ok {
+		return nil, fmt.Errorf("%s driver: %w", r.driver.String(), ErrQuotaNotSupported)
+	}
+	layer, ok := r.lookup(id)
+	if !ok {
+		return nil, ErrLayerUnknown
+	}
+	return qdriver.GetQuota(layer.ID)
+}
+
 // Requires startReading or startWriting.
 func (r *layerStore) DiffSize(from, to string) (size int64, err error) {
 	var fromLayer, toLayer *Layer
@@ -2371,7 +2767,7 @@ func (r *layerStore) DiffSize(from, to string) (size int64, err error) {
 	if err != nil {
 		return -1, ErrLayerUnknown
 	}
-	return r.driver.DiffSize(to, r.layerMappings(toLayer), from, r.layerMappings(fromLayer), toLayer.MountLabel)
+	return r.fullDiffDriver(from, toLayer).DiffSize(to, r.layerMappings(toLayer), from, r.layerMappings(fromLayer), toLayer.MountLabel)
 }
 
 func updateDigestMap(m *map[digest.Digest][]string, oldvalue, newvalue digest.Digest, id string) {
@@ -2394,12 +2790,69 @@ func updateDigestMap(m *map[digest.Digest][]string, oldvalue, newvalue digest.Di
 }
 
 // Requires startWriting.
-func (r *layerStore) ApplyDiff(to string, diff io.Reader) (size int64, err error) {
-	return r.applyDiffWithOptions(to, nil, diff)
+func (r *layerStore) ApplyDiff(ctx context.Context, to string, options *LayerOptions, diff io.Reader) (size int64, err error) {
+	return r.applyDiffWithOptions(ctx, to, options, diff)
+}
+
+// Requires startWriting.
+// Caller MUST run all returned cleanup functions after this, EVEN IF the function returns an error.
+// Ideally outside of the startWriting.
+func (r *layerStore) resetContents(id string, writeable bool) ([]tempdir.CleanupTempDirFunc, error) {
+	if !r.lockfile.IsReadWrite() {
+		return nil, fmt.Errorf("not allowed to modify layer contents at %q: %w", r.layerdir, ErrStoreIsReadOnly)
+	}
+	layer, ok := r.lookup(id)
+	if !ok {
+		return nil, ErrLayerUnknown
+	}
+	if layer.MountCount > 0 {
+		return nil, fmt.Errorf("resetting contents of layer %q: %w", layer.ID, ErrLayerMounted)
+	}
+	var parentLayer *Layer
+	if layer.Parent != "" {
+		if parentLayer, ok = r.lookup(layer.Parent); !ok {
+			return nil, fmt.Errorf("locating parent %q of layer %q: %w", layer.Parent, layer.ID, ErrLayerUnknown)
+		}
+	}
+	tempDirectory, err := tempdir.NewTempDir(filepath.Join(r.layerdir, tempDirPath))
+	if err != nil {
+		return nil, err
+	}
+	cleanFunctions := []tempdir.CleanupTempDirFunc{tempDirectory.Cleanup}
+	if err := tempDirectory.StageDeletion(r.tspath(layer.ID)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return cleanFunctions, err
+	}
+	cleanFunc, err := r.driver.DeferredRemove(layer.ID)
+	cleanFunctions = append(cleanFunctions, cleanFunc)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return cleanFunctions, err
+	}
+	idMappings := r.layerMappings(layer)
+	opts := drivers.CreateOpts{
+		MountLabel: layer.MountLabel,
+		IDMappings: idMappings,
+	}
+	if writeable {
+		err = r.driver.CreateReadWrite(layer.ID, layer.Parent, &opts)
+	} else {
+		err = r.driver.Create(layer.ID, layer.Parent, &opts)
+	}
+	if err != nil {
+		return cleanFunctions, fmt.Errorf("recreating layer %q: %w", layer.ID, err)
+	}
+	if parentLayer != nil {
+		parentMappings := r.layerMappings(parentLayer)
+		if !reflect.DeepEqual(parentMappings.UIDs(), idMappings.UIDs()) || !reflect.DeepEqual(parentMappings.GIDs(), idMappings.GIDs()) {
+			if err := r.driver.UpdateLayerIDMap(layer.ID, parentMappings, idMappings, layer.MountLabel); err != nil {
+				return cleanFunctions, err
+			}
+		}
+	}
+	return cleanFunctions, nil
 }
 
 // Requires startWriting.
-func (r *layerStore) applyDiffWithOptions(to string, layerOptions *LayerOptions, diff io.Reader) (size int64, err error) {
+func (r *layerStore) applyDiffWithOptions(ctx context.Context, to string, layerOptions *LayerOptions, diff io.Reader) (size int64, err error) {
 	if !r.lockfile.IsReadWrite() {
 		return -1, fmt.Errorf("not allowed to modify layer contents at %q: %w", r.layerdir, ErrStoreIsReadOnly)
 	}
@@ -2409,6 +2862,8 @@ func (r *layerStore) applyDiffWithOptions(to string, layerOptions *LayerOptions,
 		return -1, ErrLayerUnknown
 	}
 
+	diff = ioutils.NewContextReader(ctx, diff)
+
 	header := make([]byte, 10240)
 	n, err := diff.Read(header)
 	if err != nil && err != io.EOF {
@@ -2485,6 +2940,10 @@ func (r *layerStore) applyDiffWithOptions(to string, layerOptions *LayerOptions,
 			Diff:       payload,
 			Mappings:   r.layerMappings(layer),
 			MountLabel: layer.MountLabel,
+			Context:    ctx,
+		}
+		if layerOptions != nil {
+			options.Progress = layerOptions.Progress
 		}
 		size, err := r.driver.ApplyDiff(layer.ID, layer.Parent, options)
 		if err != nil {
@@ -2493,6 +2952,11 @@ func (r *layerStore) applyDiffWithOptions(to string, layerOptions *LayerOptions,
 		return size, err
 	}()
 	if err != nil {
+		// The error might come from a child process which only saw its
+		// input end early, so make sure the cancellation is reported.
+		if ctxErr := ctx.Err(); ctxErr != nil && !errors.Is(err, ctxErr) {
+			err = fmt.Errorf("%w: %v", ctxErr, err)
+		}
 		return -1, err
 	}
 
@@ -2552,6 +3016,38 @@ func (r *layerStore) DifferTarget(id string) (string, error) {
 	return ddriver.DifferTarget(layer.ID)
 }
 
+// Requires startWriting.
+func (r *layerStore) recordUncompressedDigest(id string) error {
+	layer, ok := r.lookup(id)
+	if !ok {
+		return ErrLayerUnknown
+	}
+	if layer.UncompressedDigest != "" {
+		return nil
+	}
+	// Without a tar-split, the diff we would generate could not be
+	// expected to match the digest which the image refers to.
+	if _, err := os.Stat(r.tspath(layer.ID)); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	uncompressed := archive.Uncompressed
+	diff, err := r.Diff(layer.Parent, layer.ID, &DiffOptions{Compression: &uncompressed})
+	if err != nil {
+		return err
+	}
+	defer diff.Close()
+	digester := digest.Canonical.Digester()
+	if _, err := io.Copy(digester.Hash(), diff); err != nil {
+		return fmt.Errorf("digesting layer %q: %w", layer.ID, err)
+	}
+	updateDigestMap(&r.byuncompressedsum, layer.UncompressedDigest, digester.Digest(), layer.ID)
+	layer.UncompressedDigest = digester.Digest()
+	return r.saveFor(layer)
+}
+
 // Requires startWriting.
 func (r *layerStore) applyDiffFromStagingDirectory(id string, diffOutput *drivers.DriverWithDifferOutput, options *drivers.ApplyDiffWithDifferOpts) error {
 	ddriver, ok := r.driver.(drivers.DriverWithDiffer)
@@ -0,0 +1,184 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/containers/storage/pkg/ioutils"
+	"github.com/containers/storage/pkg/lockfile"
+	"github.com/containers/storage/pkg/stringid"
+)
+
+// leaseRecord is what we know about a single lease.  Exactly one of Layer and
+// Image is set.
+type leaseRecord struct {
+	ID      string     `json:"id"`
+	Layer   string     `json:"layer,omitempty"`
+	Image   string     `json:"image,omitempty"`
+	Expires *time.Time `json:"expires,omitempty"` // nil if the lease lasts until it is released
+}
+
+func (l *leaseRecord) expired(now time.Time) bool {
+	return l.Expires != nil && !now.Before(*l.Expires)
+}
+
+// leaseStore keeps the list of leases in a file under the run root, which is
+// shared by all processes using the store.
+//
+// The lock file is the last one in the store's locking hierarchy: it can be
+// acquired while holding layer, image, or container store locks, but none of
+// those may be acquired while holding it.
+type leaseStore struct {
+	lockfile *lockfile.LockFile
+	path     string
+}
+
+// leasedObjects is the set of layers and images which have at least one
+// unexpired lease.
+type leasedObjects struct {
+	layers map[string]struct{}
+	images map[string]struct{}
+}
+
+func (l leasedObjects) layer(id string) bool {
+	_, ok := l.layers[id]
+	return ok
+}
+
+func (l leasedObjects) image(id string) bool {
+	_, ok := l.images[id]
+	return ok
+}
+
+func newLeaseStore(runRoot string) (*leaseStore, error) {
+	lockfile, err := lockfile.GetLockFile(filepath.Join(runRoot, "leases.lock"))
+	if err != nil {
+		return nil, err
+	}
+	return &leaseStore{
+		lockfile: lockfile,
+		path:     filepath.Join(runRoot, "leases.json"),
+	}, nil
+}
+
+// load reads the list of leases, omitting any which have expired.
+// The caller must hold l.lockfile for reading or writing.
+func (l *leaseStore) load() ([]leaseRecord, error) {
+	data, err := os.ReadFile(l.path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var leases []leaseRecord
+	if err := json.Unmarshal(data, &leases); err != nil {
+		return nil, fmt.Errorf("parsing %q: %w", l.path, err)
+	}
+	now := time.Now()
+	return slices.DeleteFunc(leases, func(lease leaseRecord) bool { return lease.expired(now) }), nil
+}
+
+// save writes the list of leases.
+// The caller must hold l.lockfile for writing.
+func (l *leaseStore) save(leases []leaseRecord) error {
+	data, err := json.Marshal(leases)
+	if err != nil {
+		return err
+	}
+	return ioutils.AtomicWriteFile(l.path, data, 0o600)
+}
+
+// add records a new lease on a layer or image, and returns its ID.
+func (l *leaseStore) add(layer, image string, ttl time.Duration) (string, error) {
+	l.lockfile.Lock()
+	defer l.lockfile.Unlock()
+	leases, err := l.load()
+	if err != nil {
+		return "", err
+	}
+	lease := leaseRecord{ID: stringid.GenerateRandomID(), Layer: layer, Image: image}
+	if ttl > 0 {
+		expires := time.Now().Add(ttl).UTC()
+		lease.Expires = &expires
+	}
+	if err := l.save(append(leases, lease)); err != nil {
+		return "", err
+	}
+	return lease.ID, nil
+}
+
+// remove discards a lease.
+func (l *leaseStore) remove(id string) error {
+	l.lockfile.Lock()
+	defer l.lockfile.Unlock()
+	leases, err := l.load()
+	if err != nil {
+		return err
+	}
+	i := slices.IndexFunc(leases, func(lease leaseRecord) bool { return lease.ID == id })
+	if i == -1 {
+		return fmt.Errorf("lease %q: %w", id, ErrLeaseUnknown)
+	}
+	return l.save(slices.Delete(leases, i, i+1))
+}
+
+// leased returns the set of layers and images which currently have leases.
+func (l *leaseStore) leased() (leasedObjects, error) {
+	l.lockfile.RLock()
+	defer l.lockfile.Unlock()
+	leases, err := l.load()
+	if err != nil {
+		return leasedObjects{}, err
+	}
+	objects := leasedObjects{
+		layers: make(map[string]struct{}),
+		images: make(map[string]struct{}),
+	}
+	for _, lease := range leases {
+		if lease.Layer != "" {
+			objects.layers[lease.Layer] = struct{}{}
+		}
+		if lease.Image != "" {
+			objects.images[lease.Image] = struct{}{}
+		}
+	}
+	return objects, nil
+}
+
+// AcquireLease protects a layer or an image from being deleted until the
+// lease is released or expires.
+func (s *store) AcquireLease(id string, ttl time.Duration) (string, error) {
+	// Keep the layer and image stores locked while the lease is recorded,
+	// so that the layer or image can't be deleted before the lease is in
+	// place.
+	rlstore, err := s.getLayerStore()
+	if err != nil {
+		return "", err
+	}
+	if err := rlstore.startReading(); err != nil {
+		return "", err
+	}
+	defer rlstore.stopReading()
+	if err := s.imageStore.startReading(); err != nil {
+		return "", err
+	}
+	defer s.imageStore.stopReading()
+
+	if layer, err := rlstore.Get(id); err == nil {
+		return s.leases.add(layer.ID, "", ttl)
+	}
+	if image, err := s.imageStore.Get(id); err == nil {
+		return s.leases.add("", image.ID, ttl)
+	}
+	return "", fmt.Errorf("acquiring lease on %q: %w", id, ErrNotAnID)
+}
+
+// ReleaseLease discards a lease which was returned by AcquireLease.
+func (s *store) ReleaseLease(leaseID string) error {
+	return s.leases.remove(leaseID)
+}
@@ -0,0 +1,217 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/containers/storage/pkg/ioutils"
+)
+
+// maxNameHistoryEntries is the number of changes which are remembered for
+// each image name.  Older changes are forgotten.
+const maxNameHistoryEntries = 100
+
+// NameHistoryOperation describes the kind of operation which changed which
+// image a name refers to.
+type NameHistoryOperation string
+
+const (
+	// NameCreated is recorded when an image is created with a name.
+	NameCreated NameHistoryOperation = "create"
+	// NameSet is recorded when SetNames assigns a name to an image, or
+	// takes it away from one.
+	NameSet NameHistoryOperation = "set"
+	// NameAdded is recorded when AddNames assigns a name to an image.
+	NameAdded NameHistoryOperation = "add"
+	// NameRemoved is recorded when RemoveNames takes a name away from an
+	// image.
+	NameRemoved NameHistoryOperation = "remove"
+	// NameDeleted is recorded when an image which had a name is deleted.
+	NameDeleted NameHistoryOperation = "delete"
+	// NameRolledBack is recorded when RollbackName changes which image a
+	// name refers to.
+	NameRolledBack NameHistoryOperation = "rollback"
+)
+
+// NameHistoryEntry records a change to which image a name refers to.
+type NameHistoryEntry struct {
+	// Name is the name which was assigned or taken away.
+	Name string `json:"name"`
+	// ImageID is the ID of the image which the name referred to after the
+	// change, or empty if it no longer referred to any image.
+	ImageID string `json:"image,omitempty"`
+	// PreviousImageID is the ID of the image which the name referred to
+	// before the change, or empty if it didn't refer to any image.
+	PreviousImageID string `json:"previous-image,omitempty"`
+	// Timestamp is when the change was made.
+	Timestamp time.Time `json:"timestamp"`
+	// Operation is the kind of operation which made the change.
+	Operation NameHistoryOperation `json:"operation"`
+}
+
+// historyOperation returns the NameHistoryOperation which is recorded for
+// changes made by op.
+func (op updateNameOperation) historyOperation() NameHistoryOperation {
+	switch op {
+	case addNames:
+		return NameAdded
+	case removeNames:
+		return NameRemoved
+	default:
+		return NameSet
+	}
+}
+
+func (r *imageStore) namehistorypath() string {
+	return filepath.Join(r.dir, "names-history.json")
+}
+
+// loadNameHistory reads the history of name assignments.
+// The caller must hold r.lockfile for reading or writing.
+func (r *imageStore) loadNameHistory() (map[string][]NameHistoryEntry, error) {
+	history := make(map[string][]NameHistoryEntry)
+	hpath := r.namehistorypath()
+	data, err := os.ReadFile(hpath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return history, nil
+		}
+		return nil, err
+	}
+	if len(data) != 0 {
+		if err := json.Unmarshal(data, &history); err != nil {
+			return nil, fmt.Errorf("loading %q: %w", hpath, err)
+		}
+	}
+	return history, nil
+}
+
+// saveNameHistory writes the history of name assignments, if it changed since
+// it was last read or written.
+// The caller must hold r.lockfile locked for writing, and must have already
+// recorded the write.
+// The caller must hold r.inProcessLock for reading, or for writing if the
+// history changed.
+func (r *imageStore) saveNameHistory() error {
+	if !r.nameHistoryChanged {
+		return nil
+	}
+	jdata, err := json.Marshal(&r.nameHistory)
+	if err != nil {
+		return err
+	}
+	if err := ioutils.AtomicWriteFile(r.namehistorypath(), jdata, 0o600); err != nil {
+		return err
+	}
+	r.nameHistoryChanged = false
+	return nil
+}
+
+// recordName notes that name was changed from referring to the image with
+// ID previousID to referring to the image with ID imageID, either of which
+// can be empty.  Nothing is recorded if they are the same.
+// The caller must hold r.inProcessLock for writing, and save the store
+// afterwards.
+func (r *imageStore) recordName(name, previousID, imageID string, op NameHistoryOperation) {
+	if previousID == imageID {
+		return
+	}
+	entries := append(r.nameHistory[name], NameHistoryEntry{
+		Name:            name,
+		ImageID:         imageID,
+		PreviousImageID: previousID,
+		Timestamp:       time.Now().UTC(),
+		Operation:       op,
+	})
+	if len(entries) > maxNameHistoryEntries {
+		entries = slices.Delete(entries, 0, len(entries)-maxNameHistoryEntries)
+	}
+	r.nameHistory[name] = entries
+	r.nameHistoryChanged = true
+}
+
+// forgetCreatedName removes the entry which recorded that name was given to
+// the image with ID imageID when it was created, if that is the most recent
+// change to the name.
+// The caller must hold r.inProcessLock for writing, and save the store
+// afterwards.
+func (r *imageStore) forgetCreatedName(name, imageID string) {
+	entries := r.nameHistory[name]
+	if len(entries) == 0 {
+		return
+	}
+	if last := entries[len(entries)-1]; last.ImageID != imageID || last.Operation != NameCreated {
+		return
+	}
+	if len(entries) == 1 {
+		delete(r.nameHistory, name)
+	} else {
+		r.nameHistory[name] = entries[:len(entries)-1]
+	}
+	r.nameHistoryChanged = true
+}
+
+// Requires startReading or startWriting.
+func (r *imageStore) NameHistory(name string) []NameHistoryEntry {
+	return slices.Clone(r.nameHistory[name])
+}
+
+// Requires startWriting.
+func (r *imageStore) rollbackName(name string, steps int) error {
+	if !r.lockfile.IsReadWrite() {
+		return fmt.Errorf("not allowed to change image name assignments at %q: %w", r.imagespath(), ErrStoreIsReadOnly)
+	}
+	entries := r.nameHistory[name]
+	if steps < 1 || steps > len(entries) {
+		return fmt.Errorf("rolling back name %q by %d changes: %d changes are recorded", name, steps, len(entries))
+	}
+	targetID := entries[len(entries)-steps].PreviousImageID
+	var target *Image
+	if targetID != "" {
+		var ok bool
+		if target, ok = r.byid[targetID]; !ok {
+			return fmt.Errorf("locating image with ID %q which %q referred to: %w", targetID, name, ErrImageUnknown)
+		}
+	}
+	current, ok := r.byname[name]
+	if current == target {
+		return nil
+	}
+	currentID := ""
+	if ok {
+		currentID = current.ID
+		r.removeName(current, name)
+		delete(r.byname, name)
+	}
+	if target != nil {
+		target.Names = append(target.Names, name)
+		target.addNameToHistory(name)
+		r.byname[name] = target
+	}
+	r.recordName(name, currentID, targetID, NameRolledBack)
+	return r.Save()
+}
+
+// NameHistory returns the recorded changes to which image a name refers to,
+// oldest first.
+func (s *store) NameHistory(name string) ([]NameHistoryEntry, error) {
+	if err := s.imageStore.startReading(); err != nil {
+		return nil, err
+	}
+	defer s.imageStore.stopReading()
+	return s.imageStore.NameHistory(name), nil
+}
+
+// RollbackName undoes the most recent steps changes to which image a name
+// refers to, by assigning it to the image which it referred to before them,
+// or by removing it if it didn't refer to any image then.  The rollback is
+// itself recorded as a change.
+func (s *store) RollbackName(name string, steps int) error {
+	_, err := writeToImageStore(s, func() (struct{}, error) {
+		return struct{}{}, s.imageStore.rollbackName(name, steps)
+	})
+	return err
+}
@@ -70,6 +70,10 @@ type (
 		ForceMask *os.FileMode
 		// Timestamp, if set, will be set in each header as create/mod/access time
 		Timestamp *time.Time
+		// Progress, if set, is called as entries are unpacked.  It can
+		// not be passed to a child process, so callers which unpack
+		// archives in one need to arrange for it to be called.
+		Progress ProgressFunc `json:"-"`
 	}
 )
 
@@ -1091,7 +1095,8 @@ func TarWithOptions(srcPath string, options *TarOptions) (io.ReadCloser, error)
 
 // Unpack unpacks the decompressedArchive to dest with options.
 func Unpack(decompressedArchive io.Reader, dest string, options *TarOptions) error {
-	tr := tar.NewReader(decompressedArchive)
+	progress := newProgressCounter(decompressedArchive, options.Progress)
+	tr := tar.NewReader(progress)
 	trBuf := pools.BufioReader32KPool.Get(nil)
 	defer pools.BufioReader32KPool.Put(trBuf)
 
@@ -1114,11 +1119,13 @@ loop:
 		hdr, err := tr.Next()
 		if err == io.EOF {
 			// end of tar archive
+			progress.done()
 			break
 		}
 		if err != nil {
 			return err
 		}
+		progress.entry(hdr)
 
 		// Normalize name, for safety and for a simple is-root check
 		// This keeps "../" as-is, but normalizes "/../" to "/". Or Windows:
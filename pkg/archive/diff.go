@@ -21,16 +21,17 @@ import (
 // compressed or uncompressed.
 // Returns the size in bytes of the contents of the layer.
 func UnpackLayer(dest string, layer io.Reader, options *TarOptions) (size int64, err error) {
-	tr := tar.NewReader(layer)
+	if options == nil {
+		options = &TarOptions{}
+	}
+	progress := newProgressCounter(layer, options.Progress)
+	tr := tar.NewReader(progress)
 	trBuf := pools.BufioReader32KPool.Get(tr)
 	defer pools.BufioReader32KPool.Put(trBuf)
 
 	var dirs []*tar.Header
 	unpackedPaths := make(map[string]struct{})
 
-	if options == nil {
-		options = &TarOptions{}
-	}
 	idMappings := idtools.NewIDMappingsFromMaps(options.UIDMaps, options.GIDMaps)
 
 	aufsTempdir := ""
@@ -42,11 +43,13 @@ func UnpackLayer(dest string, layer io.Reader, options *TarOptions) (size int64,
 		hdr, err := tr.Next()
 		if err == io.EOF {
 			// end of tar archive
+			progress.done()
 			break
 		}
 		if err != nil {
 			return 0, err
 		}
+		progress.entry(hdr)
 
 		size += hdr.Size
 
@@ -0,0 +1,129 @@
+package archive
+
+import (
+	"archive/tar"
+	"io"
+	"sync/atomic"
+
+	"github.com/containers/storage/pkg/tarlog"
+	splittar "github.com/vbatts/tar-split/archive/tar"
+)
+
+// Progress describes how much of an archive has been processed so far.
+type Progress struct {
+	// BytesRead is the number of bytes of the uncompressed archive which
+	// have been read.
+	BytesRead int64
+	// BytesWritten is the number of bytes of regular file contents which
+	// have been reached in the archive, and written out if the archive is
+	// being extracted.
+	BytesWritten int64
+	// Entries is the number of entries in the archive which have been
+	// reached.
+	Entries int64
+}
+
+// ProgressFunc is called with updated totals as each entry in an archive is
+// reached, and once more when the end of the archive is reached.
+type ProgressFunc func(Progress)
+
+// progressCounter keeps track of progress while an archive is read in the
+// current goroutine.
+type progressCounter struct {
+	reader   io.Reader
+	progress ProgressFunc
+	current  Progress
+}
+
+// newProgressCounter wraps r, counting the bytes which are read from it.  If
+// progress is nil, the counter does nothing.
+func newProgressCounter(r io.Reader, progress ProgressFunc) *progressCounter {
+	return &progressCounter{reader: r, progress: progress}
+}
+
+func (p *progressCounter) Read(b []byte) (int, error) {
+	n, err := p.reader.Read(b)
+	p.current.BytesRead += int64(n)
+	return n, err
+}
+
+// entry notes that the entry described by hdr has been reached.
+func (p *progressCounter) entry(hdr *tar.Header) {
+	if p.progress == nil {
+		return
+	}
+	p.current.Entries++
+	if hdr.Typeflag == tar.TypeReg {
+		p.current.BytesWritten += hdr.Size
+	}
+	p.progress(p.current)
+}
+
+// done notes that the end of the archive has been reached.
+func (p *progressCounter) done() {
+	if p.progress == nil {
+		return
+	}
+	p.progress(p.current)
+}
+
+// progressReader keeps track of progress while an archive is read, without
+// the reader needing to parse it.
+type progressReader struct {
+	reader   io.Reader
+	logger   io.WriteCloser
+	progress ProgressFunc
+	read     atomic.Int64
+	current  Progress // Only accessed by the logger's goroutine until it is closed.
+	closed   bool
+}
+
+// NewProgressReader returns a reader which reads an uncompressed archive from
+// r, and calls progress as each entry in it is read.  This is useful when the
+// archive is being consumed by something which can't report progress itself,
+// such as a child process.  progress is called from a separate goroutine.
+//
+// The returned reader must be closed when the caller is done with it, which
+// waits for pending calls to progress, and then makes a final one.  Closing it
+// does not close r.
+func NewProgressReader(r io.Reader, progress ProgressFunc) (io.ReadCloser, error) {
+	p := &progressReader{
+		reader:   r,
+		progress: progress,
+	}
+	logger, err := tarlog.NewLogger(func(hdr *splittar.Header) {
+		p.current.Entries++
+		if hdr.Typeflag == splittar.TypeReg {
+			p.current.BytesWritten += hdr.Size
+		}
+		p.current.BytesRead = p.read.Load()
+		p.progress(p.current)
+	})
+	if err != nil {
+		return nil, err
+	}
+	p.logger = logger
+	return p, nil
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.reader.Read(b)
+	if n > 0 {
+		p.read.Add(int64(n))
+		if _, err := p.logger.Write(b[:n]); err != nil {
+			return n, err
+		}
+	}
+	return n, err
+}
+
+func (p *progressReader) Close() error {
+	if p.closed {
+		return nil
+	}
+	p.closed = true
+	err := p.logger.Close()
+	p.current.BytesRead = p.read.Load()
+	p.progress(p.current)
+	return err
+}
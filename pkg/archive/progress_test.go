@@ -0,0 +1,61 @@
+package archive
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func progressTestArchive(t *testing.T) []byte {
+	src := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(src, "one"), []byte("hello"), 0o644))
+	require.NoError(t, os.Mkdir(filepath.Join(src, "dir"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(src, "dir", "two"), []byte("hello, world"), 0o644))
+	rc, err := Tar(src, Uncompressed)
+	require.NoError(t, err)
+	defer rc.Close()
+	data, err := io.ReadAll(rc)
+	require.NoError(t, err)
+	return data
+}
+
+func TestUnpackProgress(t *testing.T) {
+	data := progressTestArchive(t)
+	var reports []Progress
+	err := Unpack(bytes.NewReader(data), t.TempDir(), &TarOptions{
+		NoLchown: true,
+		Progress: func(p Progress) { reports = append(reports, p) },
+	})
+	require.NoError(t, err)
+	require.NotEmpty(t, reports)
+	final := reports[len(reports)-1]
+	assert.Equal(t, int64(3), final.Entries) // "dir", "dir/two", "one"
+	assert.Equal(t, int64(len("hello")+len("hello, world")), final.BytesWritten)
+	assert.Equal(t, int64(len(data)), final.BytesRead)
+	for i := 1; i < len(reports); i++ {
+		assert.GreaterOrEqual(t, reports[i].BytesRead, reports[i-1].BytesRead)
+		assert.GreaterOrEqual(t, reports[i].Entries, reports[i-1].Entries)
+	}
+}
+
+func TestProgressReader(t *testing.T) {
+	data := progressTestArchive(t)
+	var reports []Progress
+	rc, err := NewProgressReader(bytes.NewReader(data), func(p Progress) { reports = append(reports, p) })
+	require.NoError(t, err)
+	n, err := io.Copy(io.Discard, rc)
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(data)), n)
+	require.NoError(t, rc.Close())
+	require.NoError(t, rc.Close())
+	require.NotEmpty(t, reports)
+	final := reports[len(reports)-1]
+	assert.Equal(t, int64(3), final.Entries)
+	assert.Equal(t, int64(len("hello")+len("hello, world")), final.BytesWritten)
+	assert.Equal(t, int64(len(data)), final.BytesRead)
+}
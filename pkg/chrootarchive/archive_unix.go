@@ -131,6 +131,17 @@ func invokeUnpack(decompressedArchive io.Reader, dest *unpackDestination, option
 		return fmt.Errorf("untar pipe failure: %w", err)
 	}
 
+	// The child process can't call options.Progress, so watch what
+	// we send it instead.
+	if options.Progress != nil {
+		progress, err := archive.NewProgressReader(decompressedArchive, options.Progress)
+		if err != nil {
+			return err
+		}
+		defer progress.Close()
+		decompressedArchive = progress
+	}
+
 	cmd := reexec.Command("storage-untar", dest.dest, procPathForFd(rootFileDescriptor))
 	cmd.Stdin = decompressedArchive
 
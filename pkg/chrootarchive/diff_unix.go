@@ -104,6 +104,17 @@ func applyLayerHandler(dest string, layer io.Reader, options *archive.TarOptions
 		return 0, fmt.Errorf("ApplyLayer json encode: %w", err)
 	}
 
+	// The child process can't call options.Progress, so watch what
+	// we send it instead.
+	if options.Progress != nil {
+		progress, err := archive.NewProgressReader(layer, options.Progress)
+		if err != nil {
+			return 0, err
+		}
+		defer progress.Close()
+		layer = progress
+	}
+
 	cmd := reexec.Command("storage-applyLayer", dest)
 	cmd.Stdin = layer
 	cmd.Env = append(os.Environ(), fmt.Sprintf("OPT=%s", data))
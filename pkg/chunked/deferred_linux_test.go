@@ -0,0 +1,176 @@
+//go:build linux
+
+package chunked
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/containers/storage"
+	graphdriver "github.com/containers/storage/drivers"
+	"github.com/containers/storage/pkg/chunked/compressor"
+	"github.com/containers/storage/pkg/chunked/toc"
+	"github.com/containers/storage/types"
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// blobSource serves arbitrary ranges of an in-memory blob.
+type blobSource struct {
+	data []byte
+}
+
+func (b *blobSource) GetBlobAt(chunks []ImageSourceChunk) (chan io.ReadCloser, chan error, error) {
+	streams := make(chan io.ReadCloser)
+	errs := make(chan error)
+	go func() {
+		defer close(streams)
+		defer close(errs)
+		for _, chunk := range chunks {
+			streams <- io.NopCloser(bytes.NewReader(b.data[chunk.Offset : chunk.Offset+chunk.Length]))
+		}
+	}()
+	return streams, errs, nil
+}
+
+func TestDeferredFileContents(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("test requires root privileges")
+	}
+
+	big := strings.Repeat("contents which are only fetched when needed\n", 100000)
+	var layer bytes.Buffer
+	tw := tar.NewWriter(&layer)
+	for _, hdr := range []*tar.Header{
+		{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0o755},
+		{Name: "dir/small", Typeflag: tar.TypeReg, Mode: 0o644, Size: 5},
+		{Name: "dir/big", Typeflag: tar.TypeReg, Mode: 0o600, Size: int64(len(big))},
+		{Name: "dir/link", Typeflag: tar.TypeLink, Linkname: "dir/big", Mode: 0o600},
+		{Name: "dir/empty", Typeflag: tar.TypeReg, Mode: 0o644},
+	} {
+		require.NoError(t, tw.WriteHeader(hdr))
+		switch hdr.Name {
+		case "dir/small":
+			_, err := tw.Write([]byte("small"))
+			require.NoError(t, err)
+		case "dir/big":
+			_, err := tw.Write([]byte(big))
+			require.NoError(t, err)
+		}
+	}
+	require.NoError(t, tw.Close())
+	diffID := digest.FromBytes(layer.Bytes())
+
+	var blob bytes.Buffer
+	annotations := make(map[string]string)
+	w, err := compressor.ZstdCompressor(&blob, annotations, nil)
+	require.NoError(t, err)
+	_, err = io.Copy(w, &layer)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	tocDigest, err := toc.GetTOCDigest(annotations)
+	require.NoError(t, err)
+	require.NotNil(t, tocDigest)
+
+	blobs := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(blobs, tocDigest.Encoded()), blob.Bytes(), 0o600))
+
+	stage := func(pullOptions map[string]string) (storage.Store, *storage.Layer) {
+		store, err := storage.GetStore(types.StoreOptions{
+			RunRoot:         t.TempDir(),
+			GraphRoot:       t.TempDir(),
+			GraphDriverName: "overlay",
+			PullOptions:     pullOptions,
+		})
+		if err != nil {
+			t.Skipf("overlay is not usable: %v", err)
+		}
+		t.Cleanup(func() {
+			_, err := store.Shutdown(true)
+			assert.NoError(t, err)
+		})
+		differ, err := NewDiffer(context.Background(), store, digest.FromBytes(blob.Bytes()), int64(blob.Len()), annotations, &blobSource{data: blob.Bytes()})
+		require.NoError(t, err)
+		var options graphdriver.ApplyDiffWithDifferOpts
+		out, err := store.PrepareStagedLayer(&options, differ)
+		require.NoError(t, err)
+		l, err := store.ApplyStagedLayer(storage.ApplyStagedLayerOptions{
+			ID:          "deferred",
+			DiffOutput:  out,
+			DiffOptions: &options,
+		})
+		require.NoError(t, err)
+		return store, l
+	}
+
+	// Without a verified DiffID, nothing is deferred.
+	store, l := stage(map[string]string{
+		"enable_partial_images": "true",
+		"defer_file_contents":   "true",
+	})
+	assert.Equal(t, diffID, l.UncompressedDigest)
+	assert.NotContains(t, l.BigDataNames, storage.DeferredFilesBigDataKey)
+
+	store, l = stage(map[string]string{
+		"enable_partial_images":                       "true",
+		"defer_file_contents":                         "true",
+		"insecure_allow_unpredictable_image_contents": "true",
+	})
+	assert.Equal(t, *tocDigest, l.TOCDigest)
+	assert.Empty(t, l.UncompressedDigest)
+
+	missing := func() []string {
+		rc, err := store.LayerBigData(l.ID, storage.DeferredFilesBigDataKey)
+		require.NoError(t, err)
+		defer rc.Close()
+		var names []string
+		require.NoError(t, json.NewDecoder(rc).Decode(&names))
+		return names
+	}
+	assert.ElementsMatch(t, []string{"/dir/small", "/dir/big"}, missing())
+
+	// Without a fetcher, the contents can't be retrieved.
+	_, err = store.OpenLayerFile(l.ID, "dir/small")
+	assert.True(t, errors.Is(err, storage.ErrLayerContentsDeferred))
+	_, err = store.Mount(l.ID, "")
+	assert.True(t, errors.Is(err, storage.ErrLayerContentsDeferred))
+
+	// Opening a file only retrieves that file, even through a hard link.
+	store.SetLayerFetcher(storage.NewDirectoryLayerFetcher(blobs))
+	rc, err := store.OpenLayerFile(l.ID, "dir/link")
+	require.NoError(t, err)
+	contents, err := io.ReadAll(rc)
+	require.NoError(t, err)
+	require.NoError(t, rc.Close())
+	assert.Equal(t, big, string(contents))
+	assert.Equal(t, []string{"/dir/small"}, missing())
+
+	// Mounting the layer retrieves everything else.
+	mountPoint, err := store.Mount(l.ID, "")
+	require.NoError(t, err)
+	defer func() {
+		_, err := store.Unmount(l.ID, true)
+		assert.NoError(t, err)
+	}()
+	assert.Empty(t, missing())
+	l, err = store.Layer(l.ID)
+	require.NoError(t, err)
+	assert.Equal(t, diffID, l.UncompressedDigest)
+	for name, expected := range map[string]string{"small": "small", "big": big, "link": big, "empty": ""} {
+		contents, err := os.ReadFile(filepath.Join(mountPoint, "dir", name))
+		require.NoError(t, err)
+		assert.Equal(t, expected, string(contents), name)
+	}
+	st, err := os.Stat(filepath.Join(mountPoint, "dir", "big"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o600), st.Mode().Perm())
+}
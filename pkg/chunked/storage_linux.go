@@ -27,6 +27,7 @@ import (
 	"github.com/containers/storage/pkg/chunked/toc"
 	"github.com/containers/storage/pkg/fsverity"
 	"github.com/containers/storage/pkg/idtools"
+	"github.com/containers/storage/pkg/ioutils"
 	"github.com/containers/storage/pkg/system"
 	securejoin "github.com/cyphar/filepath-securejoin"
 	jsoniter "github.com/json-iterator/go"
@@ -44,7 +45,7 @@ const (
 	maxNumberMissingChunks  = 1024
 	autoMergePartsThreshold = 1024 // if the gap between two ranges is below this threshold, automatically merge them.
 	newFileFlags            = (unix.O_CREAT | unix.O_TRUNC | unix.O_EXCL | unix.O_WRONLY)
-	bigDataKey              = "zstd-chunked-manifest"
+	bigDataKey              = toc.BigDataKey
 	chunkedData             = "zstd-chunked-data"
 	chunkedLayerDataKey     = "zstd-chunked-layer-data"
 	tocKey                  = "toc"
@@ -108,7 +109,10 @@ type chunkedDiffer struct {
 	zstdReader  *zstd.Decoder
 	rawReader   io.Reader
 	useFsVerity graphdriver.DifferFsVerity
-	used        bool // the differ object was already used and cannot be used again for .ApplyDiff
+	used        bool                 // the differ object was already used and cannot be used again for .ApplyDiff
+	ctx         context.Context      // cancels .ApplyDiff
+	progress    archive.ProgressFunc // called as .ApplyDiff makes progress, may be nil
+	current     archive.Progress     // the totals passed to progress
 }
 
 var xattrsToIgnore = map[string]any{
@@ -128,6 +132,7 @@ type pullOptions struct {
 	convertImages                           bool     // convert_images
 	useHardLinks                            bool     // use_hard_links
 	insecureAllowUnpredictableImageContents bool     // insecure_allow_unpredictable_image_contents
+	deferFileContents                       bool     // defer_file_contents
 	ostreeRepos                             []string // ostree_repos
 }
 
@@ -144,6 +149,7 @@ func parsePullOptions(store storage.Store) pullOptions {
 		{&res.convertImages, "convert_images", false},
 		{&res.useHardLinks, "use_hard_links", false},
 		{&res.insecureAllowUnpredictableImageContents, "insecure_allow_unpredictable_image_contents", false},
+		{&res.deferFileContents, "defer_file_contents", false},
 	} {
 		if value, ok := options[e.name]; ok {
 			*e.dest = strings.ToLower(value) == "true"
@@ -921,6 +927,8 @@ func (c *chunkedDiffer) storeMissingFiles(streams chan io.ReadCloser, errs chan
 					return errors.New("not enough data returned from the server")
 				}
 				return err
+			case <-c.ctx.Done():
+				return c.ctx.Err()
 			}
 			if part == nil {
 				return errors.New("invalid stream returned")
@@ -930,6 +938,10 @@ func (c *chunkedDiffer) storeMissingFiles(streams chan io.ReadCloser, errs chan
 		}
 
 		for _, mf := range missingPart.Chunks {
+			if err := c.ctx.Err(); err != nil {
+				Err = err
+				goto exit
+			}
 			if mf.Gap > 0 {
 				limitReader := io.LimitReader(part, mf.Gap)
 				_, err := io.CopyBuffer(io.Discard, limitReader, c.copyBuffer)
@@ -1002,6 +1014,11 @@ func (c *chunkedDiffer) storeMissingFiles(streams chan io.ReadCloser, errs chan
 					goto exit
 				}
 			}
+			if part != nil && !readingFromLocalFile {
+				c.reportProgress(mf.CompressedSize, mf.UncompressedSize, 0)
+			} else {
+				c.reportProgress(0, mf.UncompressedSize, 0)
+			}
 		}
 	exit:
 		if part != nil {
@@ -1019,6 +1036,18 @@ func (c *chunkedDiffer) storeMissingFiles(streams chan io.ReadCloser, errs chan
 	return nil
 }
 
+// reportProgress adds to the totals of data read from the layer, data written,
+// and entries processed, and reports them if the caller asked for that.
+func (c *chunkedDiffer) reportProgress(read, written, entries int64) {
+	if c.progress == nil {
+		return
+	}
+	c.current.BytesRead += read
+	c.current.BytesWritten += written
+	c.current.Entries += entries
+	c.progress(c.current)
+}
+
 func mergeMissingChunks(missingParts []missingPart, target int) []missingPart {
 	getGap := func(missingParts []missingPart, i int) uint64 {
 		prev := missingParts[i-1].SourceChunk.Offset + missingParts[i-1].SourceChunk.Length
@@ -1366,11 +1395,13 @@ func (c *chunkedDiffer) copyAllBlobToFile(destination *os.File) (digest.Digest,
 	originalRawDigester := digest.Canonical.Digester()
 	for soe := range streamsOrErrors {
 		if soe.stream != nil {
-			r := io.TeeReader(soe.stream, originalRawDigester.Hash())
+			r := io.TeeReader(ioutils.NewContextReader(c.ctx, soe.stream), originalRawDigester.Hash())
 
 			// copy the entire tarball and compute its digest
-			_, err = io.CopyBuffer(destination, r, c.copyBuffer)
+			var n int64
+			n, err = io.CopyBuffer(destination, r, c.copyBuffer)
 			_ = soe.stream.Close()
+			c.reportProgress(n, 0, 0)
 		}
 		if soe.err != nil && err == nil {
 			err = soe.err
@@ -1411,6 +1442,11 @@ func (c *chunkedDiffer) ApplyDiff(dest string, options *archive.TarOptions, diff
 	}()
 
 	c.useFsVerity = differOpts.UseFsVerity
+	c.ctx = context.Background()
+	if differOpts.Context != nil {
+		c.ctx = differOpts.Context
+	}
+	c.progress = options.Progress
 
 	// stream to use for reading the zstd:chunked or Estargz file.
 	stream := c.stream
@@ -1582,6 +1618,13 @@ func (c *chunkedDiffer) ApplyDiff(dest string, options *archive.TarOptions, diff
 	// are retrieved
 	var hardLinks []hardLinkToCreate
 
+	// In deferred mode, files which aren't available locally are created empty,
+	// and their contents are only retrieved when the store needs them.  The
+	// layer's UncompressedDigest can't be computed without them, so the
+	// caller must not need one which matches the image's DiffID.
+	deferred := c.pullOptions.deferFileContents && c.pullOptions.insecureAllowUnpredictableImageContents && c.fileType == fileTypeZstdChunked && flatPathNameMap == nil && c.useFsVerity == graphdriver.DifferFsVerityDisabled
+	var deferredFiles []string
+
 	missingPartsSize, totalChunksSize := int64(0), int64(0)
 
 	copyOptions := findAndCopyFileOptions{
@@ -1631,7 +1674,11 @@ func (c *chunkedDiffer) ApplyDiff(dest string, options *archive.TarOptions, diff
 
 	filesToWaitFor := 0
 	for i := range mergedEntries {
+		if err := c.ctx.Err(); err != nil {
+			return output, err
+		}
 		r := &mergedEntries[i]
+		c.reportProgress(0, 0, 1)
 
 		mode := os.FileMode(r.Mode)
 
@@ -1783,6 +1830,21 @@ func (c *chunkedDiffer) ApplyDiff(dest string, options *archive.TarOptions, diff
 		// the file was already copied to its destination
 		// so nothing left to do.
 		if res.found {
+			c.reportProgress(0, r.Size, 0)
+			continue
+		}
+
+		if deferred {
+			file, err := openFileUnderRoot(dirfd, r.Name, newFileFlags, 0)
+			if err != nil {
+				return output, err
+			}
+			err = setFileAttrs(dirfd, file, res.mode, r, options, false)
+			file.Close()
+			if err != nil {
+				return output, err
+			}
+			deferredFiles = append(deferredFiles, r.Name)
 			continue
 		}
 
@@ -1853,6 +1915,14 @@ func (c *chunkedDiffer) ApplyDiff(dest string, options *archive.TarOptions, diff
 		}
 	}
 
+	if len(deferredFiles) > 0 {
+		deferredFilesData, err := json.Marshal(deferredFiles)
+		if err != nil {
+			return output, err
+		}
+		output.BigData[storage.DeferredFilesBigDataKey] = deferredFilesData
+	}
+
 	// To ensure that consumers of the layer who decompress and read the full tar stream,
 	// and consumers who consume the data via the TOC, both see exactly the same data and metadata,
 	// compute the UncompressedDigest.
@@ -1,12 +1,22 @@
 package toc
 
 import (
+	"archive/tar"
+	"encoding/base64"
 	"errors"
+	"fmt"
+	"path"
 
+	"github.com/containers/storage/pkg/archive"
 	"github.com/containers/storage/pkg/chunked/internal/minimal"
+	jsoniter "github.com/json-iterator/go"
 	digest "github.com/opencontainers/go-digest"
 )
 
+// BigDataKey is the key of the layer big data item in which the TOC of a
+// layer which was created using a zstd:chunked or eStargz blob is stored.
+const BigDataKey = "zstd-chunked-manifest"
+
 // tocJSONDigestAnnotation is the annotation key for the digest of the estargz
 // TOC JSON.
 // It is defined in github.com/containerd/stargz-snapshotter/estargz as TOCJSONDigestAnnotation
@@ -39,3 +49,165 @@ func GetTOCDigest(annotations map[string]string) (*digest.Digest, error) {
 		return nil, nil
 	}
 }
+
+// Headers parses a zstd:chunked TOC, as stored in a layer's BigDataKey item,
+// and returns tar headers for the entries which it lists, in order.  Chunk
+// entries, which only describe parts of the contents of regular files, are
+// not included.
+// This is an experimental feature and may be changed/removed in the future.
+func Headers(manifest []byte) ([]*tar.Header, error) {
+	var toc minimal.TOC
+	json := jsoniter.ConfigCompatibleWithStandardLibrary
+	if err := json.Unmarshal(manifest, &toc); err != nil {
+		return nil, fmt.Errorf("parsing TOC: %w", err)
+	}
+	headers := make([]*tar.Header, 0, len(toc.Entries))
+	for _, entry := range toc.Entries {
+		if entry.Type == minimal.TypeChunk {
+			continue
+		}
+		var typeflag byte
+		for flag, t := range minimal.TarTypes {
+			if t == entry.Type {
+				typeflag = flag
+				break
+			}
+		}
+		if typeflag == 0 {
+			return nil, fmt.Errorf("unknown type %q for TOC entry %q", entry.Type, entry.Name)
+		}
+		hdr := &tar.Header{
+			Typeflag: typeflag,
+			Name:     entry.Name,
+			Linkname: entry.Linkname,
+			Mode:     entry.Mode,
+			Size:     entry.Size,
+			Uid:      entry.UID,
+			Gid:      entry.GID,
+			Devmajor: entry.Devmajor,
+			Devminor: entry.Devminor,
+		}
+		if entry.ModTime != nil {
+			hdr.ModTime = *entry.ModTime
+		}
+		if entry.AccessTime != nil {
+			hdr.AccessTime = *entry.AccessTime
+		}
+		if entry.ChangeTime != nil {
+			hdr.ChangeTime = *entry.ChangeTime
+		}
+		for key, value := range entry.Xattrs {
+			decoded, err := base64.StdEncoding.DecodeString(value)
+			if err != nil {
+				return nil, fmt.Errorf("decoding xattr %q for TOC entry %q: %w", key, entry.Name, err)
+			}
+			if hdr.PAXRecords == nil {
+				hdr.PAXRecords = make(map[string]string)
+			}
+			hdr.PAXRecords[archive.PaxSchilyXattr+key] = string(decoded)
+		}
+		headers = append(headers, hdr)
+	}
+	return headers, nil
+}
+
+// FileChunk describes one part of the contents of a regular file in a
+// zstd:chunked blob.  Each chunk is compressed separately.
+type FileChunk struct {
+	// Offset and Length locate the compressed chunk in the blob.
+	Offset int64
+	Length int64
+	// FileOffset and Size locate the uncompressed chunk in the file.
+	FileOffset int64
+	Size       int64
+	// Digest is the digest of the uncompressed chunk.  It is only set if
+	// the file has more than one chunk; otherwise, the file's digest
+	// applies.
+	Digest digest.Digest
+}
+
+// RegularFile describes the contents of a regular file in a zstd:chunked blob.
+type RegularFile struct {
+	Name   string
+	Size   int64
+	Digest digest.Digest
+	Chunks []FileChunk
+}
+
+// RegularFiles parses a zstd:chunked TOC, as stored in a layer's BigDataKey
+// item, and returns the locations of the contents of the regular files which
+// it lists, keyed by their cleaned absolute paths.  Empty files are not
+// included.
+// This is an experimental feature and may be changed/removed in the future.
+func RegularFiles(manifest []byte) (map[string]*RegularFile, error) {
+	var toc minimal.TOC
+	json := jsoniter.ConfigCompatibleWithStandardLibrary
+	if err := json.Unmarshal(manifest, &toc); err != nil {
+		return nil, fmt.Errorf("parsing TOC: %w", err)
+	}
+	files := make(map[string]*RegularFile)
+	var current *RegularFile
+	var endOffset int64
+	finish := func() {
+		if current == nil {
+			return
+		}
+		// Each chunk ends where the next one starts, and the last one
+		// ends where the file's contents do.
+		for i := range current.Chunks {
+			end := endOffset
+			if i+1 < len(current.Chunks) {
+				end = current.Chunks[i+1].Offset
+			}
+			current.Chunks[i].Length = end - current.Chunks[i].Offset
+			if current.Chunks[i].Size == 0 {
+				current.Chunks[i].Size = current.Size - current.Chunks[i].FileOffset
+			}
+		}
+		current = nil
+	}
+	for _, entry := range toc.Entries {
+		switch entry.Type {
+		case minimal.TypeChunk:
+			if current == nil || entry.Name != current.Name {
+				return nil, fmt.Errorf("chunk entry for %q without a regular file", entry.Name)
+			}
+		case minimal.TypeReg:
+			finish()
+			if entry.Size == 0 {
+				continue
+			}
+			current = &RegularFile{Name: entry.Name, Size: entry.Size}
+			if entry.Digest != "" {
+				d, err := digest.Parse(entry.Digest)
+				if err != nil {
+					return nil, fmt.Errorf("parsing digest of TOC entry %q: %w", entry.Name, err)
+				}
+				current.Digest = d
+			}
+			files[path.Clean("/"+entry.Name)] = current
+			endOffset = 0
+		default:
+			finish()
+			continue
+		}
+		chunk := FileChunk{
+			Offset:     entry.Offset,
+			FileOffset: entry.ChunkOffset,
+			Size:       entry.ChunkSize,
+		}
+		if entry.ChunkDigest != "" {
+			d, err := digest.Parse(entry.ChunkDigest)
+			if err != nil {
+				return nil, fmt.Errorf("parsing chunk digest of TOC entry %q: %w", entry.Name, err)
+			}
+			chunk.Digest = d
+		}
+		current.Chunks = append(current.Chunks, chunk)
+		if entry.EndOffset != 0 {
+			endOffset = entry.EndOffset
+		}
+	}
+	finish()
+	return files, nil
+}
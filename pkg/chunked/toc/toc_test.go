@@ -1,6 +1,7 @@
 package toc
 
 import (
+	"archive/tar"
 	"testing"
 )
 
@@ -45,3 +46,38 @@ func TestGetTOCDigest(t *testing.T) {
 		}
 	})
 }
+
+func TestHeaders(t *testing.T) {
+	manifest := []byte(`{"version":1,"entries":[` +
+		`{"type":"dir","name":"etc/","mode":493},` +
+		`{"type":"reg","name":"etc/hosts","mode":420,"size":12,"uid":1,"gid":2,"modtime":"2024-01-02T03:04:05Z","xattrs":{"user.key":"dmFsdWU="},"chunkSize":6},` +
+		`{"type":"chunk","name":"etc/hosts","chunkOffset":6,"chunkSize":6},` +
+		`{"type":"symlink","name":"etc/localtime","linkName":"/usr/share/zoneinfo/UTC"}]}`)
+	headers, err := Headers(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(headers) != 3 {
+		t.Fatalf("Expected 3 headers, got %d", len(headers))
+	}
+	if headers[0].Typeflag != tar.TypeDir || headers[0].Name != "etc/" || headers[0].Mode != 0o755 {
+		t.Errorf("Unexpected directory header %+v", headers[0])
+	}
+	hosts := headers[1]
+	if hosts.Typeflag != tar.TypeReg || hosts.Name != "etc/hosts" || hosts.Size != 12 || hosts.Uid != 1 || hosts.Gid != 2 {
+		t.Errorf("Unexpected file header %+v", hosts)
+	}
+	if hosts.ModTime.Year() != 2024 {
+		t.Errorf("Expected modification time in 2024, got %v", hosts.ModTime)
+	}
+	if value := hosts.PAXRecords["SCHILY.xattr.user.key"]; value != "value" {
+		t.Errorf("Expected decoded xattr value, got %q", value)
+	}
+	if headers[2].Typeflag != tar.TypeSymlink || headers[2].Linkname != "/usr/share/zoneinfo/UTC" {
+		t.Errorf("Unexpected symlink header %+v", headers[2])
+	}
+
+	if _, err := Headers([]byte(`{"entries":[{"type":"socket","name":"s"}]}`)); err == nil {
+		t.Error("Expected an error for an unknown entry type")
+	}
+}
@@ -168,3 +168,25 @@ func (p *cancelReadCloser) Close() error {
 	p.closeWithError(io.EOF)
 	return nil
 }
+
+// contextReader wraps an io.Reader, and stops reading from it once a context
+// is cancelled.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+// NewContextReader creates a wrapper that reads from r until ctx is cancelled,
+// after which calls to Read return ctx.Err().  Unlike NewCancelReadCloser, it
+// does not interrupt a call to Read which has already started.
+func NewContextReader(ctx context.Context, r io.Reader) io.Reader {
+	return &contextReader{ctx: ctx, r: r}
+}
+
+// Read reads from the wrapped reader, unless the context has been cancelled.
+func (c *contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
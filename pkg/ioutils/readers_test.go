@@ -92,3 +92,15 @@ func TestCancelReadCloser(t *testing.T) {
 		}
 	}
 }
+
+func TestContextReader(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	reader := NewContextReader(ctx, strings.NewReader("some data"))
+	var buf [4]byte
+	n, err := reader.Read(buf[:])
+	assert.NoError(t, err)
+	assert.Equal(t, "some", string(buf[:n]))
+	cancel()
+	_, err = reader.Read(buf[:])
+	assert.ErrorIs(t, err, context.Canceled)
+}
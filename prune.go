@@ -0,0 +1,457 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// PrunePolicy controls the order in which Prune considers images for removal.
+type PrunePolicy string
+
+const (
+	// PruneLeastRecentlyUsed removes the images which were least recently
+	// used first.  Images which have never been used are treated as if
+	// they were last used when they were created.
+	PruneLeastRecentlyUsed PrunePolicy = "lru"
+	// PruneOldest removes the images which were created earliest first.
+	PruneOldest PrunePolicy = "age"
+	// PruneLargest removes the images which would free the most space
+	// first.
+	PruneLargest PrunePolicy = "size"
+)
+
+// PruneOptions controls which images and layers Prune removes.  Only images
+// in the writable image store which aren't used by containers or image
+// indexes, and which aren't leased, are ever removed.  If none of
+// HighWatermark, MaxSize, and MaxAge are set, no images are removed.
+type PruneOptions struct {
+	// Policy is the order in which images are considered for removal.
+	// The default is PruneLeastRecentlyUsed.
+	Policy PrunePolicy
+	// HighWatermark is a percentage of the size of the filesystem which
+	// contains the graph root.  If more of it than this is in use, images
+	// are removed until no more than LowWatermark percent of it is.
+	HighWatermark float64
+	// LowWatermark is the percentage of the size of the filesystem which
+	// contains the graph root that pruning aims for when HighWatermark is
+	// exceeded.  It defaults to HighWatermark.
+	LowWatermark float64
+	// MaxSize, if set, is the number of bytes which images, counting
+	// layers that they share only once, are allowed to use, and images
+	// are removed until they use no more than that.
+	MaxSize int64
+	// MaxAge, if set, causes images which haven't been used for longer
+	// than this (by the measure that Policy uses) to be removed whether or
+	// not any other limits have been exceeded.
+	MaxAge time.Duration
+	// DanglingLayers causes layers in the writable layer store which are
+	// not used by any image or container, and which have no names, to be
+	// removed as well.  Layers which are still being created, or which
+	// are younger than DanglingLayersMinimumAge, are kept, since an image
+	// or container which will use them may be about to be created.
+	DanglingLayers bool
+	// DanglingLayersMinimumAge is how old a dangling layer must be before
+	// it is removed.  The default is the same as the maximum age of
+	// unreferenced layers which Check allows.
+	DanglingLayersMinimumAge *time.Duration
+	// DryRun causes Prune to report what it would remove, without
+	// removing anything.
+	DryRun bool
+}
+
+// PruneReport is the result of a call to Store.Prune().
+type PruneReport struct {
+	// Images are the IDs of the images which were removed.
+	Images []string `json:"images,omitempty"`
+	// Layers are the IDs of the layers which were removed, either along
+	// with images, or because they were dangling.
+	Layers []string `json:"layers,omitempty"`
+	// Reclaimed is an estimate of the amount of disk space which was
+	// freed.
+	Reclaimed int64 `json:"reclaimed"`
+}
+
+// prunePlan is the set of images and layers which Prune has decided to
+// remove, in the order in which they should be removed.
+type prunePlan struct {
+	images       []string
+	imageLayers  map[string][]string
+	imageBigData map[string]int64
+	layers       []string
+	sizes        map[string]int64
+}
+
+// Prune removes images, and optionally dangling layers, according to
+// options.
+func (s *store) Prune(options PruneOptions) (*PruneReport, error) {
+	switch options.Policy {
+	case "":
+		options.Policy = PruneLeastRecentlyUsed
+	case PruneLeastRecentlyUsed, PruneOldest, PruneLargest:
+	default:
+		return nil, fmt.Errorf("unrecognized prune policy %q", options.Policy)
+	}
+	if options.HighWatermark < 0 || options.HighWatermark > 100 || options.LowWatermark < 0 || options.LowWatermark > 100 {
+		return nil, fmt.Errorf("prune watermarks must be percentages, not %v and %v", options.HighWatermark, options.LowWatermark)
+	}
+	if options.LowWatermark == 0 || options.LowWatermark > options.HighWatermark {
+		options.LowWatermark = options.HighWatermark
+	}
+
+	plan, err := s.planPrune(options)
+	if err != nil {
+		return nil, err
+	}
+
+	report := PruneReport{}
+	if options.DryRun {
+		report.Images = plan.images
+		for _, id := range plan.images {
+			report.Layers = append(report.Layers, plan.imageLayers[id]...)
+			report.Reclaimed += plan.imageBigData[id]
+		}
+		report.Layers = append(report.Layers, plan.layers...)
+		for _, id := range report.Layers {
+			report.Reclaimed += plan.sizes[id]
+		}
+		return &report, nil
+	}
+
+	// Things may have changed since the plan was made, so skip anything
+	// which can no longer be removed.
+	for _, id := range plan.images {
+		layers, err := s.DeleteImage(id, true)
+		if err != nil {
+			if errors.Is(err, ErrImageUsedByContainer) || errors.Is(err, ErrImageUsedByIndex) || errors.Is(err, ErrImageLeased) || errors.Is(err, ErrNotAnImage) {
+				continue
+			}
+			return &report, err
+		}
+		report.Images = append(report.Images, id)
+		report.Layers = append(report.Layers, layers...)
+		report.Reclaimed += plan.imageBigData[id]
+		for _, layer := range layers {
+			report.Reclaimed += plan.sizes[layer]
+		}
+	}
+	for _, id := range plan.layers {
+		if err := s.DeleteLayer(id); err != nil {
+			if errors.Is(err, ErrLayerUnknown) || errors.Is(err, ErrLayerHasChildren) || errors.Is(err, ErrLayerUsedByImage) || errors.Is(err, ErrLayerUsedByContainer) || errors.Is(err, ErrLayerLeased) {
+				continue
+			}
+			return &report, err
+		}
+		report.Layers = append(report.Layers, id)
+		report.Reclaimed += plan.sizes[id]
+	}
+	return &report, nil
+}
+
+// planPrune decides which images and layers Prune should remove.
+func (s *store) planPrune(options PruneOptions) (*prunePlan, error) {
+	var need int64
+	if options.HighWatermark > 0 {
+		total, used, err := filesystemUsage(s.GraphRoot())
+		if err != nil {
+			return nil, err
+		}
+		if total > 0 && float64(used)*100/float64(total) > options.HighWatermark {
+			need = int64(used) - int64(float64(total)*options.LowWatermark/100)
+		}
+	}
+
+	rlstore, lstores, err := s.bothLayerStoreKinds()
+	if err != nil {
+		return nil, err
+	}
+	layers := diskUsageLayers{
+		stores: append([]roLayerStore{rlstore}, lstores...),
+		sizes:  make(map[string]int64),
+	}
+	for _, store := range layers.stores {
+		if err := store.startReading(); err != nil {
+			return nil, err
+		}
+		defer store.stopReading()
+	}
+	imageStores := s.allImageStores()
+	for _, store := range imageStores {
+		if err := store.startReading(); err != nil {
+			return nil, err
+		}
+		defer store.stopReading()
+	}
+	if err := s.containerStore.startReading(); err != nil {
+		return nil, err
+	}
+	defer s.containerStore.stopReading()
+	leased, err := s.leases.leased()
+	if err != nil {
+		return nil, err
+	}
+
+	plan := prunePlan{
+		imageLayers:  make(map[string][]string),
+		imageBigData: make(map[string]int64),
+		sizes:        layers.sizes,
+	}
+
+	rwLayers, err := rlstore.Layers()
+	if err != nil {
+		return nil, err
+	}
+	childrenByParent := make(map[string][]string)
+	for _, layer := range rwLayers {
+		childrenByParent[layer.Parent] = append(childrenByParent[layer.Parent], layer.ID)
+		if _, err := layers.chain(layer.ID); err != nil {
+			return nil, err
+		}
+	}
+
+	// Note which layers containers use, directly or indirectly.
+	containers, err := s.containerStore.Containers()
+	if err != nil {
+		return nil, err
+	}
+	containerImages := make(map[string]struct{})
+	containerLayers := make(map[string]struct{})
+	for _, container := range containers {
+		containerImages[container.ImageID] = struct{}{}
+		chain, err := layers.chain(container.LayerID)
+		if err != nil {
+			return nil, fmt.Errorf("reading layers of container %q: %w", container.ID, err)
+		}
+		for layerID := range chain {
+			containerLayers[layerID] = struct{}{}
+		}
+	}
+
+	// Note which images use which layers, and pick out the ones which we
+	// could remove.
+	type candidate struct {
+		image     Image
+		lastUsed  time.Time
+		bigData   int64
+		exclusive int64
+	}
+	var candidates []candidate
+	lastUsedTimes, err := s.imageStore.loadLastUsed()
+	if err != nil {
+		return nil, err
+	}
+	imageTopLayers := make(map[string]int)
+	imageChains := make(map[string]map[string]struct{})
+	var totalBigData int64
+	seen := make(map[string]struct{})
+	for _, store := range imageStores {
+		storeImages, err := store.Images()
+		if err != nil {
+			return nil, err
+		}
+		for _, image := range storeImages {
+			if _, ok := seen[image.ID]; ok {
+				continue
+			}
+			seen[image.ID] = struct{}{}
+			topLayers := append([]string{image.TopLayer}, image.MappedTopLayers...)
+			chain, err := layers.chain(topLayers...)
+			if err != nil {
+				return nil, fmt.Errorf("reading layers of image %q: %w", image.ID, err)
+			}
+			imageChains[image.ID] = chain
+			for _, layerID := range topLayers {
+				imageTopLayers[layerID]++
+			}
+			var bigData int64
+			for _, name := range image.BigDataNames {
+				n, err := store.BigDataSize(image.ID, name)
+				if err != nil {
+					return nil, fmt.Errorf("reading size of big data item %q for image %q: %w", name, image.ID, err)
+				}
+				bigData += n
+			}
+			totalBigData += bigData
+			if store != s.imageStore || image.ReadOnly || leased.image(image.ID) {
+				continue
+			}
+			if _, ok := containerImages[image.ID]; ok {
+				continue
+			}
+			if len(s.imageStore.indexesUsing(image.ID)) > 0 {
+				continue
+			}
+			lastUsed := lastUsedTimes[image.ID]
+			if lastUsed.IsZero() || options.Policy == PruneOldest {
+				lastUsed = image.Created
+			}
+			candidates = append(candidates, candidate{image: image, lastUsed: lastUsed, bigData: bigData})
+		}
+	}
+
+	if options.MaxSize > 0 {
+		all := make(map[string]struct{})
+		for _, chain := range imageChains {
+			for layerID := range chain {
+				all[layerID] = struct{}{}
+			}
+		}
+		if total := layers.size(all) + totalBigData; total-options.MaxSize > need {
+			need = total - options.MaxSize
+		}
+	}
+
+	// removable returns the layers which would be removed along with an
+	// image, the same way that DeleteImage picks them, given the layers
+	// which have already been slated for removal.
+	removed := make(map[string]struct{})
+	removable := func(image Image) []string {
+		var layersToRemove []string
+		slated := make(map[string]struct{})
+		for _, layerID := range image.MappedTopLayers {
+			if leased.layer(layerID) || imageTopLayers[layerID] > 0 {
+				continue
+			}
+			layersToRemove = append(layersToRemove, layerID)
+			slated[layerID] = struct{}{}
+		}
+		hasChildrenNotBeingRemoved := func(layerID string) bool {
+			layersToCheck := []string{layerID}
+			if layerID == image.TopLayer {
+				layersToCheck = append(layersToCheck, image.MappedTopLayers...)
+			}
+			for _, layerID := range layersToCheck {
+				for _, child := range childrenByParent[layerID] {
+					_, alreadyRemoved := removed[child]
+					_, beingRemoved := slated[child]
+					if !alreadyRemoved && !beingRemoved {
+						return true
+					}
+				}
+			}
+			return false
+		}
+		for layerID := image.TopLayer; layerID != ""; {
+			layer, err := rlstore.Get(layerID)
+			if err != nil {
+				break
+			}
+			if _, ok := containerLayers[layerID]; ok {
+				break
+			}
+			if leased.layer(layerID) || imageTopLayers[layerID] > 0 || hasChildrenNotBeingRemoved(layerID) {
+				break
+			}
+			layersToRemove = append(layersToRemove, layerID)
+			slated[layerID] = struct{}{}
+			layerID = layer.Parent
+		}
+		return layersToRemove
+	}
+
+	for i := range candidates {
+		imageTopLayers[candidates[i].image.TopLayer]--
+		for _, layerID := range candidates[i].image.MappedTopLayers {
+			imageTopLayers[layerID]--
+		}
+		for _, layerID := range removable(candidates[i].image) {
+			candidates[i].exclusive += layers.sizes[layerID]
+		}
+		imageTopLayers[candidates[i].image.TopLayer]++
+		for _, layerID := range candidates[i].image.MappedTopLayers {
+			imageTopLayers[layerID]++
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if options.Policy == PruneLargest {
+			return candidates[i].exclusive+candidates[i].bigData > candidates[j].exclusive+candidates[j].bigData
+		}
+		return candidates[i].lastUsed.Before(candidates[j].lastUsed)
+	})
+
+	var freed int64
+	now := time.Now()
+	for _, c := range candidates {
+		expired := options.MaxAge > 0 && now.Sub(c.lastUsed) > options.MaxAge
+		if !expired && freed >= need {
+			continue
+		}
+		imageTopLayers[c.image.TopLayer]--
+		for _, layerID := range c.image.MappedTopLayers {
+			imageTopLayers[layerID]--
+		}
+		layersToRemove := removable(c.image)
+		for _, layerID := range layersToRemove {
+			removed[layerID] = struct{}{}
+			freed += layers.sizes[layerID]
+		}
+		freed += c.bigData
+		delete(imageChains, c.image.ID)
+		plan.images = append(plan.images, c.image.ID)
+		plan.imageLayers[c.image.ID] = layersToRemove
+		plan.imageBigData[c.image.ID] = c.bigData
+	}
+
+	if options.DanglingLayers {
+		// Keep every layer which a remaining image, a container, a
+		// named layer, a leased layer, or a layer which might be about
+		// to be used depends on.
+		minimumAge := defaultMaximumUnreferencedLayerAge
+		if options.DanglingLayersMinimumAge != nil {
+			minimumAge = *options.DanglingLayersMinimumAge
+		}
+		keep := make(map[string]struct{})
+		for _, chain := range imageChains {
+			for layerID := range chain {
+				keep[layerID] = struct{}{}
+			}
+		}
+		for layerID := range containerLayers {
+			keep[layerID] = struct{}{}
+		}
+		for _, layer := range rwLayers {
+			// Like Check, assume that layers whose creation times we
+			// don't know are old enough.
+			recent := !layer.Created.IsZero() && now.Sub(layer.Created) < minimumAge
+			if len(layer.Names) > 0 || leased.layer(layer.ID) || recent || layerHasIncompleteFlag(&layer) {
+				chain, err := layers.chain(layer.ID)
+				if err != nil {
+					return nil, err
+				}
+				for layerID := range chain {
+					keep[layerID] = struct{}{}
+				}
+			}
+		}
+		depth := make(map[string]int)
+		var depthOf func(layerID string) int
+		depthOf = func(layerID string) int {
+			if d, ok := depth[layerID]; ok {
+				return d
+			}
+			d := 0
+			if layer, err := rlstore.Get(layerID); err == nil && layer.Parent != "" {
+				d = depthOf(layer.Parent) + 1
+			}
+			depth[layerID] = d
+			return d
+		}
+		for _, layer := range rwLayers {
+			if _, ok := keep[layer.ID]; ok {
+				continue
+			}
+			if _, ok := removed[layer.ID]; ok {
+				continue
+			}
+			depthOf(layer.ID)
+			plan.layers = append(plan.layers, layer.ID)
+		}
+		// Remove children before their parents.
+		sort.SliceStable(plan.layers, func(i, j int) bool {
+			return depth[plan.layers[i]] > depth[plan.layers[j]]
+		})
+	}
+
+	return &plan, nil
+}
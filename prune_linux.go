@@ -0,0 +1,18 @@
+package storage
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+// filesystemUsage returns the total size of the filesystem which contains
+// path, and how much of it is in use.
+func filesystemUsage(path string) (total, used uint64, err error) {
+	var st unix.Statfs_t
+	if err := unix.Statfs(path, &st); err != nil {
+		return 0, 0, err
+	}
+	bsize := uint64(st.Bsize) //nolint:unconvert
+	total = st.Blocks * bsize
+	used = total - st.Bfree*bsize
+	return total, used, nil
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package storage
+
+import (
+	"fmt"
+)
+
+func filesystemUsage(path string) (total, used uint64, err error) {
+	return 0, 0, fmt.Errorf("determining filesystem usage of %q: %w", path, ErrNotSupported)
+}
@@ -0,0 +1,41 @@
+package storage
+
+import (
+	drivers "github.com/containers/storage/drivers"
+)
+
+// ContainerQuota describes the limits on the disk space and inodes which a
+// container's layer can use, and how much of each it is using.
+type ContainerQuota = drivers.LayerQuota
+
+// SetContainerQuota limits the disk space and inodes which a container's
+// layer can use.  How the limits are enforced depends on the driver:
+// overlay uses XFS or ext4 project quotas, btrfs uses qgroups, zfs sets the
+// dataset's "quota" property, and vfs moves the layer's contents into a file
+// system image of the requested size.
+func (s *store) SetContainerQuota(id string, size, inodes uint64) error {
+	layerID, err := s.ContainerLayerID(id)
+	if err != nil {
+		return err
+	}
+	_, err = writeToLayerStore(s, func(rlstore rwLayerStore) (struct{}, error) {
+		return struct{}{}, rlstore.setQuota(layerID, size, inodes)
+	})
+	return err
+}
+
+func (s *store) GetContainerQuota(id string) (*ContainerQuota, error) {
+	layerID, err := s.ContainerLayerID(id)
+	if err != nil {
+		return nil, err
+	}
+	rlstore, err := s.getLayerStore()
+	if err != nil {
+		return nil, err
+	}
+	if err := rlstore.startReading(); err != nil {
+		return nil, err
+	}
+	defer rlstore.stopReading()
+	return rlstore.getQuota(layerID)
+}
@@ -0,0 +1,241 @@
+package storage
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/containers/storage/pkg/archive"
+	"github.com/sirupsen/logrus"
+)
+
+// RebaseConflict describes a path which a layer changes, and which is
+// different in the layer's new parent than it was in its old parent.
+type RebaseConflict struct {
+	Path string `json:"path"`
+	// Whiteout is true if the layer removes the path, or everything under
+	// it, rather than writing it.
+	Whiteout bool `json:"whiteout,omitempty"`
+	// ParentChange is how the path differs between the old parent and the
+	// new one.
+	ParentChange archive.ChangeType `json:"parent-change"`
+}
+
+// RebaseLayer creates a new layer on top of newParent with the same changes
+// which the layer makes to its current parent, and moves the layer's names to
+// it.  Its metadata, big data, flags, and labels are copied.  If newParent is
+// "", the new layer has no parent.  The original layer is not removed.
+//
+// Paths which the layer changes, and which also differ between its old parent
+// and its new one, are returned as conflicts.  The new layer is created
+// regardless, and the caller can delete it if the conflicts are unacceptable.
+func (s *store) RebaseLayer(id, newParent string) (*Layer, []RebaseConflict, error) {
+	layer, err := s.Layer(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	if layer.ReadOnly {
+		return nil, nil, fmt.Errorf("rebasing layer %q: %w", layer.ID, ErrStoreIsReadOnly)
+	}
+	if newParent != "" {
+		parent, err := s.Layer(newParent)
+		if err != nil {
+			return nil, nil, fmt.Errorf("locating new parent layer %q: %w", newParent, err)
+		}
+		newParent = parent.ID
+		for ancestor := parent; ancestor != nil; {
+			if ancestor.ID == layer.ID {
+				return nil, nil, fmt.Errorf("layer %q can't be rebased onto its own child %q", layer.ID, newParent)
+			}
+			if ancestor.Parent == "" {
+				break
+			}
+			if ancestor, err = s.Layer(ancestor.Parent); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+
+	diff, err := os.CreateTemp(s.GraphRoot(), ".rebase-")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer func() {
+		diff.Close()
+		os.Remove(diff.Name())
+	}()
+	if _, _, err := s.writeFlattenedDiff(layer.ID, layer.Parent, diff); err != nil {
+		return nil, nil, err
+	}
+	if _, err := diff.Seek(0, io.SeekStart); err != nil {
+		return nil, nil, err
+	}
+	changes, err := diffPaths(diff)
+	if err != nil {
+		return nil, nil, fmt.Errorf("reading diff of layer %q: %w", layer.ID, err)
+	}
+	if _, err := diff.Seek(0, io.SeekStart); err != nil {
+		return nil, nil, err
+	}
+	parentChanges, err := s.parentDifferences(layer.Parent, newParent)
+	if err != nil {
+		return nil, nil, err
+	}
+	conflicts := rebaseConflicts(changes, parentChanges)
+
+	options := &LayerOptions{
+		Flags:  copyMapPreferringNil(layer.Flags),
+		Labels: copyMapPreferringNil(layer.Labels),
+	}
+	options.UIDMap = copySlicePreferringNil(layer.UIDMap)
+	options.GIDMap = copySlicePreferringNil(layer.GIDMap)
+	for _, key := range layer.BigDataNames {
+		rc, err := s.LayerBigData(layer.ID, key)
+		if err != nil {
+			return nil, nil, err
+		}
+		data, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return nil, nil, fmt.Errorf("reading big data item %q for layer %q: %w", key, layer.ID, err)
+		}
+		options.BigData = append(options.BigData, LayerBigDataOption{Key: key, Data: bytes.NewReader(data)})
+	}
+	rebased, _, err := s.PutLayer("", newParent, nil, layer.MountLabel, false, options, diff)
+	if err != nil {
+		return nil, nil, fmt.Errorf("creating rebased layer: %w", err)
+	}
+
+	rebased, err = writeToLayerStore(s, func(rlstore rwLayerStore) (*Layer, error) {
+		if layer.Metadata != "" {
+			if err := rlstore.SetMetadata(rebased.ID, layer.Metadata); err != nil {
+				return nil, err
+			}
+		}
+		if len(layer.Names) > 0 {
+			// Assigning the names to the new layer takes them away
+			// from the original one.
+			if err := rlstore.updateNames(rebased.ID, layer.Names, setNames); err != nil {
+				return nil, err
+			}
+		}
+		return rlstore.Get(rebased.ID)
+	})
+	if err != nil {
+		if err2 := s.DeleteLayer(rebased.ID); err2 != nil {
+			logrus.Errorf("While recovering from a failure to rebase layer %q, error deleting layer %q: %v", layer.ID, rebased.ID, err2)
+		}
+		return nil, nil, err
+	}
+	return rebased, conflicts, nil
+}
+
+// diffPaths reads a layer diff, and returns the paths which it writes or, if
+// the value is true, removes.  Directories which it writes are not included.
+func diffPaths(r io.Reader) (map[string]bool, error) {
+	paths := make(map[string]bool)
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return paths, nil
+			}
+			return nil, err
+		}
+		name := path.Clean("/" + hdr.Name)
+		dir, base := path.Split(name)
+		switch {
+		case base == archive.WhiteoutOpaqueDir:
+			paths[path.Clean(dir)] = true
+		case strings.HasPrefix(base, archive.WhiteoutMetaPrefix):
+			// Other metadata entries don't change anything by themselves.
+		case strings.HasPrefix(base, archive.WhiteoutPrefix):
+			paths[path.Join(dir, strings.TrimPrefix(base, archive.WhiteoutPrefix))] = true
+		case hdr.Typeflag != tar.TypeDir:
+			paths[name] = false
+		}
+	}
+}
+
+// parentDifferences returns the paths which differ between two layers,
+// either of which can be "".
+func (s *store) parentDifferences(from, to string) (map[string]archive.ChangeType, error) {
+	differences := make(map[string]archive.ChangeType)
+	if from == to {
+		return differences, nil
+	}
+	if from == "" || to == "" {
+		// Everything in the other layer is different.
+		layer, kind := to, archive.ChangeType(archive.ChangeAdd)
+		if to == "" {
+			layer, kind = from, archive.ChangeDelete
+		}
+		pr, pw := io.Pipe()
+		go func() {
+			_, _, err := s.writeFlattenedDiff(layer, "", pw)
+			pw.CloseWithError(err)
+		}()
+		paths, err := diffPaths(pr)
+		pr.Close()
+		if err != nil {
+			return nil, err
+		}
+		for p := range paths {
+			differences[p] = kind
+		}
+		return differences, nil
+	}
+	changes, err := s.Changes(from, to)
+	if err != nil {
+		return nil, fmt.Errorf("comparing layers %q and %q: %w", from, to, err)
+	}
+	for _, change := range changes {
+		differences[path.Clean("/"+change.Path)] = change.Kind
+	}
+	return differences, nil
+}
+
+// rebaseConflicts returns the paths which a layer changes, which also differ
+// between its old and new parents.  A path also conflicts if the layer removes
+// a directory which contains differences, or if the new parent no longer has a
+// directory which contains paths that the layer writes.
+func rebaseConflicts(changes map[string]bool, parentChanges map[string]archive.ChangeType) []RebaseConflict {
+	parentPaths := make([]string, 0, len(parentChanges))
+	for p := range parentChanges {
+		parentPaths = append(parentPaths, p)
+	}
+	sort.Strings(parentPaths)
+
+	var conflicts []RebaseConflict
+	for p, whiteout := range changes {
+		if kind, ok := parentChanges[p]; ok {
+			conflicts = append(conflicts, RebaseConflict{Path: p, Whiteout: whiteout, ParentChange: kind})
+			continue
+		}
+		if whiteout {
+			prefix := strings.TrimSuffix(p, "/") + "/"
+			i := sort.SearchStrings(parentPaths, prefix)
+			if i < len(parentPaths) && strings.HasPrefix(parentPaths[i], prefix) {
+				conflicts = append(conflicts, RebaseConflict{Path: p, Whiteout: true, ParentChange: parentChanges[parentPaths[i]]})
+			}
+			continue
+		}
+		for dir := path.Dir(p); dir != "/"; dir = path.Dir(dir) {
+			if kind, ok := parentChanges[dir]; ok && kind == archive.ChangeDelete {
+				conflicts = append(conflicts, RebaseConflict{Path: p, ParentChange: kind})
+				break
+			}
+		}
+	}
+	sort.Slice(conflicts, func(i, j int) bool {
+		return conflicts[i].Path < conflicts[j].Path
+	})
+	return conflicts
+}
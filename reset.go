@@ -0,0 +1,102 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/containers/storage/types"
+	"github.com/sirupsen/logrus"
+)
+
+// ResetContainerLayer replaces a container's read-write layer with a new,
+// empty one on top of the same parent layer, discarding any changes which
+// were made to the container's file system.  Everything else about the
+// container, including its ID, names, metadata, big data items and the
+// contents of its ContainerDirectory, is left alone.  A size limit which was
+// set for the old layer using SetContainerQuota is applied to the new one.
+// The container's layer must not be mounted.
+func (s *store) ResetContainerLayer(id string) error {
+	rlstore, lstores, err := s.bothLayerStoreKinds()
+	if err != nil {
+		return err
+	}
+	if err := rlstore.startWriting(); err != nil {
+		return err
+	}
+	defer rlstore.stopWriting()
+	for _, s := range lstores {
+		store := s
+		if err := store.startReading(); err != nil {
+			return err
+		}
+		defer store.stopReading()
+	}
+	if err := s.containerStore.startWriting(); err != nil {
+		return err
+	}
+	defer s.containerStore.stopWriting()
+
+	container, err := s.containerStore.Get(id)
+	if err != nil {
+		return err
+	}
+	oldLayer, err := rlstore.Get(container.LayerID)
+	if err != nil {
+		return fmt.Errorf("locating layer %q of container %q: %w", container.LayerID, container.ID, err)
+	}
+	mounts, err := rlstore.Mounted(oldLayer.ID)
+	if err != nil {
+		return err
+	}
+	if mounts > 0 {
+		return fmt.Errorf("resetting layer %q of container %q: %w", oldLayer.ID, container.ID, ErrLayerMounted)
+	}
+	var parentLayer *Layer
+	if oldLayer.Parent != "" {
+		for _, lstore := range append([]roLayerStore{rlstore}, lstores...) {
+			if l, err := lstore.Get(oldLayer.Parent); err == nil && l != nil {
+				parentLayer = l
+				break
+			}
+		}
+		if parentLayer == nil {
+			return fmt.Errorf("locating parent %q of layer %q: %w", oldLayer.Parent, oldLayer.ID, ErrLayerUnknown)
+		}
+	}
+	quota, err := rlstore.getQuota(oldLayer.ID)
+	if err != nil {
+		logrus.Debugf("Reading the quota for layer %q: %v", oldLayer.ID, err)
+		quota = nil
+	}
+
+	layerOptions := &LayerOptions{
+		IDMappingOptions: types.IDMappingOptions{
+			HostUIDMapping: len(oldLayer.UIDMap) == 0,
+			HostGIDMapping: len(oldLayer.GIDMap) == 0,
+			UIDMap:         copySlicePreferringNil(oldLayer.UIDMap),
+			GIDMap:         copySlicePreferringNil(oldLayer.GIDMap),
+		},
+		Labels:   oldLayer.Labels,
+		Volatile: container.volatileStore || s.transientStore,
+	}
+	newLayer, _, err := rlstore.create(context.Background(), "", parentLayer, nil, oldLayer.MountLabel, nil, layerOptions, true, nil, nil)
+	if err != nil {
+		return fmt.Errorf("creating a new layer for container %q: %w", container.ID, err)
+	}
+	if quota != nil && quota.Size != 0 {
+		err = rlstore.setQuota(newLayer.ID, quota.Size, quota.Inodes)
+	}
+	if err == nil {
+		err = s.containerStore.setLayer(container.ID, newLayer.ID)
+	}
+	if err != nil {
+		if err2 := rlstore.deleteWhileHoldingLock(newLayer.ID); err2 != nil {
+			logrus.Errorf("While recovering from a failure to reset container %q, error deleting layer %q: %v", container.ID, newLayer.ID, err2)
+		}
+		return err
+	}
+	if err := rlstore.deleteWhileHoldingLock(oldLayer.ID); err != nil {
+		return fmt.Errorf("deleting old layer %q of container %q: %w", oldLayer.ID, container.ID, err)
+	}
+	return nil
+}
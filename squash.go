@@ -0,0 +1,174 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/sirupsen/logrus"
+)
+
+// SquashOptions controls how SquashLayers creates a squashed layer.
+type SquashOptions struct {
+	// ID is the ID to give the new layer.  If it is not set, a random ID
+	// is generated.
+	ID string
+	// Names are names to give the new layer.
+	Names []string
+	// Image, if set, is the ID or name of an image whose top layer is the
+	// top of the chain being squashed.  The image is changed to use the
+	// new layer as its top layer instead.
+	Image string
+	// RemoveSquashed causes the layers which were squashed to be deleted
+	// afterward, starting with the top layer, and stopping at the first
+	// one which is still used by something else.
+	RemoveSquashed bool
+}
+
+// SquashLayers creates a new layer with the combined contents of topID and its
+// parents, up to but not including baseID, which becomes the new layer's
+// parent.  If baseID is "", the new layer has no parent, and contains all of
+// topID's contents.  Unless options.RemoveSquashed is set, the original layers
+// are not removed, and once nothing uses them, they are dangling layers which
+// Prune can remove.
+func (s *store) SquashLayers(topID, baseID string, options *SquashOptions) (*Layer, error) {
+	if options == nil {
+		options = &SquashOptions{}
+	}
+	if options.Image != "" {
+		image, err := s.Image(options.Image)
+		if err != nil {
+			return nil, err
+		}
+		top, err := s.Layer(topID)
+		if err != nil {
+			return nil, err
+		}
+		if image.TopLayer != top.ID {
+			return nil, fmt.Errorf("image %q has top layer %q, not %q", image.ID, image.TopLayer, top.ID)
+		}
+	}
+
+	diff, err := os.CreateTemp(s.GraphRoot(), ".squash-")
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		diff.Close()
+		os.Remove(diff.Name())
+	}()
+	top, base, err := s.writeFlattenedDiff(topID, baseID, diff)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := diff.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	layerOptions := &LayerOptions{}
+	layerOptions.UIDMap = copySlicePreferringNil(top.UIDMap)
+	layerOptions.GIDMap = copySlicePreferringNil(top.GIDMap)
+	layer, _, err := s.PutLayer(options.ID, base, options.Names, top.MountLabel, false, layerOptions, diff)
+	if err != nil {
+		return nil, fmt.Errorf("creating squashed layer: %w", err)
+	}
+
+	if options.Image != "" {
+		if _, err := writeToImageStore(s, func() (struct{}, error) {
+			image, err := s.imageStore.Get(options.Image)
+			if err != nil {
+				return struct{}{}, err
+			}
+			if image.TopLayer != top.ID {
+				return struct{}{}, fmt.Errorf("image %q has top layer %q, not %q", image.ID, image.TopLayer, top.ID)
+			}
+			return struct{}{}, s.imageStore.setTopLayer(image.ID, layer.ID)
+		}); err != nil {
+			if err2 := s.DeleteLayer(layer.ID); err2 != nil {
+				logrus.Errorf("While recovering from a failure to update image %q, error deleting layer %q: %v", options.Image, layer.ID, err2)
+			}
+			return nil, err
+		}
+	}
+
+	if options.RemoveSquashed {
+		for id := top.ID; id != "" && id != base; {
+			squashed, err := s.Layer(id)
+			if err != nil {
+				return nil, err
+			}
+			if err := s.DeleteLayer(squashed.ID); err != nil {
+				if errors.Is(err, ErrLayerHasChildren) || errors.Is(err, ErrLayerUsedByImage) || errors.Is(err, ErrLayerUsedByContainer) || errors.Is(err, ErrLayerLeased) || errors.Is(err, ErrNotALayer) {
+					// It, and therefore its parents, are still needed.
+					break
+				}
+				return nil, fmt.Errorf("removing squashed layer %q: %w", squashed.ID, err)
+			}
+			id = squashed.Parent
+		}
+	}
+	return layer, nil
+}
+
+// writeFlattenedDiff writes the tarstream which, applied on top of baseID,
+// produces the contents of topID, to w.  It returns the top layer and the ID of
+// the base layer.
+func (s *store) writeFlattenedDiff(topID, baseID string, w io.Writer) (*Layer, string, error) {
+	// Producing the tarstream might mount layers, so treat this like a
+	// Mount, the way Diff does.
+	if err := s.startUsingGraphDriver(); err != nil {
+		return nil, "", err
+	}
+	defer s.stopUsingGraphDriver()
+
+	rlstore, lstores, err := s.bothLayerStoreKindsLocked()
+	if err != nil {
+		return nil, "", err
+	}
+	write := func(store roLayerStore) (*Layer, string, error) {
+		top, err := store.Get(topID)
+		if err != nil {
+			return nil, "", err
+		}
+		base := ""
+		if baseID != "" {
+			layer, err := store.Get(baseID)
+			if err != nil {
+				return nil, "", fmt.Errorf("locating base layer %q alongside layer %q: %w", baseID, top.ID, err)
+			}
+			base = layer.ID
+		}
+		rc, err := store.flattenedDiff(base, top.ID)
+		if err != nil {
+			return nil, "", err
+		}
+		defer rc.Close()
+		if _, err := io.Copy(w, rc); err != nil {
+			return nil, "", err
+		}
+		return top, base, nil
+	}
+
+	// The overlay driver requires the primary layer store to be locked
+	// RW; see drivers/overlay.Driver.getMergedDir.
+	if err := rlstore.startWriting(); err != nil {
+		return nil, "", err
+	}
+	if rlstore.Exists(topID) {
+		defer rlstore.stopWriting()
+		return write(rlstore)
+	}
+	rlstore.stopWriting()
+	for _, store := range lstores {
+		if err := store.startReading(); err != nil {
+			return nil, "", err
+		}
+		if store.Exists(topID) {
+			defer store.stopReading()
+			return write(store)
+		}
+		store.stopReading()
+	}
+	return nil, "", fmt.Errorf("locating layer %q: %w", topID, ErrLayerUnknown)
+}
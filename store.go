@@ -1,11 +1,14 @@
 package storage
 
 import (
+	"archive/tar"
+	"context"
 	_ "embed"
 	"encoding/base64"
 	"errors"
 	"fmt"
 	"io"
+	"iter"
 	"maps"
 	"os"
 	"path/filepath"
@@ -67,6 +70,9 @@ type roMetadataStore interface {
 type rwMetadataStore interface {
 	// SetMetadata updates the metadata associated with the item with the specified ID.
 	SetMetadata(id, metadata string) error
+
+	// SetLabels replaces the labels associated with the item with the specified ID.
+	SetLabels(id string, labels map[string]string) error
 }
 
 // metadataStore wraps up methods for getting and setting metadata associated with IDs.
@@ -93,6 +99,17 @@ type MultiListOptions struct {
 	Images     bool // if true, Images will be listed in the result
 	Layers     bool // if true, layers will be listed in the result
 	Containers bool // if true, containers will be listed in the result
+	Indexes    bool // if true, image indexes will be listed in the result
+	// LabelSelector, if set, limits the result to layers, images, and
+	// containers with labels which match it.  It is a comma-separated list
+	// of terms which must all match, each of which is "key", "!key",
+	// "key=value", or "key!=value".  A backslash makes the character after
+	// it part of a key or value, so the term key=a\,b matches a value of
+	// "a,b".
+	// Stores index their objects' labels, so a selector which includes a
+	// "key" or "key=value" term only examines the objects which have that
+	// label.
+	LabelSelector string
 }
 
 // MultiListResult contains slices of Images, Layers or Containers listed by MultiList method
@@ -100,6 +117,7 @@ type MultiListResult struct {
 	Images     []Image
 	Layers     []Layer
 	Containers []Container
+	Indexes    []ImageIndex
 }
 
 // An roBigDataStore wraps up the read-only big-data related methods of the
@@ -226,6 +244,11 @@ type Store interface {
 	//   }
 	PutLayer(id, parent string, names []string, mountLabel string, writeable bool, options *LayerOptions, diff io.Reader) (*Layer, int64, error)
 
+	// PutLayerWithContext is like PutLayer, but stops reading the diff if
+	// ctx is cancelled, in which case the partially-created layer is
+	// removed, and ctx.Err() is returned.
+	PutLayerWithContext(ctx context.Context, id, parent string, names []string, mountLabel string, writeable bool, options *LayerOptions, diff io.Reader) (*Layer, int64, error)
+
 	// CreateImage creates a new image, optionally with the specified ID
 	// (one will be assigned if none is specified), with optional names,
 	// referring to a specified image, and with optional metadata.  An
@@ -254,6 +277,12 @@ type Store interface {
 	// the object directly.
 	SetMetadata(id, metadata string) error
 
+	// SetLabels replaces the labels which are associated with a layer,
+	// image, or container (whichever the passed-in ID refers to).  The
+	// labels can be read using Layer, Image, or Container, and used to
+	// select them using MultiList, ImagesByLabel, or ContainersByLabel.
+	SetLabels(id string, labels map[string]string) error
+
 	// Exists checks if there is a layer, image, or container which has the
 	// passed-in ID or name.
 	Exists(id string) bool
@@ -284,8 +313,30 @@ type Store interface {
 	// reached, at which point the list of removed layers is returned.  If
 	// the commit argument is false, the image and layers are not removed,
 	// but the list of layers which would be removed is still returned.
+	// Images which are members of an image index can't be deleted.
 	DeleteImage(id string, commit bool) (layers []string, err error)
 
+	// CreateImageIndex creates an image index, which refers to images
+	// which are builds of the same image for different platforms.  If id
+	// is empty, a random one is generated.  The images, which can be
+	// specified using their IDs or names, can't be deleted until the index
+	// is.
+	CreateImageIndex(id string, names []string, members []ImageIndexMember) (*ImageIndex, error)
+
+	// ImageIndex returns the image index with the specified ID or name.
+	ImageIndex(id string) (*ImageIndex, error)
+
+	// ImageIndexes returns a list of all known image indexes.
+	ImageIndexes() ([]ImageIndex, error)
+
+	// ImageForPlatform returns an image from an image index which is for
+	// the specified platform.  If the platform's variant or OS version are
+	// not set, images for any variant or OS version match.
+	ImageForPlatform(index string, platform ImagePlatform) (*Image, error)
+
+	// DeleteImageIndex removes an image index, but not its images.
+	DeleteImageIndex(id string) error
+
 	// DeleteContainer removes the specified container and its layer.  If
 	// there is no matching container, or if the container exists but its
 	// layer does not, an error will be returned.
@@ -335,20 +386,129 @@ type Store interface {
 	// Changes returns a summary of the changes which would need to be made
 	// to one layer to make its contents the same as a second layer.  If
 	// the first layer is not specified, the second layer's parent is
-	// assumed.  Each Change structure contains a Path relative to the
+	// assumed.  The first layer need not be related to the second one,
+	// but unless it is the second layer's parent, it must be in the same
+	// layer store, and the complete contents of both layers are
+	// compared.  Each Change structure contains a Path relative to the
 	// layer's root directory, and a Kind which is either ChangeAdd,
 	// ChangeModify, or ChangeDelete.
 	Changes(from, to string) ([]archive.Change, error)
 
 	// DiffSize returns a count of the size of the tarstream which would
-	// specify the changes returned by Changes.
+	// specify the changes returned by Changes.  As with Changes, unless the
+	// first layer is the second layer's parent, both must be in the same
+	// layer store.
 	DiffSize(from, to string) (int64, error)
 
 	// Diff returns the tarstream which would specify the changes returned
-	// by Changes.  If options are passed in, they can override default
-	// behaviors.
+	// by Changes.  As with Changes, unless the first layer is the second
+	// layer's parent, both must be in the same layer store, or
+	// ErrLayerUnknown is returned.  If options are passed in, they can
+	// override default behaviors.
 	Diff(from, to string, options *DiffOptions) (io.ReadCloser, error)
 
+	// SquashLayers creates a new layer with the combined contents of the
+	// top layer and its parents, up to but not including the base layer,
+	// which becomes the new layer's parent.  If the base layer is not
+	// specified, the new layer has no parent.  If options name an image
+	// whose top layer is the top layer, the image is changed to use the
+	// new layer.  The original layers are left in place unless options ask
+	// for them to be removed.
+	SquashLayers(topID, baseID string, options *SquashOptions) (*Layer, error)
+
+	// RebaseLayer creates a new layer on top of a different parent, with
+	// the same changes which a layer makes to its current parent, moves
+	// the layer's names to it, and copies its metadata, big data, and
+	// flags.  Paths
+	// which the layer changes which also differ between the old parent and
+	// the new one are returned as conflicts.  The original layer is not
+	// removed.
+	RebaseLayer(id, newParent string) (*Layer, []RebaseConflict, error)
+
+	// LayerFiles returns an iterator over the headers of the entries in a
+	// layer's diff, without mounting the layer.  They are read from the
+	// tar-split metadata recorded when the diff was applied, or from the
+	// layer's zstd:chunked TOC.
+	LayerFiles(id string) (iter.Seq2[*tar.Header, error], error)
+
+	// FindPath reports which layer in an image's chain of layers provides
+	// a path, or whites it out.  If no layer mentions the path, the
+	// returned error wraps os.ErrNotExist.
+	FindPath(imageID, path string) (*LayerPath, error)
+
+	// OpenLayerFile opens a regular file in the filesystem formed by a
+	// layer and its parents, following symbolic links and honoring
+	// whiteouts, without mounting anything.  The contents are read using
+	// the driver's DiffGetter, so it must implement
+	// drivers.DiffGetterDriver.
+	OpenLayerFile(layerID, path string) (io.ReadCloser, error)
+
+	// OpenImageFile is like OpenLayerFile, but opens a file in an image's
+	// filesystem.
+	OpenImageFile(imageID, path string) (io.ReadCloser, error)
+
+	// CreateLayerDelta writes a byte-level delta between two layers'
+	// diffs, which ApplyLayerDelta can use to recreate the new layer
+	// given the old one.  Chunks of files in the new layer which are also
+	// present in the old layer are not included in the delta.
+	CreateLayerDelta(oldID, newID string, delta io.Writer) error
+
+	// ApplyLayerDelta recreates a layer from a delta created by
+	// CreateLayerDelta and the layer it was created from, verifying that
+	// the result matches the original layer's uncompressed digest.  The
+	// new layer's parent is the original layer's parent, which must be
+	// present.
+	ApplyLayerDelta(baseID string, delta io.Reader) (*Layer, error)
+
+	// SetLayerFetcher sets the LayerFetcher which is used to retrieve the
+	// contents of files in layers which were pulled with the
+	// defer_file_contents pull option.  Files are fetched as they are
+	// opened with OpenLayerFile, and all of a layer's files, and its
+	// parents', are fetched before it is mounted or its diff is read.
+	SetLayerFetcher(fetcher LayerFetcher)
+
+	// VerifyLayer checks that a layer's contents, and optionally its
+	// parents', still match the digests which were recorded when they
+	// were created, without mounting them, and reports the first file in
+	// each layer which doesn't match.  Layers are only reported as
+	// damaged in the results; the returned error is for problems such as
+	// the layer not existing.
+	VerifyLayer(id string, options *VerifyLayerOptions) ([]LayerVerification, error)
+
+	// SetContainerQuota limits the disk space, in bytes, and the number of
+	// inodes which a container's layer can use.  A limit of 0 removes any
+	// limit that was set before.  The error wraps ErrQuotaNotSupported if
+	// the driver can't enforce the requested limits.
+	SetContainerQuota(id string, size, inodes uint64) error
+
+	// GetContainerQuota returns the limits which are set for a container's
+	// layer, and how much disk space and how many inodes it is using.
+	GetContainerQuota(id string) (*ContainerQuota, error)
+
+	// CommitContainer creates a new image from a container, whose top
+	// layer is a new read-only layer with the contents of the container's
+	// layer, on top of the container's image's top layer.  It returns the
+	// new image.
+	CommitContainer(id string, options *CommitOptions) (*Image, error)
+
+	// CloneContainer creates a new container whose read-write layer starts
+	// out as a copy of an existing container's layer, with copies of the
+	// existing container's big data items and ContainerDirectory files.
+	// If newID is empty, a random ID is generated.
+	CloneContainer(srcID, newID string, names []string, options *CloneOptions) (*Container, error)
+
+	// ResetContainerLayer discards a container's read-write layer and
+	// replaces it with a new, empty one on top of the same parent layer,
+	// keeping the container's ID, names, metadata, big data items and
+	// ContainerDirectory contents.  It fails with ErrLayerMounted if the
+	// layer is mounted.
+	ResetContainerLayer(id string) error
+
+	// DiffWithContext is like Diff, but if ctx is cancelled, reading from
+	// the returned stream fails with ctx.Err(), and the locks it holds are
+	// released without waiting for the caller to close it.
+	DiffWithContext(ctx context.Context, from, to string, options *DiffOptions) (io.ReadCloser, error)
+
 	// ApplyDiff applies a tarstream to a layer.  Information about the
 	// tarstream is cached with the layer.  Typically, a layer which is
 	// populated using a tarstream will be expected to not be modified in
@@ -363,6 +523,13 @@ type Store interface {
 	//   }
 	ApplyDiff(to string, diff io.Reader) (int64, error)
 
+	// ApplyDiffWithContext is like ApplyDiff, but accepts options, which
+	// can be nil, and stops reading the diff, and returns ctx.Err(), if ctx
+	// is cancelled.  If no diff had been applied to the layer before,
+	// whatever had been applied is then discarded, so that the call can be
+	// retried.
+	ApplyDiffWithContext(ctx context.Context, to string, options *ApplyDiffOptions, diff io.Reader) (int64, error)
+
 	// PrepareStagedLayer applies a diff to a layer.
 	// It is the caller responsibility to clean the staging directory if it is not
 	// successfully applied with ApplyStagedLayer.
@@ -370,6 +537,12 @@ type Store interface {
 	// with the returned [drivers.DriverWithDifferOutput] object.
 	PrepareStagedLayer(options *drivers.ApplyDiffWithDifferOpts, differ drivers.Differ) (*drivers.DriverWithDifferOutput, error)
 
+	// PrepareStagedLayerWithContext is like PrepareStagedLayer, but stops
+	// with an error when ctx is cancelled.  In that case the staging
+	// directory is removed before it returns, so the caller doesn't need to
+	// call CleanupStagedLayer.
+	PrepareStagedLayerWithContext(ctx context.Context, options *drivers.ApplyDiffWithDifferOpts, differ drivers.Differ) (*drivers.DriverWithDifferOutput, error)
+
 	// ApplyStagedLayer combines the functions of creating a layer and using the staging
 	// directory to populate it.
 	// It marks the layer for automatic removal if applying the diff fails for any reason.
@@ -393,6 +566,18 @@ type Store interface {
 	// specified TOC digest value recorded for them.
 	LayersByTOCDigest(d digest.Digest) ([]Layer, error)
 
+	// AddLayerProvenance records that a layer's contents were retrieved
+	// from provenance.SourceReference, for example when an existing layer
+	// is reused while pulling another image, so that LayersBySource finds
+	// it.  An entry which was recorded for the same reference is replaced.
+	AddLayerProvenance(id string, provenance LayerProvenance) error
+
+	// LayersBySource returns a slice of the layers whose provenance
+	// records that they were pulled from the specified reference.  If the
+	// reference has neither a tag nor a digest, layers which were pulled
+	// using any tag or digest in that repository are also returned.
+	LayersBySource(ref string) ([]Layer, error)
+
 	// LayerSize returns a cached approximation of the layer's size, or -1
 	// if we don't have a value on hand.
 	LayerSize(id string) (int64, error)
@@ -430,6 +615,14 @@ type Store interface {
 	// Duplicate names are removed from the list automatically.
 	RemoveNames(id string, names []string) error
 
+	// NameHistory returns the recorded changes to which image in the
+	// writeable image store a name has referred to, oldest first.
+	NameHistory(name string) ([]NameHistoryEntry, error)
+
+	// RollbackName undoes the most recent steps changes to which image a
+	// name refers to.  The rollback is itself recorded as a change.
+	RollbackName(name string, steps int) error
+
 	// ListImageBigData retrieves a list of the (possibly large) chunks of
 	// named data associated with an image.
 	ListImageBigData(id string) ([]string, error)
@@ -479,6 +672,10 @@ type Store interface {
 	// ImageSize computes the size of the image's layers and ancillary data.
 	ImageSize(id string) (int64, error)
 
+	// ImageSizeWithContext is like ImageSize, but returns ctx.Err() if ctx
+	// is cancelled before the size is computed.
+	ImageSizeWithContext(ctx context.Context, id string) (int64, error)
+
 	// ListContainerBigData retrieves a list of the (possibly large) chunks of
 	// named data associated with a container.
 	ListContainerBigData(id string) ([]string, error)
@@ -518,6 +715,16 @@ type Store interface {
 	// named ImageDigestBigDataKey whose contents have the specified digest.
 	ImagesByDigest(d digest.Digest) ([]*Image, error)
 
+	// ImagesByLabel returns a list of images with labels which match a
+	// selector, using the syntax described for
+	// MultiListOptions.LabelSelector.
+	ImagesByLabel(selector string) ([]Image, error)
+
+	// ContainersByLabel returns a list of containers with labels which
+	// match a selector, using the syntax described for
+	// MultiListOptions.LabelSelector.
+	ContainersByLabel(selector string) ([]Container, error)
+
 	// Container returns a specific container.
 	Container(id string) (*Container, error)
 
@@ -593,10 +800,15 @@ type Store interface {
 	// Tries to clean up remainders of previous containers or layers that are not
 	// references in the json files. These can happen in the case of unclean
 	// shutdowns or regular restarts in transient store mode.
+	// Layers which have leases are left alone.
 	GarbageCollect() error
 
 	// Check returns a report of things that look wrong in the store.
 	Check(options *CheckOptions) (CheckReport, error)
+
+	// CheckWithContext is like Check, but returns ctx.Err() if ctx is
+	// cancelled before the check is complete.
+	CheckWithContext(ctx context.Context, options *CheckOptions) (CheckReport, error)
 	// Repair attempts to remediate problems mentioned in the CheckReport,
 	// usually by deleting layers and images which are damaged.  If the
 	// right options are set, it will remove containers as well.
@@ -610,6 +822,69 @@ type Store interface {
 
 	// Dedup deduplicates layers in the store.
 	Dedup(DedupArgs) (drivers.DedupResult, error)
+
+	// DedupWithContext is like Dedup, but returns ctx.Err() if ctx is
+	// cancelled before deduplication is complete.
+	DedupWithContext(ctx context.Context, req DedupArgs) (drivers.DedupResult, error)
+
+	// Begin starts a transaction, which can be used to create layers,
+	// images, and containers, and to set big data items for images and
+	// containers, so that either all of those changes take effect, when the
+	// transaction is committed, or none of them do.
+	// The store remains locked until the transaction is committed or rolled
+	// back, so the caller must not call other Store methods in the meantime.
+	// A transaction which was left incomplete by a process which exited is
+	// rolled back by the next call to GetStore or Begin.
+	Begin() (Transaction, error)
+
+	// Watch returns a channel which receives an Event for each change to
+	// layers, images, and containers which matches the filter, including
+	// changes made by other processes.  Changes are noticed by periodically
+	// checking the stores' lock files, so events are not delivered
+	// immediately, and a change which is reverted before it is noticed is not
+	// reported.  The channel is closed after ctx is cancelled, or if
+	// checking for changes fails repeatedly.
+	Watch(ctx context.Context, filter *WatchFilter) (<-chan Event, error)
+
+	// ExportImage writes an image, its layers, its big data items, and its
+	// names to dest as an OCI image layout.  If dest ends in ".tar", the
+	// layout is written as a tar archive, otherwise dest is a directory,
+	// which must not already contain an image layout.  Layers are written
+	// gzip-compressed.
+	ExportImage(id, dest string) error
+
+	// ImportImage reads an image which was written by ExportImage, or an OCI
+	// image layout directory or archive containing a single image, and adds
+	// it to the store.  Images written by ExportImage keep their IDs, names,
+	// metadata, and big data items.  Layers which are already present are
+	// reused.  If the import fails, no layers or images are left behind.
+	ImportImage(src string) (*Image, error)
+
+	// AcquireLease protects a layer or an image, specified by name or ID,
+	// from being deleted until the lease is released or, if ttl is
+	// positive, until ttl has passed.  It returns an ID which can be passed
+	// to ReleaseLease.  A layer or image can have any number of leases, and
+	// is protected while any of them remain.
+	// While a layer has a lease, DeleteLayer fails, and DeleteImage and
+	// Check treat it as being in use.  While an image has a lease,
+	// DeleteImage fails.
+	// Leases are recorded under the run root, so they are shared with other
+	// processes, and do not survive a reboot.
+	AcquireLease(id string, ttl time.Duration) (string, error)
+
+	// ReleaseLease discards a lease which was returned by AcquireLease.
+	ReleaseLease(leaseID string) error
+
+	// DiskUsage reports how much disk space is used by each image and
+	// container.  Unlike ImageSize, it distinguishes between layers which
+	// are shared with other images and layers which would be freed if an
+	// image or container was deleted.
+	DiskUsage() (*DiskUsageReport, error)
+
+	// Prune removes images which aren't used by any containers, in an
+	// order chosen by the policy in options, until the limits which
+	// options sets are met, and optionally removes dangling layers.
+	Prune(options PruneOptions) (*PruneReport, error)
 }
 
 // AdditionalLayer represents a layer that is contained in the additional layer store
@@ -670,6 +945,21 @@ type LayerOptions struct {
 	// Currently these can only be set when the layer record is created, but that
 	// could change in the future.
 	Flags map[string]any
+	// Labels is a set of key/value pairs to store with the layer.
+	Labels map[string]string
+	// Provenance, if set, records where the layer's contents were
+	// retrieved from.  More entries can be added later using
+	// AddLayerProvenance.
+	Provenance []LayerProvenance
+	// Progress, if set, is called as entries in the diff are applied.
+	Progress archive.ProgressFunc
+}
+
+// ApplyDiffOptions is used for passing options to a Store's
+// ApplyDiffWithContext() method.
+type ApplyDiffOptions struct {
+	// Progress, if set, is called as entries in the diff are applied.
+	Progress archive.ProgressFunc
 }
 
 type LayerBigDataOption struct {
@@ -698,6 +988,8 @@ type ImageOptions struct {
 	// Flags is a set of named flags and their values to store with the image.  Currently these can only
 	// be set when the image record is created, but that could change in the future.
 	Flags map[string]any
+	// Labels is a set of key/value pairs to store with the image.
+	Labels map[string]string
 }
 
 type ImageBigDataOption struct {
@@ -725,6 +1017,8 @@ type ContainerOptions struct {
 	Metadata string
 	// BigData is a set of items which should be stored for the container.
 	BigData []ContainerBigDataOption
+	// Labels is a set of key/value pairs to store with the container.
+	Labels map[string]string
 }
 
 type ContainerBigDataOption struct {
@@ -741,6 +1035,7 @@ type store struct {
 	// - imageStore.start{Reading,Writing}
 	// - roImageStores[].startReading (in the order of the items of the roImageStores array)
 	// - containerStore.start{Reading,Writing}
+	// - leases.lockfile
 
 	// The following fields are only set when constructing store, and must never be modified afterwards.
 	// They are safe to access without any other locking.
@@ -774,6 +1069,7 @@ type store struct {
 	digestLockRoot  string
 	disableVolatile bool
 	transientStore  bool
+	leases          *leaseStore
 
 	// The following fields can only be accessed with graphLock held.
 	graphLockLastWrite lockfile.LastWrite
@@ -783,6 +1079,10 @@ type store struct {
 	layerStoreUseGetters    rwLayerStore   // Almost all users should use the provided accessors instead of accessing this field directly.
 	roLayerStoresUseGetters []roLayerStore // Almost all users should use the provided accessors instead of accessing this field directly.
 
+	// The following fields can only be accessed with layerFetcherLock held.
+	layerFetcherLock sync.Mutex
+	layerFetcher     LayerFetcher // Set by SetLayerFetcher()
+
 	// FIXME: The following fields need locking, and don’t have it.
 	additionalUIDs *idSet // Set by getAvailableIDs()
 	additionalGIDs *idSet // Set by getAvailableIDs()
@@ -880,6 +1180,11 @@ func GetStore(options types.StoreOptions) (Store, error) {
 		return nil, err
 	}
 
+	leases, err := newLeaseStore(options.RunRoot)
+	if err != nil {
+		return nil, err
+	}
+
 	autoNsMinSize := options.AutoNsMinSize
 	autoNsMaxSize := options.AutoNsMaxSize
 	if autoNsMinSize == 0 {
@@ -905,6 +1210,7 @@ func GetStore(options types.StoreOptions) (Store, error) {
 		autoNsMaxSize:       autoNsMaxSize,
 		disableVolatile:     options.DisableVolatile,
 		transientStore:      options.TransientStore,
+		leases:              leases,
 
 		additionalUIDs: nil,
 		additionalGIDs: nil,
@@ -912,6 +1218,9 @@ func GetStore(options types.StoreOptions) (Store, error) {
 	if err := s.load(); err != nil {
 		return nil, err
 	}
+	if err := s.recoverTransaction(); err != nil {
+		return nil, err
+	}
 
 	stores = append(stores, s)
 
@@ -1452,13 +1761,38 @@ func (s *store) canUseShifting(uidmap, gidmap []idtools.IDMap) bool {
 // On entry:
 // - rlstore must be locked for writing
 // - rlstores MUST NOT be locked
-func (s *store) putLayer(rlstore rwLayerStore, rlstores []roLayerStore, id, parent string, names []string, mountLabel string, writeable bool, lOptions *LayerOptions, diff io.Reader, slo *stagedLayerOptions) (*Layer, int64, error) {
+func (s *store) putLayer(ctx context.Context, rlstore rwLayerStore, rlstores []roLayerStore, id, parent string, names []string, mountLabel string, writeable bool, lOptions *LayerOptions, diff io.Reader, slo *stagedLayerOptions) (*Layer, int64, error) {
+	if parent != "" {
+		for _, l := range rlstores {
+			lstore := l
+			if err := lstore.startReading(); err != nil {
+				return nil, -1, err
+			}
+			defer lstore.stopReading()
+		}
+	}
+	// FIXME? It’s unclear why we are holding containerStore locked here at all
+	// (and because we are not modifying it, why it is a write lock, not a read lock).
+	if err := s.containerStore.startWriting(); err != nil {
+		return nil, -1, err
+	}
+	defer s.containerStore.stopWriting()
+	return s.putLayerLocked(ctx, rlstore, rlstores, id, parent, names, mountLabel, writeable, lOptions, diff, slo)
+}
+
+// On entry:
+// - rlstore must be locked for writing
+// - rlstores must be locked for reading, if parent != ""
+// - s.containerStore must be locked for writing
+func (s *store) putLayerLocked(ctx context.Context, rlstore rwLayerStore, rlstores []roLayerStore, id, parent string, names []string, mountLabel string, writeable bool, lOptions *LayerOptions, diff io.Reader, slo *stagedLayerOptions) (*Layer, int64, error) {
 	var parentLayer *Layer
 	var options LayerOptions
 	if lOptions != nil {
 		options = *lOptions
 		options.BigData = slices.Clone(lOptions.BigData)
 		options.Flags = copyMapPreferringNil(lOptions.Flags)
+		options.Labels = copyMapPreferringNil(lOptions.Labels)
+		options.Provenance = copyLayerProvenance(lOptions.Provenance)
 	}
 	if options.HostUIDMapping {
 		options.UIDMap = nil
@@ -1470,14 +1804,7 @@ func (s *store) putLayer(rlstore rwLayerStore, rlstores []roLayerStore, id, pare
 	gidMap := options.GIDMap
 	if parent != "" {
 		var ilayer *Layer
-		for _, l := range append([]roLayerStore{rlstore}, rlstores...) {
-			lstore := l
-			if lstore != rlstore {
-				if err := lstore.startReading(); err != nil {
-					return nil, -1, err
-				}
-				defer lstore.stopReading()
-			}
+		for _, lstore := range append([]roLayerStore{rlstore}, rlstores...) {
 			if l, err := lstore.Get(parent); err == nil && l != nil {
 				ilayer = l
 				parent = ilayer.ID
@@ -1489,10 +1816,6 @@ func (s *store) putLayer(rlstore rwLayerStore, rlstores []roLayerStore, id, pare
 		}
 		parentLayer = ilayer
 
-		if err := s.containerStore.startWriting(); err != nil {
-			return nil, -1, err
-		}
-		defer s.containerStore.stopWriting()
 		containers, err := s.containerStore.Containers()
 		if err != nil {
 			return nil, -1, err
@@ -1509,13 +1832,6 @@ func (s *store) putLayer(rlstore rwLayerStore, rlstores []roLayerStore, id, pare
 			gidMap = ilayer.GIDMap
 		}
 	} else {
-		// FIXME? It’s unclear why we are holding containerStore locked here at all
-		// (and because we are not modifying it, why it is a write lock, not a read lock).
-		if err := s.containerStore.startWriting(); err != nil {
-			return nil, -1, err
-		}
-		defer s.containerStore.stopWriting()
-
 		if !options.HostUIDMapping && len(options.UIDMap) == 0 {
 			uidMap = s.uidMap
 		}
@@ -1533,10 +1849,14 @@ func (s *store) putLayer(rlstore rwLayerStore, rlstores []roLayerStore, id, pare
 			GIDMap:         copySlicePreferringNil(gidMap),
 		}
 	}
-	return rlstore.create(id, parentLayer, names, mountLabel, nil, &options, writeable, diff, slo)
+	return rlstore.create(ctx, id, parentLayer, names, mountLabel, nil, &options, writeable, diff, slo)
 }
 
 func (s *store) PutLayer(id, parent string, names []string, mountLabel string, writeable bool, lOptions *LayerOptions, diff io.Reader) (*Layer, int64, error) {
+	return s.PutLayerWithContext(context.Background(), id, parent, names, mountLabel, writeable, lOptions, diff)
+}
+
+func (s *store) PutLayerWithContext(ctx context.Context, id, parent string, names []string, mountLabel string, writeable bool, lOptions *LayerOptions, diff io.Reader) (*Layer, int64, error) {
 	rlstore, rlstores, err := s.bothLayerStoreKinds()
 	if err != nil {
 		return nil, -1, err
@@ -1545,7 +1865,7 @@ func (s *store) PutLayer(id, parent string, names []string, mountLabel string, w
 		return nil, -1, err
 	}
 	defer rlstore.stopWriting()
-	return s.putLayer(rlstore, rlstores, id, parent, names, mountLabel, writeable, lOptions, diff, nil)
+	return s.putLayer(ctx, rlstore, rlstores, id, parent, names, mountLabel, writeable, lOptions, diff, nil)
 }
 
 func (s *store) CreateLayer(id, parent string, names []string, mountLabel string, writeable bool, options *LayerOptions) (*Layer, error) {
@@ -1554,18 +1874,45 @@ func (s *store) CreateLayer(id, parent string, names []string, mountLabel string
 }
 
 func (s *store) CreateImage(id string, names []string, layer, metadata string, iOptions *ImageOptions) (*Image, error) {
+	var layerStores []roLayerStore
 	if layer != "" {
-		layerStores, err := s.allLayerStores()
+		var err error
+		layerStores, err = s.allLayerStores()
 		if err != nil {
 			return nil, err
 		}
-		var ilayer *Layer
 		for _, s := range layerStores {
 			store := s
 			if err := store.startReading(); err != nil {
 				return nil, err
 			}
 			defer store.stopReading()
+		}
+	}
+
+	return writeToImageStore(s, func() (*Image, error) {
+		if id != "" {
+			for _, is := range s.roImageStores {
+				store := is
+				if err := store.startReading(); err != nil {
+					return nil, err
+				}
+				defer store.stopReading()
+			}
+		}
+		return s.createImageLocked(layerStores, id, names, layer, metadata, iOptions)
+	})
+}
+
+// On entry:
+// - layerStores must be locked for reading or writing, if layer != ""
+// - s.imageStore must be locked for writing
+// - s.roImageStores must be locked for reading, if id != ""
+func (s *store) createImageLocked(layerStores []roLayerStore, id string, names []string, layer, metadata string, iOptions *ImageOptions) (*Image, error) {
+	if layer != "" {
+		var ilayer *Layer
+		for _, store := range layerStores {
+			var err error
 			ilayer, err = store.Get(layer)
 			if err == nil {
 				break
@@ -1577,86 +1924,84 @@ func (s *store) CreateImage(id string, names []string, layer, metadata string, i
 		layer = ilayer.ID
 	}
 
-	return writeToImageStore(s, func() (*Image, error) {
-		var options ImageOptions
-		var namesToAddAfterCreating []string
-
-		// Check if the ID refers to an image in a read-only store -- we want
-		// to allow images in read-only stores to have their names changed, so
-		// if we find one, merge the new values in with what we know about the
-		// image that's already there.
-		if id != "" {
-			for _, is := range s.roImageStores {
-				store := is
-				if err := store.startReading(); err != nil {
-					return nil, err
+	var options ImageOptions
+	var namesToAddAfterCreating []string
+
+	// Check if the ID refers to an image in a read-only store -- we want
+	// to allow images in read-only stores to have their names changed, so
+	// if we find one, merge the new values in with what we know about the
+	// image that's already there.
+	if id != "" {
+		for _, store := range s.roImageStores {
+			if i, err := store.Get(id); err == nil {
+				// set information about this image in "options"
+				options = ImageOptions{
+					Metadata:     i.Metadata,
+					CreationDate: i.Created,
+					Digest:       i.Digest,
+					Digests:      copySlicePreferringNil(i.Digests),
+					NamesHistory: copySlicePreferringNil(i.NamesHistory),
+					Labels:       copyMapPreferringNil(i.Labels),
 				}
-				defer store.stopReading()
-				if i, err := store.Get(id); err == nil {
-					// set information about this image in "options"
-					options = ImageOptions{
-						Metadata:     i.Metadata,
-						CreationDate: i.Created,
-						Digest:       i.Digest,
-						Digests:      copySlicePreferringNil(i.Digests),
-						NamesHistory: copySlicePreferringNil(i.NamesHistory),
+				for _, key := range i.BigDataNames {
+					data, err := store.BigData(id, key)
+					if err != nil {
+						return nil, err
 					}
-					for _, key := range i.BigDataNames {
-						data, err := store.BigData(id, key)
-						if err != nil {
-							return nil, err
-						}
-						dataDigest, err := store.BigDataDigest(id, key)
-						if err != nil {
-							return nil, err
-						}
-						options.BigData = append(options.BigData, ImageBigDataOption{
-							Key:    key,
-							Data:   data,
-							Digest: dataDigest,
-						})
+					dataDigest, err := store.BigDataDigest(id, key)
+					if err != nil {
+						return nil, err
 					}
-					namesToAddAfterCreating = dedupeStrings(slices.Concat(i.Names, names))
-					break
+					options.BigData = append(options.BigData, ImageBigDataOption{
+						Key:    key,
+						Data:   data,
+						Digest: dataDigest,
+					})
 				}
+				namesToAddAfterCreating = dedupeStrings(slices.Concat(i.Names, names))
+				break
 			}
 		}
+	}
 
-		// merge any passed-in options into "options" as best we can
-		if iOptions != nil {
-			if !iOptions.CreationDate.IsZero() {
-				options.CreationDate = iOptions.CreationDate
-			}
-			if iOptions.Digest != "" {
-				options.Digest = iOptions.Digest
-			}
-			options.Digests = append(options.Digests, iOptions.Digests...)
-			if iOptions.Metadata != "" {
-				options.Metadata = iOptions.Metadata
-			}
-			options.BigData = append(options.BigData, copyImageBigDataOptionSlice(iOptions.BigData)...)
-			options.NamesHistory = append(options.NamesHistory, iOptions.NamesHistory...)
-			if options.Flags == nil {
-				options.Flags = make(map[string]any)
-			}
-			maps.Copy(options.Flags, iOptions.Flags)
+	// merge any passed-in options into "options" as best we can
+	if iOptions != nil {
+		if !iOptions.CreationDate.IsZero() {
+			options.CreationDate = iOptions.CreationDate
 		}
-
-		if options.CreationDate.IsZero() {
-			options.CreationDate = time.Now().UTC()
+		if iOptions.Digest != "" {
+			options.Digest = iOptions.Digest
 		}
-		if metadata != "" {
-			options.Metadata = metadata
+		options.Digests = append(options.Digests, iOptions.Digests...)
+		if iOptions.Metadata != "" {
+			options.Metadata = iOptions.Metadata
 		}
-
-		res, err := s.imageStore.create(id, names, layer, options)
-		if err == nil && len(namesToAddAfterCreating) > 0 {
-			// set any names we pulled up from an additional image store, now that we won't be
-			// triggering a duplicate names error
-			err = s.imageStore.updateNames(res.ID, namesToAddAfterCreating, addNames)
+		options.BigData = append(options.BigData, copyImageBigDataOptionSlice(iOptions.BigData)...)
+		options.NamesHistory = append(options.NamesHistory, iOptions.NamesHistory...)
+		if options.Flags == nil {
+			options.Flags = make(map[string]any)
 		}
-		return res, err
-	})
+		maps.Copy(options.Flags, iOptions.Flags)
+		if options.Labels == nil {
+			options.Labels = make(map[string]string)
+		}
+		maps.Copy(options.Labels, iOptions.Labels)
+	}
+
+	if options.CreationDate.IsZero() {
+		options.CreationDate = time.Now().UTC()
+	}
+	if metadata != "" {
+		options.Metadata = metadata
+	}
+
+	res, err := s.imageStore.create(id, names, layer, options)
+	if err == nil && len(namesToAddAfterCreating) > 0 {
+		// set any names we pulled up from an additional image store, now that we won't be
+		// triggering a duplicate names error
+		err = s.imageStore.updateNames(res.ID, namesToAddAfterCreating, addNames)
+	}
+	return res, err
 }
 
 // imageTopLayerForMapping locates the layer that can take the place of the
@@ -1667,7 +2012,11 @@ func (s *store) CreateImage(id string, names []string, layer, metadata string, i
 // - s.imageStore must be locked for writing; it might be identical to ristore.
 // - rlstore must be locked for writing
 // - lstores must all be locked for reading
-func (s *store) imageTopLayerForMapping(image *Image, ristore roImageStore, rlstore rwLayerStore, lstores []roLayerStore, options types.IDMappingOptions) (*Layer, error) {
+//
+// If recordMappedLayer is not nil, it is called with the ID of any ID-mapped
+// copy of the top layer before the copy is created, and the function it
+// returns is called if creating it fails.
+func (s *store) imageTopLayerForMapping(image *Image, ristore roImageStore, rlstore rwLayerStore, lstores []roLayerStore, options types.IDMappingOptions, recordMappedLayer func(imageID, layerID string) (func(), error)) (*Layer, error) {
 	layerMatchesMappingOptions := func(layer *Layer, options types.IDMappingOptions) bool {
 		// If the driver supports shifting and the layer has no mappings, we can use it.
 		if s.canUseShifting(options.UIDMap, options.GIDMap) && len(layer.UIDMap) == 0 && len(layer.GIDMap) == 0 {
@@ -1753,21 +2102,37 @@ func (s *store) imageTopLayerForMapping(image *Image, ristore roImageStore, rlst
 		}
 	}
 	layerOptions.TemplateLayer = layer.ID
-	mappedLayer, _, err := rlstore.create("", parentLayer, nil, layer.MountLabel, nil, &layerOptions, false, nil, nil)
+	mappedLayerID := ""
+	forget := func() {}
+	if recordMappedLayer != nil {
+		var err error
+		if mappedLayerID, err = newID("", rlstore.Exists); err != nil {
+			return nil, err
+		}
+		if forget, err = recordMappedLayer(image.ID, mappedLayerID); err != nil {
+			return nil, err
+		}
+	}
+	mappedLayer, _, err := rlstore.create(context.Background(), mappedLayerID, parentLayer, nil, layer.MountLabel, nil, &layerOptions, false, nil, nil)
 	if err != nil {
+		forget()
 		return nil, fmt.Errorf("creating an ID-mapped copy of layer %q: %w", layer.ID, err)
 	}
 	// By construction, createMappedLayer can only be true if ristore == s.imageStore.
 	if err = s.imageStore.addMappedTopLayer(image.ID, mappedLayer.ID); err != nil {
 		if err2 := rlstore.deleteWhileHoldingLock(mappedLayer.ID); err2 != nil {
 			err = fmt.Errorf("deleting layer %q: %v: %w", mappedLayer.ID, err2, err)
+		} else {
+			forget()
 		}
 		return nil, fmt.Errorf("registering ID-mapped layer with image %q: %w", image.ID, err)
 	}
 	return mappedLayer, nil
 }
 
-func (s *store) CreateContainer(id string, names []string, image, layer, metadata string, cOptions *ContainerOptions) (*Container, error) {
+// containerOptionsForCreate returns a copy of cOptions, which can be nil, with
+// metadata set, for use by createContainerLocked.
+func containerOptionsForCreate(cOptions *ContainerOptions, metadata string) ContainerOptions {
 	var options ContainerOptions
 	if cOptions != nil {
 		options = *cOptions
@@ -1778,6 +2143,7 @@ func (s *store) CreateContainer(id string, names []string, image, layer, metadat
 		options.MountOpts = copySlicePreferringNil(cOptions.MountOpts)
 		options.StorageOpt = copyMapPreferringNil(cOptions.StorageOpt)
 		options.BigData = copyContainerBigDataOptionSlice(cOptions.BigData)
+		options.Labels = copyMapPreferringNil(cOptions.Labels)
 	}
 	if options.HostUIDMapping {
 		options.UIDMap = nil
@@ -1786,14 +2152,16 @@ func (s *store) CreateContainer(id string, names []string, image, layer, metadat
 		options.GIDMap = nil
 	}
 	options.Metadata = metadata
+	return options
+}
+
+func (s *store) CreateContainer(id string, names []string, image, layer, metadata string, cOptions *ContainerOptions) (*Container, error) {
+	options := containerOptionsForCreate(cOptions, metadata)
 	rlstore, lstores, err := s.bothLayerStoreKinds() // lstores will be locked read-only if image != ""
 	if err != nil {
 		return nil, err
 	}
 
-	var imageTopLayer *Layer
-	imageID := ""
-
 	if options.AutoUserNs || options.UIDMap != nil || options.GIDMap != nil {
 		// Prevent multiple instances to retrieve the same range when AutoUserNs
 		// are used.
@@ -1803,15 +2171,11 @@ func (s *store) CreateContainer(id string, names []string, image, layer, metadat
 		defer s.usernsLock.Unlock()
 	}
 
-	var imageHomeStore roImageStore // Set if image != ""
-	// s.imageStore is locked read-write, if image != ""
-	// s.roImageStores are NOT NECESSARILY ALL locked read-only if image != ""
-	var cimage *Image // Set if image != ""
+	if err := rlstore.startWriting(); err != nil {
+		return nil, err
+	}
+	defer rlstore.stopWriting()
 	if image != "" {
-		if err := rlstore.startWriting(); err != nil {
-			return nil, err
-		}
-		defer rlstore.stopWriting()
 		for _, s := range lstores {
 			store := s
 			if err := store.startReading(); err != nil {
@@ -1823,21 +2187,44 @@ func (s *store) CreateContainer(id string, names []string, image, layer, metadat
 			return nil, err
 		}
 		defer s.imageStore.stopWriting()
-		cimage, err = s.imageStore.Get(image)
-		if err == nil {
-			imageHomeStore = s.imageStore
-		} else {
-			for _, s := range s.roImageStores {
-				store := s
-				if err := store.startReading(); err != nil {
-					return nil, err
-				}
-				defer store.stopReading()
-				cimage, err = store.Get(image)
-				if err == nil {
-					imageHomeStore = store
-					break
-				}
+		for _, s := range s.roImageStores {
+			store := s
+			if err := store.startReading(); err != nil {
+				return nil, err
+			}
+			defer store.stopReading()
+		}
+	}
+	if err := s.containerStore.startWriting(); err != nil {
+		return nil, err
+	}
+	defer s.containerStore.stopWriting()
+	return s.createContainerLocked(rlstore, lstores, id, names, image, layer, &options, nil)
+}
+
+// createContainerLocked creates a container, and a layer for it, using options,
+// which the caller must have already copied from the ContainerOptions it received.
+// On entry:
+// - s.usernsLock must be held, if options specifies any ID mappings
+// - rlstore must be locked for writing
+// - lstores and s.roImageStores must be locked for reading, if image != ""
+// - s.imageStore must be locked for writing, if image != ""
+// - s.containerStore must be locked for writing
+//
+// recordMappedLayer is passed to imageTopLayerForMapping.
+func (s *store) createContainerLocked(rlstore rwLayerStore, lstores []roLayerStore, id string, names []string, image, layer string, options *ContainerOptions, recordMappedLayer func(imageID, layerID string) (func(), error)) (*Container, error) {
+	var imageTopLayer *Layer
+	imageID := ""
+
+	var imageHomeStore roImageStore // Set if image != ""
+	var cimage *Image               // Set if image != ""
+	if image != "" {
+		var err error
+		for _, store := range s.allImageStores() {
+			cimage, err = store.Get(image)
+			if err == nil {
+				imageHomeStore = store
+				break
 			}
 		}
 		if cimage == nil {
@@ -1860,7 +2247,7 @@ func (s *store) CreateContainer(id string, names []string, image, layer, metadat
 	idMappingsOptions := options.IDMappingOptions
 	if image != "" {
 		if cimage.TopLayer != "" {
-			ilayer, err := s.imageTopLayerForMapping(cimage, imageHomeStore, rlstore, lstores, idMappingsOptions)
+			ilayer, err := s.imageTopLayerForMapping(cimage, imageHomeStore, rlstore, lstores, idMappingsOptions, recordMappedLayer)
 			if err != nil {
 				return nil, err
 			}
@@ -1874,10 +2261,6 @@ func (s *store) CreateContainer(id string, names []string, image, layer, metadat
 			}
 		}
 	} else {
-		if err := rlstore.startWriting(); err != nil {
-			return nil, err
-		}
-		defer rlstore.stopWriting()
 		if !options.HostUIDMapping && len(options.UIDMap) == 0 {
 			uidMap = s.uidMap
 		}
@@ -1924,7 +2307,7 @@ func (s *store) CreateContainer(id string, names []string, image, layer, metadat
 		options.Flags[mountLabelFlag] = mountLabel
 	}
 
-	clayer, _, err := rlstore.create(layer, imageTopLayer, nil, mlabel, options.StorageOpt, layerOptions, true, nil, nil)
+	clayer, _, err := rlstore.create(context.Background(), layer, imageTopLayer, nil, mlabel, options.StorageOpt, layerOptions, true, nil, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -1935,25 +2318,29 @@ func (s *store) CreateContainer(id string, names []string, image, layer, metadat
 		options.Volatile = true
 	}
 
-	return writeToContainerStore(s, func() (*Container, error) {
-		options.IDMappingOptions = types.IDMappingOptions{
-			HostUIDMapping: len(options.UIDMap) == 0,
-			HostGIDMapping: len(options.GIDMap) == 0,
-			UIDMap:         copySlicePreferringNil(options.UIDMap),
-			GIDMap:         copySlicePreferringNil(options.GIDMap),
-		}
-		container, err := s.containerStore.create(id, names, imageID, layer, &options)
-		if err != nil || container == nil {
-			if err2 := rlstore.deleteWhileHoldingLock(layer); err2 != nil {
-				if err == nil {
-					err = fmt.Errorf("deleting layer %#v: %w", layer, err2)
-				} else {
-					logrus.Errorf("While recovering from a failure to create a container, error deleting layer %#v: %v", layer, err2)
-				}
+	options.IDMappingOptions = types.IDMappingOptions{
+		HostUIDMapping: len(options.UIDMap) == 0,
+		HostGIDMapping: len(options.GIDMap) == 0,
+		UIDMap:         copySlicePreferringNil(options.UIDMap),
+		GIDMap:         copySlicePreferringNil(options.GIDMap),
+	}
+	container, err := s.containerStore.create(id, names, imageID, layer, options)
+	if err != nil || container == nil {
+		if err2 := rlstore.deleteWhileHoldingLock(layer); err2 != nil {
+			if err == nil {
+				err = fmt.Errorf("deleting layer %#v: %w", layer, err2)
+			} else {
+				logrus.Errorf("While recovering from a failure to create a container, error deleting layer %#v: %v", layer, err2)
 			}
 		}
 		return container, err
-	})
+	}
+	if imageHomeStore == s.imageStore {
+		if err := s.imageStore.recordUse(imageID); err != nil {
+			logrus.Warnf("Recording use of image %q: %v", imageID, err)
+		}
+	}
+	return container, nil
 }
 
 func (s *store) SetMetadata(id, metadata string) error {
@@ -1971,6 +2358,21 @@ func (s *store) SetMetadata(id, metadata string) error {
 	})
 }
 
+func (s *store) SetLabels(id string, labels map[string]string) error {
+	return s.writeToAllStores(func(rlstore rwLayerStore) error {
+		if rlstore.Exists(id) {
+			return rlstore.SetLabels(id, labels)
+		}
+		if s.imageStore.Exists(id) {
+			return s.imageStore.SetLabels(id, labels)
+		}
+		if s.containerStore.Exists(id) {
+			return s.containerStore.SetLabels(id, labels)
+		}
+		return ErrNotAnID
+	})
+}
+
 func (s *store) Metadata(id string) (string, error) {
 	if res, done, err := readAllLayerStores(s, func(store roLayerStore) (string, bool, error) {
 		if store.Exists(id) {
@@ -2128,6 +2530,10 @@ func (s *store) SetImageBigData(id, key string, data []byte, digestManifest func
 }
 
 func (s *store) ImageSize(id string) (int64, error) {
+	return s.ImageSizeWithContext(context.Background(), id)
+}
+
+func (s *store) ImageSizeWithContext(ctx context.Context, id string) (int64, error) {
 	layerStores, err := s.allLayerStores()
 	if err != nil {
 		return -1, err
@@ -2174,6 +2580,9 @@ func (s *store) ImageSize(id string) (int64, error) {
 			if _, ok := visited[layerID]; ok {
 				continue
 			}
+			if err := ctx.Err(); err != nil {
+				return -1, err
+			}
 			visited[layerID] = struct{}{}
 			// Look for the layer and the store that knows about it.
 			var layerStore roLayerStore
@@ -2187,14 +2596,9 @@ func (s *store) ImageSize(id string) (int64, error) {
 			if layer == nil {
 				return -1, fmt.Errorf("locating layer with ID %q: %w", layerID, ErrLayerUnknown)
 			}
-			// The UncompressedSize is only valid if there's a digest to go with it.
-			n := layer.UncompressedSize
-			if layer.UncompressedDigest == "" || n == -1 {
-				// Compute the size.
-				n, err = layerStore.DiffSize("", layer.ID)
-				if err != nil {
-					return -1, fmt.Errorf("size/digest of layer with ID %q could not be calculated: %w", layerID, err)
-				}
+			n, err := layerContentsSize(layerStore, layer)
+			if err != nil {
+				return -1, err
 			}
 			// Count this layer.
 			size += n
@@ -2550,7 +2954,7 @@ func (s *store) DeleteLayer(id string) (retErr error) {
 	}()
 	return s.writeToAllStores(func(rlstore rwLayerStore) error {
 		if rlstore.Exists(id) {
-			if l, err := rlstore.Get(id); err != nil {
+			if l, err := rlstore.Get(id); err == nil {
 				id = l.ID
 			}
 			layers, err := rlstore.Layers()
@@ -2581,6 +2985,13 @@ func (s *store) DeleteLayer(id string) (retErr error) {
 					return fmt.Errorf("layer %v used by container %v: %w", id, container.ID, ErrLayerUsedByContainer)
 				}
 			}
+			leased, err := s.leases.leased()
+			if err != nil {
+				return err
+			}
+			if leased.layer(id) {
+				return fmt.Errorf("layer %v: %w", id, ErrLayerLeased)
+			}
 			cf, err := rlstore.deferredDelete(id)
 			cleanupFunctions = append(cleanupFunctions, cf...)
 			if err != nil {
@@ -2640,6 +3051,16 @@ func (s *store) DeleteImage(id string, commit bool) (layers []string, retErr err
 			if container, ok := aContainerByImage[id]; ok {
 				return fmt.Errorf("image used by %v: %w", container, ErrImageUsedByContainer)
 			}
+			if indexes := s.imageStore.indexesUsing(id); len(indexes) > 0 {
+				return fmt.Errorf("image used by image index %v: %w", indexes[0], ErrImageUsedByIndex)
+			}
+			leased, err := s.leases.leased()
+			if err != nil {
+				return err
+			}
+			if leased.image(id) {
+				return fmt.Errorf("image %v: %w", id, ErrImageLeased)
+			}
 			images, err := is.Images()
 			if err != nil {
 				return err
@@ -2668,14 +3089,20 @@ func (s *store) DeleteImage(id string, commit bool) (layers []string, retErr err
 			}
 			layer := image.TopLayer
 			layersToRemoveMap := make(map[string]struct{})
-			layersToRemove = append(layersToRemove, image.MappedTopLayers...)
 			for _, mappedTopLayer := range image.MappedTopLayers {
+				if leased.layer(mappedTopLayer) {
+					continue
+				}
+				layersToRemove = append(layersToRemove, mappedTopLayer)
 				layersToRemoveMap[mappedTopLayer] = struct{}{}
 			}
 			for layer != "" {
 				if s.containerStore.Exists(layer) {
 					break
 				}
+				if leased.layer(layer) {
+					break
+				}
 				if _, used := otherImagesTopLayers[layer]; used {
 					break
 				}
@@ -2735,46 +3162,58 @@ func (s *store) DeleteContainer(id string) (retErr error) {
 		}
 	}()
 	return s.writeToAllStores(func(rlstore rwLayerStore) error {
-		if !s.containerStore.Exists(id) {
-			return ErrNotAContainer
-		}
+		cf, err := s.deleteContainerLocked(rlstore, id)
+		cleanupFunctions = append(cleanupFunctions, cf...)
+		return err
+	})
+}
 
-		container, err := s.containerStore.Get(id)
-		if err != nil {
-			return ErrNotAContainer
-		}
+// deleteContainerLocked deletes a container, its layer, and its directories.
+// On entry:
+// - rlstore must be locked for writing
+// - s.containerStore must be locked for writing
+// Caller MUST run all returned cleanup functions after this, EVEN IF the function returns an error.
+func (s *store) deleteContainerLocked(rlstore rwLayerStore, id string) ([]tempdir.CleanupTempDirFunc, error) {
+	if !s.containerStore.Exists(id) {
+		return nil, ErrNotAContainer
+	}
 
-		// delete the layer first, separately, so that if we get an
-		// error while trying to do so, we don't go ahead and delete
-		// the container record that refers to it, effectively losing
-		// track of it
-		if rlstore.Exists(container.LayerID) {
-			cf, err := rlstore.deferredDelete(container.LayerID)
-			cleanupFunctions = append(cleanupFunctions, cf...)
-			if err != nil {
-				return err
-			}
-		}
+	container, err := s.containerStore.Get(id)
+	if err != nil {
+		return nil, ErrNotAContainer
+	}
 
-		var wg errgroup.Group
+	// delete the layer first, separately, so that if we get an
+	// error while trying to do so, we don't go ahead and delete
+	// the container record that refers to it, effectively losing
+	// track of it
+	var cleanupFunctions []tempdir.CleanupTempDirFunc
+	if rlstore.Exists(container.LayerID) {
+		cf, err := rlstore.deferredDelete(container.LayerID)
+		cleanupFunctions = append(cleanupFunctions, cf...)
+		if err != nil {
+			return cleanupFunctions, err
+		}
+	}
 
-		middleDir := s.graphDriverName + "-containers"
+	var wg errgroup.Group
 
-		wg.Go(func() error {
-			gcpath := filepath.Join(s.GraphRoot(), middleDir, container.ID)
-			return system.EnsureRemoveAll(gcpath)
-		})
+	middleDir := s.graphDriverName + "-containers"
 
-		wg.Go(func() error {
-			rcpath := filepath.Join(s.RunRoot(), middleDir, container.ID)
-			return system.EnsureRemoveAll(rcpath)
-		})
+	wg.Go(func() error {
+		gcpath := filepath.Join(s.GraphRoot(), middleDir, container.ID)
+		return system.EnsureRemoveAll(gcpath)
+	})
 
-		if multierr := wg.Wait(); multierr != nil {
-			return multierr
-		}
-		return s.containerStore.Delete(id)
+	wg.Go(func() error {
+		rcpath := filepath.Join(s.RunRoot(), middleDir, container.ID)
+		return system.EnsureRemoveAll(rcpath)
 	})
+
+	if multierr := wg.Wait(); multierr != nil {
+		return cleanupFunctions, multierr
+	}
+	return cleanupFunctions, s.containerStore.Delete(id)
 }
 
 func (s *store) Delete(id string) (retErr error) {
@@ -2857,6 +3296,12 @@ func (s *store) MountImage(id string, mountOpts []string, mountLabel string) (st
 		return "", err
 	}
 
+	if image, err := s.Image(id); err == nil && image.TopLayer != "" {
+		if err := s.fetchDeferredLayers(image.TopLayer); err != nil {
+			return "", err
+		}
+	}
+
 	// We need to make sure the home mount is present when the Mount is done, which happens by possibly reinitializing the graph driver
 	// in startUsingGraphDriver().
 	if err := s.startUsingGraphDriver(); err != nil {
@@ -2909,7 +3354,7 @@ func (s *store) MountImage(id string, mountOpts []string, mountLabel string) (st
 		HostUIDMapping: true,
 		HostGIDMapping: true,
 	}
-	ilayer, err := s.imageTopLayerForMapping(cimage, imageHomeStore, rlstore, lstores, idmappingsOpts)
+	ilayer, err := s.imageTopLayerForMapping(cimage, imageHomeStore, rlstore, lstores, idmappingsOpts, nil)
 	if err != nil {
 		return "", err
 	}
@@ -2922,7 +3367,16 @@ func (s *store) MountImage(id string, mountOpts []string, mountLabel string) (st
 		MountLabel: mountLabel,
 		Options:    append(mountOpts, "ro"),
 	}
-	return rlstore.Mount(ilayer.ID, options)
+	mountPoint, err := rlstore.Mount(ilayer.ID, options)
+	if err != nil {
+		return "", err
+	}
+	if imageHomeStore == s.imageStore {
+		if err := s.imageStore.recordUse(cimage.ID); err != nil {
+			logrus.Warnf("Recording use of image %q: %v", cimage.ID, err)
+		}
+	}
+	return mountPoint, nil
 }
 
 func (s *store) Mount(id, mountLabel string) (string, error) {
@@ -2944,6 +3398,15 @@ func (s *store) Mount(id, mountLabel string) (string, error) {
 			}
 		}
 	}
+	return s.mountLayer(id, options)
+}
+
+// mountLayer mounts a layer in the primary layer store with the specified
+// options.
+func (s *store) mountLayer(id string, options drivers.MountOpts) (string, error) {
+	if err := s.fetchDeferredLayers(id); err != nil && !errors.Is(err, ErrLayerUnknown) {
+		return "", err
+	}
 
 	// We need to make sure the home mount is present when the Mount is done, which happens by possibly reinitializing the graph driver
 	// in startUsingGraphDriver().
@@ -3095,6 +3558,12 @@ func (s *store) DiffSize(from, to string) (int64, error) {
 }
 
 func (s *store) Diff(from, to string, options *DiffOptions) (io.ReadCloser, error) {
+	for _, id := range []string{from, to} {
+		if err := s.fetchDeferredLayers(id); err != nil && !errors.Is(err, ErrLayerUnknown) {
+			return nil, err
+		}
+	}
+
 	// NaiveDiff could cause mounts to happen without a lock, so be safe
 	// and treat the .Diff operation as a Mount.
 	// We need to make sure the home mount is present when the Mount is done, which happens by possibly reinitializing the graph driver
@@ -3153,6 +3622,19 @@ func (s *store) Diff(from, to string, options *DiffOptions) (io.ReadCloser, erro
 	return nil, ErrLayerUnknown
 }
 
+func (s *store) DiffWithContext(ctx context.Context, from, to string, options *DiffOptions) (io.ReadCloser, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	rc, err := s.Diff(from, to, options)
+	if err != nil {
+		return nil, err
+	}
+	// If ctx is cancelled, this closes rc, which releases the locks that
+	// Diff took, even if our caller is blocked somewhere else.
+	return ioutils.NewCancelReadCloser(ctx, rc), nil
+}
+
 func (s *store) ApplyStagedLayer(args ApplyStagedLayerOptions) (*Layer, error) {
 	defer func() {
 		if args.DiffOutput.TarSplit != nil {
@@ -3186,7 +3668,7 @@ func (s *store) ApplyStagedLayer(args ApplyStagedLayerOptions) (*Layer, error) {
 		DiffOutput:  args.DiffOutput,
 		DiffOptions: args.DiffOptions,
 	}
-	layer, _, err = s.putLayer(rlstore, rlstores, args.ID, args.ParentLayer, args.Names, args.MountLabel, args.Writeable, args.LayerOptions, nil, &slo)
+	layer, _, err = s.putLayer(context.Background(), rlstore, rlstores, args.ID, args.ParentLayer, args.Names, args.MountLabel, args.Writeable, args.LayerOptions, nil, &slo)
 	return layer, err
 }
 
@@ -3202,11 +3684,31 @@ func (s *store) CleanupStagedLayer(diffOutput *drivers.DriverWithDifferOutput) e
 }
 
 func (s *store) PrepareStagedLayer(options *drivers.ApplyDiffWithDifferOpts, differ drivers.Differ) (*drivers.DriverWithDifferOutput, error) {
+	ctx := context.Background()
+	if options != nil && options.Context != nil {
+		ctx = options.Context
+	}
+	return s.PrepareStagedLayerWithContext(ctx, options, differ)
+}
+
+func (s *store) PrepareStagedLayerWithContext(ctx context.Context, options *drivers.ApplyDiffWithDifferOpts, differ drivers.Differ) (*drivers.DriverWithDifferOutput, error) {
 	rlstore, err := s.getLayerStore()
 	if err != nil {
 		return nil, err
 	}
-	return rlstore.applyDiffWithDifferNoLock(options, differ)
+	var ctxOptions drivers.ApplyDiffWithDifferOpts
+	if options != nil {
+		ctxOptions = *options
+	}
+	ctxOptions.Context = ctx
+	output, err := rlstore.applyDiffWithDifferNoLock(&ctxOptions, differ)
+	if err != nil && ctx.Err() != nil && output != nil && output.Target != "" {
+		if err2 := rlstore.CleanupStagingDirectory(output.Target); err2 != nil {
+			logrus.Errorf("While recovering from a cancelled diff, error removing staging directory %q: %v", output.Target, err2)
+		}
+		output.Target = ""
+	}
+	return output, err
 }
 
 func (s *store) DifferTarget(id string) (string, error) {
@@ -3219,14 +3721,62 @@ func (s *store) DifferTarget(id string) (string, error) {
 }
 
 func (s *store) ApplyDiff(to string, diff io.Reader) (int64, error) {
+	return s.ApplyDiffWithContext(context.Background(), to, nil, diff)
+}
+
+func (s *store) ApplyDiffWithContext(ctx context.Context, to string, options *ApplyDiffOptions, diff io.Reader) (int64, error) {
+	var layerOptions *LayerOptions
+	if options != nil {
+		layerOptions = &LayerOptions{Progress: options.Progress}
+	}
+	return s.applyDiff(ctx, to, layerOptions, diff)
+}
+
+func (s *store) applyDiff(ctx context.Context, to string, options *LayerOptions, diff io.Reader) (_ int64, retErr error) {
+	cleanupFunctions := []tempdir.CleanupTempDirFunc{}
+	defer func() {
+		if cleanupErr := tempdir.CleanupTemporaryDirectories(cleanupFunctions...); cleanupErr != nil {
+			retErr = errors.Join(cleanupErr, retErr)
+		}
+	}()
 	return writeToLayerStore(s, func(rlstore rwLayerStore) (int64, error) {
-		if rlstore.Exists(to) {
-			return rlstore.ApplyDiff(to, diff)
+		layer, err := rlstore.Get(to)
+		if err != nil {
+			return -1, ErrLayerUnknown
+		}
+		empty := layer.CompressedDigest == "" && layer.UncompressedDigest == "" && layer.TOCDigest == ""
+		size, err := rlstore.ApplyDiff(ctx, layer.ID, options, diff)
+		if err != nil && ctx.Err() != nil && empty {
+			// Don't leave a partially-applied diff behind, so that the
+			// caller can try again.
+			writeable, err2 := s.layerUsedByContainer(layer.ID)
+			if err2 == nil {
+				var cf []tempdir.CleanupTempDirFunc
+				cf, err2 = rlstore.resetContents(layer.ID, writeable)
+				cleanupFunctions = append(cleanupFunctions, cf...)
+			}
+			if err2 != nil {
+				return -1, errors.Join(err, fmt.Errorf("discarding partially-applied diff: %w", err2))
+			}
 		}
-		return -1, ErrLayerUnknown
+		return size, err
 	})
 }
 
+// layerUsedByContainer returns true if the layer is a container's layer.
+// On entry: the layer stores must be locked, s.containerStore must not be.
+func (s *store) layerUsedByContainer(id string) (bool, error) {
+	if err := s.containerStore.startReading(); err != nil {
+		return false, err
+	}
+	defer s.containerStore.stopReading()
+	containers, err := s.containerStore.Containers()
+	if err != nil {
+		return false, err
+	}
+	return slices.ContainsFunc(containers, func(c Container) bool { return c.LayerID == id }), nil
+}
+
 func (s *store) layersByMappedDigest(m func(roLayerStore, digest.Digest) ([]Layer, error), d digest.Digest) ([]Layer, error) {
 	var layers []Layer
 	if _, _, err := readAllLayerStores(s, func(store roLayerStore) (struct{}, bool, error) {
@@ -3269,6 +3819,56 @@ func (s *store) LayersByTOCDigest(d digest.Digest) ([]Layer, error) {
 	return s.layersByMappedDigest(func(r roLayerStore, d digest.Digest) ([]Layer, error) { return r.LayersByTOCDigest(d) }, d)
 }
 
+func (s *store) AddLayerProvenance(id string, provenance LayerProvenance) error {
+	_, err := writeToLayerStore(s, func(rlstore rwLayerStore) (struct{}, error) {
+		return struct{}{}, rlstore.addProvenance(id, provenance)
+	})
+	return err
+}
+
+func (s *store) LayersBySource(ref string) ([]Layer, error) {
+	if ref == "" {
+		return nil, fmt.Errorf("looking for layers pulled from an empty reference: %w", ErrLayerUnknown)
+	}
+	var layers []Layer
+	if _, _, err := readAllLayerStores(s, func(store roLayerStore) (struct{}, bool, error) {
+		storeLayers, err := store.Layers()
+		if err != nil {
+			return struct{}{}, true, err
+		}
+		for _, layer := range storeLayers {
+			if slices.ContainsFunc(layer.Provenance, func(p LayerProvenance) bool {
+				return sourceMatches(ref, p.SourceReference)
+			}) {
+				layers = append(layers, layer)
+			}
+		}
+		return struct{}{}, false, nil
+	}); err != nil {
+		return nil, err
+	}
+	if len(layers) == 0 {
+		return nil, ErrLayerUnknown
+	}
+	return layers, nil
+}
+
+// sourceMatches returns true if source is ref, or if ref names a repository
+// without a tag or digest, and source is a reference in that repository.
+func sourceMatches(ref, source string) bool {
+	if source == ref {
+		return true
+	}
+	if strings.Contains(ref, "@") || strings.Contains(ref[strings.LastIndex(ref, "/")+1:], ":") {
+		return false
+	}
+	repository, _, _ := strings.Cut(source, "@")
+	if i := strings.LastIndex(repository, ":"); i > strings.LastIndex(repository, "/") {
+		repository = repository[:i]
+	}
+	return repository == ref
+}
+
 func (s *store) LayerSize(id string) (int64, error) {
 	if res, done, err := readAllLayerStores(s, func(store roLayerStore) (int64, bool, error) {
 		if store.Exists(id) {
@@ -3523,6 +4123,22 @@ func (s *store) ImagesByDigest(d digest.Digest) ([]*Image, error) {
 	return images, nil
 }
 
+func (s *store) ImagesByLabel(selector string) ([]Image, error) {
+	res, err := s.MultiList(MultiListOptions{Images: true, LabelSelector: selector})
+	if err != nil {
+		return nil, err
+	}
+	return res.Images, nil
+}
+
+func (s *store) ContainersByLabel(selector string) ([]Container, error) {
+	res, err := s.MultiList(MultiListOptions{Containers: true, LabelSelector: selector})
+	if err != nil {
+		return nil, err
+	}
+	return res.Containers, nil
+}
+
 func (s *store) Container(id string) (*Container, error) {
 	res, _, err := readContainerStore(s, func() (*Container, bool, error) {
 		res, err := s.containerStore.Get(id)
@@ -3905,6 +4521,10 @@ func (s *store) GarbageCollect() error {
 func (s *store) MultiList(options MultiListOptions) (MultiListResult, error) {
 	// TODO: Possible optimization: Deduplicate content from multiple stores.
 	out := MultiListResult{}
+	selector, err := parseLabelSelector(options.LabelSelector)
+	if err != nil {
+		return MultiListResult{}, err
+	}
 
 	if options.Layers {
 		layerStores, err := s.allLayerStores()
@@ -3916,44 +4536,49 @@ func (s *store) MultiList(options MultiListOptions) (MultiListResult, error) {
 				return MultiListResult{}, err
 			}
 			defer roStore.stopReading()
-			layers, err := roStore.Layers()
-			if err != nil {
-				return MultiListResult{}, err
-			}
-			out.Layers = append(out.Layers, layers...)
+			out.Layers = append(out.Layers, roStore.layersMatching(selector)...)
 		}
 	}
 
-	if options.Images {
+	if options.Images || options.Indexes {
 		for _, roStore := range s.allImageStores() {
 			if err := roStore.startReading(); err != nil {
 				return MultiListResult{}, err
 			}
 			defer roStore.stopReading()
 
-			images, err := roStore.Images()
-			if err != nil {
-				return MultiListResult{}, err
+			// Image indexes are only kept in the writeable store, and
+			// don't have labels.
+			if options.Indexes && roStore == s.imageStore && selector.matches(nil) {
+				out.Indexes = s.imageStore.Indexes()
+			}
+			if !options.Images {
+				break
 			}
-			out.Images = append(out.Images, images...)
+
+			out.Images = append(out.Images, roStore.imagesMatching(selector)...)
 		}
 	}
 
 	if options.Containers {
 		containers, _, err := readContainerStore(s, func() ([]Container, bool, error) {
-			res, err := s.containerStore.Containers()
-			return res, true, err
+			return s.containerStore.containersMatching(selector), true, nil
 		})
 		if err != nil {
 			return MultiListResult{}, err
 		}
-		out.Containers = append(out.Containers, containers...)
+		out.Containers = containers
 	}
 	return out, nil
 }
 
 // Dedup deduplicates layers in the store.
 func (s *store) Dedup(req DedupArgs) (drivers.DedupResult, error) {
+	return s.DedupWithContext(context.Background(), req)
+}
+
+// DedupWithContext deduplicates layers in the store, stopping if ctx is cancelled.
+func (s *store) DedupWithContext(ctx context.Context, req DedupArgs) (drivers.DedupResult, error) {
 	imgs, err := s.Images()
 	if err != nil {
 		return drivers.DedupResult{}, err
@@ -3985,6 +4610,7 @@ func (s *store) Dedup(req DedupArgs) (drivers.DedupResult, error) {
 		r := drivers.DedupArgs{
 			Options: req.Options,
 		}
+		r.Options.Context = ctx
 		for l := range layers {
 			r.Layers = append(r.Layers, l)
 		}
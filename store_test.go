@@ -1,10 +1,22 @@
 package storage
 
 import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"math/rand"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"strings"
+	"syscall"
 	"testing"
+	"time"
 
+	drivers "github.com/containers/storage/drivers"
+	"github.com/containers/storage/pkg/archive"
 	"github.com/containers/storage/pkg/idtools"
 	"github.com/containers/storage/pkg/reexec"
 	digest "github.com/opencontainers/go-digest"
@@ -48,6 +60,28 @@ func newTestStore(t *testing.T, testOptions StoreOptions) Store {
 	return store
 }
 
+// putTestLayer creates a layer on top of parent whose diff adds the specified
+// files, creating any directories which they're in.
+func putTestLayer(t *testing.T, store Store, parent string, files map[string]string) *Layer {
+	dir := t.TempDir()
+	for file, contents := range files {
+		require.NoError(t, os.MkdirAll(filepath.Dir(filepath.Join(dir, file)), 0o755))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, file), []byte(contents), 0o644))
+	}
+	return putTestLayerFromDir(t, store, parent, dir)
+}
+
+// putTestLayerFromDir creates a layer on top of parent whose diff adds the
+// contents of dir.
+func putTestLayerFromDir(t *testing.T, store Store, parent, dir string) *Layer {
+	rc, err := archive.Tar(dir, archive.Uncompressed)
+	require.NoError(t, err)
+	defer rc.Close()
+	layer, _, err := store.PutLayer("", parent, nil, "", false, nil, rc)
+	require.NoError(t, err)
+	return layer
+}
+
 func TestStore(t *testing.T) {
 	pullOpts := map[string]string{"Test1": "test1", "Test2": "test2"}
 	store := newTestStore(t, StoreOptions{
@@ -629,3 +663,1890 @@ func TestStoreDelete(t *testing.T) {
 
 	store.Free()
 }
+
+func TestStoreWatch(t *testing.T) {
+	reexec.Init()
+
+	store := newTestStore(t, StoreOptions{})
+
+	_, err := store.CreateLayer("Layer", "", []string{"l"}, "", false, nil)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events, err := store.Watch(ctx, &WatchFilter{Interval: 10 * time.Millisecond})
+	require.NoError(t, err)
+
+	// waitFor returns the first event of the specified type for the specified
+	// object, skipping over any others.
+	waitFor := func(eventType EventType, object EventObject, id string) Event {
+		timeout := time.After(10 * time.Second)
+		for {
+			select {
+			case e, ok := <-events:
+				require.True(t, ok, "event channel closed early")
+				if e.Type == eventType && e.Object == object && (id == "" || e.ID == id) {
+					return e
+				}
+			case <-timeout:
+				require.FailNow(t, "timed out waiting for event", "%s %s %s", eventType, object, id)
+			}
+		}
+	}
+
+	_, err = store.CreateImage("Image", []string{"i"}, "Layer", "", nil)
+	require.NoError(t, err)
+	e := waitFor(EventCreated, EventImage, "Image")
+	assert.Equal(t, []string{"i"}, e.Names)
+
+	err = store.AddNames("Image", []string{"i2"})
+	require.NoError(t, err)
+	e = waitFor(EventRenamed, EventImage, "Image")
+	assert.ElementsMatch(t, []string{"i", "i2"}, e.Names)
+
+	err = store.SetImageBigData("Image", "key", []byte("value"), nil)
+	require.NoError(t, err)
+	e = waitFor(EventBigDataSet, EventImage, "Image")
+	assert.Equal(t, "key", e.Key)
+
+	// Rewriting a layer's data item is noticed, too.
+	err = store.SetLayerBigData("Layer", "key", strings.NewReader("value"))
+	require.NoError(t, err)
+	e = waitFor(EventBigDataSet, EventLayer, "Layer")
+	assert.Equal(t, "key", e.Key)
+	err = store.SetLayerBigData("Layer", "key", strings.NewReader("another value"))
+	require.NoError(t, err)
+	e = waitFor(EventBigDataSet, EventLayer, "Layer")
+	assert.Equal(t, "key", e.Key)
+
+	// A data item whose file has gone missing doesn't stop the watch.
+	require.NoError(t, os.Remove(filepath.Join(store.GraphRoot(), "vfs-layers", "Layer", "key")))
+
+	container, err := store.CreateContainer("Container", nil, "Image", "", "", nil)
+	require.NoError(t, err)
+	waitFor(EventCreated, EventContainer, "Container")
+
+	_, err = store.Mount("Container", "")
+	require.NoError(t, err)
+	waitFor(EventMounted, EventLayer, container.LayerID)
+
+	_, err = store.Unmount("Container", true)
+	require.NoError(t, err)
+	waitFor(EventUnmounted, EventLayer, container.LayerID)
+
+	cancel()
+	for range events {
+	}
+
+	// A filter limits the events which are delivered.
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	events, err = store.Watch(ctx, &WatchFilter{
+		Objects:  []EventObject{EventImage},
+		Types:    []EventType{EventDeleted},
+		Interval: 10 * time.Millisecond,
+	})
+	require.NoError(t, err)
+
+	err = store.DeleteContainer("Container")
+	require.NoError(t, err)
+	_, err = store.DeleteImage("Image", true)
+	require.NoError(t, err)
+	select {
+	case e = <-events:
+		assert.Equal(t, EventDeleted, e.Type)
+		assert.Equal(t, EventImage, e.Object)
+		assert.Equal(t, "Image", e.ID)
+		assert.ElementsMatch(t, []string{"i", "i2"}, e.Names)
+	case <-time.After(10 * time.Second):
+		require.FailNow(t, "timed out waiting for event")
+	}
+
+	cancel()
+	for range events {
+	}
+
+	_, err = store.Shutdown(true)
+	require.Nil(t, err)
+
+	store.Free()
+}
+
+func TestStoreTransaction(t *testing.T) {
+	reexec.Init()
+
+	store := newTestStore(t, StoreOptions{})
+	options := StoreOptions{
+		RunRoot:         store.RunRoot(),
+		GraphRoot:       store.GraphRoot(),
+		GraphDriverName: store.GraphDriverName(),
+	}
+
+	// Committed changes are all visible afterwards.
+	tx, err := store.Begin()
+	require.NoError(t, err)
+	layer, _, err := tx.PutLayer("", "", []string{"committed-layer"}, "", false, nil, nil)
+	require.NoError(t, err)
+	image, err := tx.CreateImage("", []string{"committed-image"}, layer.ID, "", nil)
+	require.NoError(t, err)
+	container, err := tx.CreateContainer("", []string{"committed-container"}, image.ID, "", "", nil)
+	require.NoError(t, err)
+	require.NoError(t, tx.SetImageBigData(image.ID, "image-key", []byte("image-value"), nil))
+	require.NoError(t, tx.SetContainerBigData(container.ID, "container-key", []byte("container-value")))
+	require.NoError(t, tx.Commit())
+	assert.ErrorIs(t, tx.Commit(), ErrTransactionDone)
+	assert.ErrorIs(t, tx.Rollback(), ErrTransactionDone)
+
+	committedLayer, err := store.Layer(layer.ID)
+	require.NoError(t, err)
+	assert.False(t, layerHasIncompleteFlag(committedLayer))
+	data, err := store.ImageBigData(image.ID, "image-key")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("image-value"), data)
+	data, err = store.ContainerBigData(container.ID, "container-key")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("container-value"), data)
+	assert.NoDirExists(t, filepath.Join(store.GraphRoot(), transactionDirName))
+
+	// Rolled back changes are all gone afterwards.
+	before, err := store.MultiList(MultiListOptions{Layers: true, Images: true, Containers: true})
+	require.NoError(t, err)
+	tx, err = store.Begin()
+	require.NoError(t, err)
+	layer, _, err = tx.PutLayer("", "", nil, "", false, nil, nil)
+	require.NoError(t, err)
+	image, err = tx.CreateImage("", []string{"rolled-back-image"}, layer.ID, "", nil)
+	require.NoError(t, err)
+	_, err = tx.CreateContainer("", nil, image.ID, "", "", nil)
+	require.NoError(t, err)
+	require.NoError(t, tx.SetContainerBigData(container.ID, "container-key", []byte("rolled-back-value")))
+	_, err = tx.CreateImage(image.ID, nil, "", "", nil)
+	assert.ErrorIs(t, err, ErrDuplicateID)
+	require.NoError(t, tx.Rollback())
+
+	after, err := store.MultiList(MultiListOptions{Layers: true, Images: true, Containers: true})
+	require.NoError(t, err)
+	assert.Equal(t, before, after)
+	data, err = store.ContainerBigData(container.ID, "container-key")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("container-value"), data)
+	history, err := store.NameHistory("rolled-back-image")
+	require.NoError(t, err)
+	assert.Empty(t, history)
+
+	// An ID-mapped copy of the top layer of an image which wasn't created in
+	// the transaction is removed, too.
+	tx, err = store.Begin()
+	require.NoError(t, err)
+	_, err = tx.CreateContainer("", nil, "committed-image", "", "", &ContainerOptions{
+		IDMappingOptions: IDMappingOptions{
+			UIDMap: []idtools.IDMap{{ContainerID: 0, HostID: 100000, Size: 1}},
+			GIDMap: []idtools.IDMap{{ContainerID: 0, HostID: 100000, Size: 1}},
+		},
+	})
+	require.NoError(t, err)
+	require.NoError(t, tx.Rollback())
+	after, err = store.MultiList(MultiListOptions{Layers: true, Images: true, Containers: true})
+	require.NoError(t, err)
+	assert.Equal(t, before.Layers, after.Layers)
+	require.Len(t, after.Images, 1)
+	assert.Equal(t, before.Images[0].MappedTopLayers, after.Images[0].MappedTopLayers)
+	// Creating the container still counted as a use of the image.
+	before = after
+
+	// A transaction which is abandoned is rolled back when the store is next
+	// opened.
+	tx, err = store.Begin()
+	require.NoError(t, err)
+	layer, _, err = tx.PutLayer("", "", []string{"abandoned-layer"}, "", false, nil, nil)
+	require.NoError(t, err)
+	_, err = tx.CreateImage("", []string{"abandoned-image"}, layer.ID, "", nil)
+	require.NoError(t, err)
+	tx.(*transaction).unlock()
+	_, err = store.Shutdown(true)
+	require.NoError(t, err)
+	store.Free()
+
+	store, err = GetStore(options)
+	require.NoError(t, err)
+	after, err = store.MultiList(MultiListOptions{Layers: true, Images: true, Containers: true})
+	require.NoError(t, err)
+	assert.Equal(t, before, after)
+	history, err = store.NameHistory("abandoned-image")
+	require.NoError(t, err)
+	assert.Empty(t, history)
+
+	// A transaction which is interrupted after being committed is finished
+	// when the store is next opened.
+	tx, err = store.Begin()
+	require.NoError(t, err)
+	require.NoError(t, tx.SetImageBigData("committed-image", "late-key", []byte("late-value"), nil))
+	tx.(*transaction).journal.Committed = true
+	require.NoError(t, tx.(*transaction).saveJournal())
+	tx.(*transaction).unlock()
+	_, err = store.Shutdown(true)
+	require.NoError(t, err)
+	store.Free()
+
+	store, err = GetStore(options)
+	require.NoError(t, err)
+	data, err = store.ImageBigData("committed-image", "late-key")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("late-value"), data)
+	assert.NoDirExists(t, filepath.Join(store.GraphRoot(), transactionDirName))
+
+	_, err = store.Shutdown(true)
+	require.Nil(t, err)
+
+	store.Free()
+}
+
+func TestStoreExportImportImage(t *testing.T) {
+	reexec.Init()
+
+	store := newTestStore(t, StoreOptions{})
+
+	base := putTestLayer(t, store, "", map[string]string{"base": "base contents"})
+	top := putTestLayer(t, store, base.ID, map[string]string{"top": "top contents"})
+	image, err := store.CreateImage("", []string{"export-image"}, top.ID, "metadata", &ImageOptions{
+		BigData: []ImageBigDataOption{{Key: "key", Data: []byte("value")}},
+		Flags:   map[string]any{"flag": "value"},
+	})
+	require.NoError(t, err)
+
+	dir := filepath.Join(t.TempDir(), "layout")
+	archiveFile := filepath.Join(t.TempDir(), "layout.tar")
+	require.NoError(t, store.ExportImage(image.ID, dir))
+	require.NoError(t, store.ExportImage(image.ID, archiveFile))
+	assert.FileExists(t, filepath.Join(dir, ociLayoutFile))
+	assert.FileExists(t, filepath.Join(dir, ociIndexFile))
+	assert.ErrorIs(t, store.ExportImage(image.ID, dir), os.ErrExist)
+
+	// The image is already there.
+	_, err = store.ImportImage(dir)
+	assert.ErrorIs(t, err, ErrDuplicateID)
+
+	_, err = store.DeleteImage(image.ID, true)
+	require.NoError(t, err)
+	_, err = store.Layer(base.ID)
+	require.ErrorIs(t, err, ErrLayerUnknown)
+
+	imported, err := store.ImportImage(archiveFile)
+	require.NoError(t, err)
+	assert.Equal(t, image.ID, imported.ID)
+	// The archive was extracted under the graph root, and cleaned up.
+	staged, err := filepath.Glob(filepath.Join(store.GraphRoot(), ".import-image-*"))
+	require.NoError(t, err)
+	assert.Empty(t, staged)
+	assert.Equal(t, image.Names, imported.Names)
+	assert.Equal(t, image.Metadata, imported.Metadata)
+	assert.Equal(t, image.Flags, imported.Flags)
+	assert.Equal(t, image.BigDataDigests, imported.BigDataDigests)
+	data, err := store.ImageBigData(imported.ID, "key")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("value"), data)
+
+	importedTop, err := store.Layer(imported.TopLayer)
+	require.NoError(t, err)
+	assert.Equal(t, top.UncompressedDigest, importedTop.UncompressedDigest)
+	importedBase, err := store.Layer(importedTop.Parent)
+	require.NoError(t, err)
+	assert.Equal(t, base.UncompressedDigest, importedBase.UncompressedDigest)
+	assert.Empty(t, importedBase.Parent)
+	assert.False(t, layerHasIncompleteFlag(importedTop))
+
+	// Layers which are still present are reused.
+	_, err = store.CreateImage("", nil, importedTop.ID, "", nil)
+	require.NoError(t, err)
+	_, err = store.DeleteImage(imported.ID, true)
+	require.NoError(t, err)
+	reimported, err := store.ImportImage(dir)
+	require.NoError(t, err)
+	assert.Equal(t, importedTop.ID, reimported.TopLayer)
+
+	_, err = store.Shutdown(true)
+	require.Nil(t, err)
+
+	store.Free()
+}
+
+func TestCopyImage(t *testing.T) {
+	reexec.Init()
+
+	src := newTestStore(t, StoreOptions{})
+	dst := newTestStore(t, StoreOptions{})
+
+	base := putTestLayer(t, src, "", map[string]string{"base": "base contents"})
+	top := putTestLayer(t, src, base.ID, map[string]string{"top": "top contents"})
+	require.NoError(t, src.SetLayerBigData(top.ID, "layer-key", strings.NewReader("layer-value")))
+	image, err := src.CreateImage("", []string{"copied-image"}, top.ID, "metadata", &ImageOptions{
+		BigData: []ImageBigDataOption{{Key: "key", Data: []byte("value")}},
+	})
+	require.NoError(t, err)
+
+	// The base layer is already in the destination.
+	rc, err := src.Diff("", base.ID, nil)
+	require.NoError(t, err)
+	existingBase, _, err := dst.PutLayer("", "", nil, "", false, nil, rc)
+	rc.Close()
+	require.NoError(t, err)
+
+	copied, err := CopyImage(src, dst, "copied-image", nil)
+	require.NoError(t, err)
+	assert.Equal(t, image.ID, copied.ID)
+	assert.Equal(t, image.Names, copied.Names)
+	assert.Equal(t, image.Metadata, copied.Metadata)
+	assert.Equal(t, image.BigDataDigests, copied.BigDataDigests)
+	data, err := dst.ImageBigData(copied.ID, "key")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("value"), data)
+
+	copiedTop, err := dst.Layer(copied.TopLayer)
+	require.NoError(t, err)
+	assert.Equal(t, top.UncompressedDigest, copiedTop.UncompressedDigest)
+	assert.Equal(t, existingBase.ID, copiedTop.Parent)
+	assert.False(t, layerHasIncompleteFlag(copiedTop))
+	bigData, err := dst.LayerBigData(copiedTop.ID, "layer-key")
+	require.NoError(t, err)
+	layerData, err := io.ReadAll(bigData)
+	bigData.Close()
+	require.NoError(t, err)
+	assert.Equal(t, "layer-value", string(layerData))
+
+	// Copying it again only adds the new names.
+	copied, err = CopyImage(src, dst, image.ID, &CopyImageOptions{Names: []string{"another-name"}})
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"copied-image", "another-name"}, copied.Names)
+	layers, err := dst.Layers()
+	require.NoError(t, err)
+	assert.Len(t, layers, 2)
+
+	_, err = CopyImage(src, src, image.ID, nil)
+	assert.Error(t, err)
+
+	for _, store := range []Store{src, dst} {
+		_, err = store.Shutdown(true)
+		require.Nil(t, err)
+		store.Free()
+	}
+}
+
+func TestStoreLeases(t *testing.T) {
+	reexec.Init()
+
+	store := newTestStore(t, StoreOptions{})
+
+	_, err := store.AcquireLease("no-such-layer", 0)
+	assert.ErrorIs(t, err, ErrNotAnID)
+
+	// A layer with no image or container, which is protected until its
+	// last lease is released.
+	base, err := store.CreateLayer("", "", []string{"leased-layer"}, "", false, nil)
+	require.NoError(t, err)
+	first, err := store.AcquireLease("leased-layer", 0)
+	require.NoError(t, err)
+	second, err := store.AcquireLease(base.ID, time.Hour)
+	require.NoError(t, err)
+
+	noAge := time.Duration(0)
+	checkOptions := CheckMost()
+	checkOptions.LayerUnreferencedMaximumAge = &noAge
+	report, err := store.Check(checkOptions)
+	require.NoError(t, err)
+	assert.Empty(t, report.Layers[base.ID])
+	require.NoError(t, store.GarbageCollect())
+
+	require.NoError(t, store.ReleaseLease(first))
+	assert.ErrorIs(t, store.ReleaseLease(first), ErrLeaseUnknown)
+	assert.ErrorIs(t, store.DeleteLayer(base.ID), ErrLayerLeased)
+	assert.ErrorIs(t, store.DeleteLayer("leased-layer"), ErrLayerLeased)
+	require.NoError(t, store.ReleaseLease(second))
+	report, err = store.Check(checkOptions)
+	require.NoError(t, err)
+	assert.NotEmpty(t, report.Layers[base.ID])
+
+	// A lease on an image keeps it from being deleted.
+	top, err := store.CreateLayer("", base.ID, nil, "", false, nil)
+	require.NoError(t, err)
+	image, err := store.CreateImage("", nil, top.ID, "", nil)
+	require.NoError(t, err)
+	imageLease, err := store.AcquireLease(image.ID, 0)
+	require.NoError(t, err)
+	_, err = store.DeleteImage(image.ID, true)
+	assert.ErrorIs(t, err, ErrImageLeased)
+	require.NoError(t, store.ReleaseLease(imageLease))
+
+	// A lease on one of an image's layers keeps that layer, and the ones
+	// below it, when the image is deleted.
+	baseLease, err := store.AcquireLease(base.ID, 0)
+	require.NoError(t, err)
+	removed, err := store.DeleteImage(image.ID, true)
+	require.NoError(t, err)
+	assert.Equal(t, []string{top.ID}, removed)
+	assert.True(t, store.Exists(base.ID))
+	require.NoError(t, store.ReleaseLease(baseLease))
+
+	// Leases which have expired don't count.
+	_, err = store.AcquireLease(base.ID, time.Millisecond)
+	require.NoError(t, err)
+	time.Sleep(10 * time.Millisecond)
+	require.NoError(t, store.DeleteLayer(base.ID))
+
+	_, err = store.Shutdown(true)
+	require.Nil(t, err)
+
+	store.Free()
+}
+
+func TestStoreContextCancellation(t *testing.T) {
+	reexec.Init()
+
+	store := newTestStore(t, StoreOptions{})
+
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "file"), []byte("contents"), 0o644))
+	tarball := func() io.ReadCloser {
+		rc, err := archive.Tar(dir, archive.Uncompressed)
+		require.NoError(t, err)
+		return rc
+	}
+	rc := tarball()
+	base, _, err := store.PutLayer("", "", nil, "", false, nil, rc)
+	rc.Close()
+	require.NoError(t, err)
+	image, err := store.CreateImage("", nil, base.ID, "", nil)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// A layer whose diff couldn't be read is not left behind.
+	rc = tarball()
+	_, _, err = store.PutLayerWithContext(ctx, "", base.ID, []string{"cancelled"}, "", false, nil, rc)
+	rc.Close()
+	assert.ErrorIs(t, err, context.Canceled)
+	_, err = store.Layer("cancelled")
+	assert.ErrorIs(t, err, ErrLayerUnknown)
+	layers, err := store.Layers()
+	require.NoError(t, err)
+	assert.Len(t, layers, 1)
+
+	top, err := store.CreateLayer("", base.ID, nil, "", false, nil)
+	require.NoError(t, err)
+	rc = tarball()
+	_, err = store.ApplyDiffWithContext(ctx, top.ID, nil, rc)
+	rc.Close()
+	assert.ErrorIs(t, err, context.Canceled)
+
+	// A diff which is cancelled after some of it has been applied is
+	// discarded, so that it can be applied again.
+	topDir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(topDir, "a-first"), []byte("first"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(topDir, "b-second"), bytes.Repeat([]byte("second"), 1024*1024), 0o644))
+	partial, cancelPartial := context.WithCancel(context.Background())
+	rc, err = archive.Tar(topDir, archive.Uncompressed)
+	require.NoError(t, err)
+	_, err = store.ApplyDiffWithContext(partial, top.ID, nil, &cancellingReader{r: rc, remaining: 64 * 1024, cancel: cancelPartial})
+	rc.Close()
+	assert.ErrorIs(t, err, context.Canceled)
+	layerMount, err := store.Mount(top.ID, "")
+	require.NoError(t, err)
+	assert.FileExists(t, filepath.Join(layerMount, "file"))
+	assert.NoFileExists(t, filepath.Join(layerMount, "a-first"))
+	_, err = store.Unmount(top.ID, true)
+	require.NoError(t, err)
+	rc, err = archive.Tar(topDir, archive.Uncompressed)
+	require.NoError(t, err)
+	_, err = store.ApplyDiffWithContext(context.Background(), top.ID, nil, rc)
+	rc.Close()
+	require.NoError(t, err)
+
+	_, err = store.DiffWithContext(ctx, "", base.ID, nil)
+	assert.ErrorIs(t, err, context.Canceled)
+	_, err = store.ImageSizeWithContext(ctx, image.ID)
+	assert.ErrorIs(t, err, context.Canceled)
+	_, err = store.CheckWithContext(ctx, CheckEverything())
+	assert.ErrorIs(t, err, context.Canceled)
+
+	// Cancelling a diff which is being read releases the store's locks.
+	ctx, cancel = context.WithCancel(context.Background())
+	diff, err := store.DiffWithContext(ctx, "", base.ID, nil)
+	require.NoError(t, err)
+	cancel()
+	require.NoError(t, store.DeleteLayer(top.ID))
+	_, err = io.Copy(io.Discard, diff)
+	assert.ErrorIs(t, err, context.Canceled)
+	require.NoError(t, diff.Close())
+
+	_, err = store.Shutdown(true)
+	require.Nil(t, err)
+
+	store.Free()
+}
+
+// cancellingReader reads from r, and calls cancel once it has read remaining
+// bytes from it.
+type cancellingReader struct {
+	r         io.Reader
+	remaining int
+	cancel    context.CancelFunc
+}
+
+func (c *cancellingReader) Read(p []byte) (int, error) {
+	if c.remaining <= 0 {
+		c.cancel()
+	}
+	if len(p) > c.remaining && c.remaining > 0 {
+		p = p[:c.remaining]
+	}
+	n, err := c.r.Read(p)
+	c.remaining -= n
+	return n, err
+}
+
+// cancelledDiffer writes a file to the staging directory, and then waits for
+// its context to be cancelled.
+type cancelledDiffer struct{}
+
+func (cancelledDiffer) ApplyDiff(dest string, options *archive.TarOptions, differOpts *drivers.DifferOptions) (drivers.DriverWithDifferOutput, error) {
+	if err := os.WriteFile(filepath.Join(dest, "partial"), []byte("partial"), 0o644); err != nil {
+		return drivers.DriverWithDifferOutput{}, err
+	}
+	<-differOpts.Context.Done()
+	return drivers.DriverWithDifferOutput{}, differOpts.Context.Err()
+}
+
+func (cancelledDiffer) Close() error {
+	return nil
+}
+
+func TestStorePrepareStagedLayerCancellation(t *testing.T) {
+	reexec.Init()
+
+	if os.Geteuid() != 0 {
+		t.Skip("overlay requires root")
+	}
+	wd := t.TempDir()
+	store, err := GetStore(StoreOptions{
+		RunRoot:         filepath.Join(wd, "run"),
+		GraphRoot:       filepath.Join(wd, "root"),
+		GraphDriverName: "overlay",
+	})
+	if err != nil {
+		t.Skipf("overlay is not usable here: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = store.PrepareStagedLayerWithContext(ctx, nil, cancelledDiffer{})
+	assert.ErrorIs(t, err, context.Canceled)
+	staged, err := os.ReadDir(filepath.Join(store.GraphRoot(), "overlay", "staging"))
+	require.NoError(t, err)
+	assert.Empty(t, staged)
+
+	_, err = store.Shutdown(true)
+	require.Nil(t, err)
+
+	store.Free()
+}
+
+func TestStoreProgress(t *testing.T) {
+	reexec.Init()
+
+	store := newTestStore(t, StoreOptions{})
+
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "file"), []byte("contents"), 0o644))
+	rc, err := archive.Tar(dir, archive.Uncompressed)
+	require.NoError(t, err)
+	defer rc.Close()
+
+	var applied []archive.Progress
+	layer, _, err := store.PutLayer("", "", nil, "", false, &LayerOptions{
+		Progress: func(p archive.Progress) { applied = append(applied, p) },
+	}, rc)
+	require.NoError(t, err)
+	require.NotEmpty(t, applied)
+	final := applied[len(applied)-1]
+	assert.Equal(t, int64(1), final.Entries)
+	assert.Equal(t, int64(len("contents")), final.BytesWritten)
+	assert.Equal(t, layer.UncompressedSize, final.BytesRead)
+
+	var generated []archive.Progress
+	uncompressed := archive.Uncompressed
+	diff, err := store.Diff("", layer.ID, &DiffOptions{
+		Compression: &uncompressed,
+		Progress:    func(p archive.Progress) { generated = append(generated, p) },
+	})
+	require.NoError(t, err)
+	n, err := io.Copy(io.Discard, diff)
+	require.NoError(t, err)
+	require.NoError(t, diff.Close())
+	require.NotEmpty(t, generated)
+	assert.Equal(t, applied[len(applied)-1], generated[len(generated)-1])
+	assert.Equal(t, n, generated[len(generated)-1].BytesRead)
+
+	applied = nil
+	top, err := store.CreateLayer("", layer.ID, nil, "", false, nil)
+	require.NoError(t, err)
+	diff, err = store.Diff("", layer.ID, &DiffOptions{Compression: &uncompressed})
+	require.NoError(t, err)
+	contents, err := io.ReadAll(diff)
+	require.NoError(t, err)
+	require.NoError(t, diff.Close())
+	_, err = store.ApplyDiffWithContext(context.Background(), top.ID, &ApplyDiffOptions{
+		Progress: func(p archive.Progress) { applied = append(applied, p) },
+	}, bytes.NewReader(contents))
+	require.NoError(t, err)
+	require.NotEmpty(t, applied)
+	assert.Equal(t, generated[len(generated)-1], applied[len(applied)-1])
+
+	_, err = store.Shutdown(true)
+	require.Nil(t, err)
+
+	store.Free()
+}
+
+// deleteTestLayerRecord removes a layer from the writable layer store without
+// checking whether anything uses it.
+func deleteTestLayerRecord(t *testing.T, s Store, id string) {
+	st, ok := s.(*store)
+	require.True(t, ok)
+	_, err := writeToLayerStore(st, func(rlstore rwLayerStore) (struct{}, error) {
+		return struct{}{}, rlstore.deleteWhileHoldingLock(id)
+	})
+	require.NoError(t, err)
+}
+
+func TestStoreDiskUsage(t *testing.T) {
+	reexec.Init()
+
+	store := newTestStore(t, StoreOptions{})
+
+	base := putTestLayer(t, store, "", map[string]string{"base": "base contents"})
+	first := putTestLayer(t, store, base.ID, map[string]string{"first": "first contents"})
+	second := putTestLayer(t, store, base.ID, map[string]string{"second": "second contents"})
+	firstImage, err := store.CreateImage("", []string{"first"}, first.ID, "", nil)
+	require.NoError(t, err)
+	secondImage, err := store.CreateImage("", []string{"second"}, second.ID, "", nil)
+	require.NoError(t, err)
+	container, err := store.CreateContainer("", nil, firstImage.ID, "", "", nil)
+	require.NoError(t, err)
+
+	report, err := store.DiskUsage()
+	require.NoError(t, err)
+	require.Len(t, report.Images, 2)
+	require.Len(t, report.Containers, 1)
+
+	images := make(map[string]ImageDiskUsage)
+	for _, usage := range report.Images {
+		images[usage.ID] = usage
+		size, err := store.ImageSize(usage.ID)
+		require.NoError(t, err)
+		assert.Equal(t, size, usage.Size)
+	}
+	// The first image's size may include a copy of its top layer, which
+	// was created with the container's ID mappings.
+	assert.Equal(t, base.UncompressedSize, images[firstImage.ID].Shared)
+	assert.Equal(t, 1, images[firstImage.ID].Containers)
+	assert.Zero(t, images[firstImage.ID].Reclaimable)
+	assert.Equal(t, base.UncompressedSize+second.UncompressedSize, images[secondImage.ID].Size)
+	assert.Equal(t, base.UncompressedSize, images[secondImage.ID].Shared)
+	assert.Equal(t, second.UncompressedSize, images[secondImage.ID].Reclaimable)
+
+	usage := report.Containers[0]
+	assert.Equal(t, container.ID, usage.ID)
+	assert.Equal(t, firstImage.ID, usage.Image)
+	assert.Greater(t, usage.Shared, base.UncompressedSize)
+	assert.LessOrEqual(t, usage.Shared, images[firstImage.ID].Size)
+	assert.Equal(t, usage.Shared+usage.Reclaimable, usage.Size)
+	assert.Empty(t, usage.Error)
+
+	// A container whose layer is missing is reported with an error, and
+	// doesn't keep the others from being reported.
+	broken, err := store.CreateContainer("", nil, "", "", "", nil)
+	require.NoError(t, err)
+	deleteTestLayerRecord(t, store, broken.LayerID)
+	report, err = store.DiskUsage()
+	require.NoError(t, err)
+	require.Len(t, report.Containers, 2)
+	for _, usage := range report.Containers {
+		if usage.ID == broken.ID {
+			assert.Contains(t, usage.Error, broken.LayerID)
+			assert.Equal(t, int64(-1), usage.Size)
+		} else {
+			assert.Empty(t, usage.Error)
+			assert.Positive(t, usage.Size)
+		}
+	}
+
+	_, err = store.Shutdown(true)
+	require.Nil(t, err)
+
+	store.Free()
+}
+
+func TestStorePrune(t *testing.T) {
+	reexec.Init()
+
+	store := newTestStore(t, StoreOptions{})
+
+	base := putTestLayer(t, store, "", map[string]string{"base": "base contents"})
+	first := putTestLayer(t, store, base.ID, map[string]string{"first": "first contents"})
+	second := putTestLayer(t, store, base.ID, map[string]string{"second": "second contents"})
+	third := putTestLayer(t, store, base.ID, map[string]string{"third": "third contents"})
+	dangling := putTestLayer(t, store, base.ID, map[string]string{"dangling": "dangling contents"})
+	now := time.Now().UTC()
+	firstImage, err := store.CreateImage("", []string{"first"}, first.ID, "", &ImageOptions{CreationDate: now.Add(-3 * time.Hour)})
+	require.NoError(t, err)
+	secondImage, err := store.CreateImage("", []string{"second"}, second.ID, "", &ImageOptions{CreationDate: now.Add(-2 * time.Hour)})
+	require.NoError(t, err)
+	thirdImage, err := store.CreateImage("", []string{"third"}, third.ID, "", &ImageOptions{CreationDate: now.Add(-time.Hour)})
+	require.NoError(t, err)
+	_, err = store.CreateContainer("", nil, firstImage.ID, "", "", nil)
+	require.NoError(t, err)
+
+	image, err := store.Image(firstImage.ID)
+	require.NoError(t, err)
+	assert.False(t, image.LastUsed.IsZero())
+	assert.False(t, image.LastUsed.Before(now))
+	lastUsed := image.LastUsed
+
+	// Using an image again doesn't rewrite the list of images.
+	imagesFile := filepath.Join(store.GraphRoot(), "vfs-images", "images.json")
+	before, err := os.Stat(imagesFile)
+	require.NoError(t, err)
+	_, err = store.CreateContainer("", nil, firstImage.ID, "", "", nil)
+	require.NoError(t, err)
+	after, err := os.Stat(imagesFile)
+	require.NoError(t, err)
+	assert.Equal(t, before.ModTime(), after.ModTime())
+	image, err = store.Image(firstImage.ID)
+	require.NoError(t, err)
+	assert.False(t, image.LastUsed.Before(lastUsed))
+
+	// A dry run only reports what would be removed, starting with the
+	// least recently used image.  The first image is used by a container.
+	report, err := store.Prune(PruneOptions{MaxAge: 30 * time.Minute, DryRun: true})
+	require.NoError(t, err)
+	assert.Equal(t, []string{secondImage.ID, thirdImage.ID}, report.Images)
+	assert.ElementsMatch(t, []string{second.ID, third.ID}, report.Layers)
+	assert.Equal(t, second.UncompressedSize+third.UncompressedSize, report.Reclaimed)
+	for _, id := range []string{firstImage.ID, secondImage.ID, thirdImage.ID} {
+		assert.True(t, store.Exists(id))
+	}
+
+	report, err = store.Prune(PruneOptions{MaxAge: 90 * time.Minute})
+	require.NoError(t, err)
+	assert.Equal(t, []string{secondImage.ID}, report.Images)
+	assert.Equal(t, []string{second.ID}, report.Layers)
+	assert.Equal(t, second.UncompressedSize, report.Reclaimed)
+	assert.False(t, store.Exists(secondImage.ID))
+	assert.False(t, store.Exists(second.ID))
+	assert.True(t, store.Exists(thirdImage.ID))
+
+	// Dangling layers which were only just created are kept, since
+	// they may be about to be used.
+	report, err = store.Prune(PruneOptions{DanglingLayers: true})
+	require.NoError(t, err)
+	assert.Empty(t, report.Images)
+	assert.Empty(t, report.Layers)
+	assert.True(t, store.Exists(dangling.ID))
+
+	noAge := time.Duration(0)
+	report, err = store.Prune(PruneOptions{DanglingLayers: true, DanglingLayersMinimumAge: &noAge})
+	require.NoError(t, err)
+	assert.Empty(t, report.Images)
+	assert.Equal(t, []string{dangling.ID}, report.Layers)
+	assert.False(t, store.Exists(dangling.ID))
+	assert.True(t, store.Exists(base.ID))
+
+	report, err = store.Prune(PruneOptions{MaxSize: 1, Policy: PruneLargest})
+	require.NoError(t, err)
+	assert.Equal(t, []string{thirdImage.ID}, report.Images)
+	assert.True(t, store.Exists(firstImage.ID))
+	assert.True(t, store.Exists(base.ID))
+
+	_, err = store.Prune(PruneOptions{Policy: "random"})
+	assert.Error(t, err)
+
+	_, err = store.Shutdown(true)
+	require.Nil(t, err)
+
+	store.Free()
+}
+
+func TestStoreLabels(t *testing.T) {
+	reexec.Init()
+
+	store := newTestStore(t, StoreOptions{})
+
+	layer, err := store.CreateLayer("", "", nil, "", false, &LayerOptions{Labels: map[string]string{"pipeline": "nightly"}})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"pipeline": "nightly"}, layer.Labels)
+	nightly, err := store.CreateImage("", nil, layer.ID, "", &ImageOptions{Labels: map[string]string{"pipeline": "nightly", "arch": "amd64"}})
+	require.NoError(t, err)
+	weekly, err := store.CreateImage("", nil, layer.ID, "", &ImageOptions{Labels: map[string]string{"pipeline": "weekly"}})
+	require.NoError(t, err)
+	unlabeled, err := store.CreateImage("", nil, layer.ID, "", nil)
+	require.NoError(t, err)
+	container, err := store.CreateContainer("", nil, nightly.ID, "", "", &ContainerOptions{Labels: map[string]string{"role": "builder"}})
+	require.NoError(t, err)
+
+	imageIDs := func(selector string) []string {
+		images, err := store.ImagesByLabel(selector)
+		require.NoError(t, err)
+		var ids []string
+		for _, image := range images {
+			ids = append(ids, image.ID)
+		}
+		return ids
+	}
+	assert.ElementsMatch(t, []string{nightly.ID, weekly.ID, unlabeled.ID}, imageIDs(""))
+	assert.ElementsMatch(t, []string{nightly.ID, weekly.ID}, imageIDs("pipeline"))
+	assert.ElementsMatch(t, []string{nightly.ID}, imageIDs("pipeline=nightly,arch"))
+	assert.ElementsMatch(t, []string{weekly.ID, unlabeled.ID}, imageIDs("pipeline!=nightly"))
+	assert.ElementsMatch(t, []string{unlabeled.ID}, imageIDs("!pipeline"))
+	_, err = store.ImagesByLabel("=nightly")
+	assert.Error(t, err)
+
+	containers, err := store.ContainersByLabel("role=builder")
+	require.NoError(t, err)
+	require.Len(t, containers, 1)
+	assert.Equal(t, container.ID, containers[0].ID)
+	containers, err = store.ContainersByLabel("role=tester")
+	require.NoError(t, err)
+	assert.Empty(t, containers)
+
+	// Labels can be replaced after the fact, and are persistent.
+	require.NoError(t, store.SetLabels(unlabeled.ID, map[string]string{"pipeline": "nightly"}))
+	require.NoError(t, store.SetLabels(container.ID, nil))
+	runRoot, graphRoot := store.RunRoot(), store.GraphRoot()
+	_, err = store.Shutdown(true)
+	require.NoError(t, err)
+	store.Free()
+
+	store = newTestStore(t, StoreOptions{RunRoot: runRoot, GraphRoot: graphRoot})
+	assert.ElementsMatch(t, []string{nightly.ID, unlabeled.ID}, imageIDs("pipeline=nightly"))
+	listed, err := store.MultiList(MultiListOptions{Layers: true, Containers: true, LabelSelector: "pipeline=nightly"})
+	require.NoError(t, err)
+	require.Len(t, listed.Layers, 1)
+	assert.Equal(t, layer.ID, listed.Layers[0].ID)
+	assert.Empty(t, listed.Containers)
+	c, err := store.Container(container.ID)
+	require.NoError(t, err)
+	assert.Empty(t, c.Labels)
+
+	_, err = store.Shutdown(true)
+	require.Nil(t, err)
+
+	store.Free()
+}
+
+// addTestMappedTopLayer records layerID as an ID-mapped copy of the image's
+// top layer.
+func addTestMappedTopLayer(t *testing.T, s Store, imageID, layerID string) {
+	st, ok := s.(*store)
+	require.True(t, ok)
+	_, err := writeToImageStore(st, func() (struct{}, error) {
+		return struct{}{}, st.imageStore.addMappedTopLayer(imageID, layerID)
+	})
+	require.NoError(t, err)
+}
+
+func TestStoreSquashLayers(t *testing.T) {
+	reexec.Init()
+
+	store := newTestStore(t, StoreOptions{})
+
+	base := putTestLayer(t, store, "", map[string]string{"base": "base"})
+	middle := putTestLayer(t, store, base.ID, map[string]string{"removed": "removed", "changed": "old"})
+	top := putTestLayer(t, store, middle.ID, map[string]string{".wh.removed": "", "changed": "new", "added": "added"})
+	image, err := store.CreateImage("", nil, top.ID, "", nil)
+	require.NoError(t, err)
+
+	// contents returns the non-directory entries in a layer's diff.
+	contents := func(layerID string) map[string]string {
+		rc, err := store.Diff("", layerID, nil)
+		require.NoError(t, err)
+		defer rc.Close()
+		files := make(map[string]string)
+		tr := tar.NewReader(rc)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			require.NoError(t, err)
+			if hdr.Typeflag == tar.TypeDir {
+				continue
+			}
+			data, err := io.ReadAll(tr)
+			require.NoError(t, err)
+			files[strings.TrimPrefix(hdr.Name, "./")] = string(data)
+		}
+		return files
+	}
+
+	squashed, err := store.SquashLayers(top.ID, "", nil)
+	require.NoError(t, err)
+	assert.Empty(t, squashed.Parent)
+	assert.NotEmpty(t, squashed.UncompressedDigest)
+	assert.Equal(t, map[string]string{"base": "base", "changed": "new", "added": "added"}, contents(squashed.ID))
+
+	// Pretend that an ID-mapped copy of the top layer was made for the
+	// image.
+	mapped := putTestLayer(t, store, middle.ID, map[string]string{"changed": "new", "added": "added"})
+	addTestMappedTopLayer(t, store, image.ID, mapped.ID)
+
+	squashed, err = store.SquashLayers(top.ID, base.ID, &SquashOptions{Names: []string{"squashed"}, Image: image.ID})
+	require.NoError(t, err)
+	assert.Equal(t, base.ID, squashed.Parent)
+	assert.Equal(t, []string{"squashed"}, squashed.Names)
+	assert.NotEmpty(t, squashed.UncompressedDigest)
+	assert.Equal(t, map[string]string{"changed": "new", "added": "added"}, contents(squashed.ID))
+	image, err = store.Image(image.ID)
+	require.NoError(t, err)
+	assert.Equal(t, squashed.ID, image.TopLayer)
+	assert.Equal(t, []string{mapped.ID}, image.MappedTopLayers)
+
+	// The base must be one of the top layer's parents, and the image must
+	// be using the top layer.
+	_, err = store.SquashLayers(middle.ID, top.ID, nil)
+	assert.Error(t, err)
+	_, err = store.SquashLayers(top.ID, base.ID, &SquashOptions{Image: image.ID})
+	assert.Error(t, err)
+
+	// Deleting the image removes the mapped layer, too.
+	removed, err := store.DeleteImage(image.ID, true)
+	require.NoError(t, err)
+	assert.Contains(t, removed, mapped.ID)
+	assert.False(t, store.Exists(mapped.ID))
+
+	// The squashed layers can be removed, as far down the chain as nothing
+	// else uses them.
+	lower := putTestLayer(t, store, base.ID, map[string]string{"lower": "lower"})
+	shared := putTestLayer(t, store, lower.ID, map[string]string{"shared": "shared"})
+	sibling := putTestLayer(t, store, shared.ID, map[string]string{"sibling": "sibling"})
+	upper := putTestLayer(t, store, shared.ID, map[string]string{"upper": "upper"})
+	image, err = store.CreateImage("", nil, upper.ID, "", nil)
+	require.NoError(t, err)
+	squashed, err = store.SquashLayers(upper.ID, base.ID, &SquashOptions{Image: image.ID, RemoveSquashed: true})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"lower": "lower", "shared": "shared", "upper": "upper"}, contents(squashed.ID))
+	assert.False(t, store.Exists(upper.ID))
+	assert.True(t, store.Exists(shared.ID))
+	assert.True(t, store.Exists(sibling.ID))
+	assert.True(t, store.Exists(lower.ID))
+	assert.True(t, store.Exists(base.ID))
+
+	_, err = store.Shutdown(true)
+	require.Nil(t, err)
+
+	store.Free()
+}
+
+func TestStoreRebaseLayer(t *testing.T) {
+	reexec.Init()
+
+	store := newTestStore(t, StoreOptions{})
+
+	oldBase := putTestLayer(t, store, "", map[string]string{"a": "old", "d/x": "x", "unchanged": "same"})
+	newBase := putTestLayer(t, store, "", map[string]string{"a": "new version", "d/y": "y", "unchanged": "same"})
+	layer := putTestLayer(t, store, oldBase.ID, map[string]string{"a": "layer", ".wh.d": "", "b": "b"})
+	require.NoError(t, store.SetNames(layer.ID, []string{"derived"}))
+	require.NoError(t, store.SetMetadata(layer.ID, "metadata"))
+	require.NoError(t, store.SetLayerBigData(layer.ID, "key", bytes.NewReader([]byte("data"))))
+	require.NoError(t, store.SetLabels(layer.ID, map[string]string{"label": "value"}))
+
+	rebased, conflicts, err := store.RebaseLayer("derived", newBase.ID)
+	require.NoError(t, err)
+	assert.NotEqual(t, layer.ID, rebased.ID)
+	assert.Equal(t, newBase.ID, rebased.Parent)
+	assert.Equal(t, []string{"derived"}, rebased.Names)
+	assert.Equal(t, "metadata", rebased.Metadata)
+	assert.Equal(t, map[string]string{"label": "value"}, rebased.Labels)
+	assert.Equal(t, layer.UncompressedDigest, rebased.UncompressedDigest)
+	rc, err := store.LayerBigData(rebased.ID, "key")
+	require.NoError(t, err)
+	data, err := io.ReadAll(rc)
+	rc.Close()
+	require.NoError(t, err)
+	assert.Equal(t, "data", string(data))
+	original, err := store.Layer(layer.ID)
+	require.NoError(t, err)
+	assert.Empty(t, original.Names)
+
+	// The layer writes "a", which the new base changes, and removes "d",
+	// whose contents the new base changes.  Neither base has "b".
+	require.Len(t, conflicts, 2)
+	assert.Equal(t, "/a", conflicts[0].Path)
+	assert.False(t, conflicts[0].Whiteout)
+	assert.Equal(t, archive.ChangeType(archive.ChangeModify), conflicts[0].ParentChange)
+	assert.Equal(t, "/d", conflicts[1].Path)
+	assert.True(t, conflicts[1].Whiteout)
+
+	// Rebasing onto nothing conflicts with everything in the old base
+	// that the layer touches.
+	_, conflicts, err = store.RebaseLayer(layer.ID, "")
+	require.NoError(t, err)
+	var paths []string
+	for _, conflict := range conflicts {
+		paths = append(paths, conflict.Path)
+		assert.Equal(t, archive.ChangeType(archive.ChangeDelete), conflict.ParentChange)
+	}
+	assert.Equal(t, []string{"/a", "/d"}, paths)
+
+	_, _, err = store.RebaseLayer(oldBase.ID, layer.ID)
+	assert.Error(t, err)
+
+	_, err = store.Shutdown(true)
+	require.Nil(t, err)
+
+	store.Free()
+}
+
+func TestStoreLayerFiles(t *testing.T) {
+	reexec.Init()
+
+	store := newTestStore(t, StoreOptions{})
+
+	base := putTestLayer(t, store, "", map[string]string{"a": "a", "d/x": "x", "e/y": "y"})
+	top := putTestLayer(t, store, base.ID, map[string]string{"a": "changed", ".wh.d": "", "e/.wh..wh..opq": "", "e/z": "z"})
+	image, err := store.CreateImage("", nil, top.ID, "", nil)
+	require.NoError(t, err)
+
+	files, err := store.LayerFiles(base.ID)
+	require.NoError(t, err)
+	sizes := make(map[string]int64)
+	for hdr, err := range files {
+		require.NoError(t, err)
+		if hdr.Typeflag == tar.TypeReg {
+			sizes[hdr.Name] = hdr.Size
+		}
+	}
+	assert.Equal(t, map[string]int64{"a": 1, "d/x": 1, "e/y": 1}, sizes)
+
+	_, err = store.LayerFiles("no-such-layer")
+	assert.ErrorIs(t, err, ErrLayerUnknown)
+
+	found, err := store.FindPath(image.ID, "a")
+	require.NoError(t, err)
+	assert.Equal(t, top.ID, found.Layer)
+	assert.False(t, found.Whiteout)
+	assert.Equal(t, int64(len("changed")), found.Header.Size)
+
+	found, err = store.FindPath(image.ID, "/d/x")
+	require.NoError(t, err)
+	assert.Equal(t, top.ID, found.Layer)
+	assert.True(t, found.Whiteout)
+
+	found, err = store.FindPath(image.ID, "/e/y")
+	require.NoError(t, err)
+	assert.Equal(t, top.ID, found.Layer)
+	assert.True(t, found.Whiteout)
+
+	found, err = store.FindPath(image.ID, "/e/z")
+	require.NoError(t, err)
+	assert.Equal(t, top.ID, found.Layer)
+	assert.False(t, found.Whiteout)
+
+	found, err = store.FindPath(image.ID, "/e")
+	require.NoError(t, err)
+	assert.Equal(t, top.ID, found.Layer)
+	assert.False(t, found.Whiteout)
+
+	_, err = store.FindPath(image.ID, "/missing")
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	_, err = store.Shutdown(true)
+	require.Nil(t, err)
+	store.Free()
+}
+
+func TestStoreOpenImageFile(t *testing.T) {
+	reexec.Init()
+
+	store := newTestStore(t, StoreOptions{})
+
+	dir := t.TempDir()
+	for file, contents := range map[string]string{"usr/lib/os-release": "ID=base", "d/x": "x", "e/y": "y"} {
+		require.NoError(t, os.MkdirAll(filepath.Dir(filepath.Join(dir, file)), 0o755))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, file), []byte(contents), 0o644))
+	}
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "etc"), 0o755))
+	require.NoError(t, os.Symlink("../usr/lib/os-release", filepath.Join(dir, "etc", "os-release")))
+	require.NoError(t, os.Symlink("usr/lib", filepath.Join(dir, "lib")))
+	require.NoError(t, os.Link(filepath.Join(dir, "usr", "lib", "os-release"), filepath.Join(dir, "usr", "lib", "hardlink")))
+	base := putTestLayerFromDir(t, store, "", dir)
+	top := putTestLayer(t, store, base.ID, map[string]string{"usr/lib/os-release": "ID=top-version", ".wh.d": "", "e/.wh..wh..opq": "", "e/z": "z"})
+	image, err := store.CreateImage("", nil, top.ID, "", nil)
+	require.NoError(t, err)
+
+	readFile := func(open func() (io.ReadCloser, error)) string {
+		rc, err := open()
+		require.NoError(t, err)
+		defer rc.Close()
+		data, err := io.ReadAll(rc)
+		require.NoError(t, err)
+		return string(data)
+	}
+	assert.Equal(t, "ID=top-version", readFile(func() (io.ReadCloser, error) { return store.OpenImageFile(image.ID, "/etc/os-release") }))
+	assert.Equal(t, "ID=top-version", readFile(func() (io.ReadCloser, error) { return store.OpenImageFile(image.ID, "lib/os-release") }))
+	assert.Equal(t, "z", readFile(func() (io.ReadCloser, error) { return store.OpenImageFile(image.ID, "/e/z") }))
+	assert.Equal(t, "ID=base", readFile(func() (io.ReadCloser, error) { return store.OpenLayerFile(base.ID, "/etc/os-release") }))
+	assert.Equal(t, "ID=base", readFile(func() (io.ReadCloser, error) { return store.OpenImageFile(image.ID, "/usr/lib/hardlink") }))
+
+	_, err = store.OpenImageFile(image.ID, "/d/x")
+	assert.ErrorIs(t, err, os.ErrNotExist)
+	_, err = store.OpenImageFile(image.ID, "/e/y")
+	assert.ErrorIs(t, err, os.ErrNotExist)
+	_, err = store.OpenImageFile(image.ID, "/missing")
+	assert.ErrorIs(t, err, os.ErrNotExist)
+	_, err = store.OpenImageFile(image.ID, "/usr")
+	assert.Error(t, err)
+	_, err = store.OpenImageFile(image.ID, "/usr/lib/os-release/x")
+	assert.ErrorIs(t, err, syscall.ENOTDIR)
+
+	_, err = store.Shutdown(true)
+	require.Nil(t, err)
+	store.Free()
+}
+
+func TestStoreDiffUnrelatedLayers(t *testing.T) {
+	reexec.Init()
+
+	store := newTestStore(t, StoreOptions{})
+
+	oldBase := putTestLayer(t, store, "", map[string]string{"base": "old base", "shared": "shared"})
+	newBase := putTestLayer(t, store, "", map[string]string{"base": "new base contents", "shared": "shared"})
+	oldApp := putTestLayer(t, store, oldBase.ID, map[string]string{"app": "version 1", "removed": "removed"})
+	newApp := putTestLayer(t, store, newBase.ID, map[string]string{"app": "version 2.0", "added": "added"})
+
+	changes, err := store.Changes(oldApp.ID, newApp.ID)
+	require.NoError(t, err)
+	kinds := make(map[string]archive.ChangeType)
+	for _, change := range changes {
+		kinds[change.Path] = change.Kind
+	}
+	assert.Equal(t, map[string]archive.ChangeType{
+		"/added":   archive.ChangeAdd,
+		"/app":     archive.ChangeModify,
+		"/base":    archive.ChangeModify,
+		"/removed": archive.ChangeDelete,
+	}, kinds)
+
+	uncompressed := archive.Uncompressed
+	rc, err := store.Diff(oldApp.ID, newApp.ID, &DiffOptions{Compression: &uncompressed})
+	require.NoError(t, err)
+	contents := make(map[string]string)
+	tr := tar.NewReader(rc)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		require.NoError(t, err)
+		data, err := io.ReadAll(tr)
+		require.NoError(t, err)
+		contents[hdr.Name] = string(data)
+	}
+	require.NoError(t, rc.Close())
+	assert.Equal(t, map[string]string{
+		"added":       "added",
+		"app":         "version 2.0",
+		"base":        "new base contents",
+		".wh.removed": "",
+	}, contents)
+
+	// Applying the diff on top of the old layer reproduces the new one.
+	rc, err = store.Diff(oldApp.ID, newApp.ID, nil)
+	require.NoError(t, err)
+	diff, err := io.ReadAll(rc)
+	require.NoError(t, err)
+	require.NoError(t, rc.Close())
+	updated, _, err := store.PutLayer("", oldApp.ID, nil, "", false, nil, bytes.NewReader(diff))
+	require.NoError(t, err)
+	changes, err = store.Changes(newApp.ID, updated.ID)
+	require.NoError(t, err)
+	assert.Empty(t, changes)
+
+	_, err = store.Changes("no-such-layer", newApp.ID)
+	assert.ErrorIs(t, err, ErrLayerUnknown)
+	_, err = store.Diff("no-such-layer", newApp.ID, nil)
+	assert.ErrorIs(t, err, ErrLayerUnknown)
+	_, err = store.DiffSize("no-such-layer", newApp.ID)
+	assert.ErrorIs(t, err, ErrLayerUnknown)
+
+	_, err = store.Shutdown(true)
+	require.Nil(t, err)
+	store.Free()
+}
+
+func TestStoreLayerDelta(t *testing.T) {
+	reexec.Init()
+
+	store := newTestStore(t, StoreOptions{})
+
+	random := make([]byte, 1<<20)
+	_, err := rand.New(rand.NewSource(1)).Read(random)
+	require.NoError(t, err)
+	modified := bytes.Clone(random)
+	copy(modified[len(modified)/2:], "a small change in the middle of the file")
+
+	base := putTestLayer(t, store, "", map[string]string{"base": "base"})
+	oldLayer := putTestLayer(t, store, base.ID, map[string]string{"binary": string(random), "config": "version=1"})
+	newLayer := putTestLayer(t, store, base.ID, map[string]string{"binary": string(modified), "config": "version=2", "added": "added"})
+
+	var delta bytes.Buffer
+	require.NoError(t, store.CreateLayerDelta(oldLayer.ID, newLayer.ID, &delta))
+	assert.Less(t, delta.Len(), len(random)/4)
+
+	recreated, err := store.ApplyLayerDelta(oldLayer.ID, bytes.NewReader(delta.Bytes()))
+	require.NoError(t, err)
+	assert.NotEqual(t, newLayer.ID, recreated.ID)
+	assert.Equal(t, base.ID, recreated.Parent)
+	assert.Equal(t, newLayer.UncompressedDigest, recreated.UncompressedDigest)
+	rc, err := store.OpenLayerFile(recreated.ID, "binary")
+	require.NoError(t, err)
+	contents, err := io.ReadAll(rc)
+	rc.Close()
+	require.NoError(t, err)
+	assert.Equal(t, modified, contents)
+
+	// The delta can't be applied to a different layer.
+	_, err = store.ApplyLayerDelta(base.ID, bytes.NewReader(delta.Bytes()))
+	assert.Error(t, err)
+	_, err = store.ApplyLayerDelta(oldLayer.ID, strings.NewReader("not a delta"))
+	assert.Error(t, err)
+
+	_, err = store.Shutdown(true)
+	require.Nil(t, err)
+	store.Free()
+}
+
+func TestStoreVerifyLayer(t *testing.T) {
+	reexec.Init()
+
+	store := newTestStore(t, StoreOptions{})
+
+	base := putTestLayer(t, store, "", map[string]string{"base": "base contents"})
+	top := putTestLayer(t, store, base.ID, map[string]string{"top": "top contents"})
+
+	results, err := store.VerifyLayer(top.ID, &VerifyLayerOptions{Parents: true, Parallelism: 2})
+	require.NoError(t, err)
+	require.Len(t, results, 2)
+	assert.Equal(t, LayerVerification{Layer: top.ID}, results[0])
+	assert.Equal(t, LayerVerification{Layer: base.ID}, results[1])
+
+	// Damage the file which the top layer added.
+	require.NoError(t, os.WriteFile(filepath.Join(store.GraphRoot(), "vfs", "dir", top.ID, "top"), []byte("TOP contents"), 0o644))
+	results, err = store.VerifyLayer(top.ID, &VerifyLayerOptions{Parents: true})
+	require.NoError(t, err)
+	require.Len(t, results, 2)
+	assert.Equal(t, top.ID, results[0].Layer)
+	assert.Equal(t, "top", results[0].Path)
+	assert.ErrorIs(t, results[0].Err, ErrLayerIncorrectContentDigest)
+	assert.NoError(t, results[1].Err)
+
+	require.NoError(t, os.Remove(filepath.Join(store.GraphRoot(), "vfs", "dir", top.ID, "top")))
+	results, err = store.VerifyLayer(top.ID, nil)
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+	assert.Equal(t, "top", results[0].Path)
+	assert.ErrorIs(t, results[0].Err, os.ErrNotExist)
+
+	_, err = store.VerifyLayer("no-such-layer", nil)
+	assert.ErrorIs(t, err, ErrLayerUnknown)
+
+	_, err = store.Shutdown(true)
+	require.Nil(t, err)
+	store.Free()
+}
+
+func TestStoreContainerQuota(t *testing.T) {
+	reexec.Init()
+
+	if os.Geteuid() != 0 {
+		t.Skip("test requires root privileges")
+	}
+	if _, err := exec.LookPath("mkfs.ext4"); err != nil {
+		t.Skip("test requires mkfs.ext4")
+	}
+
+	store := newTestStore(t, StoreOptions{})
+
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "file"), []byte("image contents"), 0o644))
+	rc, err := archive.Tar(dir, archive.Uncompressed)
+	require.NoError(t, err)
+	defer rc.Close()
+	layer, _, err := store.PutLayer("", "", nil, "", false, nil, rc)
+	require.NoError(t, err)
+	_, err = store.CreateImage("image", nil, layer.ID, "", nil)
+	require.NoError(t, err)
+	container, err := store.CreateContainer("container", nil, "image", "", "", nil)
+	require.NoError(t, err)
+
+	quota, err := store.GetContainerQuota(container.ID)
+	require.NoError(t, err)
+	assert.Zero(t, quota.Size)
+
+	require.NoError(t, store.SetContainerQuota(container.ID, 8<<20, 0))
+	quota, err = store.GetContainerQuota(container.ID)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(8<<20), quota.Size)
+	assert.NotZero(t, quota.UsedSize)
+
+	mountPoint, err := store.Mount(container.ID, "")
+	require.NoError(t, err)
+	contents, err := os.ReadFile(filepath.Join(mountPoint, "file"))
+	require.NoError(t, err)
+	assert.Equal(t, "image contents", string(contents))
+	err = os.WriteFile(filepath.Join(mountPoint, "big"), make([]byte, 16<<20), 0o644)
+	assert.ErrorIs(t, err, syscall.ENOSPC)
+	require.NoError(t, os.Remove(filepath.Join(mountPoint, "big")))
+
+	// The limit can be raised, but not lowered.
+	require.NoError(t, store.SetContainerQuota(container.ID, 32<<20, 0))
+	require.NoError(t, os.WriteFile(filepath.Join(mountPoint, "big"), make([]byte, 16<<20), 0o644))
+	quota, err = store.GetContainerQuota(container.ID)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(32<<20), quota.Size)
+	assert.Greater(t, quota.UsedSize, int64(16<<20))
+	assert.ErrorIs(t, store.SetContainerQuota(container.ID, 16<<20, 0), ErrQuotaNotSupported)
+	require.NotZero(t, quota.Inodes)
+	require.NoError(t, store.SetContainerQuota(container.ID, 32<<20, quota.Inodes))
+	assert.ErrorIs(t, store.SetContainerQuota(container.ID, 32<<20, quota.Inodes+1), ErrQuotaNotSupported)
+
+	reopen := func() {
+		_, err := store.Shutdown(true)
+		require.NoError(t, err)
+		store.Free()
+		store, err = GetStore(StoreOptions{
+			RunRoot:         store.RunRoot(),
+			GraphRoot:       store.GraphRoot(),
+			GraphDriverName: store.GraphDriverName(),
+		})
+		require.NoError(t, err)
+	}
+
+	// Shutting down unmounts the image, and examining or growing it
+	// doesn't mount it again.
+	_, err = store.Unmount(container.ID, true)
+	require.NoError(t, err)
+	reopen()
+	unmounted, err := store.GetContainerQuota(container.ID)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(32<<20), unmounted.Size)
+	assert.Equal(t, quota.Inodes, unmounted.Inodes)
+	assert.Greater(t, unmounted.UsedSize, int64(16<<20))
+	assert.Positive(t, unmounted.UsedInodes)
+	require.NoError(t, store.SetContainerQuota(container.ID, 64<<20, 0))
+	unmounted, err = store.GetContainerQuota(container.ID)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(64<<20), unmounted.Size)
+
+	// Reading the layer's contents without going through Mount mounts the
+	// image first, instead of finding an empty directory.
+	report, err := store.DiskUsage()
+	require.NoError(t, err)
+	require.Len(t, report.Containers, 1)
+	assert.Greater(t, report.Containers[0].Size, int64(16<<20))
+	reopen()
+	driver, err := store.GraphDriver()
+	require.NoError(t, err)
+	getter, ok := driver.(drivers.DiffGetterDriver)
+	require.True(t, ok)
+	fgc, err := getter.DiffGetter(container.LayerID)
+	require.NoError(t, err)
+	rc, err = fgc.Get("file")
+	require.NoError(t, err)
+	contents, err = io.ReadAll(rc)
+	require.NoError(t, err)
+	require.NoError(t, rc.Close())
+	require.NoError(t, fgc.Close())
+	assert.Equal(t, "image contents", string(contents))
+
+	mountPoint, err = store.Mount(container.ID, "")
+	require.NoError(t, err)
+	contents, err = os.ReadFile(filepath.Join(mountPoint, "file"))
+	require.NoError(t, err)
+	assert.Equal(t, "image contents", string(contents))
+	assert.NoDirExists(t, filepath.Join(mountPoint, "lost+found"))
+	_, err = store.Unmount(container.ID, true)
+	require.NoError(t, err)
+	require.NoError(t, store.DeleteContainer(container.ID))
+
+	_, err = store.GetContainerQuota("no-such-container")
+	assert.ErrorIs(t, err, ErrContainerUnknown)
+
+	_, err = store.Shutdown(true)
+	require.Nil(t, err)
+	store.Free()
+}
+
+func TestStoreLayerProvenance(t *testing.T) {
+	reexec.Init()
+
+	store := newTestStore(t, StoreOptions{})
+	options := StoreOptions{
+		RunRoot:         store.RunRoot(),
+		GraphRoot:       store.GraphRoot(),
+		GraphDriverName: store.GraphDriverName(),
+	}
+
+	pulledAt := time.Date(2026, time.October, 1, 12, 0, 0, 0, time.UTC)
+	provenance := LayerProvenance{
+		SourceReference: "registry.example.com/repo:v1",
+		PulledAt:        &pulledAt,
+		MediaType:       "application/vnd.oci.image.layer.v1.tar+gzip",
+		SignatureDigest: digest.FromString("signature"),
+	}
+	base, _, err := store.PutLayer("", "", nil, "", false, &LayerOptions{Provenance: []LayerProvenance{provenance}}, nil)
+	require.NoError(t, err)
+	assert.Equal(t, []LayerProvenance{provenance}, base.Provenance)
+
+	provenance.SourceReference = "registry.example.com/repo@" + digest.FromString("manifest").String()
+	top, _, err := store.PutLayer("", base.ID, nil, "", false, &LayerOptions{Provenance: []LayerProvenance{provenance}}, nil)
+	require.NoError(t, err)
+	other, _, err := store.PutLayer("", "", nil, "", false, nil, nil)
+	require.NoError(t, err)
+	assert.Nil(t, other.Provenance)
+
+	// A layer which is reused while pulling another image can be found
+	// using either reference, and pulling it again using the same
+	// reference updates the entry for that reference.
+	require.NoError(t, store.AddLayerProvenance(other.ID, LayerProvenance{SourceReference: "registry.example.com/other:v1"}))
+	require.NoError(t, store.AddLayerProvenance(other.ID, LayerProvenance{SourceReference: "registry.example.com/repo:v3"}))
+	repulledAt := pulledAt.Add(time.Hour)
+	require.NoError(t, store.AddLayerProvenance(other.ID, LayerProvenance{SourceReference: "registry.example.com/other:v1", PulledAt: &repulledAt}))
+	assert.ErrorIs(t, store.AddLayerProvenance("no-such-layer", provenance), ErrLayerUnknown)
+
+	_, err = store.Shutdown(true)
+	require.NoError(t, err)
+	store.Free()
+	store, err = GetStore(options)
+	require.NoError(t, err)
+
+	layer, err := store.Layer(base.ID)
+	require.NoError(t, err)
+	require.Len(t, layer.Provenance, 1)
+	assert.Equal(t, "registry.example.com/repo:v1", layer.Provenance[0].SourceReference)
+	require.NotNil(t, layer.Provenance[0].PulledAt)
+	assert.True(t, pulledAt.Equal(*layer.Provenance[0].PulledAt))
+	layer, err = store.Layer(other.ID)
+	require.NoError(t, err)
+	require.Len(t, layer.Provenance, 2)
+	assert.Equal(t, "registry.example.com/other:v1", layer.Provenance[0].SourceReference)
+	require.NotNil(t, layer.Provenance[0].PulledAt)
+	assert.True(t, repulledAt.Equal(*layer.Provenance[0].PulledAt))
+	assert.Equal(t, "registry.example.com/repo:v3", layer.Provenance[1].SourceReference)
+	assert.Nil(t, layer.Provenance[1].PulledAt)
+
+	layerIDs := func(layers []Layer) []string {
+		var ids []string
+		for _, layer := range layers {
+			ids = append(ids, layer.ID)
+		}
+		return ids
+	}
+	layers, err := store.LayersBySource("registry.example.com/repo:v1")
+	require.NoError(t, err)
+	assert.Equal(t, []string{base.ID}, layerIDs(layers))
+	layers, err = store.LayersBySource("registry.example.com/repo")
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{base.ID, top.ID, other.ID}, layerIDs(layers))
+	layers, err = store.LayersBySource("registry.example.com/other:v1")
+	require.NoError(t, err)
+	assert.Equal(t, []string{other.ID}, layerIDs(layers))
+	_, err = store.LayersBySource("registry.example.com/repo:v2")
+	assert.ErrorIs(t, err, ErrLayerUnknown)
+	_, err = store.LayersBySource("registry.example.com/rep")
+	assert.ErrorIs(t, err, ErrLayerUnknown)
+
+	_, err = store.Shutdown(true)
+	require.Nil(t, err)
+	store.Free()
+}
+
+// testLayerMountOptions returns the options which a layer was first mounted
+// with.
+func testLayerMountOptions(t *testing.T, s Store, id string) *drivers.MountOpts {
+	st, ok := s.(*store)
+	require.True(t, ok)
+	options, err := writeToLayerStore(st, func(rlstore rwLayerStore) (*drivers.MountOpts, error) {
+		r, ok := rlstore.(*layerStore)
+		require.True(t, ok)
+		layer, ok := r.lookup(id)
+		if !ok {
+			return nil, ErrLayerUnknown
+		}
+		return layer.mountOptions, nil
+	})
+	require.NoError(t, err)
+	return options
+}
+
+func TestStoreCommitContainer(t *testing.T) {
+	reexec.Init()
+
+	store := newTestStore(t, StoreOptions{})
+
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "base"), []byte("base"), 0o644))
+	rc, err := archive.Tar(dir, archive.Uncompressed)
+	require.NoError(t, err)
+	defer rc.Close()
+	base, _, err := store.PutLayer("", "", nil, "", false, nil, rc)
+	require.NoError(t, err)
+	image, err := store.CreateImage("", []string{"base-image"}, base.ID, "", &ImageOptions{
+		BigData: []ImageBigDataOption{
+			{Key: "config", Data: []byte("base config")},
+			{Key: "notes", Data: []byte("base notes")},
+		},
+	})
+	require.NoError(t, err)
+	container, err := store.CreateContainer("", nil, image.ID, "", "", nil)
+	require.NoError(t, err)
+
+	// The label differs from the container's, so the layer would be
+	// remounted differently if it was remounted as the container.
+	mountLabel := "system_u:object_r:container_file_t:s0:c1,c2"
+	mountPoint, err := store.Mount(container.ID, mountLabel)
+	require.NoError(t, err)
+	_, err = store.Mount(container.ID, "")
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(mountPoint, "added"), []byte("added"), 0o644))
+	require.NoError(t, os.Remove(filepath.Join(mountPoint, "base")))
+	mountOptions := testLayerMountOptions(t, store, container.LayerID)
+	require.NotNil(t, mountOptions)
+	assert.Equal(t, mountLabel, mountOptions.MountLabel)
+
+	committed, err := store.CommitContainer(container.ID, &CommitOptions{
+		Names:       []string{"committed-image"},
+		Metadata:    "committed",
+		CopyBigData: true,
+		BigData:     []ImageBigDataOption{{Key: "config", Data: []byte("new config")}},
+		Pause:       true,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"committed-image"}, committed.Names)
+	assert.Equal(t, "committed", committed.Metadata)
+	assert.ElementsMatch(t, []string{"config", "notes"}, committed.BigDataNames)
+	data, err := store.ImageBigData(committed.ID, "config")
+	require.NoError(t, err)
+	assert.Equal(t, "new config", string(data))
+	data, err = store.ImageBigData(committed.ID, "notes")
+	require.NoError(t, err)
+	assert.Equal(t, "base notes", string(data))
+
+	// The container is mounted again as many times as it was before, the
+	// same way.
+	mounts, err := store.Mounted(container.ID)
+	require.NoError(t, err)
+	assert.Equal(t, 2, mounts)
+	assert.Equal(t, mountOptions, testLayerMountOptions(t, store, container.LayerID))
+	contents, err := os.ReadFile(filepath.Join(mountPoint, "added"))
+	require.NoError(t, err)
+	assert.Equal(t, "added", string(contents))
+
+	layer, err := store.Layer(committed.TopLayer)
+	require.NoError(t, err)
+	assert.Equal(t, base.ID, layer.Parent)
+	assert.NotEmpty(t, layer.UncompressedDigest)
+	assert.NotEqual(t, container.LayerID, layer.ID)
+
+	// A container created from the new image sees the committed changes.
+	second, err := store.CreateContainer("", nil, committed.ID, "", "", nil)
+	require.NoError(t, err)
+	secondMountPoint, err := store.Mount(second.ID, "")
+	require.NoError(t, err)
+	contents, err = os.ReadFile(filepath.Join(secondMountPoint, "added"))
+	require.NoError(t, err)
+	assert.Equal(t, "added", string(contents))
+	_, err = os.Stat(filepath.Join(secondMountPoint, "base"))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+	_, err = store.Unmount(second.ID, true)
+	require.NoError(t, err)
+
+	_, err = store.CommitContainer("no-such-container", nil)
+	assert.ErrorIs(t, err, ErrContainerUnknown)
+
+	_, err = store.Unmount(container.ID, true)
+	require.NoError(t, err)
+	_, err = store.Shutdown(true)
+	require.Nil(t, err)
+	store.Free()
+}
+
+func TestStoreCloneContainer(t *testing.T) {
+	reexec.Init()
+
+	store := newTestStore(t, StoreOptions{})
+
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "base"), []byte("base"), 0o644))
+	rc, err := archive.Tar(dir, archive.Uncompressed)
+	require.NoError(t, err)
+	defer rc.Close()
+	base, _, err := store.PutLayer("", "", nil, "", false, nil, rc)
+	require.NoError(t, err)
+	image, err := store.CreateImage("", []string{"base-image"}, base.ID, "", nil)
+	require.NoError(t, err)
+	container, err := store.CreateContainer("", []string{"source"}, image.ID, "", "source metadata", &ContainerOptions{
+		BigData: []ContainerBigDataOption{{Key: "config", Data: []byte("source config")}},
+		Labels:  map[string]string{"role": "source"},
+	})
+	require.NoError(t, err)
+	require.NoError(t, store.SetContainerDirectoryFile(container.ID, "state/notes", []byte("notes")))
+
+	mountPoint, err := store.Mount(container.ID, "")
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(mountPoint, "added"), []byte("added"), 0o644))
+	require.NoError(t, os.Remove(filepath.Join(mountPoint, "base")))
+	_, err = store.Unmount(container.ID, true)
+	require.NoError(t, err)
+
+	clone, err := store.CloneContainer(container.ID, "", []string{"clone"}, &CloneOptions{
+		Labels: map[string]string{"role": "clone"},
+	})
+	require.NoError(t, err)
+	assert.NotEqual(t, container.ID, clone.ID)
+	assert.NotEqual(t, container.LayerID, clone.LayerID)
+	assert.Equal(t, []string{"clone"}, clone.Names)
+	assert.Equal(t, image.ID, clone.ImageID)
+	assert.Equal(t, "source metadata", clone.Metadata)
+	assert.Equal(t, map[string]string{"role": "clone"}, clone.Labels)
+	assert.Equal(t, container.UIDMap, clone.UIDMap)
+	data, err := store.ContainerBigData(clone.ID, "config")
+	require.NoError(t, err)
+	assert.Equal(t, "source config", string(data))
+	data, err = store.FromContainerDirectory(clone.ID, "state/notes")
+	require.NoError(t, err)
+	assert.Equal(t, "notes", string(data))
+
+	layer, err := store.Layer(clone.LayerID)
+	require.NoError(t, err)
+	sourceLayer, err := store.Layer(container.LayerID)
+	require.NoError(t, err)
+	assert.Equal(t, sourceLayer.Parent, layer.Parent)
+
+	// The clone starts out with the source's contents, but changes to
+	// either container don't affect the other.
+	cloneMountPoint, err := store.Mount(clone.ID, "")
+	require.NoError(t, err)
+	contents, err := os.ReadFile(filepath.Join(cloneMountPoint, "added"))
+	require.NoError(t, err)
+	assert.Equal(t, "added", string(contents))
+	_, err = os.Stat(filepath.Join(cloneMountPoint, "base"))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+	require.NoError(t, os.WriteFile(filepath.Join(cloneMountPoint, "added"), []byte("changed"), 0o644))
+	_, err = store.Unmount(clone.ID, true)
+	require.NoError(t, err)
+	mountPoint, err = store.Mount(container.ID, "")
+	require.NoError(t, err)
+	contents, err = os.ReadFile(filepath.Join(mountPoint, "added"))
+	require.NoError(t, err)
+	assert.Equal(t, "added", string(contents))
+	_, err = store.Unmount(container.ID, true)
+	require.NoError(t, err)
+
+	// The clone outlives the source.
+	require.NoError(t, store.DeleteContainer(container.ID))
+	cloneMountPoint, err = store.Mount(clone.ID, "")
+	require.NoError(t, err)
+	contents, err = os.ReadFile(filepath.Join(cloneMountPoint, "added"))
+	require.NoError(t, err)
+	assert.Equal(t, "changed", string(contents))
+	_, err = store.Unmount(clone.ID, true)
+	require.NoError(t, err)
+
+	_, err = store.CloneContainer(clone.ID, "", []string{"clone"}, nil)
+	assert.ErrorIs(t, err, ErrDuplicateName)
+	_, err = store.CloneContainer("no-such-container", "", nil, nil)
+	assert.ErrorIs(t, err, ErrContainerUnknown)
+
+	_, err = store.Shutdown(true)
+	require.Nil(t, err)
+	store.Free()
+}
+
+func TestStoreResetContainerLayer(t *testing.T) {
+	reexec.Init()
+
+	store := newTestStore(t, StoreOptions{})
+
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "base"), []byte("base"), 0o644))
+	rc, err := archive.Tar(dir, archive.Uncompressed)
+	require.NoError(t, err)
+	defer rc.Close()
+	base, _, err := store.PutLayer("", "", nil, "", false, nil, rc)
+	require.NoError(t, err)
+	image, err := store.CreateImage("", nil, base.ID, "", nil)
+	require.NoError(t, err)
+	container, err := store.CreateContainer("", []string{"ci"}, image.ID, "", "ci metadata", &ContainerOptions{
+		BigData: []ContainerBigDataOption{{Key: "config", Data: []byte("config")}},
+	})
+	require.NoError(t, err)
+	require.NoError(t, store.SetContainerDirectoryFile(container.ID, "notes", []byte("notes")))
+	oldLayer, err := store.Layer(container.LayerID)
+	require.NoError(t, err)
+
+	mountPoint, err := store.Mount(container.ID, "")
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(mountPoint, "junk"), []byte("junk"), 0o644))
+	require.NoError(t, os.Remove(filepath.Join(mountPoint, "base")))
+
+	// A mounted layer can't be reset.
+	err = store.ResetContainerLayer(container.ID)
+	assert.ErrorIs(t, err, ErrLayerMounted)
+	_, err = store.Unmount(container.ID, true)
+	require.NoError(t, err)
+
+	require.NoError(t, store.ResetContainerLayer("ci"))
+	reset, err := store.Container(container.ID)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"ci"}, reset.Names)
+	assert.Equal(t, "ci metadata", reset.Metadata)
+	assert.Equal(t, image.ID, reset.ImageID)
+	assert.NotEqual(t, container.LayerID, reset.LayerID)
+	assert.False(t, store.Exists(container.LayerID))
+	data, err := store.ContainerBigData(container.ID, "config")
+	require.NoError(t, err)
+	assert.Equal(t, "config", string(data))
+	data, err = store.FromContainerDirectory(container.ID, "notes")
+	require.NoError(t, err)
+	assert.Equal(t, "notes", string(data))
+
+	newLayer, err := store.Layer(reset.LayerID)
+	require.NoError(t, err)
+	assert.Equal(t, oldLayer.Parent, newLayer.Parent)
+	byLayer, err := store.Container(newLayer.ID)
+	require.NoError(t, err)
+	assert.Equal(t, container.ID, byLayer.ID)
+
+	mountPoint, err = store.Mount(container.ID, "")
+	require.NoError(t, err)
+	_, err = os.Stat(filepath.Join(mountPoint, "junk"))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+	contents, err := os.ReadFile(filepath.Join(mountPoint, "base"))
+	require.NoError(t, err)
+	assert.Equal(t, "base", string(contents))
+	_, err = store.Unmount(container.ID, true)
+	require.NoError(t, err)
+
+	err = store.ResetContainerLayer("no-such-container")
+	assert.ErrorIs(t, err, ErrContainerUnknown)
+
+	_, err = store.Shutdown(true)
+	require.Nil(t, err)
+	store.Free()
+}
+
+func TestStoreImageIndex(t *testing.T) {
+	reexec.Init()
+
+	store := newTestStore(t, StoreOptions{})
+
+	layer, err := store.CreateLayer("", "", nil, "", false, nil)
+	require.NoError(t, err)
+	amd64, err := store.CreateImage("", []string{"app:amd64"}, layer.ID, "", nil)
+	require.NoError(t, err)
+	arm64, err := store.CreateImage("", nil, layer.ID, "", nil)
+	require.NoError(t, err)
+	armv7, err := store.CreateImage("", nil, layer.ID, "", nil)
+	require.NoError(t, err)
+	unused, err := store.CreateImage("", nil, layer.ID, "", nil)
+	require.NoError(t, err)
+
+	_, err = store.CreateImageIndex("", []string{"app:latest"}, nil)
+	assert.Error(t, err)
+	_, err = store.CreateImageIndex("", []string{"app:latest"}, []ImageIndexMember{
+		{ImageID: "no-such-image", Platform: ImagePlatform{OS: "linux", Architecture: "amd64"}},
+	})
+	assert.ErrorIs(t, err, ErrImageUnknown)
+	_, err = store.CreateImageIndex("", []string{"app:latest"}, []ImageIndexMember{
+		{ImageID: amd64.ID, Platform: ImagePlatform{OS: "linux", Architecture: "amd64"}},
+		{ImageID: arm64.ID, Platform: ImagePlatform{OS: "linux", Architecture: "amd64"}},
+	})
+	assert.Error(t, err)
+
+	index, err := store.CreateImageIndex("", []string{"app:latest"}, []ImageIndexMember{
+		{ImageID: "app:amd64", Platform: ImagePlatform{OS: "linux", Architecture: "amd64"}},
+		{ImageID: arm64.ID, Platform: ImagePlatform{OS: "linux", Architecture: "arm64", Variant: "v8"}},
+		{ImageID: armv7.ID, Platform: ImagePlatform{OS: "linux", Architecture: "arm", Variant: "v7"}},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"app:latest"}, index.Names)
+	require.Len(t, index.Members, 3)
+	assert.Equal(t, amd64.ID, index.Members[0].ImageID)
+
+	_, err = store.CreateImageIndex("", []string{"app:latest"}, []ImageIndexMember{
+		{ImageID: unused.ID, Platform: ImagePlatform{OS: "linux", Architecture: "amd64"}},
+	})
+	assert.ErrorIs(t, err, ErrDuplicateName)
+
+	// Members can be looked up by platform.
+	image, err := store.ImageForPlatform("app:latest", ImagePlatform{OS: "linux", Architecture: "arm64"})
+	require.NoError(t, err)
+	assert.Equal(t, arm64.ID, image.ID)
+	image, err = store.ImageForPlatform(index.ID, ImagePlatform{OS: "linux", Architecture: "arm", Variant: "v7"})
+	require.NoError(t, err)
+	assert.Equal(t, armv7.ID, image.ID)
+	_, err = store.ImageForPlatform(index.ID, ImagePlatform{OS: "linux", Architecture: "arm", Variant: "v6"})
+	assert.ErrorIs(t, err, ErrImageUnknown)
+	_, err = store.ImageForPlatform("no-such-index", ImagePlatform{OS: "linux", Architecture: "amd64"})
+	assert.ErrorIs(t, err, ErrImageIndexUnknown)
+
+	// Members can't be deleted while the index refers to them.
+	_, err = store.DeleteImage(arm64.ID, true)
+	assert.ErrorIs(t, err, ErrImageUsedByIndex)
+
+	// Changing images which aren't in indexes doesn't rewrite the list of
+	// indexes.
+	indexesFile := filepath.Join(store.GraphRoot(), "vfs-images", "image-indexes.json")
+	before, err := os.Stat(indexesFile)
+	require.NoError(t, err)
+	_, err = store.DeleteImage(unused.ID, true)
+	require.NoError(t, err)
+	after, err := os.Stat(indexesFile)
+	require.NoError(t, err)
+	assert.Equal(t, before.ModTime(), after.ModTime())
+
+	listed, err := store.MultiList(MultiListOptions{Indexes: true})
+	require.NoError(t, err)
+	require.Len(t, listed.Indexes, 1)
+	assert.Equal(t, index.ID, listed.Indexes[0].ID)
+	assert.Empty(t, listed.Images)
+	listed, err = store.MultiList(MultiListOptions{Images: true, Indexes: true})
+	require.NoError(t, err)
+	assert.Len(t, listed.Indexes, 1)
+	assert.Len(t, listed.Images, 3)
+
+	// The index is still there after reloading the store.
+	_, err = store.Shutdown(true)
+	require.NoError(t, err)
+	store.Free()
+	store = newTestStore(t, StoreOptions{
+		RunRoot:   store.RunRoot(),
+		GraphRoot: store.GraphRoot(),
+	})
+	indexes, err := store.ImageIndexes()
+	require.NoError(t, err)
+	require.Len(t, indexes, 1)
+	assert.Equal(t, index.ID, indexes[0].ID)
+
+	require.NoError(t, store.DeleteImageIndex("app:latest"))
+	assert.ErrorIs(t, store.DeleteImageIndex("app:latest"), ErrImageIndexUnknown)
+	_, err = store.DeleteImage(arm64.ID, true)
+	require.NoError(t, err)
+	indexes, err = store.ImageIndexes()
+	require.NoError(t, err)
+	assert.Empty(t, indexes)
+
+	_, err = store.Shutdown(true)
+	require.Nil(t, err)
+	store.Free()
+}
@@ -0,0 +1,622 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/containers/storage/internal/tempdir"
+	"github.com/containers/storage/pkg/ioutils"
+	"github.com/containers/storage/pkg/stringid"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// transactionDirName is the name of the directory, under the graph
+	// root, which holds the journal of a transaction which has not been
+	// completed, along with the big data items which it has staged.
+	transactionDirName = "transaction"
+	// transactionJournalName is the name of the journal file in the
+	// transaction directory.
+	transactionJournalName = "journal.json"
+)
+
+// A Transaction batches the creation of layers, images, and containers, and
+// the setting of big data items for images and containers, so that either all
+// of them take effect, or none of them do.
+//
+// Layers created in a transaction are flagged as incomplete until the
+// transaction is committed, and big data items are only written when the
+// transaction is committed.  If the process exits before it calls Commit or
+// Rollback, the transaction is rolled back, or, if it was interrupted while
+// committing, finished, by the next call to GetStore or Store.Begin.
+type Transaction interface {
+	// PutLayer is like Store.PutLayer.
+	PutLayer(id, parent string, names []string, mountLabel string, writeable bool, options *LayerOptions, diff io.Reader) (*Layer, int64, error)
+
+	// CreateImage is like Store.CreateImage.
+	CreateImage(id string, names []string, layer, metadata string, options *ImageOptions) (*Image, error)
+
+	// CreateContainer is like Store.CreateContainer.
+	CreateContainer(id string, names []string, image, layer, metadata string, options *ContainerOptions) (*Container, error)
+
+	// SetImageBigData is like Store.SetImageBigData, except that the data is
+	// only written when the transaction is committed.
+	SetImageBigData(id, key string, data []byte, digestManifest func([]byte) (digest.Digest, error)) error
+
+	// SetContainerBigData is like Store.SetContainerBigData, except that the
+	// data is only written when the transaction is committed.
+	SetContainerBigData(id, key string, data []byte) error
+
+	// Commit makes all of the changes made in the transaction permanent,
+	// and releases the store's locks.
+	Commit() error
+
+	// Rollback undoes all of the changes made in the transaction, and
+	// releases the store's locks.
+	Rollback() error
+}
+
+// transactionJournal is the on-disk record of a transaction.  It lists every
+// object the transaction has created, or was about to create, so that they can
+// be removed if the transaction is rolled back.
+type transactionJournal struct {
+	// Committed is set when the transaction has been committed, and only the
+	// staged big data items remain to be written.
+	Committed  bool                 `json:"committed,omitempty"`
+	Layers     []string             `json:"layers,omitempty"`
+	Images     []string             `json:"images,omitempty"`
+	Containers []string             `json:"containers,omitempty"`
+	BigData    []transactionBigData `json:"big-data,omitempty"`
+	// MappedLayers are ID-mapped copies of images' top layers which were
+	// made for containers created in the transaction.
+	MappedLayers []transactionMappedLayer `json:"mapped-layers,omitempty"`
+}
+
+// transactionMappedLayer describes an ID-mapped copy of an image's top layer,
+// which is recorded in the image's list of MappedTopLayers.
+type transactionMappedLayer struct {
+	Image string `json:"image"`
+	Layer string `json:"layer"`
+}
+
+// transactionBigData describes a big data item which is to be written when a
+// transaction is committed.  Exactly one of Image and Container is set.
+type transactionBigData struct {
+	Image     string        `json:"image,omitempty"`
+	Container string        `json:"container,omitempty"`
+	Key       string        `json:"key"`
+	Digest    digest.Digest `json:"digest,omitempty"` // Only used for images
+	File      string        `json:"file"`
+}
+
+type transaction struct {
+	s       *store
+	rlstore rwLayerStore
+	lstores []roLayerStore
+	unlock  func()
+	journal transactionJournal
+	done    bool
+}
+
+func (s *store) transactionDir() string {
+	return filepath.Join(s.graphRoot, transactionDirName)
+}
+
+// lockForTransaction acquires every lock which a transaction might need, in the
+// usual order, and returns a function which releases them.
+func (s *store) lockForTransaction() (rwLayerStore, []roLayerStore, func(), error) {
+	var unlockFns []func()
+	unlock := func() {
+		for _, fn := range slices.Backward(unlockFns) {
+			fn()
+		}
+	}
+	succeeded := false
+	defer func() {
+		if !succeeded {
+			unlock()
+		}
+	}()
+
+	rlstore, lstores, err := s.bothLayerStoreKinds()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	// Containers which use ID mappings can be created in a transaction, so
+	// take this one first, as CreateContainer does.
+	s.usernsLock.Lock()
+	unlockFns = append(unlockFns, s.usernsLock.Unlock)
+	if err := rlstore.startWriting(); err != nil {
+		return nil, nil, nil, err
+	}
+	unlockFns = append(unlockFns, rlstore.stopWriting)
+	for _, store := range lstores {
+		if err := store.startReading(); err != nil {
+			return nil, nil, nil, err
+		}
+		unlockFns = append(unlockFns, store.stopReading)
+	}
+	if err := s.imageStore.startWriting(); err != nil {
+		return nil, nil, nil, err
+	}
+	unlockFns = append(unlockFns, s.imageStore.stopWriting)
+	for _, store := range s.roImageStores {
+		if err := store.startReading(); err != nil {
+			return nil, nil, nil, err
+		}
+		unlockFns = append(unlockFns, store.stopReading)
+	}
+	if err := s.containerStore.startWriting(); err != nil {
+		return nil, nil, nil, err
+	}
+	unlockFns = append(unlockFns, s.containerStore.stopWriting)
+
+	succeeded = true
+	return rlstore, lstores, unlock, nil
+}
+
+// Begin starts a transaction.
+func (s *store) Begin() (Transaction, error) {
+	rlstore, lstores, unlock, err := s.lockForTransaction()
+	if err != nil {
+		return nil, err
+	}
+	succeeded := false
+	defer func() {
+		if !succeeded {
+			unlock()
+		}
+	}()
+
+	if err := s.recoverTransactionLocked(rlstore); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(s.transactionDir(), 0o700); err != nil {
+		return nil, err
+	}
+	t := &transaction{
+		s:       s,
+		rlstore: rlstore,
+		lstores: lstores,
+		unlock:  unlock,
+	}
+	if err := t.saveJournal(); err != nil {
+		if err2 := os.RemoveAll(s.transactionDir()); err2 != nil {
+			logrus.Errorf("Removing transaction directory %q: %v", s.transactionDir(), err2)
+		}
+		return nil, err
+	}
+
+	succeeded = true
+	return t, nil
+}
+
+// saveJournal writes the transaction's journal to disk.
+func (t *transaction) saveJournal() error {
+	data, err := json.Marshal(&t.journal)
+	if err != nil {
+		return err
+	}
+	return ioutils.AtomicWriteFile(filepath.Join(t.s.transactionDir(), transactionJournalName), data, 0o600)
+}
+
+// record adds id to the list in the journal, and saves it, before the object
+// with that ID is created.  It returns a function which removes it from the
+// journal again, for use if creating the object fails.
+func (t *transaction) record(list *[]string, id string) (func(), error) {
+	*list = append(*list, id)
+	if err := t.saveJournal(); err != nil {
+		*list = (*list)[:len(*list)-1]
+		return nil, fmt.Errorf("saving transaction journal: %w", err)
+	}
+	return func() {
+		*list = slices.DeleteFunc(*list, func(v string) bool { return v == id })
+		if err := t.saveJournal(); err != nil {
+			// Harmless: objects which don't exist are skipped when rolling back.
+			logrus.Debugf("Saving transaction journal: %v", err)
+		}
+	}, nil
+}
+
+// recordMappedLayer adds an ID-mapped copy of an image's top layer to the
+// journal, and saves it, before the layer is created.  It returns a function
+// which removes it from the journal again, for use if creating the layer fails.
+func (t *transaction) recordMappedLayer(imageID, layerID string) (func(), error) {
+	item := transactionMappedLayer{Image: imageID, Layer: layerID}
+	t.journal.MappedLayers = append(t.journal.MappedLayers, item)
+	if err := t.saveJournal(); err != nil {
+		t.journal.MappedLayers = t.journal.MappedLayers[:len(t.journal.MappedLayers)-1]
+		return nil, fmt.Errorf("saving transaction journal: %w", err)
+	}
+	return func() {
+		t.journal.MappedLayers = slices.DeleteFunc(t.journal.MappedLayers, func(v transactionMappedLayer) bool { return v == item })
+		if err := t.saveJournal(); err != nil {
+			// Harmless: layers which don't exist are skipped when rolling back.
+			logrus.Debugf("Saving transaction journal: %v", err)
+		}
+	}, nil
+}
+
+// newID returns id, or a new random ID if it is empty, after checking that it
+// is not already in use according to exists.
+func newID(id string, exists func(id string) bool) (string, error) {
+	if id == "" {
+		id = stringid.GenerateRandomID()
+		for exists(id) {
+			id = stringid.GenerateRandomID()
+		}
+		return id, nil
+	}
+	if exists(id) {
+		return "", fmt.Errorf("%q: %w", id, ErrDuplicateID)
+	}
+	return id, nil
+}
+
+func (t *transaction) PutLayer(id, parent string, names []string, mountLabel string, writeable bool, options *LayerOptions, diff io.Reader) (*Layer, int64, error) {
+	if t.done {
+		return nil, -1, ErrTransactionDone
+	}
+	id, err := newID(id, t.rlstore.Exists)
+	if err != nil {
+		return nil, -1, err
+	}
+	forget, err := t.record(&t.journal.Layers, id)
+	if err != nil {
+		return nil, -1, err
+	}
+	layer, size, err := t.s.putLayerLocked(context.Background(), t.rlstore, t.lstores, id, parent, names, mountLabel, writeable, options, diff, nil)
+	if err != nil {
+		forget()
+		return nil, -1, err
+	}
+	// Keep the layer flagged as incomplete until the transaction is
+	// committed, so that it is cleaned up like any other incomplete
+	// layer if the transaction never is.
+	if err := t.rlstore.SetFlag(layer.ID, incompleteFlag, true); err != nil {
+		return nil, -1, err
+	}
+	return layer, size, nil
+}
+
+func (t *transaction) CreateImage(id string, names []string, layer, metadata string, options *ImageOptions) (*Image, error) {
+	if t.done {
+		return nil, ErrTransactionDone
+	}
+	id, err := newID(id, t.s.imageStore.Exists)
+	if err != nil {
+		return nil, err
+	}
+	forget, err := t.record(&t.journal.Images, id)
+	if err != nil {
+		return nil, err
+	}
+	image, err := t.s.createImageLocked(append([]roLayerStore{t.rlstore}, t.lstores...), id, names, layer, metadata, options)
+	if err != nil {
+		forget()
+		return nil, err
+	}
+	return image, nil
+}
+
+func (t *transaction) CreateContainer(id string, names []string, image, layer, metadata string, cOptions *ContainerOptions) (*Container, error) {
+	if t.done {
+		return nil, ErrTransactionDone
+	}
+	id, err := newID(id, t.s.containerStore.Exists)
+	if err != nil {
+		return nil, err
+	}
+	layer, err = newID(layer, t.rlstore.Exists)
+	if err != nil {
+		return nil, err
+	}
+	forgetLayer, err := t.record(&t.journal.Layers, layer)
+	if err != nil {
+		return nil, err
+	}
+	forgetContainer, err := t.record(&t.journal.Containers, id)
+	if err != nil {
+		forgetLayer()
+		return nil, err
+	}
+	options := containerOptionsForCreate(cOptions, metadata)
+	container, err := t.s.createContainerLocked(t.rlstore, t.lstores, id, names, image, layer, &options, t.recordMappedLayer)
+	if err != nil {
+		forgetContainer()
+		forgetLayer()
+		return nil, err
+	}
+	if err := t.rlstore.SetFlag(container.LayerID, incompleteFlag, true); err != nil {
+		return nil, err
+	}
+	return container, nil
+}
+
+// stageBigData writes data to a file in the transaction directory, and records
+// it in the journal, so that it can be written to its final location when the
+// transaction is committed.
+func (t *transaction) stageBigData(item transactionBigData, data []byte) error {
+	item.File = fmt.Sprintf("big-data-%d", len(t.journal.BigData))
+	if err := ioutils.AtomicWriteFile(filepath.Join(t.s.transactionDir(), item.File), data, 0o600); err != nil {
+		return err
+	}
+	t.journal.BigData = append(t.journal.BigData, item)
+	if err := t.saveJournal(); err != nil {
+		t.journal.BigData = t.journal.BigData[:len(t.journal.BigData)-1]
+		return fmt.Errorf("saving transaction journal: %w", err)
+	}
+	return nil
+}
+
+func (t *transaction) SetImageBigData(id, key string, data []byte, digestManifest func([]byte) (digest.Digest, error)) error {
+	if t.done {
+		return ErrTransactionDone
+	}
+	if key == "" {
+		return fmt.Errorf("can't set empty name for image big data item: %w", ErrInvalidBigDataName)
+	}
+	image, err := t.s.imageStore.Get(id)
+	if err != nil {
+		return err
+	}
+	var dataDigest digest.Digest
+	if bigDataNameIsManifest(key) {
+		if digestManifest == nil {
+			return fmt.Errorf("digesting manifest: no manifest digest callback provided: %w", ErrDigestUnknown)
+		}
+		if dataDigest, err = digestManifest(data); err != nil {
+			return fmt.Errorf("digesting manifest: %w", err)
+		}
+	} else {
+		dataDigest = digest.Canonical.FromBytes(data)
+	}
+	return t.stageBigData(transactionBigData{Image: image.ID, Key: key, Digest: dataDigest}, data)
+}
+
+func (t *transaction) SetContainerBigData(id, key string, data []byte) error {
+	if t.done {
+		return ErrTransactionDone
+	}
+	if key == "" {
+		return fmt.Errorf("can't set empty name for container big data item: %w", ErrInvalidBigDataName)
+	}
+	container, err := t.s.containerStore.Get(id)
+	if err != nil {
+		return err
+	}
+	return t.stageBigData(transactionBigData{Container: container.ID, Key: key}, data)
+}
+
+func (t *transaction) Commit() error {
+	if t.done {
+		return ErrTransactionDone
+	}
+	t.done = true
+	defer t.unlock()
+
+	// Clear the incomplete flags first: once the journal says that the
+	// transaction is committed, nothing may delete these layers.
+	for _, id := range t.journal.Layers {
+		if err := t.rlstore.ClearFlag(id, incompleteFlag); err != nil {
+			return t.rollbackAfter(fmt.Errorf("committing transaction: %w", err))
+		}
+	}
+	t.journal.Committed = true
+	if err := t.saveJournal(); err != nil {
+		t.journal.Committed = false
+		return t.rollbackAfter(fmt.Errorf("committing transaction: %w", err))
+	}
+	// From here on, a failure leaves the journal in place, so that the
+	// remaining work is retried later.
+	if err := t.s.completeTransactionLocked(t.rlstore, &t.journal); err != nil {
+		return err
+	}
+	return os.RemoveAll(t.s.transactionDir())
+}
+
+func (t *transaction) Rollback() error {
+	if t.done {
+		return ErrTransactionDone
+	}
+	t.done = true
+	defer t.unlock()
+	if err := t.s.rollbackTransactionLocked(t.rlstore, &t.journal); err != nil {
+		return err
+	}
+	return os.RemoveAll(t.s.transactionDir())
+}
+
+// rollbackAfter rolls back the transaction after a failed commit, and returns
+// the error which caused the commit to fail, along with any which occurred
+// while rolling back.
+func (t *transaction) rollbackAfter(err error) error {
+	if err2 := t.s.rollbackTransactionLocked(t.rlstore, &t.journal); err2 != nil {
+		return errors.Join(err, fmt.Errorf("rolling back transaction: %w", err2))
+	}
+	if err2 := os.RemoveAll(t.s.transactionDir()); err2 != nil {
+		return errors.Join(err, err2)
+	}
+	return err
+}
+
+// readTransactionJournal reads the journal of a transaction which was not
+// completed, if there is one.
+func (s *store) readTransactionJournal() (*transactionJournal, error) {
+	data, err := os.ReadFile(filepath.Join(s.transactionDir(), transactionJournalName))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var journal transactionJournal
+	if err := json.Unmarshal(data, &journal); err != nil {
+		return nil, fmt.Errorf("parsing transaction journal: %w", err)
+	}
+	return &journal, nil
+}
+
+// recoverTransaction finishes, or rolls back, a transaction which was left
+// behind by a process which exited without completing it.
+func (s *store) recoverTransaction() error {
+	if _, err := os.Stat(filepath.Join(s.transactionDir(), transactionJournalName)); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	rlstore, _, unlock, err := s.lockForTransaction()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return s.recoverTransactionLocked(rlstore)
+}
+
+// On entry: all of the locks taken by lockForTransaction must be held.
+func (s *store) recoverTransactionLocked(rlstore rwLayerStore) error {
+	journal, err := s.readTransactionJournal()
+	if err != nil {
+		return err
+	}
+	if journal != nil {
+		if journal.Committed {
+			logrus.Debugf("Completing an interrupted transaction")
+			err = s.completeTransactionLocked(rlstore, journal)
+		} else {
+			logrus.Warnf("Rolling back an incomplete transaction")
+			err = s.rollbackTransactionLocked(rlstore, journal)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	// If there's a directory without a journal, we didn't get far enough to
+	// make any changes.
+	return os.RemoveAll(s.transactionDir())
+}
+
+// completeTransactionLocked makes sure that none of the layers created in a
+// committed transaction are still flagged as incomplete, and writes the big
+// data items which the transaction staged.  Objects which have since been
+// removed are skipped.
+// On entry: all of the locks taken by lockForTransaction must be held.
+func (s *store) completeTransactionLocked(rlstore rwLayerStore, journal *transactionJournal) error {
+	for _, id := range journal.Layers {
+		layer, err := rlstore.Get(id)
+		if err != nil {
+			continue
+		}
+		if layerHasIncompleteFlag(layer) {
+			if err := rlstore.ClearFlag(layer.ID, incompleteFlag); err != nil {
+				return err
+			}
+		}
+	}
+	for _, item := range journal.BigData {
+		data, err := os.ReadFile(filepath.Join(s.transactionDir(), item.File))
+		if err != nil {
+			return err
+		}
+		switch {
+		case item.Image != "":
+			if !s.imageStore.Exists(item.Image) {
+				logrus.Debugf("Not setting big data item %q for image %q, which no longer exists", item.Key, item.Image)
+				continue
+			}
+			if err := s.imageStore.SetBigData(item.Image, item.Key, data, func([]byte) (digest.Digest, error) {
+				return item.Digest, nil
+			}); err != nil {
+				return err
+			}
+		case item.Container != "":
+			if !s.containerStore.Exists(item.Container) {
+				logrus.Debugf("Not setting big data item %q for container %q, which no longer exists", item.Key, item.Container)
+				continue
+			}
+			if err := s.containerStore.SetBigData(item.Container, item.Key, data); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// rollbackTransactionLocked removes the objects created by a transaction, in
+// the reverse of the order in which they were created.
+// On entry: all of the locks taken by lockForTransaction must be held.
+func (s *store) rollbackTransactionLocked(rlstore rwLayerStore, journal *transactionJournal) (retErr error) {
+	cleanupFunctions := []tempdir.CleanupTempDirFunc{}
+	defer func() {
+		if cleanupErr := tempdir.CleanupTemporaryDirectories(cleanupFunctions...); cleanupErr != nil {
+			retErr = errors.Join(cleanupErr, retErr)
+		}
+	}()
+
+	for _, id := range slices.Backward(journal.Containers) {
+		if !s.containerStore.Exists(id) {
+			continue
+		}
+		cf, err := s.deleteContainerLocked(rlstore, id)
+		cleanupFunctions = append(cleanupFunctions, cf...)
+		if err != nil {
+			return fmt.Errorf("deleting container %q: %w", id, err)
+		}
+	}
+	for _, id := range slices.Backward(journal.Images) {
+		image, err := s.imageStore.Get(id)
+		if err != nil {
+			continue
+		}
+		if err := s.imageStore.deleteRolledBack(image.ID); err != nil {
+			return fmt.Errorf("deleting image %q: %w", id, err)
+		}
+		// Any ID-mapped copies of the image's top layer were made for
+		// containers created in this transaction, which are gone now.
+		for _, layerID := range image.MappedTopLayers {
+			if !rlstore.Exists(layerID) {
+				continue
+			}
+			cf, err := rlstore.deferredDelete(layerID)
+			cleanupFunctions = append(cleanupFunctions, cf...)
+			if err != nil {
+				return fmt.Errorf("deleting layer %q: %w", layerID, err)
+			}
+		}
+	}
+	// ID-mapped copies of the top layers of images which weren't created in
+	// this transaction were made for containers which are gone now, too.
+	for _, mapped := range slices.Backward(journal.MappedLayers) {
+		if image, err := s.imageStore.Get(mapped.Image); err == nil && slices.Contains(image.MappedTopLayers, mapped.Layer) {
+			if err := s.imageStore.removeMappedTopLayer(image.ID, mapped.Layer); err != nil {
+				return fmt.Errorf("updating image %q: %w", image.ID, err)
+			}
+		}
+		if !rlstore.Exists(mapped.Layer) {
+			continue
+		}
+		cf, err := rlstore.deferredDelete(mapped.Layer)
+		cleanupFunctions = append(cleanupFunctions, cf...)
+		if err != nil {
+			return fmt.Errorf("deleting layer %q: %w", mapped.Layer, err)
+		}
+	}
+	for _, id := range slices.Backward(journal.Layers) {
+		if !rlstore.Exists(id) {
+			continue
+		}
+		cf, err := rlstore.deferredDelete(id)
+		cleanupFunctions = append(cleanupFunctions, cf...)
+		if err != nil {
+			return fmt.Errorf("deleting layer %q: %w", id, err)
+		}
+	}
+	return nil
+}
@@ -21,6 +21,10 @@ var (
 	ErrImageUnknown = errors.New("image not known")
 	// ErrImageUsedByContainer is returned when the caller attempts to delete an image that is a container's image.
 	ErrImageUsedByContainer = errors.New("image is in use by a container")
+	// ErrImageUsedByIndex is returned when the caller attempts to delete an image that is a member of an image index.
+	ErrImageUsedByIndex = errors.New("image is in use by an image index")
+	// ErrImageIndexUnknown indicates that there was no image index with the specified name or ID.
+	ErrImageIndexUnknown = errors.New("image index not known")
 	// ErrIncompleteOptions is returned when the caller attempts to initialize a Store without providing required information.
 	ErrIncompleteOptions = errors.New("missing necessary StoreOptions")
 	// ErrInvalidBigDataName indicates that the name for a big data item is not acceptable; it may be empty.
@@ -59,6 +63,22 @@ var (
 	ErrInvalidMappings = errors.New("invalid mappings specified")
 	// ErrNoAvailableIDs is returned when there are not enough unused IDS within the user namespace.
 	ErrNoAvailableIDs = errors.New("not enough unused IDs in user namespace")
+	// ErrTransactionDone is returned when the caller attempts to use a transaction which has
+	// already been committed or rolled back.
+	ErrTransactionDone = errors.New("transaction has already been committed or rolled back")
+	// ErrLayerLeased is returned when the caller attempts to delete a layer that has a lease.
+	ErrLayerLeased = errors.New("layer is leased")
+	// ErrImageLeased is returned when the caller attempts to delete an image that has a lease.
+	ErrImageLeased = errors.New("image is leased")
+	// ErrLeaseUnknown is returned when the caller attempts to release a lease that doesn't exist,
+	// possibly because it has expired.
+	ErrLeaseUnknown = errors.New("lease not known")
+	// ErrLayerContentsDeferred is returned when the deferred contents of a layer's files are
+	// needed, but no LayerFetcher has been set to retrieve them.
+	ErrLayerContentsDeferred = errors.New("layer contents have not been retrieved")
+	// ErrLayerMounted is returned when the caller attempts an operation which can only be
+	// performed on a layer which is not mounted, and the layer is mounted.
+	ErrLayerMounted = errors.New("layer is mounted")
 
 	// ErrLayerUnaccounted describes a layer that is present in the lower-level storage driver,
 	// but which is not known to or managed by the higher-level driver-agnostic logic.
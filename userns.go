@@ -3,6 +3,7 @@
 package storage
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"os/user"
@@ -197,7 +198,7 @@ outer:
 
 	// We need to create a temporary layer so we can mount it and lookup the
 	// maximum IDs used.
-	clayer, _, err := rlstore.create("", topLayer, nil, "", nil, layerOptions, false, nil, nil)
+	clayer, _, err := rlstore.create(context.Background(), "", topLayer, nil, "", nil, layerOptions, false, nil, nil)
 	if err != nil {
 		return 0, err
 	}
@@ -241,6 +242,7 @@ outer:
 }
 
 // getAutoUserNS creates an automatic user namespace
+// On entry, s.containerStore must be locked for reading or writing.
 // If image != nil, On entry, rlstore must be locked for writing, and lstores must be locked for reading.
 func (s *store) getAutoUserNS(options *types.AutoUserNsOptions, image *Image, rlstore rwLayerStore, lstores []roLayerStore) ([]idtools.IDMap, []idtools.IDMap, error) {
 	requestedSize := uint32(0)
@@ -259,7 +261,7 @@ func (s *store) getAutoUserNS(options *types.AutoUserNsOptions, image *Image, rl
 
 	// Look at every container that is using a user namespace and store
 	// the intervals that are already used.
-	containers, err := s.Containers()
+	containers, err := s.containerStore.Containers()
 	if err != nil {
 		return nil, nil, err
 	}
@@ -0,0 +1,298 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"hash/crc64"
+	"io"
+	"os"
+	"path"
+
+	"github.com/containers/storage/pkg/archive"
+	"github.com/containers/storage/pkg/chunked/toc"
+	"github.com/containers/storage/pkg/ioutils"
+	"github.com/klauspost/pgzip"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/vbatts/tar-split/tar/storage"
+	"golang.org/x/sync/errgroup"
+)
+
+// VerifyLayerOptions controls which layers VerifyLayer checks.
+type VerifyLayerOptions struct {
+	// Parents causes the layer's parents to be verified, too.
+	Parents bool
+	// Parallelism is the maximum number of layers which are verified at
+	// the same time.  If it is 0, they are verified one at a time.
+	Parallelism int
+}
+
+// LayerVerification is the result of verifying one layer's contents.
+type LayerVerification struct {
+	// Layer is the ID of the layer.
+	Layer string
+	// Path is the name, as recorded in the layer's diff, of the first
+	// file whose contents didn't match, if a single file was at fault.
+	Path string
+	// Err is nil if the layer's contents matched what was recorded for
+	// it.  Otherwise, it describes the mismatch, or why the layer couldn't
+	// be verified.
+	Err error
+}
+
+// errVerifyNeedsDiff is returned by verifyLayerFiles when the driver can't
+// read individual files from the layer, so its whole diff has to be
+// reconstructed instead.
+var errVerifyNeedsDiff = errors.New("layer files can't be read individually")
+
+// VerifyLayer checks that the contents of a layer, and optionally those of
+// its parents, still match the digests recorded when they were created,
+// without mounting them.  Each file is checked individually, so that the
+// first one which doesn't match can be reported, and the reconstructed diff
+// is checked against the layer's UncompressedDigest, if it has one, or else
+// each file is checked against the digests in its zstd:chunked TOC.  Files
+// whose deferred contents have not been retrieved yet are not checked.
+// Results are returned in order, starting with the specified layer.
+func (s *store) VerifyLayer(id string, options *VerifyLayerOptions) ([]LayerVerification, error) {
+	if options == nil {
+		options = &VerifyLayerOptions{}
+	}
+	layer, err := s.Layer(id)
+	if err != nil {
+		return nil, err
+	}
+	layers := []*Layer{layer}
+	for options.Parents && layer.Parent != "" {
+		if layer, err = s.Layer(layer.Parent); err != nil {
+			return nil, err
+		}
+		layers = append(layers, layer)
+	}
+
+	results := make([]LayerVerification, len(layers))
+	var group errgroup.Group
+	group.SetLimit(max(options.Parallelism, 1))
+	for i, layer := range layers {
+		group.Go(func() error {
+			results[i] = s.verifyLayer(layer)
+			return nil
+		})
+	}
+	if err := group.Wait(); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// verifyLayer verifies one layer's contents.
+func (s *store) verifyLayer(layer *Layer) LayerVerification {
+	if layer.UncompressedDigest == "" && layer.TOCDigest == "" {
+		return LayerVerification{Layer: layer.ID, Err: fmt.Errorf("layer %s: no digest was recorded to verify against: %w", layer.ID, ErrNotSupported)}
+	}
+	res, done, err := readAllLayerStores(s, func(store roLayerStore) (LayerVerification, bool, error) {
+		if !store.Exists(layer.ID) {
+			return LayerVerification{}, false, nil
+		}
+		res, err := verifyLayerFiles(store, layer)
+		return res, true, err
+	})
+	if !done {
+		err = ErrLayerUnknown
+	}
+	if errors.Is(err, errVerifyNeedsDiff) {
+		return s.verifyLayerDiff(layer)
+	}
+	if err != nil {
+		return LayerVerification{Layer: layer.ID, Err: fmt.Errorf("layer %s: %w", layer.ID, err)}
+	}
+	return res
+}
+
+// verifyLayerFiles verifies a layer's contents using the metadata which was
+// recorded when it was created, reading each of its files from the driver.
+// Requires startReading or startWriting.
+func verifyLayerFiles(store roLayerStore, layer *Layer) (LayerVerification, error) {
+	missing, err := deferredFiles(store, layer.ID)
+	if err != nil {
+		return LayerVerification{}, err
+	}
+	skip := make(map[string]struct{}, len(missing))
+	for _, name := range missing {
+		skip[name] = struct{}{}
+	}
+
+	tarSplit, err := store.tarSplitData(layer.ID)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return LayerVerification{}, err
+	}
+	if tarSplit != nil && (layer.UncompressedDigest != "" || layer.TOCDigest == "") {
+		return verifyTarSplit(store, layer, tarSplit, skip)
+	}
+	rc, err := store.BigData(layer.ID, toc.BigDataKey)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			return LayerVerification{}, err
+		}
+		if tarSplit != nil {
+			return verifyTarSplit(store, layer, tarSplit, skip)
+		}
+		return LayerVerification{}, errVerifyNeedsDiff
+	}
+	defer rc.Close()
+	manifest, err := io.ReadAll(rc)
+	if err != nil {
+		return LayerVerification{}, err
+	}
+	return verifyTOC(store, layer, manifest, skip)
+}
+
+// verifyTarSplit checks each of the files listed in a layer's tar-split
+// metadata against the checksum recorded for it, and the diff which they
+// make up against the layer's UncompressedDigest.
+// Requires startReading or startWriting.
+func verifyTarSplit(store roLayerStore, layer *Layer, tarSplit []byte, skip map[string]struct{}) (LayerVerification, error) {
+	decompressor, err := pgzip.NewReader(bytes.NewReader(tarSplit))
+	if err != nil {
+		return LayerVerification{}, err
+	}
+	defer decompressor.Close()
+	unpacker := storage.NewJSONUnpacker(decompressor)
+
+	digester := digest.Canonical.Digester()
+	if layer.UncompressedDigest != "" {
+		digester = layer.UncompressedDigest.Algorithm().Digester()
+	}
+	counter := ioutils.NewWriteCounter(digester.Hash())
+	skipped := false
+	for {
+		entry, err := unpacker.Next()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return LayerVerification{}, fmt.Errorf("reading tar-split metadata: %w", err)
+		}
+		switch entry.Type {
+		case storage.SegmentType:
+			if _, err := counter.Write(entry.Payload); err != nil {
+				return LayerVerification{}, err
+			}
+		case storage.FileType:
+			if entry.Size == 0 {
+				continue
+			}
+			name := entry.GetName()
+			if _, ok := skip[path.Clean("/"+name)]; ok {
+				skipped = true
+				continue
+			}
+			crc := crc64.New(storage.CRCTable)
+			if err := verifyLayerFile(store, layer.ID, name, entry.Size, io.MultiWriter(counter, crc)); err != nil {
+				if errors.Is(err, errVerifyNeedsDiff) {
+					return LayerVerification{}, err
+				}
+				return LayerVerification{Layer: layer.ID, Path: name, Err: err}, nil
+			}
+			if !bytes.Equal(crc.Sum(nil), entry.Payload) {
+				return LayerVerification{Layer: layer.ID, Path: name, Err: fmt.Errorf("layer %s: %q: %w", layer.ID, name, ErrLayerIncorrectContentDigest)}, nil
+			}
+		}
+	}
+	if layer.UncompressedDigest == "" || skipped {
+		return LayerVerification{Layer: layer.ID}, nil
+	}
+	if digester.Digest() != layer.UncompressedDigest {
+		return LayerVerification{Layer: layer.ID, Err: fmt.Errorf("layer %s: %w", layer.ID, ErrLayerIncorrectContentDigest)}, nil
+	}
+	if layer.UncompressedSize != -1 && counter.Count != layer.UncompressedSize {
+		return LayerVerification{Layer: layer.ID, Err: fmt.Errorf("layer %s: read %d bytes instead of %d bytes: %w", layer.ID, counter.Count, layer.UncompressedSize, ErrLayerIncorrectContentSize)}, nil
+	}
+	return LayerVerification{Layer: layer.ID}, nil
+}
+
+// verifyTOC checks each of the regular files listed in a layer's
+// zstd:chunked TOC against the digest recorded for it.
+// Requires startReading or startWriting.
+func verifyTOC(store roLayerStore, layer *Layer, manifest []byte, skip map[string]struct{}) (LayerVerification, error) {
+	headers, err := toc.Headers(manifest)
+	if err != nil {
+		return LayerVerification{}, fmt.Errorf("reading TOC: %w", err)
+	}
+	files, err := toc.RegularFiles(manifest)
+	if err != nil {
+		return LayerVerification{}, fmt.Errorf("reading TOC: %w", err)
+	}
+	for _, hdr := range headers {
+		name := path.Clean("/" + hdr.Name)
+		file, ok := files[name]
+		if !ok {
+			continue
+		}
+		if _, ok := skip[name]; ok {
+			continue
+		}
+		if file.Digest == "" {
+			return LayerVerification{}, fmt.Errorf("TOC has no digest for %q", hdr.Name)
+		}
+		digester := file.Digest.Algorithm().Digester()
+		if err := verifyLayerFile(store, layer.ID, hdr.Name, file.Size, digester.Hash()); err != nil {
+			if errors.Is(err, errVerifyNeedsDiff) {
+				return LayerVerification{}, err
+			}
+			return LayerVerification{Layer: layer.ID, Path: hdr.Name, Err: err}, nil
+		}
+		if digester.Digest() != file.Digest {
+			return LayerVerification{Layer: layer.ID, Path: hdr.Name, Err: fmt.Errorf("layer %s: %q: %w", layer.ID, hdr.Name, ErrLayerIncorrectContentDigest)}, nil
+		}
+	}
+	return LayerVerification{Layer: layer.ID}, nil
+}
+
+// verifyLayerFile copies the contents of a file in a layer to w, checking
+// that it has the expected size.
+// Requires startReading or startWriting.
+func verifyLayerFile(store roLayerStore, id, name string, size int64, w io.Writer) error {
+	rc, err := store.openFile(id, name)
+	if err != nil {
+		if errors.Is(err, ErrNotSupported) {
+			return errVerifyNeedsDiff
+		}
+		return fmt.Errorf("layer %s: %q: %w", id, name, err)
+	}
+	defer rc.Close()
+	n, err := io.Copy(w, rc)
+	if err != nil {
+		return fmt.Errorf("layer %s: reading %q: %w", id, name, err)
+	}
+	if n != size {
+		return fmt.Errorf("layer %s: %q has %d bytes instead of %d bytes: %w", id, name, n, size, ErrLayerIncorrectContentSize)
+	}
+	return nil
+}
+
+// verifyLayerDiff checks a layer's reconstructed diff against its
+// UncompressedDigest, for drivers which can't read individual files from a
+// layer.
+func (s *store) verifyLayerDiff(layer *Layer) LayerVerification {
+	if layer.UncompressedDigest == "" {
+		return LayerVerification{Layer: layer.ID, Err: fmt.Errorf("layer %s: no uncompressed digest was recorded, and its files can't be read individually: %w", layer.ID, ErrNotSupported)}
+	}
+	uncompressed := archive.Uncompressed
+	diff, err := s.Diff("", layer.ID, &DiffOptions{Compression: &uncompressed})
+	if err != nil {
+		return LayerVerification{Layer: layer.ID, Err: fmt.Errorf("layer %s: %w", layer.ID, err)}
+	}
+	defer diff.Close()
+	digester := layer.UncompressedDigest.Algorithm().Digester()
+	n, err := io.Copy(digester.Hash(), diff)
+	if err != nil {
+		return LayerVerification{Layer: layer.ID, Err: fmt.Errorf("layer %s: %w", layer.ID, err)}
+	}
+	if digester.Digest() != layer.UncompressedDigest {
+		return LayerVerification{Layer: layer.ID, Err: fmt.Errorf("layer %s: %w", layer.ID, ErrLayerIncorrectContentDigest)}
+	}
+	if layer.UncompressedSize != -1 && n != layer.UncompressedSize {
+		return LayerVerification{Layer: layer.ID, Err: fmt.Errorf("layer %s: read %d bytes instead of %d bytes: %w", layer.ID, n, layer.UncompressedSize, ErrLayerIncorrectContentSize)}
+	}
+	return LayerVerification{Layer: layer.ID}
+}